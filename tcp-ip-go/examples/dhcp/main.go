@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log"
+	"tcp/internet"
+	"tcp/network"
+)
+
+// 在tap0上通过DHCP获取地址、默认网关和DNS服务器
+func main() {
+	tap0, err := network.NewTap("tap0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	tap0.Bind()
+
+	ip := internet.NewIpPacketQueue()
+	iface := ip.AddInterface(tap0)
+	client, err := ip.StartDhcp(iface)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for lease := range client.Bound() {
+		log.Printf("address %s, gateway %s, dns %v, lease %s", lease.Addr, lease.Gateway, lease.Dns, lease.LeaseTime)
+		for _, route := range ip.Routes().Routes() {
+			log.Println(route)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"tcp/internet"
+	"tcp/network"
+	"tcp/transport"
+)
+
+// net/http直接运行在用户态协议栈上，curl http://10.0.0.2:8080/
+func main() {
+	tun, err := network.NewTun()
+	if err != nil {
+		log.Fatal(err)
+	}
+	tun.Bind()
+	ip := internet.NewIpPacketQueue()
+	ip.ManageQueues(tun, netip.MustParsePrefix("10.0.0.2/24"))
+	tcp := transport.NewTcpPacketQueue()
+	tcp.ManageQueues(ip)
+
+	listener, err := tcp.Listen(netip.AddrPortFrom(netip.IPv4Unspecified(), 8080))
+	if err != nil {
+		log.Fatal(err)
+	}
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s\n", r.RemoteAddr)
+	})
+	log.Fatal(http.Serve(listener, nil))
+}
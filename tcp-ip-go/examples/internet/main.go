@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"net/netip"
 	"tcp/internet"
 	"tcp/network"
 )
@@ -10,7 +11,7 @@ func main() {
 	network, _ := network.NewTun()
 	network.Bind()
 	ip := internet.NewIpPacketQueue()
-	ip.ManageQueues(network)
+	ip.ManageQueues(network, netip.MustParsePrefix("10.0.0.2/24"))
 
 	for {
 		pkt, _ := ip.Read()
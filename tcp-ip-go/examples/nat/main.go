@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"net/netip"
+	"tcp/internet"
+	"tcp/network"
+)
+
+func main() {
+	// tun0连接内网实验网段，tun1连接上游网络
+	tun0, err := network.NewTunWithName("tun0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	tun1, err := network.NewTunWithName("tun1")
+	if err != nil {
+		log.Fatal(err)
+	}
+	tun0.Bind()
+	tun1.Bind()
+
+	ip := internet.NewIpPacketQueue()
+	ip.AddInterface(tun0, netip.MustParsePrefix("192.168.10.1/24"))
+	uplink := ip.AddInterface(tun1, netip.MustParsePrefix("10.0.1.2/24"))
+	ip.Routes().Add(internet.Route{
+		Prefix:    netip.MustParsePrefix("0.0.0.0/0"),
+		Gateway:   netip.MustParseAddr("10.0.1.1"),
+		Interface: uplink,
+	})
+	ip.SetForwarding(true)
+
+	// 内网访问外部时使用上游接口的地址
+	err = ip.Nat().Append(internet.NatRule{
+		Type:         internet.NAT_MASQUERADE,
+		Src:          netip.MustParsePrefix("192.168.10.0/24"),
+		OutInterface: "tun1",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	// 上游访问8080端口时转发到内网的Web服务器
+	err = ip.Nat().Append(internet.NatRule{
+		Type:        internet.NAT_DNAT,
+		InInterface: "tun1",
+		Protocol:    internet.TCP_PROTOCOL,
+		DstPort:     internet.PortRange{Min: 8080, Max: 8080},
+		ToAddr:      netip.MustParseAddr("192.168.10.10"),
+		ToPorts:     internet.PortRange{Min: 80},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, route := range ip.Routes().Routes() {
+		log.Println(route)
+	}
+	select {}
+}
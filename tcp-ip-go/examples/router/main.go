@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log"
+	"net/netip"
+	"tcp/internet"
+	"tcp/network"
+)
+
+func main() {
+	tun0, err := network.NewTunWithName("tun0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	tun1, err := network.NewTunWithName("tun1")
+	if err != nil {
+		log.Fatal(err)
+	}
+	tun0.Bind()
+	tun1.Bind()
+
+	ip := internet.NewIpPacketQueue()
+	ip.AddInterface(tun0, netip.MustParsePrefix("10.0.0.2/24"))
+	ip.AddInterface(tun1, netip.MustParsePrefix("10.0.1.2/24"))
+	ip.SetForwarding(true)
+
+	for _, route := range ip.Routes().Routes() {
+		log.Println(route)
+	}
+	select {}
+}
@@ -1,22 +1,36 @@
 package main
 
 import (
-	"fmt"
+	"io"
+	"log"
+	"net/netip"
 	"tcp/internet"
 	"tcp/network"
 	"tcp/transport"
 )
 
+// 在10.0.0.2:80上运行echo服务
 func main() {
 	network, _ := network.NewTun()
 	network.Bind()
 	ip := internet.NewIpPacketQueue()
-	ip.ManageQueues(network)
+	ip.ManageQueues(network, netip.MustParsePrefix("10.0.0.2/24"))
 	tcp := transport.NewTcpPacketQueue()
 	tcp.ManageQueues(ip)
+	listener, err := tcp.Listen(netip.AddrPortFrom(netip.IPv4Unspecified(), 80))
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	for {
-		pkt, _ := tcp.ReadAcceptConnection()
-		fmt.Printf("TCP Header: %+v\n", pkt.Pkt.TcpHeader)
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			defer conn.Close()
+			log.Printf("accept connection from %s", conn.RemoteAddr())
+			io.Copy(conn, conn)
+		}()
 	}
 }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+	"net/netip"
+	"tcp/internet"
+	"tcp/network"
+)
+
+// 经由tun0与10.0.0.1建立GRE隧道，发往192.168.20.0/24的数据报走隧道
+func main() {
+	tun0, err := network.NewTunWithName("tun0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	tun0.Bind()
+
+	ip := internet.NewIpPacketQueue()
+	ip.AddInterface(tun0, netip.MustParsePrefix("10.0.0.2/24"))
+
+	gre0, err := ip.NewTunnel("gre0", internet.TUNNEL_GRE, netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.1"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	tunnel := ip.AddInterface(gre0, netip.MustParsePrefix("172.16.0.2/30"))
+	ip.Routes().Add(internet.Route{
+		Prefix:    netip.MustParsePrefix("192.168.20.0/24"),
+		Gateway:   netip.MustParseAddr("172.16.0.1"),
+		Interface: tunnel,
+	})
+	ip.SetForwarding(true)
+
+	for _, route := range ip.Routes().Routes() {
+		log.Println(route)
+	}
+	select {}
+}
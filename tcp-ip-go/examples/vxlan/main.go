@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/netip"
+	"strings"
+	"tcp/internet"
+	"tcp/network"
+)
+
+// 加入VNI为42的VXLAN网段，例如在同一台机器上运行两个进程：
+//
+//	go run ./examples/vxlan -local 127.0.0.1:4789 -peers 127.0.0.1:4790 -addr 10.10.0.1/24
+//	go run ./examples/vxlan -local 127.0.0.1:4790 -peers 127.0.0.1:4789 -addr 10.10.0.2/24
+func main() {
+	local := flag.String("local", ":4789", "local udp address")
+	peers := flag.String("peers", "", "comma separated remote vteps")
+	addr := flag.String("addr", "10.10.0.1/24", "interface address")
+	vni := flag.Uint("vni", 42, "vxlan network identifier")
+	flag.Parse()
+
+	var remotes []string
+	if *peers != "" {
+		remotes = strings.Split(*peers, ",")
+	}
+	vxlan0, err := network.NewVxlan("vxlan0", uint32(*vni), *local, remotes...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer vxlan0.Close()
+
+	ip := internet.NewIpPacketQueue()
+	ip.AddInterface(vxlan0, netip.MustParsePrefix(*addr))
+
+	for _, route := range ip.Routes().Routes() {
+		log.Println(route)
+	}
+	select {}
+}
@@ -0,0 +1,251 @@
+package internet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sort"
+)
+
+// InterfaceAddr 接口地址表中的一个地址
+type InterfaceAddr struct {
+	Prefix     netip.Prefix // 地址及所在网络的前缀长度
+	Broadcast  netip.Addr   // IPv4子网的定向广播地址，/31、/32和IPv6地址没有
+	Secondary  bool         // IPv4子网中第一个地址为主地址，其余为从地址，从地址不作为源地址
+	Deprecated bool         // 首选有效期已过的IPv6地址，只在没有其他选择时作为源地址
+	Tentative  bool         // 正在进行重复地址检测的IPv6地址，不能作为源地址，也不接收发往它的数据报 (RFC 4862 5.4)
+}
+
+// AddAddress 为接口添加地址，并添加到所在网络的直连路由
+func (q *IpPacketQueue) AddAddress(iface *Interface, prefix netip.Prefix) error {
+	if !prefix.IsValid() {
+		return fmt.Errorf("invalid address: %s", prefix)
+	}
+	if !iface.addAddress(prefix, false) {
+		return fmt.Errorf("address %s already exists on %s", prefix.Addr(), iface.Name)
+	}
+	// 子网中已有地址时直连路由已经存在
+	q.routes.Add(Route{
+		Prefix:    prefix.Masked(),
+		Interface: iface,
+	})
+	return nil
+}
+
+// RemoveAddress 删除接口地址，子网中没有其他地址时同时删除直连路由
+func (q *IpPacketQueue) RemoveAddress(iface *Interface, addr netip.Addr) error {
+	var prefix netip.Prefix
+	for _, a := range iface.AddressTable() {
+		if a.Prefix.Addr() == addr {
+			prefix = a.Prefix
+		}
+	}
+	if !prefix.IsValid() || !iface.removeAddress(addr) {
+		return fmt.Errorf("address %s not found on %s", addr, iface.Name)
+	}
+
+	for _, a := range iface.AddressTable() {
+		if a.Prefix.Masked() == prefix.Masked() {
+			return nil
+		}
+	}
+	q.routes.Delete(prefix.Masked(), netip.Addr{})
+	return nil
+}
+
+// 判断数据报是否发往本机：本机地址、子网广播、受限广播、已加入的IPv4组播组或IPv6组播地址
+func (q *IpPacketQueue) isLocal(dst netip.Addr) bool {
+	if dst == netip.AddrFrom4([4]byte{255, 255, 255, 255}) || (dst.Is6() && dst.IsMulticast()) {
+		return true
+	}
+
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	for _, iface := range q.interfaces {
+		if dst.IsMulticast() {
+			if iface.isMember(dst) {
+				return true
+			}
+			continue
+		}
+		for _, a := range iface.AddressTable() {
+			if a.Tentative {
+				continue
+			}
+			if a.Prefix.Addr() == dst || (a.Broadcast.IsValid() && a.Broadcast == dst) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 是否为受限广播或本机所在子网的广播地址
+func (q *IpPacketQueue) isBroadcast(dst netip.Addr) bool {
+	if dst == netip.AddrFrom4([4]byte{255, 255, 255, 255}) {
+		return true
+	}
+
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	for _, iface := range q.interfaces {
+		for _, a := range iface.AddressTable() {
+			if a.Broadcast.IsValid() && a.Broadcast == dst {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 子网的定向广播地址，即主机位全为1的地址
+func directedBroadcast(prefix netip.Prefix) netip.Addr {
+	if !prefix.Addr().Is4() || prefix.Bits() >= 31 {
+		return netip.Addr{}
+	}
+	ip := prefix.Masked().Addr().As4()
+	host := ^uint32(0) >> prefix.Bits()
+	binary.BigEndian.PutUint32(ip[:], binary.BigEndian.Uint32(ip[:])|host)
+	return netip.AddrFrom4(ip)
+}
+
+// SelectSource 为发往dst的数据报选择源地址，候选地址为出接口上的地址，IPv6按RFC 6724排序
+func (q *IpPacketQueue) SelectSource(dst netip.Addr) (netip.Addr, error) {
+	route, ok := q.routes.Lookup(dst)
+	if !ok {
+		return netip.Addr{}, fmt.Errorf("network unreachable: %s", dst)
+	}
+
+	if dst.Is4() {
+		// 优先选择与下一跳在同一子网的主地址
+		prefix, ok := route.Interface.addrOf(route.NextHop(dst))
+		if !ok {
+			return netip.Addr{}, fmt.Errorf("no ipv4 address on %s", route.Interface.Name)
+		}
+		return prefix.Addr(), nil
+	}
+
+	candidates := []InterfaceAddr{}
+	for _, a := range route.Interface.AddressTable() {
+		if a.Prefix.Addr().Is6() && !a.Tentative {
+			candidates = append(candidates, a)
+		}
+	}
+	if len(candidates) == 0 {
+		return netip.Addr{}, fmt.Errorf("no ipv6 address on %s", route.Interface.Name)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return preferSource(candidates[i], candidates[j], dst)
+	})
+	return candidates[0].Prefix.Addr(), nil
+}
+
+// 按RFC 6724 5中的规则比较两个候选源地址，a优于b时返回true。
+// 规则4(家乡地址)和规则7(临时地址)不适用，规则5由候选集合保证
+func preferSource(a, b InterfaceAddr, dst netip.Addr) bool {
+	sa, sb := a.Prefix.Addr(), b.Prefix.Addr()
+
+	// 规则1：与目的地址相同
+	if sa == dst || sb == dst {
+		return sa == dst && sb != dst
+	}
+
+	// 规则2：选择合适的作用域
+	scopeA, scopeB, scopeD := addrScope(sa), addrScope(sb), addrScope(dst)
+	if scopeA < scopeB {
+		return scopeA >= scopeD
+	}
+	if scopeB < scopeA {
+		return scopeB < scopeD
+	}
+
+	// 规则3：避免已废弃的地址
+	if a.Deprecated != b.Deprecated {
+		return !a.Deprecated
+	}
+
+	// 规则6：标签与目的地址相同
+	labelD := policyLabel(dst)
+	if matchA, matchB := policyLabel(sa) == labelD, policyLabel(sb) == labelD; matchA != matchB {
+		return matchA
+	}
+
+	// 规则8：最长匹配前缀
+	return commonPrefixLen(sa, dst, a.Prefix.Bits()) > commonPrefixLen(sb, dst, b.Prefix.Bits())
+}
+
+// 地址的作用域 (RFC 4291 2.7, RFC 6724 3.1)
+const (
+	SCOPE_INTERFACE_LOCAL = 0x1
+	SCOPE_LINK_LOCAL      = 0x2
+	SCOPE_ADMIN_LOCAL     = 0x4
+	SCOPE_SITE_LOCAL      = 0x5
+	SCOPE_ORG_LOCAL       = 0x8
+	SCOPE_GLOBAL          = 0xe
+)
+
+func addrScope(addr netip.Addr) int {
+	switch {
+	case addr.IsMulticast():
+		return int(addr.As16()[1] & 0x0f)
+	case addr.IsLoopback(), addr.IsLinkLocalUnicast():
+		return SCOPE_LINK_LOCAL
+	case addr.Is6() && addr.As16()[0] == 0xfe && addr.As16()[1]&0xc0 == 0xc0:
+		// 已废弃的站点本地地址 fec0::/10
+		return SCOPE_SITE_LOCAL
+	}
+	return SCOPE_GLOBAL
+}
+
+// RFC 6724 2.1 的默认策略表
+var policyTable = []struct {
+	prefix netip.Prefix
+	label  int
+}{
+	{netip.MustParsePrefix("::1/128"), 0},
+	{netip.MustParsePrefix("::ffff:0:0/96"), 4},
+	{netip.MustParsePrefix("::/96"), 3},
+	{netip.MustParsePrefix("2001::/32"), 5},
+	{netip.MustParsePrefix("2002::/16"), 2},
+	{netip.MustParsePrefix("3ffe::/16"), 12},
+	{netip.MustParsePrefix("fec0::/10"), 11},
+	{netip.MustParsePrefix("fc00::/7"), 13},
+	{netip.MustParsePrefix("::/0"), 1},
+}
+
+// 按最长前缀匹配策略表，返回地址的标签
+func policyLabel(addr netip.Addr) int {
+	if addr.Is4() {
+		addr = netip.AddrFrom16(addr.As16())
+	}
+	for _, p := range policyTable {
+		if p.prefix.Contains(addr) {
+			return p.label
+		}
+	}
+	return 1
+}
+
+// 源地址与目的地址的公共前缀长度，不超过源地址的前缀长度 (RFC 6724 2.2)
+func commonPrefixLen(src, dst netip.Addr, bits int) int {
+	a, b := src.As16(), dst.As16()
+	n := 0
+	for i := 0; i < 16 && n < bits; i++ {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	if n > bits {
+		n = bits
+	}
+	return n
+}
@@ -0,0 +1,144 @@
+package internet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/netip"
+	"tcp/network"
+)
+
+const (
+	ARP_LENGTH             = 28 // 以太网上IPv4的ARP报文长度
+	ARP_HARDWARE_ETHERNET  = 1
+	ARP_OPERATION_REQUEST  = 1
+	ARP_OPERATION_REPLY    = 2
+	ARP_HARDWARE_ADDR_SIZE = 6
+	ARP_PROTOCOL_ADDR_SIZE = 4
+)
+
+// 0                   1                   2                   3
+// 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |         Hardware Type         |         Protocol Type         |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |  HW Addr Len  | Proto Addr Len|           Operation           |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |            Sender Hardware Address (6) + Sender IP (4)        |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |            Target Hardware Address (6) + Target IP (4)        |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+type ArpPacket struct {
+	HardwareType uint16
+	ProtocolType uint16
+	Operation    uint16
+	SenderHwAddr network.HardwareAddr
+	SenderIP     [4]byte
+	TargetHwAddr network.HardwareAddr
+	TargetIP     [4]byte
+}
+
+func unmarshalArp(pkt []byte) (*ArpPacket, error) {
+	if len(pkt) < ARP_LENGTH {
+		return nil, fmt.Errorf("invalid arp length: %d", len(pkt))
+	}
+	if pkt[4] != ARP_HARDWARE_ADDR_SIZE || pkt[5] != ARP_PROTOCOL_ADDR_SIZE {
+		return nil, fmt.Errorf("unsupported arp address size: %d, %d", pkt[4], pkt[5])
+	}
+
+	arp := &ArpPacket{
+		HardwareType: binary.BigEndian.Uint16(pkt[0:2]),
+		ProtocolType: binary.BigEndian.Uint16(pkt[2:4]),
+		Operation:    binary.BigEndian.Uint16(pkt[6:8]),
+	}
+	copy(arp.SenderHwAddr[:], pkt[8:14])
+	copy(arp.SenderIP[:], pkt[14:18])
+	copy(arp.TargetHwAddr[:], pkt[18:24])
+	copy(arp.TargetIP[:], pkt[24:28])
+
+	return arp, nil
+}
+
+func (a *ArpPacket) Marshal() []byte {
+	pkt := make([]byte, ARP_LENGTH)
+	binary.BigEndian.PutUint16(pkt[0:2], a.HardwareType)
+	binary.BigEndian.PutUint16(pkt[2:4], a.ProtocolType)
+	pkt[4] = ARP_HARDWARE_ADDR_SIZE
+	pkt[5] = ARP_PROTOCOL_ADDR_SIZE
+	binary.BigEndian.PutUint16(pkt[6:8], a.Operation)
+	copy(pkt[8:14], a.SenderHwAddr[:])
+	copy(pkt[14:18], a.SenderIP[:])
+	copy(pkt[18:24], a.TargetHwAddr[:])
+	copy(pkt[24:28], a.TargetIP[:])
+	return pkt
+}
+
+// 处理收到的ARP报文 (RFC 826)
+func (q *IpPacketQueue) recvArp(iface *Interface, pkt []byte) {
+	arp, err := unmarshalArp(pkt)
+	if err != nil {
+		log.Printf("arp unmarshal error: %s", err)
+		return
+	}
+	if arp.HardwareType != ARP_HARDWARE_ETHERNET || arp.ProtocolType != network.ETHER_TYPE_IPV4 {
+		return
+	}
+
+	sender := addrFrom4(arp.SenderIP)
+	target := addrFrom4(arp.TargetIP)
+	forMe := iface.hasAddress(target)
+
+	// 已有的条目总是更新，发给本机的报文才新建条目
+	if sender.IsValid() && !sender.IsUnspecified() {
+		q.learnNeighbor(iface, sender, arp.SenderHwAddr, forMe)
+	}
+
+	if c := iface.dhcpClient(); c != nil {
+		c.recvArp(arp)
+	}
+
+	if forMe && arp.Operation == ARP_OPERATION_REQUEST {
+		reply := &ArpPacket{
+			HardwareType: ARP_HARDWARE_ETHERNET,
+			ProtocolType: network.ETHER_TYPE_IPV4,
+			Operation:    ARP_OPERATION_REPLY,
+			SenderHwAddr: iface.Link.HardwareAddr(),
+			SenderIP:     arp.TargetIP,
+			TargetHwAddr: arp.SenderHwAddr,
+			TargetIP:     arp.SenderIP,
+		}
+		q.outputFrame(iface, arp.SenderHwAddr, network.ETHER_TYPE_ARP, reply.Marshal())
+	}
+}
+
+// 广播ARP请求，解析target的MAC地址
+func (q *IpPacketQueue) sendArpRequest(iface *Interface, target netip.Addr) {
+	src, ok := iface.addrOf(target)
+	if !ok {
+		log.Printf("no ipv4 address on %s for arp request", iface.Name)
+		return
+	}
+
+	request := &ArpPacket{
+		HardwareType: ARP_HARDWARE_ETHERNET,
+		ProtocolType: network.ETHER_TYPE_IPV4,
+		Operation:    ARP_OPERATION_REQUEST,
+		SenderHwAddr: iface.Link.HardwareAddr(),
+		SenderIP:     src.Addr().As4(),
+		TargetIP:     target.As4(),
+	}
+	q.outputFrame(iface, network.BroadcastHardwareAddr, network.ETHER_TYPE_ARP, request.Marshal())
+}
+
+// 广播ARP探测，发送方地址为0.0.0.0，不会更新其他主机的缓存 (RFC 5227 2.1.1)
+func (q *IpPacketQueue) sendArpProbe(iface *Interface, target netip.Addr) {
+	probe := &ArpPacket{
+		HardwareType: ARP_HARDWARE_ETHERNET,
+		ProtocolType: network.ETHER_TYPE_IPV4,
+		Operation:    ARP_OPERATION_REQUEST,
+		SenderHwAddr: iface.Link.HardwareAddr(),
+		TargetIP:     target.As4(),
+	}
+	q.outputFrame(iface, network.BroadcastHardwareAddr, network.ETHER_TYPE_ARP, probe.Marshal())
+}
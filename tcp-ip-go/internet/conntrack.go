@@ -0,0 +1,489 @@
+package internet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 数据报在连接跟踪中的状态，按位组合后用于规则匹配
+type CtState uint8
+
+const (
+	CT_STATE_INVALID     CtState = 1 << iota // 无法归属于任何连接，如没有请求的应答
+	CT_STATE_NEW                             // 连接的第一个数据报，或尚未收到应答的连接
+	CT_STATE_ESTABLISHED                     // 双向都已经有数据报的连接
+	CT_STATE_RELATED                         // 与已有连接相关的ICMP差错
+	CT_STATE_UNTRACKED                       // 不跟踪的数据报，如非首个分片和邻居发现报文
+)
+
+var ctStateNames = []struct {
+	state CtState
+	name  string
+}{
+	{CT_STATE_INVALID, "INVALID"},
+	{CT_STATE_NEW, "NEW"},
+	{CT_STATE_ESTABLISHED, "ESTABLISHED"},
+	{CT_STATE_RELATED, "RELATED"},
+	{CT_STATE_UNTRACKED, "UNTRACKED"},
+}
+
+func (s CtState) String() string {
+	names := []string{}
+	for _, n := range ctStateNames {
+		if s&n.state != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// TCP连接在跟踪表中的状态，由双向的标志位推进
+type TcpCtState uint8
+
+const (
+	TCP_CT_NONE TcpCtState = iota
+	TCP_CT_SYN_SENT
+	TCP_CT_SYN_RECV
+	TCP_CT_ESTABLISHED
+	TCP_CT_FIN_WAIT
+	TCP_CT_CLOSE_WAIT
+	TCP_CT_LAST_ACK
+	TCP_CT_TIME_WAIT
+	TCP_CT_CLOSE
+)
+
+var tcpCtStateNames = map[TcpCtState]string{
+	TCP_CT_NONE:        "NONE",
+	TCP_CT_SYN_SENT:    "SYN_SENT",
+	TCP_CT_SYN_RECV:    "SYN_RECV",
+	TCP_CT_ESTABLISHED: "ESTABLISHED",
+	TCP_CT_FIN_WAIT:    "FIN_WAIT",
+	TCP_CT_CLOSE_WAIT:  "CLOSE_WAIT",
+	TCP_CT_LAST_ACK:    "LAST_ACK",
+	TCP_CT_TIME_WAIT:   "TIME_WAIT",
+	TCP_CT_CLOSE:       "CLOSE",
+}
+
+func (s TcpCtState) String() string {
+	return tcpCtStateNames[s]
+}
+
+// 各TCP状态的超时时间，与Linux nf_conntrack的默认值相同
+var tcpCtTimeouts = map[TcpCtState]time.Duration{
+	TCP_CT_SYN_SENT:    2 * time.Minute,
+	TCP_CT_SYN_RECV:    time.Minute,
+	TCP_CT_ESTABLISHED: 5 * 24 * time.Hour,
+	TCP_CT_FIN_WAIT:    2 * time.Minute,
+	TCP_CT_CLOSE_WAIT:  time.Minute,
+	TCP_CT_LAST_ACK:    30 * time.Second,
+	TCP_CT_TIME_WAIT:   2 * time.Minute,
+	TCP_CT_CLOSE:       10 * time.Second,
+}
+
+const (
+	CT_UDP_TIMEOUT        = 30 * time.Second  // 未收到应答的UDP伪连接
+	CT_UDP_STREAM_TIMEOUT = 180 * time.Second // 双向都有数据的UDP伪连接
+	CT_ICMP_TIMEOUT       = 30 * time.Second  // ICMP回显的伪连接
+	CT_GENERIC_TIMEOUT    = 600 * time.Second // 其他协议
+	CONNTRACK_MAX         = 65536             // 跟踪表的最大连接数
+
+	CT_DIR_ORIGINAL = 0 // 发起连接的方向
+	CT_DIR_REPLY    = 1 // 应答方向
+)
+
+// Tuple 一个方向上的连接标识，ICMP回显使用标识符作为端口
+type Tuple struct {
+	Protocol uint8
+	Src      netip.Addr
+	Dst      netip.Addr
+	SrcPort  uint16
+	DstPort  uint16
+}
+
+func (t Tuple) reverse() Tuple {
+	return Tuple{
+		Protocol: t.Protocol,
+		Src:      t.Dst,
+		Dst:      t.Src,
+		SrcPort:  t.DstPort,
+		DstPort:  t.SrcPort,
+	}
+}
+
+func (t Tuple) String() string {
+	return fmt.Sprintf("proto=%d src=%s dst=%s sport=%d dport=%d", t.Protocol, t.Src, t.Dst, t.SrcPort, t.DstPort)
+}
+
+// 跟踪表中的一条连接
+type ctEntry struct {
+	orig      Tuple
+	reply     Tuple
+	tcpState  TcpCtState
+	finDir    int  // 最先发送FIN的方向，-1表示还没有FIN
+	replied   bool // 是否收到过应答方向的数据报
+	confirmed bool // 数据报通过所有hook后才加入跟踪表
+	snatDone  bool // 已经为连接选择过源地址转换
+	dnatDone  bool // 已经为连接选择过目的地址转换
+	expires   time.Time
+	packets   [2]uint64
+	bytes     [2]uint64
+}
+
+// ConnEntry 跟踪表中一条连接的快照
+type ConnEntry struct {
+	Orig     Tuple
+	Reply    Tuple
+	TcpState TcpCtState
+	Replied  bool
+	Expires  time.Time
+	Packets  [2]uint64 // 原方向和应答方向的数据报数
+	Bytes    [2]uint64
+}
+
+func (e ConnEntry) String() string {
+	s := fmt.Sprintf("%s [%d pkts %d bytes] reply %s [%d pkts %d bytes]",
+		e.Orig, e.Packets[CT_DIR_ORIGINAL], e.Bytes[CT_DIR_ORIGINAL], e.Reply, e.Packets[CT_DIR_REPLY], e.Bytes[CT_DIR_REPLY])
+	if e.Orig.Protocol == TCP_PROTOCOL {
+		s = e.TcpState.String() + " " + s
+	}
+	if !e.Replied {
+		s += " [UNREPLIED]"
+	}
+	return s
+}
+
+// Conntrack 连接跟踪表，原方向和应答方向的Tuple都指向同一条连接
+type Conntrack struct {
+	entries map[Tuple]*ctEntry
+	lock    sync.Mutex
+}
+
+func NewConntrack() *Conntrack {
+	return &Conntrack{
+		entries: make(map[Tuple]*ctEntry),
+	}
+}
+
+// Conntrack 返回协议栈的连接跟踪表
+func (q *IpPacketQueue) Conntrack() *Conntrack {
+	return q.conntrack
+}
+
+// 提取数据报的连接标识，不跟踪的数据报返回false
+func flowTuple(protocol uint8, src, dst netip.Addr, payload []byte) (Tuple, bool) {
+	tuple := Tuple{
+		Protocol: protocol,
+		Src:      src,
+		Dst:      dst,
+	}
+	switch protocol {
+	case TCP_PROTOCOL, UDP_PROTOCOL:
+		if len(payload) < 4 {
+			return tuple, false
+		}
+		tuple.SrcPort = binary.BigEndian.Uint16(payload[0:2])
+		tuple.DstPort = binary.BigEndian.Uint16(payload[2:4])
+	case ICMP_PROTOCOL, ICMPV6_PROTOCOL:
+		// 只有回显请求和应答组成伪连接
+		if len(payload) < ICMP_HEADER_LENGTH || !isEcho(protocol, payload[0]) {
+			return tuple, false
+		}
+		id := binary.BigEndian.Uint16(payload[4:6])
+		tuple.SrcPort, tuple.DstPort = id, id
+	case IPV6_NO_NEXT:
+		return tuple, false
+	}
+	return tuple, true
+}
+
+func isEcho(protocol, typ uint8) bool {
+	if protocol == ICMP_PROTOCOL {
+		return typ == ICMP_TYPE_ECHO_REQUEST || typ == ICMP_TYPE_ECHO_REPLY
+	}
+	return typ == ICMPV6_TYPE_ECHO_REQUEST || typ == ICMPV6_TYPE_ECHO_REPLY
+}
+
+func isIcmpErrorPacket(pkt IpPacket) bool {
+	if len(pkt.Payload) < ICMP_HEADER_LENGTH {
+		return false
+	}
+	switch pkt.Protocol {
+	case ICMP_PROTOCOL:
+		return isIcmpError(pkt.Payload[0])
+	case ICMPV6_PROTOCOL:
+		return isIcmpv6Error(pkt.Payload[0])
+	}
+	return false
+}
+
+// ICMP差错中携带的原始数据报的连接标识
+func embeddedTuple(pkt IpPacket) (Tuple, bool) {
+	data := pkt.Payload[ICMP_HEADER_LENGTH:]
+	if pkt.IpHeader != nil {
+		hdr, err := unmarshal(data)
+		if err != nil || len(data) < int(hdr.IHL)*4 {
+			return Tuple{}, false
+		}
+		return flowTuple(hdr.Protocol, addrFrom4(hdr.SrcIP), addrFrom4(hdr.DstIP), data[hdr.IHL*4:])
+	}
+	hdr, err := unmarshalIpv6(data)
+	if err != nil {
+		return Tuple{}, false
+	}
+	chain, err := walkExtensionHeaders(data, hdr.NextHeader)
+	if err != nil {
+		return Tuple{}, false
+	}
+	return flowTuple(chain.protocol, netip.AddrFrom16(hdr.SrcIP), netip.AddrFrom16(hdr.DstIP), data[chain.offset:])
+}
+
+// 数据报能否开启一条新连接
+func startsFlow(pkt IpPacket) bool {
+	switch pkt.Protocol {
+	case TCP_PROTOCOL:
+		// 只有SYN能开启TCP连接，不接管中途的连接
+		return len(pkt.Payload) >= 14 && pkt.Payload[13]&(TCP_FLAG_SYN|TCP_FLAG_ACK|TCP_FLAG_RST) == TCP_FLAG_SYN
+	case ICMP_PROTOCOL:
+		return pkt.Payload[0] == ICMP_TYPE_ECHO_REQUEST
+	case ICMPV6_PROTOCOL:
+		return pkt.Payload[0] == ICMPV6_TYPE_ECHO_REQUEST
+	}
+	return true
+}
+
+// 查找数据报所属的连接并设置pkt.CtState，新连接在confirm之前不加入跟踪表
+func (c *Conntrack) track(pkt *IpPacket) {
+	// 非首个分片没有上层协议头部
+	if pkt.IpHeader != nil && pkt.IpHeader.FragmentOffset != 0 {
+		pkt.CtState = CT_STATE_UNTRACKED
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	if isIcmpErrorPacket(*pkt) {
+		pkt.CtState = CT_STATE_INVALID
+		tuple, ok := embeddedTuple(*pkt)
+		if !ok {
+			return
+		}
+		// 差错与原始数据报方向相反，应答方向的Tuple就是原始数据报反转后的Tuple
+		if entry := c.lookup(tuple.reverse(), now); entry != nil {
+			pkt.CtState = CT_STATE_RELATED
+			pkt.ct = entry
+			pkt.ctDir = CT_DIR_ORIGINAL
+			if tuple.reverse() == entry.reply {
+				pkt.ctDir = CT_DIR_REPLY
+			}
+		} else if entry := c.lookup(tuple, now); entry != nil {
+			// 原始数据报尚未经过地址转换，差错也不需要转换
+			pkt.CtState = CT_STATE_RELATED
+		}
+		return
+	}
+
+	tuple, ok := flowTuple(pkt.Protocol, pkt.SrcAddr, pkt.DstAddr, pkt.Payload)
+	if !ok {
+		pkt.CtState = CT_STATE_UNTRACKED
+		return
+	}
+
+	entry := c.lookup(tuple, now)
+	// 已关闭的TCP连接收到新的SYN时重新开始跟踪
+	if entry != nil && entry.orig == tuple && startsFlow(*pkt) && pkt.Protocol == TCP_PROTOCOL &&
+		(entry.tcpState == TCP_CT_TIME_WAIT || entry.tcpState == TCP_CT_CLOSE) {
+		c.remove(entry)
+		entry = nil
+	}
+	if entry == nil {
+		if !startsFlow(*pkt) {
+			pkt.CtState = CT_STATE_INVALID
+			return
+		}
+		entry = &ctEntry{
+			orig:   tuple,
+			reply:  tuple.reverse(),
+			finDir: -1,
+		}
+	}
+
+	dir := CT_DIR_ORIGINAL
+	if entry.confirmed && tuple == entry.reply {
+		dir = CT_DIR_REPLY
+		entry.replied = true
+	}
+	entry.update(dir, *pkt, now)
+
+	pkt.ct = entry
+	pkt.ctDir = dir
+	pkt.CtState = CT_STATE_NEW
+	if entry.replied {
+		pkt.CtState = CT_STATE_ESTABLISHED
+	}
+}
+
+// 查找未过期的连接，过期的连接顺便删除
+func (c *Conntrack) lookup(tuple Tuple, now time.Time) *ctEntry {
+	entry, ok := c.entries[tuple]
+	if !ok {
+		return nil
+	}
+	if now.After(entry.expires) {
+		c.remove(entry)
+		return nil
+	}
+	return entry
+}
+
+// 连接是否做了源地址转换，即应答的目的地址不是原方向的源地址
+func (e *ctEntry) srcNat() bool {
+	return e.reply.Dst != e.orig.Src || e.reply.DstPort != e.orig.SrcPort
+}
+
+// 连接是否做了目的地址转换
+func (e *ctEntry) dstNat() bool {
+	return e.reply.Src != e.orig.Dst || e.reply.SrcPort != e.orig.DstPort
+}
+
+func (c *Conntrack) remove(entry *ctEntry) {
+	delete(c.entries, entry.orig)
+	delete(c.entries, entry.reply)
+}
+
+// 数据报通过所有hook后确认新连接，加入跟踪表
+func (c *Conntrack) confirm(pkt IpPacket) {
+	entry := pkt.ct
+	if entry == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if entry.confirmed {
+		return
+	}
+	if len(c.entries) >= CONNTRACK_MAX*2 {
+		c.expire(time.Now())
+		if len(c.entries) >= CONNTRACK_MAX*2 {
+			return
+		}
+	}
+	// 同一条连接的多个首包同时经过时只保留第一个
+	if _, ok := c.entries[entry.orig]; ok {
+		return
+	}
+	entry.confirmed = true
+	c.entries[entry.orig] = entry
+	c.entries[entry.reply] = entry
+}
+
+func (c *Conntrack) expire(now time.Time) {
+	for _, entry := range c.entries {
+		if now.After(entry.expires) {
+			c.remove(entry)
+		}
+	}
+}
+
+// 更新连接的计数器、TCP状态和超时时间
+func (e *ctEntry) update(dir int, pkt IpPacket, now time.Time) {
+	e.packets[dir]++
+	e.bytes[dir] += uint64(pkt.Packet.N)
+
+	timeout := CT_GENERIC_TIMEOUT
+	switch pkt.Protocol {
+	case TCP_PROTOCOL:
+		if len(pkt.Payload) >= 14 {
+			e.updateTcp(dir, pkt.Payload[13])
+		}
+		timeout = tcpCtTimeouts[e.tcpState]
+	case UDP_PROTOCOL:
+		timeout = CT_UDP_TIMEOUT
+		if e.replied {
+			timeout = CT_UDP_STREAM_TIMEOUT
+		}
+	case ICMP_PROTOCOL, ICMPV6_PROTOCOL:
+		timeout = CT_ICMP_TIMEOUT
+	}
+	e.expires = now.Add(timeout)
+}
+
+// 根据一个方向上的TCP标志位推进连接状态
+func (e *ctEntry) updateTcp(dir int, flags uint8) {
+	switch {
+	case flags&TCP_FLAG_RST != 0:
+		e.tcpState = TCP_CT_CLOSE
+	case flags&TCP_FLAG_SYN != 0:
+		if flags&TCP_FLAG_ACK == 0 && dir == CT_DIR_ORIGINAL && e.tcpState == TCP_CT_NONE {
+			e.tcpState = TCP_CT_SYN_SENT
+		} else if flags&TCP_FLAG_ACK != 0 && dir == CT_DIR_REPLY && e.tcpState == TCP_CT_SYN_SENT {
+			e.tcpState = TCP_CT_SYN_RECV
+		}
+	case flags&TCP_FLAG_FIN != 0:
+		switch e.tcpState {
+		case TCP_CT_SYN_RECV, TCP_CT_ESTABLISHED:
+			e.tcpState = TCP_CT_FIN_WAIT
+			e.finDir = dir
+		case TCP_CT_FIN_WAIT, TCP_CT_CLOSE_WAIT:
+			if dir != e.finDir {
+				e.tcpState = TCP_CT_LAST_ACK
+			}
+		}
+	case flags&TCP_FLAG_ACK != 0:
+		switch e.tcpState {
+		case TCP_CT_SYN_RECV:
+			if dir == CT_DIR_ORIGINAL {
+				e.tcpState = TCP_CT_ESTABLISHED
+			}
+		case TCP_CT_FIN_WAIT:
+			if dir != e.finDir {
+				e.tcpState = TCP_CT_CLOSE_WAIT
+			}
+		case TCP_CT_LAST_ACK:
+			// 先关闭的一方确认了对方的FIN
+			if dir == e.finDir {
+				e.tcpState = TCP_CT_TIME_WAIT
+			}
+		}
+	}
+}
+
+// Entries 返回跟踪表中未过期连接的快照
+func (c *Conntrack) Entries() []ConnEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	c.expire(now)
+	entries := make([]ConnEntry, 0, len(c.entries)/2)
+	for tuple, entry := range c.entries {
+		if tuple != entry.orig {
+			continue
+		}
+		entries = append(entries, ConnEntry{
+			Orig:     entry.orig,
+			Reply:    entry.reply,
+			TcpState: entry.tcpState,
+			Replied:  entry.replied,
+			Expires:  entry.expires,
+			Packets:  entry.packets,
+			Bytes:    entry.bytes,
+		})
+	}
+	return entries
+}
+
+// Flush 清空跟踪表
+func (c *Conntrack) Flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries = make(map[Tuple]*ctEntry)
+}
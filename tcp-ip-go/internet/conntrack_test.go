@@ -0,0 +1,245 @@
+package internet
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"tcp/network"
+	"testing"
+	"time"
+)
+
+var (
+	testClient = netip.MustParseAddrPort("192.168.1.10:40000")
+	testServer = netip.MustParseAddrPort("198.51.100.7:80")
+)
+
+// 构造带校验和的TCP报文段，只有20字节的头部
+func tcpSegment(src, dst netip.AddrPort, flags uint8, payload []byte) []byte {
+	seg := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(seg[0:2], src.Port())
+	binary.BigEndian.PutUint16(seg[2:4], dst.Port())
+	binary.BigEndian.PutUint32(seg[4:8], 1000)
+	binary.BigEndian.PutUint32(seg[8:12], 2000)
+	seg[12] = 5 << 4
+	seg[13] = flags
+	binary.BigEndian.PutUint16(seg[14:16], 65535)
+	seg = append(seg, payload...)
+	sum := checksum(append(pseudoHeader(src.Addr(), dst.Addr(), len(seg), TCP_PROTOCOL), seg...))
+	binary.BigEndian.PutUint16(seg[16:18], sum)
+	return seg
+}
+
+func tcpDatagram(src, dst netip.AddrPort, flags uint8) []byte {
+	return NewDatagram(src.Addr(), dst.Addr(), TCP_PROTOCOL, TOS, tcpSegment(src, dst, flags, []byte("data")))
+}
+
+func udpTestDatagram(src, dst netip.AddrPort) []byte {
+	return NewDatagram(src.Addr(), dst.Addr(), UDP_PROTOCOL, TOS, marshalUdp(src.Addr(), dst.Addr(), src.Port(), dst.Port(), []byte("data")))
+}
+
+// 携带原始数据报orig的ICMP差错，从from发往orig的源地址
+func icmpErrorDatagram(from netip.Addr, orig []byte, length int) []byte {
+	icmp := (&IcmpMessage{
+		Type: ICMP_TYPE_DESTINATION_UNREACHABLE,
+		Code: ICMP_CODE_PORT_UNREACHABLE,
+		Data: orig[:length],
+	}).Marshal()
+	return NewDatagram(from, netip.AddrFrom4([4]byte(orig[12:16])), ICMP_PROTOCOL, TOS, icmp)
+}
+
+func testPacket(t *testing.T, datagram []byte) *IpPacket {
+	t.Helper()
+	buf := append([]byte(nil), datagram...)
+	pkt, err := parseDatagram(network.Packet{Buf: buf, N: uintptr(len(buf))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pkt
+}
+
+func TestUpdateTcp(t *testing.T) {
+	const (
+		orig  = CT_DIR_ORIGINAL
+		reply = CT_DIR_REPLY
+		syn   = TCP_FLAG_SYN
+		ack   = TCP_FLAG_ACK
+		fin   = TCP_FLAG_FIN | TCP_FLAG_ACK
+		rst   = TCP_FLAG_RST
+	)
+	type step struct {
+		dir   int
+		flags uint8
+		want  TcpCtState
+	}
+	handshake := []step{
+		{orig, syn, TCP_CT_SYN_SENT},
+		{reply, syn | ack, TCP_CT_SYN_RECV},
+		{orig, ack, TCP_CT_ESTABLISHED},
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"handshake", handshake},
+		{"syn retransmitted", []step{{orig, syn, TCP_CT_SYN_SENT}, {orig, syn, TCP_CT_SYN_SENT}, {reply, syn | ack, TCP_CT_SYN_RECV}}},
+		{"syn-ack from originator", []step{{orig, syn, TCP_CT_SYN_SENT}, {orig, syn | ack, TCP_CT_SYN_SENT}}},
+		{"ack from responder in syn-recv", []step{{orig, syn, TCP_CT_SYN_SENT}, {reply, syn | ack, TCP_CT_SYN_RECV}, {reply, ack, TCP_CT_SYN_RECV}}},
+		{"originator closes", append(handshake,
+			step{orig, fin, TCP_CT_FIN_WAIT},
+			step{orig, fin, TCP_CT_FIN_WAIT},
+			step{reply, ack, TCP_CT_CLOSE_WAIT},
+			step{reply, fin, TCP_CT_LAST_ACK},
+			step{reply, ack, TCP_CT_LAST_ACK},
+			step{orig, ack, TCP_CT_TIME_WAIT})},
+		{"responder closes", append(handshake,
+			step{reply, fin, TCP_CT_FIN_WAIT},
+			step{orig, ack, TCP_CT_CLOSE_WAIT},
+			step{orig, fin, TCP_CT_LAST_ACK},
+			step{reply, ack, TCP_CT_TIME_WAIT})},
+		{"simultaneous close", append(handshake,
+			step{orig, fin, TCP_CT_FIN_WAIT},
+			step{reply, fin, TCP_CT_LAST_ACK},
+			step{orig, ack, TCP_CT_TIME_WAIT})},
+		{"fin in syn-recv", []step{{orig, syn, TCP_CT_SYN_SENT}, {reply, syn | ack, TCP_CT_SYN_RECV}, {orig, fin, TCP_CT_FIN_WAIT}}},
+		{"fin before handshake", []step{{orig, syn, TCP_CT_SYN_SENT}, {orig, fin, TCP_CT_SYN_SENT}}},
+		{"reset during handshake", []step{{orig, syn, TCP_CT_SYN_SENT}, {reply, rst | ack, TCP_CT_CLOSE}}},
+		{"reset when established", append(handshake, step{orig, rst, TCP_CT_CLOSE})},
+		{"syn after close", append(handshake, step{orig, rst, TCP_CT_CLOSE}, step{orig, syn, TCP_CT_CLOSE})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &ctEntry{finDir: -1}
+			for i, s := range tt.steps {
+				e.updateTcp(s.dir, s.flags)
+				if e.tcpState != s.want {
+					t.Fatalf("step %d: state %s, want %s", i, e.tcpState, s.want)
+				}
+			}
+		})
+	}
+}
+
+// 连接的超时时间随TCP状态和UDP是否收到应答变化
+func TestConntrackTimeout(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		datagram []byte
+		tcpState TcpCtState
+		replied  bool
+		want     time.Duration
+	}{
+		{"tcp syn", tcpDatagram(testClient, testServer, TCP_FLAG_SYN), TCP_CT_NONE, false, tcpCtTimeouts[TCP_CT_SYN_SENT]},
+		{"tcp established", tcpDatagram(testClient, testServer, TCP_FLAG_ACK), TCP_CT_ESTABLISHED, true, tcpCtTimeouts[TCP_CT_ESTABLISHED]},
+		{"udp unreplied", udpTestDatagram(testClient, testServer), TCP_CT_NONE, false, CT_UDP_TIMEOUT},
+		{"udp stream", udpTestDatagram(testClient, testServer), TCP_CT_NONE, true, CT_UDP_STREAM_TIMEOUT},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &ctEntry{finDir: -1, tcpState: tt.tcpState, replied: tt.replied}
+			e.update(CT_DIR_ORIGINAL, *testPacket(t, tt.datagram), now)
+			if got := e.expires.Sub(now); got != tt.want {
+				t.Fatalf("timeout %s, want %s", got, tt.want)
+			}
+			if e.packets[CT_DIR_ORIGINAL] != 1 || e.bytes[CT_DIR_ORIGINAL] != uint64(len(tt.datagram)) {
+				t.Fatalf("counters %v %v", e.packets, e.bytes)
+			}
+		})
+	}
+}
+
+func TestConntrackTrack(t *testing.T) {
+	c := NewConntrack()
+
+	// 第一个SYN是新连接，通过所有hook之前不加入跟踪表
+	syn := testPacket(t, tcpDatagram(testClient, testServer, TCP_FLAG_SYN))
+	c.track(syn)
+	if syn.CtState != CT_STATE_NEW || syn.ct == nil || len(c.entries) != 0 {
+		t.Fatalf("syn state %s, %d entries", syn.CtState, len(c.entries))
+	}
+	c.confirm(*syn)
+	if len(c.entries) != 2 {
+		t.Fatalf("%d entries after confirm, want both directions", len(c.entries))
+	}
+
+	synAck := testPacket(t, tcpDatagram(testServer, testClient, TCP_FLAG_SYN|TCP_FLAG_ACK))
+	c.track(synAck)
+	if synAck.CtState != CT_STATE_ESTABLISHED || synAck.ct != syn.ct || synAck.ctDir != CT_DIR_REPLY {
+		t.Fatalf("syn-ack state %s dir %d", synAck.CtState, synAck.ctDir)
+	}
+
+	// 没有连接的非SYN报文段和没有请求的回显应答无法归属
+	stray := testPacket(t, tcpDatagram(testClient, netip.MustParseAddrPort("198.51.100.8:80"), TCP_FLAG_ACK))
+	c.track(stray)
+	if stray.CtState != CT_STATE_INVALID || stray.ct != nil {
+		t.Fatalf("stray ack state %s", stray.CtState)
+	}
+	echoReply := (&IcmpMessage{Type: ICMP_TYPE_ECHO_REPLY, Rest: 7 << 16}).Marshal()
+	reply := testPacket(t, NewDatagram(testServer.Addr(), testClient.Addr(), ICMP_PROTOCOL, TOS, echoReply))
+	c.track(reply)
+	if reply.CtState != CT_STATE_INVALID {
+		t.Fatalf("unsolicited echo reply state %s", reply.CtState)
+	}
+
+	// 非首个分片不跟踪
+	frag := testPacket(t, udpTestDatagram(testClient, testServer))
+	frag.IpHeader.FragmentOffset = 10
+	c.track(frag)
+	if frag.CtState != CT_STATE_UNTRACKED {
+		t.Fatalf("fragment state %s", frag.CtState)
+	}
+
+	// 对原方向数据报的ICMP差错沿应答方向返回
+	orig := tcpDatagram(testClient, testServer, TCP_FLAG_ACK)
+	icmp := testPacket(t, icmpErrorDatagram(testServer.Addr(), orig, IP_HEADER_MIN_LENGTH+8))
+	c.track(icmp)
+	if icmp.CtState != CT_STATE_RELATED || icmp.ct != syn.ct || icmp.ctDir != CT_DIR_REPLY {
+		t.Fatalf("icmp error state %s dir %d", icmp.CtState, icmp.ctDir)
+	}
+	unrelated := testPacket(t, icmpErrorDatagram(testServer.Addr(), stray.Packet.Buf, IP_HEADER_MIN_LENGTH+8))
+	c.track(unrelated)
+	if unrelated.CtState != CT_STATE_INVALID {
+		t.Fatalf("unrelated icmp error state %s", unrelated.CtState)
+	}
+
+	entries := c.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("%d entries, want 1", len(entries))
+	}
+	if e := entries[0]; e.Orig != syn.ct.orig || !e.Replied || e.TcpState != TCP_CT_SYN_RECV || e.Packets != [2]uint64{1, 1} {
+		t.Fatalf("entry %s", e)
+	}
+
+	// 连接关闭后新的SYN重新开始跟踪
+	rst := testPacket(t, tcpDatagram(testClient, testServer, TCP_FLAG_RST))
+	c.track(rst)
+	if syn.ct.tcpState != TCP_CT_CLOSE {
+		t.Fatalf("state %s after reset", syn.ct.tcpState)
+	}
+	again := testPacket(t, tcpDatagram(testClient, testServer, TCP_FLAG_SYN))
+	c.track(again)
+	if again.CtState != CT_STATE_NEW || again.ct == syn.ct || again.ct.tcpState != TCP_CT_SYN_SENT {
+		t.Fatalf("new syn state %s, reused entry %t", again.CtState, again.ct == syn.ct)
+	}
+	if len(c.entries) != 0 {
+		t.Fatalf("%d entries, want the closed connection removed", len(c.entries))
+	}
+}
+
+// 过期的连接在查找时删除
+func TestConntrackExpire(t *testing.T) {
+	c := NewConntrack()
+	pkt := testPacket(t, udpTestDatagram(testClient, testServer))
+	c.track(pkt)
+	c.confirm(*pkt)
+	pkt.ct.expires = time.Now().Add(-time.Second)
+
+	reply := testPacket(t, udpTestDatagram(testServer, testClient))
+	c.track(reply)
+	if reply.CtState != CT_STATE_NEW || reply.ct == pkt.ct {
+		t.Fatalf("reply to expired connection state %s", reply.CtState)
+	}
+	if len(c.entries) != 0 {
+		t.Fatalf("%d entries after expiry", len(c.entries))
+	}
+}
@@ -0,0 +1,720 @@
+package internet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/netip"
+	"sort"
+	"sync"
+	"tcp/network"
+	"time"
+)
+
+const (
+	DHCP_SERVER_PORT = 67
+	DHCP_CLIENT_PORT = 68
+
+	DHCP_OP_REQUEST     = 1 // BOOTREQUEST
+	DHCP_OP_REPLY       = 2 // BOOTREPLY
+	DHCP_HTYPE_ETHERNET = 1
+	DHCP_FLAG_BROADCAST = 0x8000     // 要求服务器以广播回应，客户端还没有地址时使用
+	DHCP_MAGIC_COOKIE   = 0x63825363 // 选项字段的开头 (RFC 2131 3)
+	DHCP_HEADER_LENGTH  = 240        // 固定字段和magic cookie的长度
+
+	// DHCP消息类型 (RFC 2132 9.6)
+	DHCP_DISCOVER = 1
+	DHCP_OFFER    = 2
+	DHCP_REQUEST  = 3
+	DHCP_DECLINE  = 4
+	DHCP_ACK      = 5
+	DHCP_NAK      = 6
+	DHCP_RELEASE  = 7
+
+	// DHCP选项 (RFC 2132)
+	DHCP_OPTION_PAD            = 0
+	DHCP_OPTION_SUBNET_MASK    = 1
+	DHCP_OPTION_ROUTER         = 3
+	DHCP_OPTION_DNS            = 6
+	DHCP_OPTION_REQUESTED_IP   = 50
+	DHCP_OPTION_LEASE_TIME     = 51
+	DHCP_OPTION_MESSAGE_TYPE   = 53
+	DHCP_OPTION_SERVER_ID      = 54
+	DHCP_OPTION_PARAMETER_LIST = 55
+	DHCP_OPTION_RENEWAL_TIME   = 58
+	DHCP_OPTION_REBINDING_TIME = 59
+	DHCP_OPTION_CLIENT_ID      = 61
+	DHCP_OPTION_END            = 255
+
+	DHCP_INITIAL_TIMEOUT     = 4 * time.Second  // 第一次重传的等待时间，之后每次加倍 (RFC 2131 4.1)
+	DHCP_MAX_TIMEOUT         = 64 * time.Second // 重传等待时间的上限
+	DHCP_MAX_REQUESTS        = 4                // REQUEST没有回应时的最大发送次数
+	DHCP_MIN_RENEW_INTERVAL  = 60 * time.Second // 续租和重新绑定时重传间隔的下限 (RFC 2131 4.4.5)
+	DHCP_DEFAULT_LEASE_TIME  = time.Hour        // 服务器没有给出租期时使用
+	DHCP_PROBE_WAIT          = time.Second      // 发出ARP探测后等待冲突回应的时间
+	DHCP_DECLINE_WAIT        = 10 * time.Second // 拒绝地址后重新获取前的等待时间 (RFC 2131 3.1.5)
+	DHCP_INFINITE_LEASE_TIME = 0xffffffff
+)
+
+var limitedBroadcastAddr = netip.AddrFrom4([4]byte{255, 255, 255, 255})
+
+// DhcpMessage DHCP报文，选项按代码保存
+type DhcpMessage struct {
+	Op      uint8
+	Xid     uint32 // 事务ID，用于匹配请求和应答
+	Secs    uint16 // 客户端开始获取地址后经过的秒数
+	Flags   uint16
+	Ciaddr  netip.Addr // 客户端已有的地址，续租时填写
+	Yiaddr  netip.Addr // 服务器分配给客户端的地址
+	Siaddr  netip.Addr
+	Giaddr  netip.Addr // 中继代理地址
+	Chaddr  network.HardwareAddr
+	Options map[uint8][]byte
+}
+
+// 0                   1                   2                   3
+// 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+// +---------------+---------------+---------------+---------------+
+// |     op (1)    |   htype (1)   |   hlen (1)    |   hops (1)    |
+// +---------------+---------------+---------------+---------------+
+// |                            xid (4)                            |
+// +-------------------------------+-------------------------------+
+// |           secs (2)            |           flags (2)           |
+// +-------------------------------+-------------------------------+
+// |                          ciaddr  (4)                          |
+// +---------------------------------------------------------------+
+// |                          yiaddr  (4)                          |
+// +---------------------------------------------------------------+
+// |                          siaddr  (4)                          |
+// +---------------------------------------------------------------+
+// |                          giaddr  (4)                          |
+// +---------------------------------------------------------------+
+// |                          chaddr  (16)                         |
+// +---------------------------------------------------------------+
+// |                          sname   (64)                         |
+// +---------------------------------------------------------------+
+// |                          file    (128)                        |
+// +---------------------------------------------------------------+
+// |                          options (variable)                   |
+// +---------------------------------------------------------------+
+
+// UnmarshalDhcp 解析DHCP报文，不支持选项重载(sname和file字段中的选项)
+func UnmarshalDhcp(buf []byte) (*DhcpMessage, error) {
+	if len(buf) < DHCP_HEADER_LENGTH {
+		return nil, fmt.Errorf("invalid dhcp length: %d", len(buf))
+	}
+	if binary.BigEndian.Uint32(buf[236:240]) != DHCP_MAGIC_COOKIE {
+		return nil, fmt.Errorf("invalid dhcp magic cookie")
+	}
+
+	msg := &DhcpMessage{
+		Op:      buf[0],
+		Xid:     binary.BigEndian.Uint32(buf[4:8]),
+		Secs:    binary.BigEndian.Uint16(buf[8:10]),
+		Flags:   binary.BigEndian.Uint16(buf[10:12]),
+		Ciaddr:  netip.AddrFrom4([4]byte(buf[12:16])),
+		Yiaddr:  netip.AddrFrom4([4]byte(buf[16:20])),
+		Siaddr:  netip.AddrFrom4([4]byte(buf[20:24])),
+		Giaddr:  netip.AddrFrom4([4]byte(buf[24:28])),
+		Options: make(map[uint8][]byte),
+	}
+	copy(msg.Chaddr[:], buf[28:34])
+
+	opts := buf[DHCP_HEADER_LENGTH:]
+	for len(opts) > 0 {
+		code := opts[0]
+		if code == DHCP_OPTION_END {
+			break
+		}
+		if code == DHCP_OPTION_PAD {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, fmt.Errorf("truncated dhcp option: %d", code)
+		}
+		end := 2 + int(opts[1])
+		// 同一选项出现多次时拼接在一起 (RFC 3396)
+		msg.Options[code] = append(msg.Options[code], opts[2:end]...)
+		opts = opts[end:]
+	}
+	if t := msg.Options[DHCP_OPTION_MESSAGE_TYPE]; len(t) != 1 {
+		return nil, fmt.Errorf("missing dhcp message type")
+	}
+	return msg, nil
+}
+
+// Marshal 组装DHCP报文，消息类型选项放在最前面
+func (msg *DhcpMessage) Marshal() []byte {
+	buf := make([]byte, DHCP_HEADER_LENGTH)
+	buf[0] = msg.Op
+	buf[1] = DHCP_HTYPE_ETHERNET
+	buf[2] = uint8(len(msg.Chaddr))
+	binary.BigEndian.PutUint32(buf[4:8], msg.Xid)
+	binary.BigEndian.PutUint16(buf[8:10], msg.Secs)
+	binary.BigEndian.PutUint16(buf[10:12], msg.Flags)
+	for i, addr := range []netip.Addr{msg.Ciaddr, msg.Yiaddr, msg.Siaddr, msg.Giaddr} {
+		if addr.Is4() {
+			ip := addr.As4()
+			copy(buf[12+4*i:16+4*i], ip[:])
+		}
+	}
+	copy(buf[28:34], msg.Chaddr[:])
+	binary.BigEndian.PutUint32(buf[236:240], DHCP_MAGIC_COOKIE)
+
+	codes := make([]int, 0, len(msg.Options))
+	for code := range msg.Options {
+		if code != DHCP_OPTION_MESSAGE_TYPE {
+			codes = append(codes, int(code))
+		}
+	}
+	sort.Ints(codes)
+	codes = append([]int{DHCP_OPTION_MESSAGE_TYPE}, codes...)
+	for _, code := range codes {
+		data := msg.Options[uint8(code)]
+		// 超过255字节的选项拆成多个
+		for len(data) > 255 {
+			buf = append(buf, uint8(code), 255)
+			buf = append(buf, data[:255]...)
+			data = data[255:]
+		}
+		buf = append(buf, uint8(code), uint8(len(data)))
+		buf = append(buf, data...)
+	}
+	return append(buf, DHCP_OPTION_END)
+}
+
+// Type 返回DHCP消息类型
+func (msg *DhcpMessage) Type() uint8 {
+	if t := msg.Options[DHCP_OPTION_MESSAGE_TYPE]; len(t) == 1 {
+		return t[0]
+	}
+	return 0
+}
+
+// 以IPv4地址列表形式读取选项
+func (msg *DhcpMessage) addrs(code uint8) []netip.Addr {
+	data := msg.Options[code]
+	addrs := make([]netip.Addr, 0, len(data)/4)
+	for i := 0; i+4 <= len(data); i += 4 {
+		addrs = append(addrs, netip.AddrFrom4([4]byte(data[i:i+4])))
+	}
+	return addrs
+}
+
+// 以秒为单位读取时间选项
+func (msg *DhcpMessage) duration(code uint8) (time.Duration, bool) {
+	data := msg.Options[code]
+	if len(data) != 4 {
+		return 0, false
+	}
+	return time.Duration(binary.BigEndian.Uint32(data)) * time.Second, true
+}
+
+type DhcpState int
+
+// 客户端状态 (RFC 2131 4.4)
+const (
+	DHCP_STATE_INIT DhcpState = iota
+	DHCP_STATE_SELECTING
+	DHCP_STATE_REQUESTING
+	DHCP_STATE_PROBING // 收到ACK后用ARP探测地址是否已被使用
+	DHCP_STATE_BOUND
+	DHCP_STATE_RENEWING
+	DHCP_STATE_REBINDING
+	DHCP_STATE_STOPPED
+)
+
+func (s DhcpState) String() string {
+	switch s {
+	case DHCP_STATE_INIT:
+		return "INIT"
+	case DHCP_STATE_SELECTING:
+		return "SELECTING"
+	case DHCP_STATE_REQUESTING:
+		return "REQUESTING"
+	case DHCP_STATE_PROBING:
+		return "PROBING"
+	case DHCP_STATE_BOUND:
+		return "BOUND"
+	case DHCP_STATE_RENEWING:
+		return "RENEWING"
+	case DHCP_STATE_REBINDING:
+		return "REBINDING"
+	case DHCP_STATE_STOPPED:
+		return "STOPPED"
+	}
+	return fmt.Sprintf("DhcpState(%d)", int(s))
+}
+
+// DhcpLease 从服务器获得的租约
+type DhcpLease struct {
+	Addr      netip.Prefix // 分配的地址和子网前缀
+	Gateway   netip.Addr   // 默认网关，服务器没有给出时无效
+	Dns       []netip.Addr // DNS服务器
+	Server    netip.Addr   // 服务器标识
+	LeaseTime time.Duration
+	T1        time.Duration // 开始向原服务器续租的时间
+	T2        time.Duration // 开始向任意服务器重新绑定的时间
+	Acquired  time.Time
+}
+
+// DhcpClient 接口上的DHCP客户端，获得的地址和默认路由写入协议栈的地址表和路由表
+type DhcpClient struct {
+	q       *IpPacketQueue
+	iface   *Interface
+	state   DhcpState
+	xid     uint32
+	started time.Time // 本次获取开始的时间，用于填写secs字段
+	offer   *DhcpMessage
+	ack     *DhcpMessage // PROBING状态下等待探测结果的ACK
+	lease   *DhcpLease
+	prev    netip.Addr    // 上一次租约的地址，重新获取时请求继续使用
+	timeout time.Duration // 当前的重传等待时间
+	retries int
+	timer   *time.Timer // 重传计时器
+	t1      *time.Timer
+	t2      *time.Timer
+	expire  *time.Timer
+	gen     int // 计时器的代数，停止计时器后已触发但未执行的回调不再生效
+	bound   chan DhcpLease
+	lock    sync.Mutex
+}
+
+// StartDhcp 在以太网接口上启动DHCP客户端
+func (q *IpPacketQueue) StartDhcp(iface *Interface) (*DhcpClient, error) {
+	if !iface.isEthernet() {
+		return nil, fmt.Errorf("dhcp requires an ethernet link: %s", iface.Name)
+	}
+	c := &DhcpClient{
+		q:     q,
+		iface: iface,
+		bound: make(chan DhcpLease, 1),
+	}
+
+	iface.lock.Lock()
+	if iface.dhcp != nil {
+		iface.lock.Unlock()
+		return nil, fmt.Errorf("dhcp client already running on %s", iface.Name)
+	}
+	iface.dhcp = c
+	iface.lock.Unlock()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.discover()
+	return c, nil
+}
+
+// State 返回客户端当前的状态
+func (c *DhcpClient) State() DhcpState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.state
+}
+
+// Lease 返回当前的租约
+func (c *DhcpClient) Lease() (DhcpLease, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.lease == nil {
+		return DhcpLease{}, false
+	}
+	return *c.lease, true
+}
+
+// Bound 每次获得或更新租约后从该通道通知，只保留最新的一个
+func (c *DhcpClient) Bound() <-chan DhcpLease {
+	return c.bound
+}
+
+// Stop 释放租约并停止客户端
+func (c *DhcpClient) Stop() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.lease != nil && (c.state == DHCP_STATE_BOUND || c.state == DHCP_STATE_RENEWING || c.state == DHCP_STATE_REBINDING) {
+		msg := c.newMessage(DHCP_RELEASE)
+		msg.Ciaddr = c.lease.Addr.Addr()
+		msg.Options[DHCP_OPTION_SERVER_ID] = addrBytes(c.lease.Server)
+		c.sendUnicast(msg, c.lease.Server)
+	}
+	c.unbind()
+	c.stopTimers()
+	c.state = DHCP_STATE_STOPPED
+
+	c.iface.lock.Lock()
+	c.iface.dhcp = nil
+	c.iface.lock.Unlock()
+}
+
+// 进入SELECTING状态，广播DISCOVER寻找服务器。调用时需持有锁
+func (c *DhcpClient) discover() {
+	c.state = DHCP_STATE_SELECTING
+	c.xid = rand.Uint32()
+	c.started = time.Now()
+	c.offer = nil
+	c.timeout = DHCP_INITIAL_TIMEOUT
+	c.retries = 0
+	c.sendDiscover()
+}
+
+func (c *DhcpClient) sendDiscover() {
+	msg := c.newMessage(DHCP_DISCOVER)
+	// 重新获取时希望继续使用原来的地址
+	if c.prev.IsValid() {
+		msg.Options[DHCP_OPTION_REQUESTED_IP] = addrBytes(c.prev)
+	}
+	c.sendBroadcast(msg)
+	c.retransmit(c.sendDiscover)
+}
+
+// 选择OFFER后广播REQUEST，同时告知其他服务器未被选中
+func (c *DhcpClient) sendRequest() {
+	if c.retries >= DHCP_MAX_REQUESTS {
+		log.Printf("dhcp on %s: no response to request, restart", c.iface.Name)
+		c.discover()
+		return
+	}
+	c.retries++
+	msg := c.newMessage(DHCP_REQUEST)
+	msg.Options[DHCP_OPTION_REQUESTED_IP] = addrBytes(c.offer.Yiaddr)
+	msg.Options[DHCP_OPTION_SERVER_ID] = c.offer.Options[DHCP_OPTION_SERVER_ID]
+	c.sendBroadcast(msg)
+	c.retransmit(c.sendRequest)
+}
+
+// 按指数退避安排下一次重传，加上±1秒的随机抖动 (RFC 2131 4.1)
+func (c *DhcpClient) retransmit(send func()) {
+	c.stopTimer(&c.timer)
+	delay := c.timeout + time.Duration(rand.Int63n(int64(2*time.Second))) - time.Second
+	c.timer = c.after(delay, func() {
+		if c.timeout *= 2; c.timeout > DHCP_MAX_TIMEOUT {
+			c.timeout = DHCP_MAX_TIMEOUT
+		}
+		send()
+	})
+}
+
+// 续租和重新绑定时在剩余时间的一半后重传，不少于60秒 (RFC 2131 4.4.5)
+func (c *DhcpClient) retransmitUntil(deadline time.Time, send func()) {
+	c.stopTimer(&c.timer)
+	delay := time.Until(deadline) / 2
+	if delay < DHCP_MIN_RENEW_INTERVAL {
+		return
+	}
+	c.timer = c.after(delay, send)
+}
+
+// T1到期后向原服务器单播REQUEST续租
+func (c *DhcpClient) sendRenew() {
+	msg := c.newMessage(DHCP_REQUEST)
+	msg.Ciaddr = c.lease.Addr.Addr()
+	c.sendUnicast(msg, c.lease.Server)
+	c.retransmitUntil(c.lease.Acquired.Add(c.lease.T2), c.sendRenew)
+}
+
+// T2到期后广播REQUEST，任何服务器都可以延长租约
+func (c *DhcpClient) sendRebind() {
+	msg := c.newMessage(DHCP_REQUEST)
+	msg.Ciaddr = c.lease.Addr.Addr()
+	c.sendBroadcast(msg)
+	c.retransmitUntil(c.lease.Acquired.Add(c.lease.LeaseTime), c.sendRebind)
+}
+
+// 处理服务器发来的报文
+func (c *DhcpClient) recv(buf []byte) {
+	msg, err := UnmarshalDhcp(buf)
+	if err != nil {
+		log.Printf("dhcp on %s: %s", c.iface.Name, err)
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if msg.Op != DHCP_OP_REPLY || msg.Xid != c.xid || msg.Chaddr != c.iface.Link.HardwareAddr() {
+		return
+	}
+
+	switch {
+	case c.state == DHCP_STATE_SELECTING && msg.Type() == DHCP_OFFER:
+		if !msg.Yiaddr.IsValid() || msg.Yiaddr.IsUnspecified() || len(msg.Options[DHCP_OPTION_SERVER_ID]) != 4 {
+			return
+		}
+		// 选择第一个OFFER
+		log.Printf("dhcp on %s: offer %s from %s", c.iface.Name, msg.Yiaddr, msg.addrs(DHCP_OPTION_SERVER_ID)[0])
+		c.offer = msg
+		c.state = DHCP_STATE_REQUESTING
+		c.timeout = DHCP_INITIAL_TIMEOUT
+		c.retries = 0
+		c.sendRequest()
+	case c.awaitingAck() && msg.Type() == DHCP_ACK:
+		if !msg.Yiaddr.IsValid() || msg.Yiaddr.IsUnspecified() || !c.fromServer(msg) {
+			return
+		}
+		// 新获得的地址先探测是否已被使用，续租时直接更新租约
+		if c.state == DHCP_STATE_REQUESTING {
+			c.probe(msg)
+			return
+		}
+		c.bind(msg)
+	case c.awaitingAck() && msg.Type() == DHCP_NAK:
+		if !c.fromServer(msg) {
+			return
+		}
+		log.Printf("dhcp on %s: nak in state %s, restart", c.iface.Name, c.state)
+		c.unbind()
+		c.stopTimers()
+		c.discover()
+	}
+}
+
+// 是否发出了REQUEST正在等待服务器确认
+func (c *DhcpClient) awaitingAck() bool {
+	return c.state == DHCP_STATE_REQUESTING || c.state == DHCP_STATE_RENEWING || c.state == DHCP_STATE_REBINDING
+}
+
+// REQUESTING状态下只接受被选中的服务器的回应，续租时只接受原服务器的回应，
+// 重新绑定时任何服务器都可以回应
+func (c *DhcpClient) fromServer(msg *DhcpMessage) bool {
+	switch c.state {
+	case DHCP_STATE_REQUESTING:
+		return c.serverOf(msg) == c.serverOf(c.offer)
+	case DHCP_STATE_RENEWING:
+		return c.serverOf(msg) == c.lease.Server
+	}
+	return true
+}
+
+// 广播ARP探测，等待期间没有其他主机声明该地址才进入BOUND状态 (RFC 2131 4.4.1)
+func (c *DhcpClient) probe(ack *DhcpMessage) {
+	c.state = DHCP_STATE_PROBING
+	c.ack = ack
+	c.stopTimer(&c.timer)
+	c.q.sendArpProbe(c.iface, ack.Yiaddr)
+	c.timer = c.after(DHCP_PROBE_WAIT, func() {
+		c.ack = nil
+		c.bind(ack)
+	})
+}
+
+// 处理接口上收到的ARP报文：探测期间其他主机使用或同时探测该地址时拒绝 (RFC 5227 2.1.1)
+func (c *DhcpClient) recvArp(arp *ArpPacket) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.state != DHCP_STATE_PROBING || arp.SenderHwAddr == c.iface.Link.HardwareAddr() {
+		return
+	}
+	addr := c.ack.Yiaddr
+	sender := addrFrom4(arp.SenderIP)
+	target := addrFrom4(arp.TargetIP)
+	if sender == addr || (sender.IsUnspecified() && target == addr && arp.Operation == ARP_OPERATION_REQUEST) {
+		c.decline()
+	}
+}
+
+// 通知服务器地址已被使用，等待一段时间后重新获取 (RFC 2131 3.1.5)
+func (c *DhcpClient) decline() {
+	log.Printf("dhcp on %s: %s is already in use, decline", c.iface.Name, c.ack.Yiaddr)
+	msg := c.newMessage(DHCP_DECLINE)
+	// DECLINE不能带参数请求列表 (RFC 2131 表5)
+	delete(msg.Options, DHCP_OPTION_PARAMETER_LIST)
+	msg.Options[DHCP_OPTION_REQUESTED_IP] = addrBytes(c.ack.Yiaddr)
+	msg.Options[DHCP_OPTION_SERVER_ID] = addrBytes(c.serverOf(c.ack))
+	c.sendBroadcast(msg)
+
+	c.stopTimers()
+	c.state = DHCP_STATE_INIT
+	c.ack = nil
+	c.prev = netip.Addr{}
+	c.timer = c.after(DHCP_DECLINE_WAIT, c.discover)
+}
+
+// 收到ACK后进入BOUND状态，写入地址和默认路由并设置续租计时器
+func (c *DhcpClient) bind(ack *DhcpMessage) {
+	lease := &DhcpLease{
+		Server:    c.serverOf(ack),
+		LeaseTime: DHCP_DEFAULT_LEASE_TIME,
+		Acquired:  c.started,
+	}
+
+	bits := 32
+	if mask := ack.Options[DHCP_OPTION_SUBNET_MASK]; len(mask) == 4 {
+		bits = 0
+		for m := binary.BigEndian.Uint32(mask); m&0x80000000 != 0; m <<= 1 {
+			bits++
+		}
+	}
+	lease.Addr = netip.PrefixFrom(ack.Yiaddr, bits)
+	if routers := ack.addrs(DHCP_OPTION_ROUTER); len(routers) > 0 {
+		lease.Gateway = routers[0]
+	}
+	lease.Dns = ack.addrs(DHCP_OPTION_DNS)
+
+	infinite := false
+	if t, ok := ack.duration(DHCP_OPTION_LEASE_TIME); ok {
+		lease.LeaseTime = t
+		infinite = t == DHCP_INFINITE_LEASE_TIME*time.Second
+	}
+	// 默认T1为租期的一半，T2为租期的7/8 (RFC 2131 4.4.5)
+	lease.T1 = lease.LeaseTime / 2
+	lease.T2 = lease.LeaseTime * 7 / 8
+	if t, ok := ack.duration(DHCP_OPTION_RENEWAL_TIME); ok && t < lease.LeaseTime {
+		lease.T1 = t
+	}
+	if t, ok := ack.duration(DHCP_OPTION_REBINDING_TIME); ok && t < lease.LeaseTime {
+		lease.T2 = t
+	}
+	if lease.T1 > lease.T2 {
+		lease.T1 = lease.T2
+	}
+
+	// 地址或网关变化时先撤销原来的配置
+	if c.lease != nil && (c.lease.Addr != lease.Addr || c.lease.Gateway != lease.Gateway) {
+		c.unbind()
+	}
+	if c.lease == nil {
+		if err := c.q.AddAddress(c.iface, lease.Addr); err != nil {
+			log.Printf("dhcp on %s: %s", c.iface.Name, err)
+		}
+		if lease.Gateway.IsValid() {
+			c.q.routes.Add(Route{
+				Prefix:    netip.PrefixFrom(netip.IPv4Unspecified(), 0),
+				Gateway:   lease.Gateway,
+				Interface: c.iface,
+			})
+		}
+	}
+	c.lease = lease
+	c.state = DHCP_STATE_BOUND
+	log.Printf("dhcp on %s: bound to %s, gateway %s, lease %s", c.iface.Name, lease.Addr, lease.Gateway, lease.LeaseTime)
+
+	c.stopTimers()
+	if !infinite {
+		c.t1 = c.after(time.Until(lease.Acquired.Add(lease.T1)), func() {
+			c.state = DHCP_STATE_RENEWING
+			c.xid = rand.Uint32()
+			c.started = time.Now()
+			c.sendRenew()
+		})
+		c.t2 = c.after(time.Until(lease.Acquired.Add(lease.T2)), func() {
+			c.state = DHCP_STATE_REBINDING
+			c.sendRebind()
+		})
+		c.expire = c.after(time.Until(lease.Acquired.Add(lease.LeaseTime)), func() {
+			log.Printf("dhcp on %s: lease of %s expired", c.iface.Name, c.lease.Addr)
+			c.stopTimers()
+			c.unbind()
+			c.discover()
+		})
+	}
+
+	select {
+	case <-c.bound:
+	default:
+	}
+	c.bound <- *lease
+}
+
+// 从地址表和路由表中撤销租约的配置，调用时需持有锁
+func (c *DhcpClient) unbind() {
+	if c.lease == nil {
+		return
+	}
+	if c.lease.Gateway.IsValid() {
+		c.q.routes.Delete(netip.PrefixFrom(netip.IPv4Unspecified(), 0), c.lease.Gateway)
+	}
+	c.q.RemoveAddress(c.iface, c.lease.Addr.Addr())
+	c.prev = c.lease.Addr.Addr()
+	c.lease = nil
+}
+
+// 服务器标识选项，没有时使用siaddr
+func (c *DhcpClient) serverOf(msg *DhcpMessage) netip.Addr {
+	if ids := msg.addrs(DHCP_OPTION_SERVER_ID); len(ids) > 0 {
+		return ids[0]
+	}
+	return msg.Siaddr
+}
+
+func (c *DhcpClient) newMessage(typ uint8) *DhcpMessage {
+	hwAddr := c.iface.Link.HardwareAddr()
+	secs := time.Since(c.started) / time.Second
+	if secs > 0xffff {
+		secs = 0xffff
+	}
+	return &DhcpMessage{
+		Op:     DHCP_OP_REQUEST,
+		Xid:    c.xid,
+		Secs:   uint16(secs),
+		Flags:  DHCP_FLAG_BROADCAST,
+		Chaddr: hwAddr,
+		Options: map[uint8][]byte{
+			DHCP_OPTION_MESSAGE_TYPE: {typ},
+			DHCP_OPTION_CLIENT_ID:    append([]byte{DHCP_HTYPE_ETHERNET}, hwAddr[:]...),
+			DHCP_OPTION_PARAMETER_LIST: {
+				DHCP_OPTION_SUBNET_MASK, DHCP_OPTION_ROUTER, DHCP_OPTION_DNS,
+				DHCP_OPTION_LEASE_TIME, DHCP_OPTION_RENEWAL_TIME, DHCP_OPTION_REBINDING_TIME,
+			},
+		},
+	}
+}
+
+// 广播报文，源地址为已有的租约地址或0.0.0.0，直接从接口发出
+func (c *DhcpClient) sendBroadcast(msg *DhcpMessage) {
+	src := netip.IPv4Unspecified()
+	if msg.Ciaddr.IsValid() {
+		src = msg.Ciaddr
+	}
+	udp := marshalUdp(src, limitedBroadcastAddr, DHCP_CLIENT_PORT, DHCP_SERVER_PORT, msg.Marshal())
+	datagram := NewDatagram(src, limitedBroadcastAddr, UDP_PROTOCOL, TOS, udp)
+	if err := c.q.output(c.iface, limitedBroadcastAddr, network.Packet{Buf: datagram, N: uintptr(len(datagram))}); err != nil {
+		log.Printf("dhcp on %s: %s", c.iface.Name, err)
+	}
+}
+
+// 单播报文按路由表发往服务器
+func (c *DhcpClient) sendUnicast(msg *DhcpMessage, server netip.Addr) {
+	msg.Flags = 0
+	udp := marshalUdp(msg.Ciaddr, server, DHCP_CLIENT_PORT, DHCP_SERVER_PORT, msg.Marshal())
+	datagram := NewDatagram(msg.Ciaddr, server, UDP_PROTOCOL, TOS, udp)
+	if err := c.q.Write(network.Packet{Buf: datagram, N: uintptr(len(datagram))}); err != nil {
+		log.Printf("dhcp on %s: %s", c.iface.Name, err)
+	}
+}
+
+// 在delay后持有锁执行fn，客户端停止或协议栈关闭后不再执行
+func (c *DhcpClient) after(delay time.Duration, fn func()) *time.Timer {
+	gen := c.gen
+	return time.AfterFunc(delay, func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if gen != c.gen || c.state == DHCP_STATE_STOPPED || c.q.ctx.Err() != nil {
+			return
+		}
+		fn()
+	})
+}
+
+func (c *DhcpClient) stopTimer(timer **time.Timer) {
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+}
+
+func (c *DhcpClient) stopTimers() {
+	c.gen++
+	c.stopTimer(&c.timer)
+	c.stopTimer(&c.t1)
+	c.stopTimer(&c.t2)
+	c.stopTimer(&c.expire)
+}
+
+func addrBytes(addr netip.Addr) []byte {
+	ip := addr.As4()
+	return ip[:]
+}
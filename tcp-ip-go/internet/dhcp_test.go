@@ -0,0 +1,351 @@
+package internet
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"tcp/network"
+	"testing"
+	"time"
+)
+
+var (
+	testServerAddr   = netip.MustParseAddr("192.168.1.1")
+	testServerHwAddr = network.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	testClientHwAddr = network.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+	testOfferAddr    = netip.MustParseAddr("192.168.1.100")
+)
+
+// 测试用的以太网链路，协议栈写出的帧放入out，放入in的帧作为收到的帧
+type fakeEthernet struct {
+	in, out chan network.Packet
+	hwAddr  network.HardwareAddr
+}
+
+func newFakeEthernet(hwAddr network.HardwareAddr) *fakeEthernet {
+	return &fakeEthernet{
+		in:     make(chan network.Packet, QUEUE_SIZE),
+		out:    make(chan network.Packet, QUEUE_SIZE),
+		hwAddr: hwAddr,
+	}
+}
+
+func (l *fakeEthernet) Read() (network.Packet, error)      { return <-l.in, nil }
+func (l *fakeEthernet) Write(pkt network.Packet) error     { l.out <- pkt; return nil }
+func (l *fakeEthernet) Name() string                       { return "fake0" }
+func (l *fakeEthernet) MTU() int                           { return 1500 }
+func (l *fakeEthernet) Type() network.LinkType             { return network.LINK_TYPE_ETHERNET }
+func (l *fakeEthernet) HardwareAddr() network.HardwareAddr { return l.hwAddr }
+
+// 从服务器一侧注入一帧
+func (l *fakeEthernet) inject(dst network.HardwareAddr, etherType uint16, payload []byte) {
+	eth := &network.EthernetHeader{Dst: dst, Src: testServerHwAddr, Type: etherType}
+	frame := append(eth.Marshal(), payload...)
+	l.in <- network.Packet{Buf: frame, N: uintptr(len(frame))}
+}
+
+// 等待协议栈写出的下一帧指定类型的帧，跳过其他帧(如IPv6邻居发现)
+func (l *fakeEthernet) next(t *testing.T, etherType uint16) (*network.EthernetHeader, []byte) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case frame := <-l.out:
+			hdr, err := network.UnmarshalEthernet(frame.Buf[:frame.N])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Type == etherType {
+				return hdr, frame.Buf[network.ETHERNET_HEADER_LENGTH:frame.N]
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for ether type %#04x", etherType)
+		}
+	}
+}
+
+// 模拟的DHCP服务器，回应发往服务器地址的ARP请求，返回客户端发出的下一个DHCP报文和IP目的地址
+func (l *fakeEthernet) nextDhcp(t *testing.T) (*DhcpMessage, netip.Addr) {
+	t.Helper()
+	for {
+		_, payload := l.next(t, network.ETHER_TYPE_IPV4)
+		hdr, err := unmarshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Protocol != UDP_PROTOCOL {
+			continue
+		}
+		src, dst := addrFrom4(hdr.SrcIP), addrFrom4(hdr.DstIP)
+		udp, data, err := unmarshalUdp(src, dst, payload[hdr.IHL*4:hdr.TotalLength])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if udp.DstPort != DHCP_SERVER_PORT {
+			continue
+		}
+		msg, err := UnmarshalDhcp(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg, dst
+	}
+}
+
+// 回应发往服务器地址的ARP请求，续租的单播REQUEST需要先解析服务器的MAC地址
+func (l *fakeEthernet) answerArp(t *testing.T) {
+	t.Helper()
+	_, payload := l.next(t, network.ETHER_TYPE_ARP)
+	arp, err := unmarshalArp(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arp.Operation != ARP_OPERATION_REQUEST || addrFrom4(arp.TargetIP) != testServerAddr {
+		t.Fatalf("unexpected arp %+v", arp)
+	}
+	l.inject(arp.SenderHwAddr, network.ETHER_TYPE_ARP, (&ArpPacket{
+		HardwareType: ARP_HARDWARE_ETHERNET,
+		ProtocolType: network.ETHER_TYPE_IPV4,
+		Operation:    ARP_OPERATION_REPLY,
+		SenderHwAddr: testServerHwAddr,
+		SenderIP:     testServerAddr.As4(),
+		TargetHwAddr: arp.SenderHwAddr,
+		TargetIP:     arp.SenderIP,
+	}).Marshal())
+}
+
+// 以服务器身份广播回应
+func (l *fakeEthernet) reply(req *DhcpMessage, typ uint8, server, yiaddr netip.Addr) {
+	msg := &DhcpMessage{
+		Op:     DHCP_OP_REPLY,
+		Xid:    req.Xid,
+		Flags:  req.Flags,
+		Yiaddr: yiaddr,
+		Chaddr: req.Chaddr,
+		Options: map[uint8][]byte{
+			DHCP_OPTION_MESSAGE_TYPE: {typ},
+			DHCP_OPTION_SERVER_ID:    addrBytes(server),
+		},
+	}
+	if typ != DHCP_NAK {
+		msg.Options[DHCP_OPTION_SUBNET_MASK] = []byte{255, 255, 255, 0}
+		msg.Options[DHCP_OPTION_ROUTER] = addrBytes(testServerAddr)
+		msg.Options[DHCP_OPTION_LEASE_TIME] = binary.BigEndian.AppendUint32(nil, 3600)
+		msg.Options[DHCP_OPTION_RENEWAL_TIME] = binary.BigEndian.AppendUint32(nil, 2)
+	}
+	udp := marshalUdp(testServerAddr, limitedBroadcastAddr, DHCP_SERVER_PORT, DHCP_CLIENT_PORT, msg.Marshal())
+	l.inject(network.BroadcastHardwareAddr, network.ETHER_TYPE_IPV4, NewDatagram(testServerAddr, limitedBroadcastAddr, UDP_PROTOCOL, TOS, udp))
+}
+
+func startDhcpClient(t *testing.T) (*fakeEthernet, *IpPacketQueue, *DhcpClient) {
+	t.Helper()
+	link := newFakeEthernet(testClientHwAddr)
+	q := NewIpPacketQueue()
+	t.Cleanup(q.Close)
+	c, err := q.StartDhcp(q.AddInterface(link))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return link, q, c
+}
+
+// 等待DISCOVER并回应OFFER，返回客户端随后发出的REQUEST
+func offer(t *testing.T, link *fakeEthernet) *DhcpMessage {
+	t.Helper()
+	discover, _ := link.nextDhcp(t)
+	if discover.Type() != DHCP_DISCOVER {
+		t.Fatalf("got message type %d, want DISCOVER", discover.Type())
+	}
+	link.reply(discover, DHCP_OFFER, testServerAddr, testOfferAddr)
+
+	request, _ := link.nextDhcp(t)
+	if request.Type() != DHCP_REQUEST || request.Xid != discover.Xid {
+		t.Fatalf("got message type %d xid %#x, want REQUEST xid %#x", request.Type(), request.Xid, discover.Xid)
+	}
+	if got := request.addrs(DHCP_OPTION_REQUESTED_IP); len(got) != 1 || got[0] != testOfferAddr {
+		t.Fatalf("requested ip %v, want %s", got, testOfferAddr)
+	}
+	if got := request.addrs(DHCP_OPTION_SERVER_ID); len(got) != 1 || got[0] != testServerAddr {
+		t.Fatalf("server id %v, want %s", got, testServerAddr)
+	}
+	return request
+}
+
+func waitBound(t *testing.T, c *DhcpClient) DhcpLease {
+	t.Helper()
+	select {
+	case lease := <-c.Bound():
+		return lease
+	case <-time.After(5 * time.Second):
+		t.Fatalf("not bound, state %s", c.State())
+	}
+	return DhcpLease{}
+}
+
+func hasAddress(q *IpPacketQueue, addr netip.Addr) bool {
+	for _, iface := range q.Interfaces() {
+		if iface.hasAddress(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDhcpAcquireAndRenew(t *testing.T) {
+	link, q, c := startDhcpClient(t)
+
+	request := offer(t, link)
+	link.reply(request, DHCP_ACK, testServerAddr, testOfferAddr)
+
+	// 绑定前用ARP探测地址
+	_, payload := link.next(t, network.ETHER_TYPE_ARP)
+	probe, err := unmarshalArp(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrFrom4(probe.SenderIP) != netip.IPv4Unspecified() || addrFrom4(probe.TargetIP) != testOfferAddr {
+		t.Fatalf("bad arp probe %+v", probe)
+	}
+
+	lease := waitBound(t, c)
+	if want := netip.PrefixFrom(testOfferAddr, 24); lease.Addr != want {
+		t.Fatalf("lease address %s, want %s", lease.Addr, want)
+	}
+	if lease.Gateway != testServerAddr || lease.Server != testServerAddr {
+		t.Fatalf("lease gateway %s server %s, want %s", lease.Gateway, lease.Server, testServerAddr)
+	}
+	if !hasAddress(q, testOfferAddr) {
+		t.Fatalf("address %s not configured", testOfferAddr)
+	}
+	if route, ok := q.Routes().Lookup(netip.MustParseAddr("8.8.8.8")); !ok || route.Gateway != testServerAddr {
+		t.Fatalf("default route %+v, want gateway %s", route, testServerAddr)
+	}
+
+	// T1到期后向原服务器单播续租
+	link.answerArp(t)
+	renew, dst := link.nextDhcp(t)
+	if renew.Type() != DHCP_REQUEST || dst != testServerAddr || renew.Ciaddr != testOfferAddr {
+		t.Fatalf("got message type %d to %s ciaddr %s, want REQUEST to %s", renew.Type(), dst, renew.Ciaddr, testServerAddr)
+	}
+	if _, ok := renew.Options[DHCP_OPTION_SERVER_ID]; ok {
+		t.Fatal("renewing REQUEST must not carry a server id")
+	}
+	if c.State() != DHCP_STATE_RENEWING {
+		t.Fatalf("state %s, want RENEWING", c.State())
+	}
+	link.reply(renew, DHCP_ACK, testServerAddr, testOfferAddr)
+	waitBound(t, c)
+	if c.State() != DHCP_STATE_BOUND || !hasAddress(q, testOfferAddr) {
+		t.Fatalf("state %s after renew, want BOUND", c.State())
+	}
+}
+
+func TestDhcpNak(t *testing.T) {
+	link, _, c := startDhcpClient(t)
+
+	request := offer(t, link)
+	link.reply(request, DHCP_NAK, testServerAddr, netip.IPv4Unspecified())
+
+	// NAK后重新开始，使用新的事务ID
+	discover, _ := link.nextDhcp(t)
+	if discover.Type() != DHCP_DISCOVER || discover.Xid == request.Xid {
+		t.Fatalf("got message type %d xid %#x after nak, want DISCOVER with new xid", discover.Type(), discover.Xid)
+	}
+	if c.State() != DHCP_STATE_SELECTING {
+		t.Fatalf("state %s, want SELECTING", c.State())
+	}
+}
+
+func TestDhcpIgnoresInvalidAck(t *testing.T) {
+	link, q, c := startDhcpClient(t)
+	request := offer(t, link)
+
+	other := netip.MustParseAddr("192.168.1.2")
+	tests := []struct {
+		name   string
+		typ    uint8
+		server netip.Addr
+		yiaddr netip.Addr
+	}{
+		{"ack from other server", DHCP_ACK, other, testOfferAddr},
+		{"nak from other server", DHCP_NAK, other, netip.IPv4Unspecified()},
+		{"ack without address", DHCP_ACK, testServerAddr, netip.IPv4Unspecified()},
+	}
+	for _, tt := range tests {
+		link.reply(request, tt.typ, tt.server, tt.yiaddr)
+		time.Sleep(50 * time.Millisecond)
+		if c.State() != DHCP_STATE_REQUESTING {
+			t.Fatalf("%s: state %s, want REQUESTING", tt.name, c.State())
+		}
+	}
+
+	link.reply(request, DHCP_ACK, testServerAddr, testOfferAddr)
+	waitBound(t, c)
+	if !hasAddress(q, testOfferAddr) {
+		t.Fatalf("address %s not configured", testOfferAddr)
+	}
+}
+
+func TestDhcpDecline(t *testing.T) {
+	link, q, c := startDhcpClient(t)
+
+	request := offer(t, link)
+	link.reply(request, DHCP_ACK, testServerAddr, testOfferAddr)
+
+	// 其他主机回应探测，说明地址已被使用
+	_, payload := link.next(t, network.ETHER_TYPE_ARP)
+	probe, err := unmarshalArp(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link.inject(probe.SenderHwAddr, network.ETHER_TYPE_ARP, (&ArpPacket{
+		HardwareType: ARP_HARDWARE_ETHERNET,
+		ProtocolType: network.ETHER_TYPE_IPV4,
+		Operation:    ARP_OPERATION_REPLY,
+		SenderHwAddr: network.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x03},
+		SenderIP:     testOfferAddr.As4(),
+		TargetHwAddr: probe.SenderHwAddr,
+	}).Marshal())
+
+	decline, _ := link.nextDhcp(t)
+	if decline.Type() != DHCP_DECLINE {
+		t.Fatalf("got message type %d, want DECLINE", decline.Type())
+	}
+	if got := decline.addrs(DHCP_OPTION_REQUESTED_IP); len(got) != 1 || got[0] != testOfferAddr {
+		t.Fatalf("declined %v, want %s", got, testOfferAddr)
+	}
+	if got := decline.addrs(DHCP_OPTION_SERVER_ID); len(got) != 1 || got[0] != testServerAddr {
+		t.Fatalf("server id %v, want %s", got, testServerAddr)
+	}
+	if c.State() != DHCP_STATE_INIT || hasAddress(q, testOfferAddr) {
+		t.Fatalf("state %s after decline, want INIT without address", c.State())
+	}
+}
+
+func TestDhcpMessageRoundTrip(t *testing.T) {
+	msg := &DhcpMessage{
+		Op:     DHCP_OP_REQUEST,
+		Xid:    0x12345678,
+		Secs:   3,
+		Flags:  DHCP_FLAG_BROADCAST,
+		Ciaddr: netip.IPv4Unspecified(),
+		Yiaddr: testOfferAddr,
+		Siaddr: testServerAddr,
+		Giaddr: netip.IPv4Unspecified(),
+		Chaddr: testClientHwAddr,
+		Options: map[uint8][]byte{
+			DHCP_OPTION_MESSAGE_TYPE: {DHCP_REQUEST},
+			DHCP_OPTION_DNS:          make([]byte, 300), // 超过255字节的选项拆分后再拼接
+		},
+	}
+	got, err := UnmarshalDhcp(msg.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Op != msg.Op || got.Xid != msg.Xid || got.Secs != msg.Secs || got.Flags != msg.Flags ||
+		got.Yiaddr != msg.Yiaddr || got.Siaddr != msg.Siaddr || got.Chaddr != msg.Chaddr {
+		t.Fatalf("got %+v, want %+v", got, msg)
+	}
+	if got.Type() != DHCP_REQUEST || len(got.Options[DHCP_OPTION_DNS]) != 300 {
+		t.Fatalf("options %v", got.Options)
+	}
+}
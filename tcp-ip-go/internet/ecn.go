@@ -0,0 +1,81 @@
+package internet
+
+import (
+	"encoding/binary"
+)
+
+// 区分服务代码点，占TOS或Traffic Class的高6位 (RFC 2474, RFC 4594)
+const (
+	DSCP_CS0  = 0  // 默认转发
+	DSCP_CS1  = 8  // 低优先级数据
+	DSCP_AF11 = 10 // 高吞吐量数据
+	DSCP_AF21 = 18 // 低时延数据
+	DSCP_AF31 = 26 // 多媒体流
+	DSCP_AF41 = 34 // 交互式多媒体
+	DSCP_CS5  = 40 // 信令
+	DSCP_EF   = 46 // 加速转发，用于语音
+	DSCP_CS6  = 48 // 网络控制
+	DSCP_CS7  = 56
+	DSCP_MAX  = 63
+)
+
+// 显式拥塞通知代码点，占TOS或Traffic Class的低2位 (RFC 3168 5)
+const (
+	ECN_NOT_ECT = 0x0 // 不支持ECN
+	ECN_ECT1    = 0x1
+	ECN_ECT0    = 0x2
+	ECN_CE      = 0x3 // 经历了拥塞
+	ECN_MASK    = 0x3
+)
+
+// 出接口发送队列达到该长度时视为拥塞，对支持ECN的数据报标记CE
+const ECN_MARK_THRESHOLD = QUEUE_SIZE / 2
+
+// Tos 由DSCP和ECN代码点组成TOS字段或IPv6的Traffic Class
+func Tos(dscp, ecn uint8) uint8 {
+	return dscp<<2 | ecn&ECN_MASK
+}
+
+// Dscp 返回数据报的区分服务代码点
+func (pkt IpPacket) Dscp() uint8 {
+	return pkt.Tos >> 2
+}
+
+// Ecn 返回数据报的ECN代码点
+func (pkt IpPacket) Ecn() uint8 {
+	return pkt.Tos & ECN_MASK
+}
+
+// 读取数据报的ECN代码点
+func datagramEcn(datagram []byte) uint8 {
+	if datagram[0]>>4 == IP_VERSION_4 {
+		return datagram[1] & ECN_MASK
+	}
+	// IPv6的Traffic Class跨第一、二字节，ECN位于第二字节的高4位中的低2位
+	return datagram[1] >> 4 & ECN_MASK
+}
+
+// 原地修改数据报的ECN代码点，IPv4需要增量更新头部校验和
+func setDatagramEcn(datagram []byte, ecn uint8) {
+	if datagram[0]>>4 == IP_VERSION_4 {
+		oldWord := binary.BigEndian.Uint16(datagram[0:2])
+		datagram[1] = datagram[1]&^ECN_MASK | ecn
+		newWord := binary.BigEndian.Uint16(datagram[0:2])
+		sum := updateChecksum(binary.BigEndian.Uint16(datagram[10:12]), oldWord, newWord)
+		binary.BigEndian.PutUint16(datagram[10:12], sum)
+		return
+	}
+	datagram[1] = datagram[1]&^(ECN_MASK<<4) | ecn<<4
+}
+
+// 出接口拥塞时对支持ECN的数据报标记CE代替丢弃 (RFC 3168 5)，
+// 不支持ECN的数据报照常排队
+func markCongestion(iface *Interface, datagram []byte) {
+	if len(iface.outgoingQueue) < ECN_MARK_THRESHOLD {
+		return
+	}
+	switch datagramEcn(datagram) {
+	case ECN_ECT0, ECN_ECT1:
+		setDatagramEcn(datagram, ECN_CE)
+	}
+}
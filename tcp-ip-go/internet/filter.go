@@ -0,0 +1,458 @@
+package internet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"tcp/network"
+)
+
+// 数据报经过的挂载点，与netfilter的五个hook对应
+type Hook int
+
+const (
+	HOOK_PREROUTING  Hook = iota // 收到数据报后、路由判断前
+	HOOK_INPUT                   // 发往本机的数据报
+	HOOK_FORWARD                 // 需要转发的数据报
+	HOOK_OUTPUT                  // 本机发出的数据报
+	HOOK_POSTROUTING             // 所有从接口发出的数据报
+	hookCount
+)
+
+func (h Hook) String() string {
+	switch h {
+	case HOOK_PREROUTING:
+		return "PREROUTING"
+	case HOOK_INPUT:
+		return "INPUT"
+	case HOOK_FORWARD:
+		return "FORWARD"
+	case HOOK_OUTPUT:
+		return "OUTPUT"
+	case HOOK_POSTROUTING:
+		return "POSTROUTING"
+	}
+	return fmt.Sprintf("HOOK(%d)", int(h))
+}
+
+// 规则命中后的动作
+type Action int
+
+const (
+	ACTION_ACCEPT       Action = iota // 接受数据报，不再匹配后续规则
+	ACTION_DROP                       // 静默丢弃
+	ACTION_REJECT                     // 丢弃并回送ICMP端口不可达
+	ACTION_REJECT_RESET               // 丢弃并回送TCP RST，非TCP数据报同ACTION_REJECT
+	ACTION_LOG                        // 记录日志后继续匹配下一条规则
+)
+
+func (a Action) String() string {
+	switch a {
+	case ACTION_ACCEPT:
+		return "ACCEPT"
+	case ACTION_DROP:
+		return "DROP"
+	case ACTION_REJECT:
+		return "REJECT"
+	case ACTION_REJECT_RESET:
+		return "REJECT-RESET"
+	case ACTION_LOG:
+		return "LOG"
+	}
+	return fmt.Sprintf("ACTION(%d)", int(a))
+}
+
+const (
+	// TCP头部的标志位，用于按标志匹配
+	TCP_FLAG_FIN = 0x01
+	TCP_FLAG_SYN = 0x02
+	TCP_FLAG_RST = 0x04
+	TCP_FLAG_PSH = 0x08
+	TCP_FLAG_ACK = 0x10
+	TCP_FLAG_URG = 0x20
+)
+
+// 端口范围，零值匹配任意端口
+type PortRange struct {
+	Min uint16
+	Max uint16
+}
+
+func (r PortRange) any() bool {
+	return r.Min == 0 && r.Max == 0
+}
+
+func (r PortRange) contains(port uint16) bool {
+	return r.any() || (port >= r.Min && port <= r.Max)
+}
+
+// Rule 过滤规则，零值字段匹配任意数据报
+type Rule struct {
+	Src          netip.Prefix
+	Dst          netip.Prefix
+	Protocol     uint8 // 上层协议，0匹配任意协议
+	SrcPort      PortRange
+	DstPort      PortRange
+	TcpFlags     uint8 // 标志位与TcpFlagsMask按位与后等于TcpFlags时匹配
+	TcpFlagsMask uint8
+	InInterface  string  // 接收接口的名称，OUTPUT中不可用
+	OutInterface string  // 发送接口的名称，PREROUTING和INPUT中不可用
+	States       CtState // 连接跟踪状态的组合，数据报处于其中任一状态时匹配
+	Action       Action
+
+	// 命中的数据报数和字节数，仅由Rules返回
+	Packets uint64
+	Bytes   uint64
+}
+
+func (r *Rule) validate(hook Hook) error {
+	if !r.SrcPort.any() || !r.DstPort.any() {
+		if r.Protocol != TCP_PROTOCOL && r.Protocol != UDP_PROTOCOL {
+			return fmt.Errorf("port match requires tcp or udp protocol")
+		}
+	}
+	if r.TcpFlagsMask != 0 && r.Protocol != TCP_PROTOCOL {
+		return fmt.Errorf("tcp flags match requires tcp protocol")
+	}
+	if r.TcpFlags&^r.TcpFlagsMask != 0 {
+		return fmt.Errorf("tcp flags %#x not covered by mask %#x", r.TcpFlags, r.TcpFlagsMask)
+	}
+	if r.InInterface != "" && hook == HOOK_OUTPUT {
+		return fmt.Errorf("input interface match is not available in %s", hook)
+	}
+	if r.OutInterface != "" && (hook == HOOK_PREROUTING || hook == HOOK_INPUT) {
+		return fmt.Errorf("output interface match is not available in %s", hook)
+	}
+	if r.Action < ACTION_ACCEPT || r.Action > ACTION_LOG {
+		return fmt.Errorf("invalid action: %d", r.Action)
+	}
+	return nil
+}
+
+// 判断数据报是否匹配规则，in和out分别为接收和发送接口，未知时为nil
+func (r *Rule) matches(pkt IpPacket, in, out *Interface) bool {
+	if r.Src.IsValid() && !r.Src.Contains(pkt.SrcAddr) {
+		return false
+	}
+	if r.Dst.IsValid() && !r.Dst.Contains(pkt.DstAddr) {
+		return false
+	}
+	if r.Protocol != 0 && r.Protocol != pkt.Protocol {
+		return false
+	}
+	if r.InInterface != "" && (in == nil || in.Name != r.InInterface) {
+		return false
+	}
+	if r.OutInterface != "" && (out == nil || out.Name != r.OutInterface) {
+		return false
+	}
+	if r.States != 0 && pkt.CtState&r.States == 0 {
+		return false
+	}
+
+	if !r.SrcPort.any() || !r.DstPort.any() || r.TcpFlagsMask != 0 {
+		// 非首个分片不含上层协议头部，不能匹配端口和标志位
+		if pkt.IpHeader != nil && pkt.IpHeader.FragmentOffset != 0 {
+			return false
+		}
+		if len(pkt.Payload) < 4 {
+			return false
+		}
+		if !r.SrcPort.contains(binary.BigEndian.Uint16(pkt.Payload[0:2])) ||
+			!r.DstPort.contains(binary.BigEndian.Uint16(pkt.Payload[2:4])) {
+			return false
+		}
+	}
+	if r.TcpFlagsMask != 0 {
+		if len(pkt.Payload) < 14 || pkt.Payload[13]&r.TcpFlagsMask != r.TcpFlags {
+			return false
+		}
+	}
+	return true
+}
+
+// 规则及其计数器
+type filterRule struct {
+	Rule
+	packets atomic.Uint64
+	bytes   atomic.Uint64
+}
+
+// 一个hook上按顺序匹配的规则链，没有规则命中时执行默认策略
+type filterChain struct {
+	rules  []*filterRule
+	policy Action
+}
+
+// Filter 数据报过滤表，每个hook对应一条规则链
+type Filter struct {
+	chains [hookCount]filterChain
+	lock   sync.RWMutex
+}
+
+func NewFilter() *Filter {
+	return &Filter{}
+}
+
+func (f *Filter) chain(hook Hook) (*filterChain, error) {
+	if hook < 0 || hook >= hookCount {
+		return nil, fmt.Errorf("invalid hook: %d", hook)
+	}
+	return &f.chains[hook], nil
+}
+
+// Append 在规则链末尾添加规则
+func (f *Filter) Append(hook Hook, rule Rule) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	chain, err := f.chain(hook)
+	if err != nil {
+		return err
+	}
+	return f.insert(chain, hook, len(chain.rules), rule)
+}
+
+// Insert 在规则链的index处插入规则，0为链首
+func (f *Filter) Insert(hook Hook, index int, rule Rule) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	chain, err := f.chain(hook)
+	if err != nil {
+		return err
+	}
+	return f.insert(chain, hook, index, rule)
+}
+
+func (f *Filter) insert(chain *filterChain, hook Hook, index int, rule Rule) error {
+	if index < 0 || index > len(chain.rules) {
+		return fmt.Errorf("rule index out of range: %d", index)
+	}
+	if err := rule.validate(hook); err != nil {
+		return err
+	}
+	rule.Packets, rule.Bytes = 0, 0
+
+	rules := make([]*filterRule, 0, len(chain.rules)+1)
+	rules = append(rules, chain.rules[:index]...)
+	rules = append(rules, &filterRule{Rule: rule})
+	chain.rules = append(rules, chain.rules[index:]...)
+	return nil
+}
+
+// Delete 删除规则链中index处的规则
+func (f *Filter) Delete(hook Hook, index int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	chain, err := f.chain(hook)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= len(chain.rules) {
+		return fmt.Errorf("rule index out of range: %d", index)
+	}
+	rules := make([]*filterRule, 0, len(chain.rules)-1)
+	rules = append(rules, chain.rules[:index]...)
+	chain.rules = append(rules, chain.rules[index+1:]...)
+	return nil
+}
+
+// Flush 清空规则链，默认策略不变
+func (f *Filter) Flush(hook Hook) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	chain, err := f.chain(hook)
+	if err != nil {
+		return err
+	}
+	chain.rules = nil
+	return nil
+}
+
+// SetPolicy 设置没有规则命中时的默认策略，只能是ACCEPT或DROP
+func (f *Filter) SetPolicy(hook Hook, action Action) error {
+	if action != ACTION_ACCEPT && action != ACTION_DROP {
+		return fmt.Errorf("invalid policy: %s", action)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	chain, err := f.chain(hook)
+	if err != nil {
+		return err
+	}
+	chain.policy = action
+	return nil
+}
+
+// Rules 返回规则链中规则及其计数器的快照
+func (f *Filter) Rules(hook Hook) []Rule {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	chain, err := f.chain(hook)
+	if err != nil {
+		return nil
+	}
+	rules := make([]Rule, len(chain.rules))
+	for i, r := range chain.rules {
+		rules[i] = r.Rule
+		rules[i].Packets = r.packets.Load()
+		rules[i].Bytes = r.bytes.Load()
+	}
+	return rules
+}
+
+// 按顺序匹配规则链，返回最终动作(ACCEPT、DROP、REJECT或REJECT_RESET)
+func (f *Filter) evaluate(hook Hook, pkt IpPacket, in, out *Interface) Action {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	chain := &f.chains[hook]
+	for _, r := range chain.rules {
+		if !r.matches(pkt, in, out) {
+			continue
+		}
+		r.packets.Add(1)
+		r.bytes.Add(uint64(pkt.Packet.N))
+
+		if r.Action == ACTION_LOG {
+			log.Printf("filter %s: %s", hook, describePacket(pkt, in, out))
+			continue
+		}
+		return r.Action
+	}
+	return chain.policy
+}
+
+func describePacket(pkt IpPacket, in, out *Interface) string {
+	inName, outName := "", ""
+	if in != nil {
+		inName = in.Name
+	}
+	if out != nil {
+		outName = out.Name
+	}
+	desc := fmt.Sprintf("in=%s out=%s src=%s dst=%s len=%d proto=%d state=%s", inName, outName, pkt.SrcAddr, pkt.DstAddr, pkt.Packet.N, pkt.Protocol, pkt.CtState)
+	if (pkt.Protocol == TCP_PROTOCOL || pkt.Protocol == UDP_PROTOCOL) && len(pkt.Payload) >= 4 {
+		desc += fmt.Sprintf(" spt=%d dpt=%d", binary.BigEndian.Uint16(pkt.Payload[0:2]), binary.BigEndian.Uint16(pkt.Payload[2:4]))
+	}
+	return desc
+}
+
+// Filter 返回协议栈的过滤表
+func (q *IpPacketQueue) Filter() *Filter {
+	return q.filter
+}
+
+// 在hook处过滤数据报，返回是否继续处理。in为nil说明是本机发出的数据报，被拒绝时不回送报文
+func (q *IpPacketQueue) filterHook(hook Hook, pkt IpPacket, in, out *Interface) bool {
+	action := q.filter.evaluate(hook, pkt, in, out)
+	if action == ACTION_ACCEPT {
+		return true
+	}
+	if in != nil && (action == ACTION_REJECT || action == ACTION_REJECT_RESET) {
+		q.reject(pkt, action == ACTION_REJECT_RESET)
+	}
+	return false
+}
+
+// 收到的数据报在路由判断前经过连接跟踪、过滤和目的地址转换
+func (q *IpPacketQueue) prerouting(pkt *IpPacket) bool {
+	q.conntrack.track(pkt)
+	if !q.filterHook(HOOK_PREROUTING, *pkt, pkt.Interface, nil) {
+		return false
+	}
+	q.translate(HOOK_PREROUTING, pkt, pkt.Interface, nil)
+	return true
+}
+
+// 发往本机的数据报经过过滤，通过后确认新连接
+func (q *IpPacketQueue) localInput(pkt IpPacket) bool {
+	if !q.filterHook(HOOK_INPUT, pkt, pkt.Interface, nil) {
+		return false
+	}
+	q.conntrack.confirm(pkt)
+	return true
+}
+
+// 发出的数据报经过过滤和源地址转换，通过后确认新连接
+func (q *IpPacketQueue) postrouting(pkt *IpPacket, in, out *Interface) bool {
+	if !q.filterHook(HOOK_POSTROUTING, *pkt, in, out) {
+		return false
+	}
+	q.translate(HOOK_POSTROUTING, pkt, in, out)
+	q.conntrack.confirm(*pkt)
+	return true
+}
+
+// 回送TCP RST或ICMP端口不可达，拒绝数据报
+func (q *IpPacketQueue) reject(pkt IpPacket, reset bool) {
+	if reset && pkt.Protocol == TCP_PROTOCOL {
+		if err := q.sendTcpReset(pkt); err != nil {
+			log.Printf("send tcp reset error: %s", err)
+		}
+		return
+	}
+	if pkt.IpHeader != nil {
+		q.SendIcmpError(pkt, ICMP_TYPE_DESTINATION_UNREACHABLE, ICMP_CODE_PORT_UNREACHABLE, 0)
+	} else {
+		q.SendIcmpv6Error(pkt, ICMPV6_TYPE_DESTINATION_UNREACHABLE, ICMPV6_CODE_PORT_UNREACHABLE, 0)
+	}
+}
+
+// 针对TCP报文段回送RST (RFC 793 3.4)
+func (q *IpPacketQueue) sendTcpReset(pkt IpPacket) error {
+	seg := pkt.Payload
+	if len(seg) < 20 {
+		return fmt.Errorf("truncated tcp segment")
+	}
+	dataOffs := int(seg[12]>>4) * 4
+	if dataOffs < 20 || dataOffs > len(seg) {
+		return fmt.Errorf("invalid tcp data offset: %d", seg[12]>>4)
+	}
+	flags := seg[13]
+	// 不回应RST，也不回应发往广播或组播地址的报文段
+	if flags&TCP_FLAG_RST != 0 || pkt.DstAddr.IsMulticast() || !pkt.DstAddr.IsValid() {
+		return nil
+	}
+	if pkt.IpHeader != nil && isBroadcastOrMulticast(pkt.IpHeader.DstIP) {
+		return nil
+	}
+
+	rst := make([]byte, 20)
+	copy(rst[0:2], seg[2:4])
+	copy(rst[2:4], seg[0:2])
+	rst[12] = 5 << 4
+	if flags&TCP_FLAG_ACK != 0 {
+		// <SEQ=SEG.ACK><CTL=RST>
+		copy(rst[4:8], seg[8:12])
+		rst[13] = TCP_FLAG_RST
+	} else {
+		// <SEQ=0><ACK=SEG.SEQ+SEG.LEN><CTL=RST,ACK>
+		length := uint32(len(seg) - dataOffs)
+		if flags&TCP_FLAG_SYN != 0 {
+			length++
+		}
+		if flags&TCP_FLAG_FIN != 0 {
+			length++
+		}
+		binary.BigEndian.PutUint32(rst[8:12], binary.BigEndian.Uint32(seg[4:8])+length)
+		rst[13] = TCP_FLAG_RST | TCP_FLAG_ACK
+	}
+	sum := checksum(append(pseudoHeader(pkt.DstAddr, pkt.SrcAddr, len(rst), TCP_PROTOCOL), rst...))
+	binary.BigEndian.PutUint16(rst[16:18], sum)
+
+	datagram := NewDatagram(pkt.DstAddr, pkt.SrcAddr, TCP_PROTOCOL, TOS, rst)
+	return q.Write(network.Packet{
+		Buf: datagram,
+		N:   uintptr(len(datagram)),
+	})
+}
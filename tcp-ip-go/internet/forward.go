@@ -0,0 +1,171 @@
+package internet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/netip"
+	"tcp/network"
+)
+
+// SetForwarding 开启或关闭路由转发，开启后不是发往本机的数据报会按路由表转发
+func (q *IpPacketQueue) SetForwarding(enabled bool) {
+	q.forwarding.Store(enabled)
+}
+
+func (q *IpPacketQueue) Forwarding() bool {
+	return q.forwarding.Load()
+}
+
+// 转发不是发往本机的数据报 (RFC 1812 5.2)
+func (q *IpPacketQueue) forward(pkt IpPacket) {
+	hdr := pkt.IpHeader
+	// 不转发广播、组播、环回和未指定源地址的数据报
+	if isBroadcastOrMulticast(hdr.DstIP) || hdr.DstIP[0] == 127 || hdr.SrcIP[0] == 127 || hdr.SrcIP == [4]byte{} {
+		return
+	}
+
+	// TTL耗尽时丢弃数据报并通知源主机
+	if hdr.TTL <= 1 {
+		q.SendIcmpError(pkt, ICMP_TYPE_TIME_EXCEEDED, ICMP_CODE_TTL_EXCEEDED, 0)
+		return
+	}
+
+	route, ok := q.routes.Lookup(pkt.DstAddr)
+	if !ok {
+		q.SendIcmpError(pkt, ICMP_TYPE_DESTINATION_UNREACHABLE, ICMP_CODE_NET_UNREACHABLE, 0)
+		return
+	}
+	nextHop := route.NextHop(pkt.DstAddr)
+	if !q.filterHook(HOOK_FORWARD, pkt, pkt.Interface, route.Interface) ||
+		!q.postrouting(&pkt, pkt.Interface, route.Interface) {
+		return
+	}
+
+	// 复制一份再修改，TTL减一并增量更新校验和
+	buf := make([]byte, hdr.TotalLength)
+	copy(buf, pkt.Packet.Buf[:hdr.TotalLength])
+	oldWord := binary.BigEndian.Uint16(buf[8:10])
+	buf[8]--
+	newWord := binary.BigEndian.Uint16(buf[8:10])
+	sum := updateChecksum(binary.BigEndian.Uint16(buf[10:12]), oldWord, newWord)
+	binary.BigEndian.PutUint16(buf[10:12], sum)
+
+	mtu := route.Interface.MTU
+	if len(buf) <= mtu {
+		q.output(route.Interface, nextHop, network.Packet{Buf: buf, N: uintptr(len(buf))})
+		return
+	}
+
+	// 超过出接口MTU时，设置了DF则回送Fragmentation Needed，否则分片发送
+	if hdr.Flags&FLAG_DONT_FRAGMENT != 0 {
+		q.SendIcmpError(pkt, ICMP_TYPE_DESTINATION_UNREACHABLE, ICMP_CODE_FRAGMENTATION_NEEDED, uint32(mtu))
+		return
+	}
+	fragments, err := fragment(buf, mtu)
+	if err != nil {
+		log.Printf("fragment error: %s", err)
+		return
+	}
+	for _, frag := range fragments {
+		q.output(route.Interface, nextHop, network.Packet{Buf: frag, N: uintptr(len(frag))})
+	}
+}
+
+// 将数据报发往下一跳，以太网链路需要先解析下一跳的MAC地址
+func (q *IpPacketQueue) output(iface *Interface, nextHop netip.Addr, pkt network.Packet) error {
+	markCongestion(iface, pkt.Buf[:pkt.N])
+	if iface.isEthernet() {
+		return q.outputEthernet(iface, nextHop, pkt.Buf[:pkt.N])
+	}
+	return q.enqueue(iface, pkt)
+}
+
+// 将数据包放入出接口的发送队列
+func (q *IpPacketQueue) enqueue(iface *Interface, pkt network.Packet) error {
+	select {
+	case iface.outgoingQueue <- pkt:
+		return nil
+	case <-q.ctx.Done():
+		return fmt.Errorf("network closed")
+	}
+}
+
+// 按MTU将数据报分片 (RFC 791)，每个分片的数据长度都是8字节的整数倍(最后一片除外)。
+// 第一片保留全部选项，之后的分片只保留设置了复制标志的选项
+func fragment(datagram []byte, mtu int) ([][]byte, error) {
+	hdrLen := int(datagram[0]&0x0f) * 4
+	payload := datagram[hdrLen:]
+	flagsAndOffset := binary.BigEndian.Uint16(datagram[6:8])
+	baseOffset := int(flagsAndOffset & 0x1fff)
+	moreFragments := flagsAndOffset&(FLAG_MORE_FRAGMENTS<<13) != 0
+
+	header := datagram[:hdrLen]
+	fragments := make([][]byte, 0)
+	for offset := 0; offset < len(payload); {
+		if offset > 0 {
+			header = copiedHeader(datagram[:hdrLen])
+		}
+		maxData := (mtu - len(header)) &^ 7
+		if maxData <= 0 {
+			return nil, fmt.Errorf("mtu %d too small for header length %d", mtu, len(header))
+		}
+		end := min(offset+maxData, len(payload))
+
+		frag := make([]byte, len(header)+end-offset)
+		copy(frag, header)
+		copy(frag[len(header):], payload[offset:end])
+
+		fragOffset := uint16(baseOffset + offset/8)
+		// 原数据报本身是分片时，最后一片保留原来的MF标志
+		if end < len(payload) || moreFragments {
+			fragOffset |= FLAG_MORE_FRAGMENTS << 13
+		}
+		frag[0] = frag[0]&0xf0 | byte(len(header)/4)
+		binary.BigEndian.PutUint16(frag[2:4], uint16(len(frag)))
+		binary.BigEndian.PutUint16(frag[6:8], fragOffset)
+		binary.BigEndian.PutUint16(frag[10:12], 0)
+		binary.BigEndian.PutUint16(frag[10:12], checksum(frag[:len(header)]))
+
+		fragments = append(fragments, frag)
+		offset = end
+	}
+	return fragments, nil
+}
+
+// 非第一片的头部：只保留复制标志为1的选项，用EOL填充到4字节对齐 (RFC 791 3.1)
+func copiedHeader(header []byte) []byte {
+	copied := append([]byte(nil), header[:IP_HEADER_MIN_LENGTH]...)
+	options := header[IP_HEADER_MIN_LENGTH:]
+	for i := 0; i < len(options); {
+		optType := options[i]
+		if optType == IP_OPTION_EOL {
+			break
+		}
+		if optType == IP_OPTION_NOP {
+			i++
+			continue
+		}
+		if i+1 >= len(options) || options[i+1] < 2 || i+int(options[i+1]) > len(options) {
+			break
+		}
+		optLen := int(options[i+1])
+		if optType&IP_OPTION_COPIED != 0 {
+			copied = append(copied, options[i:i+optLen]...)
+		}
+		i += optLen
+	}
+	for len(copied)%4 != 0 {
+		copied = append(copied, IP_OPTION_EOL)
+	}
+	return copied
+}
+
+// 修改一个16位字后增量更新校验和 (RFC 1624)
+func updateChecksum(sum, oldWord, newWord uint16) uint16 {
+	s := uint32(^sum) + uint32(^oldWord) + uint32(newWord)
+	for s > 0xffff {
+		s = (s & 0xffff) + (s >> 16)
+	}
+	return ^uint16(s)
+}
@@ -0,0 +1,341 @@
+package internet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/netip"
+	"sync"
+	"tcp/network"
+	"time"
+)
+
+const (
+	ICMP_PROTOCOL      = 1 // ICMP协议
+	ICMP_HEADER_LENGTH = 8 // ICMP头部长度
+
+	ICMP_TYPE_ECHO_REPLY              = 0
+	ICMP_TYPE_DESTINATION_UNREACHABLE = 3
+	ICMP_TYPE_SOURCE_QUENCH           = 4
+	ICMP_TYPE_ECHO_REQUEST            = 8
+	ICMP_TYPE_TIME_EXCEEDED           = 11
+	ICMP_TYPE_PARAMETER_PROBLEM       = 12
+
+	// Destination Unreachable 的代码
+	ICMP_CODE_NET_UNREACHABLE       = 0
+	ICMP_CODE_HOST_UNREACHABLE      = 1
+	ICMP_CODE_PROTOCOL_UNREACHABLE  = 2
+	ICMP_CODE_PORT_UNREACHABLE      = 3
+	ICMP_CODE_FRAGMENTATION_NEEDED  = 4 // 需要分片但设置了DF
+	ICMP_CODE_SOURCE_ROUTE_FAILED   = 5
+	ICMP_CODE_ADMIN_PROHIBITED      = 13 // 被管理策略禁止 (RFC 1812)
+	ICMP_CODE_TTL_EXCEEDED          = 0  // Time Exceeded: 传输中TTL耗尽
+	ICMP_CODE_REASSEMBLY_EXCEEDED   = 1  // Time Exceeded: 分片重组超时
+	ICMP_CODE_POINTER_INDICATES     = 0  // Parameter Problem: 指针指向出错字节
+	ICMP_CODE_MISSING_REQUIRED_OPTS = 1  // Parameter Problem: 缺少必需的选项
+
+	ICMP_ERROR_MAX_LENGTH = 576 // 差错报文(含IP头部)的最大长度 (RFC 1812 4.3.2.3)
+	ICMP_RATE_LIMIT       = 100 // 每秒最多发送的差错报文数
+	ICMP_RATE_BURST       = 50  // 令牌桶容量
+)
+
+// 0                   1                   2                   3
+// 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |     Type      |     Code      |          Checksum             |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                 Rest of Header (依类型而定)                    |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |      Internet Header + 原始数据报的前若干字节 (差错报文)       |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+type IcmpMessage struct {
+	Type     uint8
+	Code     uint8
+	Checksum uint16
+	Rest     uint32 // Echo: 标识符+序号, Fragmentation Needed: 下一跳MTU, Parameter Problem: 指针
+	Data     []byte
+}
+
+// 上层协议收到的ICMP差错，描述了出错的原始数据报
+type IcmpError struct {
+	Type       uint8
+	Code       uint8
+	NextHopMTU uint16 // 仅在 Fragmentation Needed 时有效
+	Pointer    uint32 // 仅在 Parameter Problem 时有效
+	Protocol   uint8  // 原始数据报的上层协议
+	SrcIP      netip.Addr
+	DstIP      netip.Addr
+	Data       []byte // 原始数据报的上层头部(至少8字节)
+}
+
+func (e IcmpError) Error() string {
+	return fmt.Sprintf("icmp error type %d code %d from %v to %v", e.Type, e.Code, e.SrcIP, e.DstIP)
+}
+
+// 硬错误需要中止连接 (RFC 1122 4.2.3.9)，Fragmentation Needed 交给路径MTU发现处理
+func (e IcmpError) IsHard() bool {
+	if e.DstIP.Is6() {
+		// 端口不可达和无法识别的下一个头部(相当于协议不可达)
+		return (e.Type == ICMPV6_TYPE_DESTINATION_UNREACHABLE && e.Code == ICMPV6_CODE_PORT_UNREACHABLE) ||
+			(e.Type == ICMPV6_TYPE_PARAMETER_PROBLEM && e.Code == ICMPV6_CODE_UNRECOGNIZED_NEXT_HEADER)
+	}
+	return e.Type == ICMP_TYPE_DESTINATION_UNREACHABLE &&
+		(e.Code == ICMP_CODE_PROTOCOL_UNREACHABLE || e.Code == ICMP_CODE_PORT_UNREACHABLE)
+}
+
+// IPv4的 Fragmentation Needed 或 IPv6的 Packet Too Big
+func (e IcmpError) IsFragmentationNeeded() bool {
+	if e.DstIP.Is6() {
+		return e.Type == ICMPV6_TYPE_PACKET_TOO_BIG
+	}
+	return e.Type == ICMP_TYPE_DESTINATION_UNREACHABLE && e.Code == ICMP_CODE_FRAGMENTATION_NEEDED
+}
+
+func unmarshalIcmp(pkt []byte) (*IcmpMessage, error) {
+	if len(pkt) < ICMP_HEADER_LENGTH {
+		return nil, fmt.Errorf("invalid icmp length: %d", len(pkt))
+	}
+	if checksum(pkt) != 0 {
+		return nil, fmt.Errorf("invalid icmp checksum")
+	}
+
+	return &IcmpMessage{
+		Type:     pkt[0],
+		Code:     pkt[1],
+		Checksum: binary.BigEndian.Uint16(pkt[2:4]),
+		Rest:     binary.BigEndian.Uint32(pkt[4:8]),
+		Data:     pkt[ICMP_HEADER_LENGTH:],
+	}, nil
+}
+
+func (m *IcmpMessage) Marshal() []byte {
+	pkt := make([]byte, ICMP_HEADER_LENGTH+len(m.Data))
+	pkt[0] = m.Type
+	pkt[1] = m.Code
+	binary.BigEndian.PutUint32(pkt[4:8], m.Rest)
+	copy(pkt[ICMP_HEADER_LENGTH:], m.Data)
+
+	m.Checksum = checksum(pkt)
+	binary.BigEndian.PutUint16(pkt[2:4], m.Checksum)
+
+	return pkt
+}
+
+func isIcmpError(typ uint8) bool {
+	switch typ {
+	case ICMP_TYPE_DESTINATION_UNREACHABLE, ICMP_TYPE_SOURCE_QUENCH,
+		ICMP_TYPE_TIME_EXCEEDED, ICMP_TYPE_PARAMETER_PROBLEM:
+		return true
+	}
+	return false
+}
+
+// 判断是否允许为该数据报生成差错报文 (RFC 1122 3.2.2)
+func shouldSendIcmpError(pkt IpPacket) bool {
+	hdr := pkt.IpHeader
+	// 不为非首个分片生成差错
+	if hdr.FragmentOffset != 0 {
+		return false
+	}
+	// 不为广播、组播或无效源地址生成差错
+	if isBroadcastOrMulticast(hdr.DstIP) || isBroadcastOrMulticast(hdr.SrcIP) ||
+		hdr.SrcIP == [4]byte{} || hdr.SrcIP[0] == 127 {
+		return false
+	}
+	// 不为ICMP差错报文生成差错，避免差错风暴
+	if hdr.Protocol == ICMP_PROTOCOL {
+		offset := int(hdr.IHL) * 4
+		if int(pkt.Packet.N) <= offset || isIcmpError(pkt.Packet.Buf[offset]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isBroadcastOrMulticast(ip [4]byte) bool {
+	return ip == [4]byte{255, 255, 255, 255} || ip[0] >= 224
+}
+
+// 令牌桶限速，避免差错报文淹没网络 (RFC 1812 4.3.2.8)
+type rateLimiter struct {
+	lock   sync.Mutex
+	tokens float64
+	rate   float64 // 每秒补充的令牌数
+	burst  float64
+	last   time.Time
+}
+
+func newRateLimiter(rate, burst int) *rateLimiter {
+	return &rateLimiter{
+		tokens: float64(burst),
+		rate:   float64(rate),
+		burst:  float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (r *rateLimiter) allow() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+// SendIcmpError 针对收到的数据报pkt回送一个ICMP差错报文
+func (q *IpPacketQueue) SendIcmpError(pkt IpPacket, typ, code uint8, rest uint32) error {
+	// 也不为发往子网广播地址的数据报生成差错
+	if !shouldSendIcmpError(pkt) || q.isBroadcast(pkt.DstAddr) {
+		return nil
+	}
+	if !q.icmpLimiter.allow() {
+		return fmt.Errorf("icmp rate limit exceeded")
+	}
+
+	// 携带原始数据报的IP头部和尽可能多的数据，总长度不超过576字节
+	orig := pkt.Packet.Buf[:pkt.Packet.N]
+	if max := ICMP_ERROR_MAX_LENGTH - LENGTH - ICMP_HEADER_LENGTH; len(orig) > max {
+		orig = orig[:max]
+	}
+	msg := &IcmpMessage{
+		Type: typ,
+		Code: code,
+		Rest: rest,
+		Data: orig,
+	}
+	// 转发路径上产生的差错按发回源主机的出接口选择源地址
+	srcIP := pkt.IpHeader.DstIP
+	if !q.isLocal(pkt.DstAddr) {
+		src, err := q.SelectSource(pkt.SrcAddr)
+		if err != nil {
+			return err
+		}
+		srcIP = src.As4()
+	}
+	return q.writeIcmp(srcIP, pkt.IpHeader.SrcIP, msg)
+}
+
+func (q *IpPacketQueue) writeIcmp(srcIP, dstIP [4]byte, msg *IcmpMessage) error {
+	icmp := msg.Marshal()
+	hdr := NewHeader(srcIP, dstIP, len(icmp))
+	hdr.Protocol = ICMP_PROTOCOL
+
+	buf := append(hdr.Marshal(), icmp...)
+	return q.Write(network.Packet{
+		Buf: buf,
+		N:   uintptr(len(buf)),
+	})
+}
+
+// 处理收到的ICMP报文
+func (q *IpPacketQueue) recvIcmp(pkt IpPacket) {
+	offset := int(pkt.IpHeader.IHL) * 4
+	msg, err := unmarshalIcmp(pkt.Packet.Buf[offset:pkt.IpHeader.TotalLength])
+	if err != nil {
+		log.Printf("icmp unmarshal error: %s", err)
+		return
+	}
+
+	if !isIcmpError(msg.Type) || msg.Type == ICMP_TYPE_SOURCE_QUENCH {
+		// Source Quench 已被废弃 (RFC 6633)，其余查询报文暂不处理
+		return
+	}
+
+	// 差错报文中携带原始数据报的IP头部和至少8字节的上层数据
+	origHdr, err := unmarshal(msg.Data)
+	if err != nil || len(msg.Data) < int(origHdr.IHL)*4+8 {
+		log.Printf("icmp error with truncated datagram, type: %d, code: %d", msg.Type, msg.Code)
+		return
+	}
+
+	icmpErr := IcmpError{
+		Type:     msg.Type,
+		Code:     msg.Code,
+		Protocol: origHdr.Protocol,
+		SrcIP:    addrFrom4(origHdr.SrcIP),
+		DstIP:    addrFrom4(origHdr.DstIP),
+		Data:     msg.Data[int(origHdr.IHL)*4:],
+	}
+	switch {
+	case icmpErr.IsFragmentationNeeded():
+		// 更新路径MTU缓存，上层协议据此调整报文段大小
+		mtu := uint16(msg.Rest)
+		if mtu == 0 || mtu >= origHdr.TotalLength {
+			mtu = nextPlateau(origHdr.TotalLength)
+		}
+		if mtu < q.PathMTU(icmpErr.DstIP) {
+			q.pmtu.Update(icmpErr.DstIP, mtu)
+		}
+		icmpErr.NextHopMTU = q.PathMTU(icmpErr.DstIP)
+	case msg.Type == ICMP_TYPE_PARAMETER_PROBLEM:
+		icmpErr.Pointer = msg.Rest >> 24
+	}
+
+	q.reportIcmpError(icmpErr)
+}
+
+// 把差错交给上层协议，队列满时丢弃
+func (q *IpPacketQueue) reportIcmpError(icmpErr IcmpError) {
+	select {
+	case q.errorQueue <- icmpErr:
+	default:
+		log.Printf("icmp error queue is full, drop type: %d, code: %d", icmpErr.Type, icmpErr.Code)
+	}
+}
+
+// 设置了DF的IPv4数据报超过了mtu：转发的数据报向源主机回送 Fragmentation Needed，
+// 本机发出的数据报直接更新路径MTU缓存并通知上层协议，效果与收到差错报文相同
+func (q *IpPacketQueue) fragmentationNeeded(pkt IpPacket, mtu int) {
+	if !q.isLocal(pkt.SrcAddr) {
+		q.SendIcmpError(pkt, ICMP_TYPE_DESTINATION_UNREACHABLE, ICMP_CODE_FRAGMENTATION_NEEDED, uint32(mtu))
+		return
+	}
+	if uint16(mtu) < q.PathMTU(pkt.DstAddr) {
+		q.pmtu.Update(pkt.DstAddr, uint16(mtu))
+	}
+	q.reportIcmpError(IcmpError{
+		Type:       ICMP_TYPE_DESTINATION_UNREACHABLE,
+		Code:       ICMP_CODE_FRAGMENTATION_NEEDED,
+		NextHopMTU: q.PathMTU(pkt.DstAddr),
+		Protocol:   pkt.Protocol,
+		SrcIP:      pkt.SrcAddr,
+		DstIP:      pkt.DstAddr,
+		Data:       append([]byte(nil), pkt.Payload...),
+	})
+}
+
+// ReadIcmpError 读取上层协议需要处理的ICMP差错
+func (q *IpPacketQueue) ReadIcmpError() (IcmpError, error) {
+	e, ok := <-q.errorQueue
+	if !ok {
+		return IcmpError{}, fmt.Errorf("icmp error queue is closed")
+	}
+	return e, nil
+}
+
+// 计算互联网校验和 (RFC 1071)，对包含校验和字段的数据计算结果为0表示校验通过
+func checksum(buf []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(buf); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(buf[i : i+2]))
+	}
+	// 奇数长度时最后一个字节补0
+	if len(buf)%2 != 0 {
+		sum += uint32(buf[len(buf)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
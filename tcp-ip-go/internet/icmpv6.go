@@ -0,0 +1,234 @@
+package internet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/netip"
+	"tcp/network"
+)
+
+const (
+	ICMPV6_PROTOCOL = 58 // ICMPv6协议
+
+	ICMPV6_TYPE_DESTINATION_UNREACHABLE = 1
+	ICMPV6_TYPE_PACKET_TOO_BIG          = 2
+	ICMPV6_TYPE_TIME_EXCEEDED           = 3
+	ICMPV6_TYPE_PARAMETER_PROBLEM       = 4
+	ICMPV6_TYPE_ECHO_REQUEST            = 128
+	ICMPV6_TYPE_ECHO_REPLY              = 129
+	ICMPV6_TYPE_ROUTER_SOLICITATION     = 133
+	ICMPV6_TYPE_ROUTER_ADVERTISEMENT    = 134
+	ICMPV6_TYPE_NEIGHBOR_SOLICITATION   = 135
+	ICMPV6_TYPE_NEIGHBOR_ADVERTISEMENT  = 136
+
+	// Destination Unreachable 的代码
+	ICMPV6_CODE_NO_ROUTE            = 0
+	ICMPV6_CODE_ADMIN_PROHIBITED    = 1
+	ICMPV6_CODE_ADDRESS_UNREACHABLE = 3
+	ICMPV6_CODE_PORT_UNREACHABLE    = 4
+	// Time Exceeded 的代码
+	ICMPV6_CODE_HOP_LIMIT_EXCEEDED  = 0
+	ICMPV6_CODE_REASSEMBLY_EXCEEDED = 1
+	// Parameter Problem 的代码
+	ICMPV6_CODE_ERRONEOUS_HEADER         = 0
+	ICMPV6_CODE_UNRECOGNIZED_NEXT_HEADER = 1
+	ICMPV6_CODE_UNRECOGNIZED_OPTION      = 2
+)
+
+// ICMPv6的报文格式与ICMP相同，但校验和包含IPv6伪首部 (RFC 4443 2.3)
+func unmarshalIcmpv6(src, dst netip.Addr, pkt []byte) (*IcmpMessage, error) {
+	if len(pkt) < ICMP_HEADER_LENGTH {
+		return nil, fmt.Errorf("invalid icmpv6 length: %d", len(pkt))
+	}
+	if checksum(append(ipv6PseudoHeader(src, dst, len(pkt), ICMPV6_PROTOCOL), pkt...)) != 0 {
+		return nil, fmt.Errorf("invalid icmpv6 checksum")
+	}
+
+	return &IcmpMessage{
+		Type:     pkt[0],
+		Code:     pkt[1],
+		Checksum: binary.BigEndian.Uint16(pkt[2:4]),
+		Rest:     binary.BigEndian.Uint32(pkt[4:8]),
+		Data:     pkt[ICMP_HEADER_LENGTH:],
+	}, nil
+}
+
+func marshalIcmpv6(src, dst netip.Addr, m *IcmpMessage) []byte {
+	pkt := make([]byte, ICMP_HEADER_LENGTH+len(m.Data))
+	pkt[0] = m.Type
+	pkt[1] = m.Code
+	binary.BigEndian.PutUint32(pkt[4:8], m.Rest)
+	copy(pkt[ICMP_HEADER_LENGTH:], m.Data)
+
+	m.Checksum = checksum(append(ipv6PseudoHeader(src, dst, len(pkt), ICMPV6_PROTOCOL), pkt...))
+	binary.BigEndian.PutUint16(pkt[2:4], m.Checksum)
+
+	return pkt
+}
+
+// 上层协议校验和使用的IPv6伪首部 (RFC 8200 8.1)
+func ipv6PseudoHeader(src, dst netip.Addr, length int, nextHeader uint8) []byte {
+	srcIP, dstIP := src.As16(), dst.As16()
+	pseudoHeader := make([]byte, 40)
+	copy(pseudoHeader[0:16], srcIP[:])
+	copy(pseudoHeader[16:32], dstIP[:])
+	binary.BigEndian.PutUint32(pseudoHeader[32:36], uint32(length))
+	pseudoHeader[39] = nextHeader
+	return pseudoHeader
+}
+
+func isIcmpv6Error(typ uint8) bool {
+	// 类型值小于128的都是差错报文
+	return typ < 128
+}
+
+// 判断是否允许为该数据报生成ICMPv6差错报文 (RFC 4443 2.4)
+func shouldSendIcmpv6Error(pkt IpPacket, typ, code uint8) bool {
+	if pkt.SrcAddr.IsUnspecified() || pkt.SrcAddr.IsMulticast() {
+		return false
+	}
+	// 发往组播地址的数据报只允许回送 Packet Too Big 和无法识别选项的参数问题
+	if pkt.DstAddr.IsMulticast() &&
+		typ != ICMPV6_TYPE_PACKET_TOO_BIG &&
+		!(typ == ICMPV6_TYPE_PARAMETER_PROBLEM && code == ICMPV6_CODE_UNRECOGNIZED_OPTION) {
+		return false
+	}
+	// 不为ICMPv6差错报文生成差错
+	if pkt.Protocol == ICMPV6_PROTOCOL && (len(pkt.Payload) == 0 || isIcmpv6Error(pkt.Payload[0])) {
+		return false
+	}
+	return true
+}
+
+// SendIcmpv6Error 针对收到的IPv6数据报pkt回送一个ICMPv6差错报文
+func (q *IpPacketQueue) SendIcmpv6Error(pkt IpPacket, typ, code uint8, rest uint32) error {
+	if !shouldSendIcmpv6Error(pkt, typ, code) {
+		return nil
+	}
+	if !q.icmpLimiter.allow() {
+		return fmt.Errorf("icmp rate limit exceeded")
+	}
+
+	// 携带尽可能多的原始数据报，总长度不超过IPv6最小MTU
+	end := IPV6_HEADER_LENGTH + int(pkt.Ipv6Header.PayloadLength)
+	if end > int(pkt.Packet.N) {
+		end = int(pkt.Packet.N)
+	}
+	orig := pkt.Packet.Buf[:end]
+	if max := IPV6_MIN_MTU - IPV6_HEADER_LENGTH - ICMP_HEADER_LENGTH; len(orig) > max {
+		orig = orig[:max]
+	}
+
+	// 源地址使用数据报的目的地址，目的地址不是本机单播地址时按RFC 6724选择
+	src := pkt.DstAddr
+	if src.IsMulticast() || !q.isLocal(src) {
+		var err error
+		if src, err = q.SelectSource(pkt.SrcAddr); err != nil {
+			return err
+		}
+	}
+
+	msg := &IcmpMessage{
+		Type: typ,
+		Code: code,
+		Rest: rest,
+		Data: orig,
+	}
+	return q.writeIcmpv6(nil, src, pkt.SrcAddr, HOP_LIMIT, msg)
+}
+
+// 发送ICMPv6报文，iface为nil时按路由表选择出接口
+func (q *IpPacketQueue) writeIcmpv6(iface *Interface, src, dst netip.Addr, hopLimit uint8, msg *IcmpMessage) error {
+	icmp := marshalIcmpv6(src, dst, msg)
+	hdr := NewIpv6Header(src.As16(), dst.As16(), ICMPV6_PROTOCOL, len(icmp))
+	hdr.HopLimit = hopLimit
+
+	buf := append(hdr.Marshal(), icmp...)
+	pkt := network.Packet{
+		Buf: buf,
+		N:   uintptr(len(buf)),
+	}
+	if iface == nil {
+		return q.Write(pkt)
+	}
+	return q.output(iface, dst, pkt)
+}
+
+// 处理收到的ICMPv6报文
+func (q *IpPacketQueue) recvIcmpv6(pkt IpPacket) {
+	msg, err := unmarshalIcmpv6(pkt.SrcAddr, pkt.DstAddr, pkt.Payload)
+	if err != nil {
+		log.Printf("icmpv6 unmarshal error: %s", err)
+		return
+	}
+
+	switch msg.Type {
+	case ICMPV6_TYPE_ECHO_REQUEST:
+		// 回显应答使用请求的目的地址作为源地址，组播请求则使用接收接口的地址
+		src := pkt.DstAddr
+		if src.IsMulticast() {
+			var err error
+			if src, err = q.SelectSource(pkt.SrcAddr); err != nil {
+				return
+			}
+		}
+		reply := &IcmpMessage{
+			Type: ICMPV6_TYPE_ECHO_REPLY,
+			Rest: msg.Rest,
+			Data: msg.Data,
+		}
+		q.writeIcmpv6(nil, src, pkt.SrcAddr, HOP_LIMIT, reply)
+	case ICMPV6_TYPE_DESTINATION_UNREACHABLE, ICMPV6_TYPE_PACKET_TOO_BIG,
+		ICMPV6_TYPE_TIME_EXCEEDED, ICMPV6_TYPE_PARAMETER_PROBLEM:
+		q.recvIcmpv6Error(msg)
+	case ICMPV6_TYPE_ROUTER_SOLICITATION:
+		// 主机不处理路由器请求
+	case ICMPV6_TYPE_ROUTER_ADVERTISEMENT:
+		q.recvRouterAdvertisement(pkt, msg)
+	case ICMPV6_TYPE_NEIGHBOR_SOLICITATION:
+		q.recvNeighborSolicitation(pkt, msg)
+	case ICMPV6_TYPE_NEIGHBOR_ADVERTISEMENT:
+		q.recvNeighborAdvertisement(pkt, msg)
+	}
+}
+
+// 将ICMPv6差错交给上层协议处理
+func (q *IpPacketQueue) recvIcmpv6Error(msg *IcmpMessage) {
+	// 差错报文中携带原始数据报，需要遍历扩展头部找到上层协议
+	origHdr, err := unmarshalIpv6(msg.Data)
+	if err != nil {
+		log.Printf("icmpv6 error with truncated datagram, type: %d, code: %d", msg.Type, msg.Code)
+		return
+	}
+	chain, err := walkExtensionHeaders(msg.Data, origHdr.NextHeader)
+	if err != nil || len(msg.Data) < chain.offset+8 {
+		log.Printf("icmpv6 error with truncated datagram, type: %d, code: %d", msg.Type, msg.Code)
+		return
+	}
+
+	icmpErr := IcmpError{
+		Type:     msg.Type,
+		Code:     msg.Code,
+		Protocol: chain.protocol,
+		SrcIP:    netip.AddrFrom16(origHdr.SrcIP),
+		DstIP:    netip.AddrFrom16(origHdr.DstIP),
+		Data:     msg.Data[chain.offset:],
+	}
+	switch msg.Type {
+	case ICMPV6_TYPE_PACKET_TOO_BIG:
+		// 更新路径MTU缓存 (RFC 8201)
+		mtu := msg.Rest
+		if mtu > 0xffff {
+			mtu = 0xffff
+		}
+		if uint16(mtu) < q.PathMTU(icmpErr.DstIP) {
+			q.pmtu.Update(icmpErr.DstIP, uint16(mtu))
+		}
+		icmpErr.NextHopMTU = q.PathMTU(icmpErr.DstIP)
+	case ICMPV6_TYPE_PARAMETER_PROBLEM:
+		icmpErr.Pointer = msg.Rest
+	}
+
+	q.reportIcmpError(icmpErr)
+}
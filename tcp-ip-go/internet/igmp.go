@@ -0,0 +1,445 @@
+package internet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/netip"
+	"sort"
+	"sync"
+	"tcp/network"
+	"time"
+)
+
+const (
+	IGMP_PROTOCOL = 2
+
+	IGMP_TYPE_MEMBERSHIP_QUERY     = 0x11
+	IGMP_TYPE_V1_MEMBERSHIP_REPORT = 0x12
+	IGMP_TYPE_V2_MEMBERSHIP_REPORT = 0x16
+	IGMP_TYPE_V2_LEAVE_GROUP       = 0x17
+	IGMP_TYPE_V3_MEMBERSHIP_REPORT = 0x22
+
+	// IGMPv3组记录类型 (RFC 3376 4.2.12)
+	IGMP_MODE_IS_INCLUDE        = 1
+	IGMP_MODE_IS_EXCLUDE        = 2
+	IGMP_CHANGE_TO_INCLUDE_MODE = 3
+	IGMP_CHANGE_TO_EXCLUDE_MODE = 4
+
+	IGMP_V1 = 1
+	IGMP_V2 = 2
+	IGMP_V3 = 3
+
+	IGMP_MIN_LENGTH          = 8  // IGMPv1/v2报文和IGMPv3查询的公共部分
+	IGMP_V3_QUERY_MIN_LENGTH = 12 // IGMPv3查询报文的最小长度
+	IGMP_TTL                 = 1  // IGMP报文只在本链路上传播
+
+	IGMP_ROBUSTNESS                  = 2                 // 状态变化报告的发送次数 (RFC 3376 8.1)
+	IGMP_UNSOLICITED_REPORT_INTERVAL = 1 * time.Second   // IGMPv3状态变化报告的重传间隔 (RFC 3376 8.11)
+	IGMP_V2_UNSOLICITED_INTERVAL     = 10 * time.Second  // IGMPv1/v2主动报告的重传间隔 (RFC 2236 8.10)
+	IGMP_V1_MAX_RESPONSE_TIME        = 10 * time.Second  // IGMPv1查询不携带最大响应时间
+	IGMP_OLDER_QUERIER_TIMEOUT       = 260 * time.Second // 旧版本查询器存在的超时时间 (RFC 3376 8.12)
+)
+
+var (
+	allSystemsAddr   = netip.AddrFrom4([4]byte{224, 0, 0, 1})
+	allRouters4Addr  = netip.AddrFrom4([4]byte{224, 0, 0, 2})
+	igmpv3ReportAddr = netip.AddrFrom4([4]byte{224, 0, 0, 22})
+)
+
+// 接口加入的一个组播组
+type igmpGroup struct {
+	refs     int         // 加入该组的次数，减到0时离开
+	timer    *time.Timer // 等待发送的报告
+	deadline time.Time   // 报告的发送时间
+	pending  int         // 还需要重传的状态变化报告数
+}
+
+// 接口上的组播组成员关系
+type igmpState struct {
+	groups       map[netip.Addr]*igmpGroup
+	version      int         // 兼容模式，收到旧版本查询后降级 (RFC 3376 7.2.1)
+	olderQuerier *time.Timer // 旧版本查询器存在的计时器，超时后恢复IGMPv3
+	generalTimer *time.Timer // IGMPv3下对通用查询的响应
+	lock         sync.Mutex
+}
+
+func newIgmpState() *igmpState {
+	return &igmpState{
+		groups:  make(map[netip.Addr]*igmpGroup),
+		version: IGMP_V3,
+	}
+}
+
+// IPv4组播地址映射为 01:00:5e 加上地址的低23位 (RFC 1112 6.4)
+func ipv4MulticastHardwareAddr(group netip.Addr) network.HardwareAddr {
+	ip := group.As4()
+	return network.HardwareAddr{0x01, 0x00, 0x5e, ip[1] & 0x7f, ip[2], ip[3]}
+}
+
+// Groups 返回接口加入的IPv4组播组，不包括始终加入的 224.0.0.1
+func (iface *Interface) Groups() []netip.Addr {
+	iface.igmp.lock.Lock()
+	defer iface.igmp.lock.Unlock()
+
+	groups := make([]netip.Addr, 0, len(iface.igmp.groups))
+	for group := range iface.igmp.groups {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Less(groups[j]) })
+	return groups
+}
+
+// 接口是否加入了该IPv4组播组
+func (iface *Interface) isMember(group netip.Addr) bool {
+	if group == allSystemsAddr {
+		return true
+	}
+	iface.igmp.lock.Lock()
+	defer iface.igmp.lock.Unlock()
+
+	_, ok := iface.igmp.groups[group]
+	return ok
+}
+
+// JoinGroup 在接口上加入IPv4组播组，首次加入时主动发送报告
+func (q *IpPacketQueue) JoinGroup(iface *Interface, group netip.Addr) error {
+	if !group.Is4() || !group.IsMulticast() {
+		return fmt.Errorf("invalid multicast group: %s", group)
+	}
+	if group == allSystemsAddr {
+		return nil
+	}
+
+	s := iface.igmp
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if g, ok := s.groups[group]; ok {
+		g.refs++
+		return nil
+	}
+	g := &igmpGroup{refs: 1}
+	s.groups[group] = g
+	log.Printf("join group %s on %s", group, iface.Name)
+
+	// 立即发送一次报告，剩下的在随机时间后重传 (RFC 3376 5.1)
+	q.sendStateChange(iface, s.version, group, IGMP_CHANGE_TO_EXCLUDE_MODE)
+	g.pending = IGMP_ROBUSTNESS - 1
+	q.scheduleRetransmit(iface, group, g)
+	return nil
+}
+
+// LeaveGroup 离开IPv4组播组，最后一次离开时通知路由器
+func (q *IpPacketQueue) LeaveGroup(iface *Interface, group netip.Addr) error {
+	s := iface.igmp
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	g, ok := s.groups[group]
+	if !ok {
+		return fmt.Errorf("group %s not joined on %s", group, iface.Name)
+	}
+	g.refs--
+	if g.refs > 0 {
+		return nil
+	}
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+	delete(s.groups, group)
+	log.Printf("leave group %s on %s", group, iface.Name)
+
+	// IGMPv1没有离开报文，IGMPv3的离开报文也需要重传
+	switch s.version {
+	case IGMP_V2:
+		q.sendStateChange(iface, s.version, group, 0)
+	case IGMP_V3:
+		q.sendStateChange(iface, s.version, group, IGMP_CHANGE_TO_INCLUDE_MODE)
+		retransmits := IGMP_ROBUSTNESS - 1
+		var retransmit func()
+		retransmit = func() {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			// 期间重新加入了该组或降级到旧版本时不再发送
+			if _, ok := s.groups[group]; ok || s.version != IGMP_V3 || q.ctx.Err() != nil {
+				return
+			}
+			q.sendStateChange(iface, s.version, group, IGMP_CHANGE_TO_INCLUDE_MODE)
+			if retransmits--; retransmits > 0 {
+				time.AfterFunc(randomDelay(IGMP_UNSOLICITED_REPORT_INTERVAL), retransmit)
+			}
+		}
+		time.AfterFunc(randomDelay(IGMP_UNSOLICITED_REPORT_INTERVAL), retransmit)
+	}
+	return nil
+}
+
+// 在随机时间后重传状态变化报告，调用时需持有锁
+func (q *IpPacketQueue) scheduleRetransmit(iface *Interface, group netip.Addr, g *igmpGroup) {
+	if g.pending <= 0 {
+		return
+	}
+	interval := IGMP_UNSOLICITED_REPORT_INTERVAL
+	if iface.igmp.version != IGMP_V3 {
+		interval = IGMP_V2_UNSOLICITED_INTERVAL
+	}
+	q.scheduleReport(iface, group, g, randomDelay(interval), true)
+}
+
+// 在delay后发送组的报告，已有更早的报告时保持不变。调用时需持有锁
+func (q *IpPacketQueue) scheduleReport(iface *Interface, group netip.Addr, g *igmpGroup, delay time.Duration, stateChange bool) {
+	deadline := time.Now().Add(delay)
+	if g.timer != nil && g.timer.Stop() && g.deadline.Before(deadline) {
+		deadline = g.deadline
+	}
+	g.deadline = deadline
+	g.timer = time.AfterFunc(time.Until(deadline), func() {
+		s := iface.igmp
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		if s.groups[group] != g || q.ctx.Err() != nil {
+			return
+		}
+		g.timer = nil
+		if stateChange && g.pending > 0 {
+			g.pending--
+			q.sendStateChange(iface, s.version, group, IGMP_CHANGE_TO_EXCLUDE_MODE)
+			q.scheduleRetransmit(iface, group, g)
+			return
+		}
+		q.sendCurrentState(iface, s.version, []netip.Addr{group})
+		// 回应查询不影响尚未发完的状态变化报告
+		q.scheduleRetransmit(iface, group, g)
+	})
+}
+
+// 处理收到的IGMP报文
+func (q *IpPacketQueue) recvIgmp(pkt IpPacket) {
+	msg := pkt.Payload
+	if len(msg) < IGMP_MIN_LENGTH || checksum(msg) != 0 {
+		log.Printf("invalid igmp message, length: %d", len(msg))
+		return
+	}
+	// 只处理本链路上的报文
+	if pkt.IpHeader.TTL != IGMP_TTL {
+		return
+	}
+	group := netip.AddrFrom4([4]byte(msg[4:8]))
+
+	switch msg[0] {
+	case IGMP_TYPE_MEMBERSHIP_QUERY:
+		q.recvIgmpQuery(pkt.Interface, msg, group)
+	case IGMP_TYPE_V1_MEMBERSHIP_REPORT, IGMP_TYPE_V2_MEMBERSHIP_REPORT:
+		// IGMPv1/v2下收到其他主机对同一组的报告时取消自己的报告 (RFC 2236 3)
+		s := pkt.Interface.igmp
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if g, ok := s.groups[group]; ok && s.version != IGMP_V3 && g.pending == 0 && g.timer != nil {
+			g.timer.Stop()
+			g.timer = nil
+		}
+	}
+}
+
+// 处理成员关系查询，根据报文长度和最大响应时间判断查询器的版本 (RFC 3376 7.1)
+func (q *IpPacketQueue) recvIgmpQuery(iface *Interface, msg []byte, group netip.Addr) {
+	if !group.IsUnspecified() && !group.IsMulticast() {
+		return
+	}
+
+	version := IGMP_V3
+	var maxResp time.Duration
+	switch {
+	case len(msg) == IGMP_MIN_LENGTH && msg[1] == 0:
+		version = IGMP_V1
+		maxResp = IGMP_V1_MAX_RESPONSE_TIME
+	case len(msg) == IGMP_MIN_LENGTH:
+		version = IGMP_V2
+		maxResp = time.Duration(msg[1]) * time.Second / 10
+	case len(msg) >= IGMP_V3_QUERY_MIN_LENGTH:
+		maxResp = igmpDecodeTime(msg[1]) * time.Second / 10
+	default:
+		return
+	}
+
+	s := iface.igmp
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if version < IGMP_V3 {
+		q.setIgmpVersion(iface, version)
+	}
+
+	// 通用查询
+	if group.IsUnspecified() {
+		if s.version == IGMP_V3 {
+			// IGMPv3用一个报告回应所有组，已有更早的响应时保持不变 (RFC 3376 5.2)
+			if s.generalTimer == nil {
+				s.generalTimer = time.AfterFunc(randomDelay(maxResp), func() {
+					s.lock.Lock()
+					defer s.lock.Unlock()
+					s.generalTimer = nil
+					if s.version == IGMP_V3 && q.ctx.Err() == nil {
+						q.sendCurrentState(iface, s.version, s.groupList())
+					}
+				})
+			}
+			return
+		}
+		for addr, g := range s.groups {
+			q.scheduleReport(iface, addr, g, randomDelay(maxResp), false)
+		}
+		return
+	}
+
+	// 特定组查询，IGMPv3的特定源查询按特定组处理，本实现只支持排除模式且不过滤源地址
+	if g, ok := s.groups[group]; ok {
+		q.scheduleReport(iface, group, g, randomDelay(maxResp), false)
+	}
+}
+
+// 切换兼容模式，调用时需持有锁
+func (q *IpPacketQueue) setIgmpVersion(iface *Interface, version int) {
+	s := iface.igmp
+	if version < s.version {
+		log.Printf("igmp on %s falls back to version %d", iface.Name, version)
+		s.version = version
+		if s.generalTimer != nil {
+			s.generalTimer.Stop()
+			s.generalTimer = nil
+		}
+	}
+	if s.olderQuerier != nil {
+		s.olderQuerier.Stop()
+	}
+	// 一段时间内没有再收到旧版本查询时恢复IGMPv3
+	s.olderQuerier = time.AfterFunc(IGMP_OLDER_QUERIER_TIMEOUT, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.version = IGMP_V3
+		s.olderQuerier = nil
+	})
+}
+
+// 加入的所有组，调用时需持有锁
+func (s *igmpState) groupList() []netip.Addr {
+	groups := make([]netip.Addr, 0, len(s.groups))
+	for group := range s.groups {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// 发送状态变化报告。IGMPv1/v2的加入报告发往组地址，recordType为0表示离开，离开报文发往所有路由器
+func (q *IpPacketQueue) sendStateChange(iface *Interface, version int, group netip.Addr, recordType uint8) {
+	switch version {
+	case IGMP_V1:
+		q.writeIgmp(iface, group, igmpMessage(IGMP_TYPE_V1_MEMBERSHIP_REPORT, group))
+	case IGMP_V2:
+		if recordType == 0 {
+			q.writeIgmp(iface, allRouters4Addr, igmpMessage(IGMP_TYPE_V2_LEAVE_GROUP, group))
+		} else {
+			q.writeIgmp(iface, group, igmpMessage(IGMP_TYPE_V2_MEMBERSHIP_REPORT, group))
+		}
+	default:
+		q.writeIgmp(iface, igmpv3ReportAddr, igmpv3Report(recordType, []netip.Addr{group}))
+	}
+}
+
+// 回应查询，报告当前的成员关系
+func (q *IpPacketQueue) sendCurrentState(iface *Interface, version int, groups []netip.Addr) {
+	if version == IGMP_V3 {
+		if len(groups) > 0 {
+			q.writeIgmp(iface, igmpv3ReportAddr, igmpv3Report(IGMP_MODE_IS_EXCLUDE, groups))
+		}
+		return
+	}
+	for _, group := range groups {
+		q.sendStateChange(iface, version, group, IGMP_MODE_IS_EXCLUDE)
+	}
+}
+
+// 0                   1                   2                   3
+// 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |      Type     | Max Resp Time |           Checksum            |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                         Group Address                         |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+// 组装IGMPv1/v2报文
+func igmpMessage(typ uint8, group netip.Addr) []byte {
+	msg := make([]byte, IGMP_MIN_LENGTH)
+	msg[0] = typ
+	ip := group.As4()
+	copy(msg[4:8], ip[:])
+	binary.BigEndian.PutUint16(msg[2:4], checksum(msg))
+	return msg
+}
+
+// IGMPv3成员关系报告 (RFC 3376 4.2)，每个组记录都不带源地址
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |  Type = 0x22  |    Reserved   |           Checksum            |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |           Reserved            |  Number of Group Records (M)  |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |  Record Type  |  Aux Data Len |     Number of Sources (N)     |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                       Multicast Address                       |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+func igmpv3Report(recordType uint8, groups []netip.Addr) []byte {
+	msg := make([]byte, 8, 8+8*len(groups))
+	msg[0] = IGMP_TYPE_V3_MEMBERSHIP_REPORT
+	binary.BigEndian.PutUint16(msg[6:8], uint16(len(groups)))
+	for _, group := range groups {
+		ip := group.As4()
+		msg = append(msg, recordType, 0, 0, 0, ip[0], ip[1], ip[2], ip[3])
+	}
+	binary.BigEndian.PutUint16(msg[2:4], checksum(msg))
+	return msg
+}
+
+// 解码IGMPv3的最大响应码，大于等于128时为浮点格式 (RFC 3376 4.1.1)，单位为0.1秒
+func igmpDecodeTime(code uint8) time.Duration {
+	if code < 128 {
+		return time.Duration(code)
+	}
+	exp := (code >> 4) & 0x07
+	mant := code & 0x0f
+	return time.Duration(int(mant|0x10) << (exp + 3))
+}
+
+// [0, max)内的随机时间
+func randomDelay(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// 发送IGMP报文，TTL为1并携带路由器告警选项 (RFC 2113)，源地址为接口的主地址
+func (q *IpPacketQueue) writeIgmp(iface *Interface, dst netip.Addr, msg []byte) {
+	var src [4]byte
+	if prefix, ok := iface.addrOf(dst); ok {
+		src = prefix.Addr().As4()
+	}
+
+	hdr := NewHeader(src, dst.As4(), 4+len(msg))
+	hdr.IHL = IHL + 1
+	hdr.TTL = IGMP_TTL
+	hdr.Protocol = IGMP_PROTOCOL
+	buf := hdr.Marshal()
+
+	// 路由器告警选项：类型0x94，长度4，值0表示路由器应检查该数据报
+	copy(buf[LENGTH:], []byte{0x94, 0x04, 0x00, 0x00})
+	binary.BigEndian.PutUint16(buf[10:12], 0)
+	binary.BigEndian.PutUint16(buf[10:12], checksum(buf))
+
+	buf = append(buf, msg...)
+	if err := q.output(iface, dst, network.Packet{Buf: buf, N: uintptr(len(buf))}); err != nil {
+		log.Printf("send igmp error: %s", err)
+	}
+}
@@ -0,0 +1,217 @@
+package internet
+
+import (
+	"net/netip"
+	"sync"
+	"tcp/network"
+)
+
+// 网络接口，即协议栈挂载的一条链路及其地址
+type Interface struct {
+	Name          string
+	Link          network.Link
+	Addrs         []InterfaceAddr // 接口的地址表，可同时包含IPv4和IPv6地址
+	MTU           int             // 链路MTU，创建后不再修改
+	mtu6          int             // IPv6链路MTU，可由路由器通告调小，由lock保护
+	outgoingQueue chan network.Packet
+	neighbors     *neighborCache // 以太网链路上的邻居缓存(ARP和邻居发现共用)
+	ndp           *ndpState      // 邻居发现和无状态地址自动配置的状态
+	igmp          *igmpState     // IPv4组播组成员关系
+	dhcp          *DhcpClient    // 接口上运行的DHCP客户端
+	lock          sync.RWMutex
+}
+
+func newInterface(link network.Link) *Interface {
+	iface := &Interface{
+		Name:          link.Name(),
+		Link:          link,
+		MTU:           link.MTU(),
+		mtu6:          link.MTU(),
+		outgoingQueue: make(chan network.Packet, QUEUE_SIZE),
+		igmp:          newIgmpState(),
+	}
+	if iface.isEthernet() {
+		iface.neighbors = newNeighborCache()
+		iface.ndp = newNdpState()
+	}
+	return iface
+}
+
+func (iface *Interface) isEthernet() bool {
+	return iface.Link.Type() == network.LINK_TYPE_ETHERNET
+}
+
+// 发往addr时使用的链路MTU，路由器通告的MTU只适用于IPv6 (RFC 4861 6.3.4)
+func (iface *Interface) mtuFor(addr netip.Addr) int {
+	if addr.Is4() {
+		return iface.MTU
+	}
+	iface.lock.RLock()
+	defer iface.lock.RUnlock()
+	return iface.mtu6
+}
+
+func (iface *Interface) setMtu6(mtu int) {
+	iface.lock.Lock()
+	defer iface.lock.Unlock()
+	iface.mtu6 = mtu
+}
+
+// Addresses 返回接口地址及前缀长度的快照
+func (iface *Interface) Addresses() []netip.Prefix {
+	iface.lock.RLock()
+	defer iface.lock.RUnlock()
+
+	addrs := make([]netip.Prefix, len(iface.Addrs))
+	for i, a := range iface.Addrs {
+		addrs[i] = a.Prefix
+	}
+	return addrs
+}
+
+// AddressTable 返回接口地址表的快照
+func (iface *Interface) AddressTable() []InterfaceAddr {
+	iface.lock.RLock()
+	defer iface.lock.RUnlock()
+
+	addrs := make([]InterfaceAddr, len(iface.Addrs))
+	copy(addrs, iface.Addrs)
+	return addrs
+}
+
+// 添加接口地址，已存在时返回false。IPv4子网中已有地址时新地址为从地址，
+// tentative的地址在重复地址检测完成前不能使用
+func (iface *Interface) addAddress(prefix netip.Prefix, tentative bool) bool {
+	iface.lock.Lock()
+	defer iface.lock.Unlock()
+
+	a := InterfaceAddr{
+		Prefix:    prefix,
+		Broadcast: directedBroadcast(prefix),
+		Tentative: tentative,
+	}
+	for _, existing := range iface.Addrs {
+		if existing.Prefix.Addr() == prefix.Addr() {
+			return false
+		}
+		if prefix.Addr().Is4() && existing.Prefix.Masked() == prefix.Masked() {
+			a.Secondary = true
+		}
+	}
+	iface.Addrs = append(iface.Addrs, a)
+	return true
+}
+
+// 删除接口地址，删除主地址时把同一子网的第一个从地址提升为主地址
+func (iface *Interface) removeAddress(addr netip.Addr) bool {
+	iface.lock.Lock()
+	defer iface.lock.Unlock()
+
+	for i, a := range iface.Addrs {
+		if a.Prefix.Addr() != addr {
+			continue
+		}
+		iface.Addrs = append(iface.Addrs[:i:i], iface.Addrs[i+1:]...)
+		if a.Secondary {
+			return true
+		}
+		for j := range iface.Addrs {
+			if iface.Addrs[j].Secondary && iface.Addrs[j].Prefix.Masked() == a.Prefix.Masked() {
+				iface.Addrs[j].Secondary = false
+				break
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (iface *Interface) setDeprecated(addr netip.Addr, deprecated bool) {
+	iface.lock.Lock()
+	defer iface.lock.Unlock()
+
+	for i := range iface.Addrs {
+		if iface.Addrs[i].Prefix.Addr() == addr {
+			iface.Addrs[i].Deprecated = deprecated
+		}
+	}
+}
+
+// 重复地址检测通过后地址成为可用地址，地址已被删除时返回false
+func (iface *Interface) setPreferred(addr netip.Addr) bool {
+	iface.lock.Lock()
+	defer iface.lock.Unlock()
+
+	for i := range iface.Addrs {
+		if iface.Addrs[i].Prefix.Addr() == addr {
+			iface.Addrs[i].Tentative = false
+			return true
+		}
+	}
+	return false
+}
+
+// 接口上是否配置了该地址，不包括正在进行重复地址检测的地址
+func (iface *Interface) hasAddress(addr netip.Addr) bool {
+	iface.lock.RLock()
+	defer iface.lock.RUnlock()
+
+	for _, a := range iface.Addrs {
+		if a.Prefix.Addr() == addr {
+			return !a.Tentative
+		}
+	}
+	return false
+}
+
+// 地址是否正在进行重复地址检测
+func (iface *Interface) isTentative(addr netip.Addr) bool {
+	iface.lock.RLock()
+	defer iface.lock.RUnlock()
+
+	for _, a := range iface.Addrs {
+		if a.Prefix.Addr() == addr {
+			return a.Tentative
+		}
+	}
+	return false
+}
+
+// 返回接口上与addr同地址族的主地址，优先选择与addr在同一子网的地址
+func (iface *Interface) addrOf(addr netip.Addr) (netip.Prefix, bool) {
+	iface.lock.RLock()
+	defer iface.lock.RUnlock()
+
+	var found netip.Prefix
+	for _, a := range iface.Addrs {
+		if a.Secondary || a.Tentative || a.Prefix.Addr().Is4() != addr.Is4() {
+			continue
+		}
+		if a.Prefix.Contains(addr) {
+			return a.Prefix, true
+		}
+		if !found.IsValid() {
+			found = a.Prefix
+		}
+	}
+	return found, found.IsValid()
+}
+
+func (iface *Interface) dhcpClient() *DhcpClient {
+	iface.lock.RLock()
+	defer iface.lock.RUnlock()
+	return iface.dhcp
+}
+
+// 将[4]byte形式的IPv4地址转换为netip.Addr
+func addrFrom4(ip [4]byte) netip.Addr {
+	return netip.AddrFrom4(ip)
+}
+
+// HeaderLength 返回不含选项和扩展头部时对应地址族的IP头部长度
+func HeaderLength(addr netip.Addr) int {
+	if addr.Is4() {
+		return LENGTH
+	}
+	return IPV6_HEADER_LENGTH
+}
@@ -2,8 +2,12 @@ package internet
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
 	"log"
+	"net/netip"
+	"sync"
+	"sync/atomic"
 	"tcp/network"
 )
 
@@ -11,27 +15,87 @@ const (
 	QUEUE_SIZE = 10
 )
 
+// 收到的IPv4或IPv6数据报
 type IpPacket struct {
-	IpHeader *Header
-	Packet   network.Packet
+	IpHeader   *Header     // IPv4头部，IPv6数据报为nil
+	Ipv6Header *Ipv6Header // IPv6头部，IPv4数据报为nil
+	Packet     network.Packet
+	Interface  *Interface // 接收该数据报的接口
+	SrcAddr    netip.Addr
+	DstAddr    netip.Addr
+	Protocol   uint8    // 上层协议，IPv6为扩展头部链末端的协议
+	Tos        uint8    // IPv4的TOS或IPv6的Traffic Class，包含DSCP和ECN
+	Payload    []byte   // 上层协议的数据
+	CtState    CtState  // 连接跟踪状态
+	ct         *ctEntry // 所属的连接，不跟踪时为nil
+	ctDir      int      // 数据报在连接中的方向
 }
 
 type IpPacketQueue struct {
 	incomingQueue chan IpPacket
-	outgoingQueue chan network.Packet
+	errorQueue    chan IcmpError // 交给上层协议处理的ICMP差错
+	interfaces    []*Interface
+	routes        *RouteTable
+	icmpLimiter   *rateLimiter
+	pmtu          *PmtuCache                  // 路径MTU缓存
+	reassembly    *reassembler                // 发往本机的分片
+	forwarding    atomic.Bool                 // 是否开启路由转发
+	fragmentId    atomic.Uint32               // 本机分片的数据报使用的标识
+	filter        *Filter                     // 各hook上的过滤规则
+	conntrack     *Conntrack                  // 连接跟踪表
+	nat           *Nat                        // 地址转换规则
+	tunnels       []*Tunnel                   // GRE和IP-in-IP隧道
+	udpConns      map[netip.AddrPort]*UdpConn // 绑定的UDP套接字
+	lock          sync.RWMutex
 	ctx           context.Context
 	cancel        context.CancelFunc
 }
 
 func NewIpPacketQueue() *IpPacketQueue {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &IpPacketQueue{
 		incomingQueue: make(chan IpPacket, QUEUE_SIZE),
-		outgoingQueue: make(chan network.Packet, QUEUE_SIZE),
+		errorQueue:    make(chan IcmpError, QUEUE_SIZE),
+		interfaces:    make([]*Interface, 0),
+		routes:        NewRouteTable(),
+		icmpLimiter:   newRateLimiter(ICMP_RATE_LIMIT, ICMP_RATE_BURST),
+		pmtu:          NewPmtuCache(),
+		reassembly:    newReassembler(),
+		udpConns:      make(map[netip.AddrPort]*UdpConn),
+		filter:        NewFilter(),
+		nat:           NewNat(),
+		conntrack:     NewConntrack(),
+		ctx:           ctx,
+		cancel:        cancel,
 	}
 }
 
-func (ip *IpPacketQueue) ManageQueues(network *network.NetDevice) {
-	ip.ctx, ip.cancel = context.WithCancel(context.Background())
+// ManageQueues 在单一链路上运行协议栈，所有数据报都经由该链路收发
+func (ip *IpPacketQueue) ManageQueues(link network.Link, addrs ...netip.Prefix) {
+	iface := ip.AddInterface(link, addrs...)
+	ip.routes.Add(Route{
+		Prefix:    netip.PrefixFrom(netip.IPv4Unspecified(), 0),
+		Interface: iface,
+	})
+	ip.routes.Add(Route{
+		Prefix:    netip.PrefixFrom(netip.IPv6Unspecified(), 0),
+		Interface: iface,
+	})
+}
+
+// AddInterface 挂载一条链路，并为接口添加地址及到所在网络的直连路由
+func (ip *IpPacketQueue) AddInterface(link network.Link, addrs ...netip.Prefix) *Interface {
+	iface := newInterface(link)
+
+	ip.lock.Lock()
+	ip.interfaces = append(ip.interfaces, iface)
+	ip.lock.Unlock()
+
+	for _, addr := range addrs {
+		if err := ip.AddAddress(iface, addr); err != nil {
+			log.Printf("add address error: %s", err)
+		}
+	}
 
 	go func() {
 		for {
@@ -39,20 +103,16 @@ func (ip *IpPacketQueue) ManageQueues(network *network.NetDevice) {
 			case <-ip.ctx.Done():
 				return
 			default:
-				pkt, err := network.Read()
+				pkt, err := link.Read()
 				if err != nil {
 					log.Printf("read error: %s", err.Error())
-				}
-				ipHeader, err := unmarshal(pkt.Buf[:pkt.N])
-				if err != nil {
-					log.Printf("unmarshal error: %s", err)
 					continue
 				}
-				ipPacket := IpPacket{
-					IpHeader: ipHeader,
-					Packet:   pkt,
+				if iface.isEthernet() {
+					ip.receiveFrame(iface, pkt)
+				} else {
+					ip.receive(iface, pkt)
 				}
-				ip.incomingQueue <- ipPacket
 			}
 		}
 	}()
@@ -62,14 +122,134 @@ func (ip *IpPacketQueue) ManageQueues(network *network.NetDevice) {
 			select {
 			case <-ip.ctx.Done():
 				return
-			case pkt := <-ip.outgoingQueue:
-				err := network.Write(pkt)
+			case pkt := <-iface.outgoingQueue:
+				err := link.Write(pkt)
 				if err != nil {
 					log.Printf("write error: %s", err.Error())
 				}
 			}
 		}
 	}()
+
+	if iface.isEthernet() {
+		ip.startNdp(iface)
+	}
+
+	return iface
+}
+
+// 根据版本号分发收到的数据报
+func (ip *IpPacketQueue) receive(iface *Interface, pkt network.Packet) {
+	if pkt.N == 0 {
+		return
+	}
+	switch pkt.Buf[0] >> 4 {
+	case IP_VERSION_4:
+		ipHeader, err := unmarshal(pkt.Buf[:pkt.N])
+		if err != nil {
+			log.Printf("unmarshal error: %s", err)
+			return
+		}
+		ip.input(IpPacket{
+			IpHeader:  ipHeader,
+			Packet:    pkt,
+			Interface: iface,
+			SrcAddr:   addrFrom4(ipHeader.SrcIP),
+			DstAddr:   addrFrom4(ipHeader.DstIP),
+			Protocol:  ipHeader.Protocol,
+			Tos:       ipHeader.TOS,
+		})
+	case IP_VERSION_6:
+		ipv6Header, err := unmarshalIpv6(pkt.Buf[:pkt.N])
+		if err != nil {
+			log.Printf("unmarshal error: %s", err)
+			return
+		}
+		ip.input6(IpPacket{
+			Ipv6Header: ipv6Header,
+			Packet:     pkt,
+			Interface:  iface,
+			SrcAddr:    netip.AddrFrom16(ipv6Header.SrcIP),
+			DstAddr:    netip.AddrFrom16(ipv6Header.DstIP),
+			Tos:        ipv6Header.TrafficClass,
+		})
+	default:
+		log.Printf("unsupported ip version: %d", pkt.Buf[0]>>4)
+	}
+}
+
+// Interfaces 返回协议栈挂载的所有接口
+func (ip *IpPacketQueue) Interfaces() []*Interface {
+	ip.lock.RLock()
+	defer ip.lock.RUnlock()
+
+	interfaces := make([]*Interface, len(ip.interfaces))
+	copy(interfaces, ip.interfaces)
+	return interfaces
+}
+
+// Routes 返回协议栈的路由表
+func (ip *IpPacketQueue) Routes() *RouteTable {
+	return ip.routes
+}
+
+// 校验IPv4数据报并根据上层协议分发
+func (q *IpPacketQueue) input(pkt IpPacket) {
+	hdr := pkt.IpHeader
+	// 头部长度或总长度不合法时回送参数问题报文，指针指向出错字段
+	if hdr.IHL < IHL || int(hdr.IHL)*4 > int(pkt.Packet.N) {
+		q.SendIcmpError(pkt, ICMP_TYPE_PARAMETER_PROBLEM, ICMP_CODE_POINTER_INDICATES, 0)
+		return
+	}
+	if int(hdr.TotalLength) < int(hdr.IHL)*4 || int(hdr.TotalLength) > int(pkt.Packet.N) {
+		q.SendIcmpError(pkt, ICMP_TYPE_PARAMETER_PROBLEM, ICMP_CODE_POINTER_INDICATES, 2<<24)
+		return
+	}
+
+	// 头部校验和错误的数据报直接丢弃，转发前也必须检查 (RFC 1122 3.2.1.2, RFC 1812 5.2.2)
+	if checksum(pkt.Packet.Buf[:hdr.IHL*4]) != 0 {
+		log.Printf("drop datagram with bad header checksum: %s -> %s", pkt.SrcAddr, pkt.DstAddr)
+		return
+	}
+
+	pkt.Payload = pkt.Packet.Buf[hdr.IHL*4 : hdr.TotalLength]
+	if !q.prerouting(&pkt) {
+		return
+	}
+
+	// 不是发往本机的数据报只在路由器模式下转发，否则丢弃
+	if !q.isLocal(pkt.DstAddr) {
+		if q.Forwarding() {
+			q.forward(pkt)
+		}
+		return
+	}
+	// 分片重组后再交给上层协议，否则非首个分片的数据会被当作上层头部解析
+	if hdr.FragmentOffset != 0 || hdr.Flags&FLAG_MORE_FRAGMENTS != 0 {
+		var ok bool
+		if pkt, ok = q.reassemble(pkt); !ok {
+			return
+		}
+		hdr = pkt.IpHeader
+	}
+	if !q.localInput(pkt) {
+		return
+	}
+
+	switch hdr.Protocol {
+	case ICMP_PROTOCOL:
+		q.recvIcmp(pkt)
+	case IGMP_PROTOCOL:
+		q.recvIgmp(pkt)
+	case IPIP_PROTOCOL, GRE_PROTOCOL:
+		q.recvTunnel(pkt)
+	case UDP_PROTOCOL:
+		q.recvUdp(pkt)
+	case TCP_PROTOCOL:
+		q.incomingQueue <- pkt
+	default:
+		q.SendIcmpError(pkt, ICMP_TYPE_DESTINATION_UNREACHABLE, ICMP_CODE_PROTOCOL_UNREACHABLE, 0)
+	}
 }
 
 func (q *IpPacketQueue) Close() {
@@ -84,11 +264,168 @@ func (q *IpPacketQueue) Read() (IpPacket, error) {
 	return pkt, nil
 }
 
+// 校验IPv6数据报，遍历扩展头部后根据上层协议分发
+func (q *IpPacketQueue) input6(pkt IpPacket) {
+	hdr := pkt.Ipv6Header
+	end := IPV6_HEADER_LENGTH + int(hdr.PayloadLength)
+	if end > int(pkt.Packet.N) {
+		log.Printf("truncated ipv6 datagram, payload length: %d", hdr.PayloadLength)
+		return
+	}
+
+	chain, err := walkExtensionHeaders(pkt.Packet.Buf[:end], hdr.NextHeader)
+	if err != nil {
+		log.Printf("ipv6 extension header error: %s", err)
+		return
+	}
+	// 暂不支持分片重组
+	if chain.fragmented {
+		log.Printf("drop ipv6 fragment, offset: %d", chain.fragOffset)
+		return
+	}
+	pkt.Protocol = chain.protocol
+	pkt.Payload = pkt.Packet.Buf[chain.offset:end]
+
+	if !q.prerouting(&pkt) {
+		return
+	}
+	if !q.isLocal(pkt.DstAddr) {
+		return
+	}
+	if !q.localInput(pkt) {
+		return
+	}
+
+	switch pkt.Protocol {
+	case ICMPV6_PROTOCOL:
+		q.recvIcmpv6(pkt)
+	case TCP_PROTOCOL:
+		q.incomingQueue <- pkt
+	case IPV6_NO_NEXT:
+	default:
+		// 无法识别的 Next Header，指针指向该字段 (RFC 8200 4)
+		q.SendIcmpv6Error(pkt, ICMPV6_TYPE_PARAMETER_PROBLEM, ICMPV6_CODE_UNRECOGNIZED_NEXT_HEADER, uint32(chain.nextHeaderPos))
+	}
+}
+
+// Write 按目的地址查找路由，将IPv4或IPv6数据报交给出接口发送
 func (q *IpPacketQueue) Write(pkt network.Packet) error {
-	select {
-	case q.outgoingQueue <- pkt:
-		return nil
-	case <-q.ctx.Done():
-		return fmt.Errorf("network closed")
+	ipPkt, err := parseDatagram(pkt)
+	if err != nil {
+		return err
+	}
+	q.conntrack.track(&ipPkt)
+
+	route, ok := q.routes.Lookup(ipPkt.DstAddr)
+	if !ok {
+		return fmt.Errorf("network unreachable: %s", ipPkt.DstAddr)
+	}
+	if !q.filterHook(HOOK_OUTPUT, ipPkt, nil, route.Interface) ||
+		!q.postrouting(&ipPkt, nil, route.Interface) {
+		return fmt.Errorf("operation not permitted: %s -> %s", ipPkt.SrcAddr, ipPkt.DstAddr)
+	}
+	nextHop := route.NextHop(ipPkt.DstAddr)
+	mtu := route.Interface.mtuFor(ipPkt.DstAddr)
+	if int(pkt.N) <= mtu {
+		return q.output(route.Interface, nextHop, pkt)
+	}
+
+	// 超过出接口MTU时，没有设置DF的IPv4数据报与转发时一样分片发送
+	if ipPkt.IpHeader == nil || ipPkt.IpHeader.Flags&FLAG_DONT_FRAGMENT != 0 {
+		return fmt.Errorf("message too long: %d > mtu %d of %s", pkt.N, mtu, route.Interface.Name)
+	}
+	// 分片的数据报需要唯一的标识，在副本上修改，不改动调用方的缓冲区 (RFC 6864 4.1)
+	datagram := append([]byte(nil), pkt.Buf[:ipPkt.IpHeader.TotalLength]...)
+	binary.BigEndian.PutUint16(datagram[4:6], uint16(q.fragmentId.Add(1)))
+	fragments, err := fragment(datagram, mtu)
+	if err != nil {
+		return err
+	}
+	for _, frag := range fragments {
+		if err := q.output(route.Interface, nextHop, network.Packet{Buf: frag, N: uintptr(len(frag))}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 解析本机发出的数据报，找到上层协议及其数据
+func parseDatagram(pkt network.Packet) (IpPacket, error) {
+	if pkt.N == 0 {
+		return IpPacket{}, fmt.Errorf("empty datagram")
+	}
+
+	switch pkt.Buf[0] >> 4 {
+	case IP_VERSION_4:
+		hdr, err := unmarshal(pkt.Buf[:pkt.N])
+		if err != nil {
+			return IpPacket{}, err
+		}
+		if int(hdr.IHL)*4 > int(hdr.TotalLength) || int(hdr.TotalLength) > int(pkt.N) {
+			return IpPacket{}, fmt.Errorf("invalid datagram length: %d", hdr.TotalLength)
+		}
+		return IpPacket{
+			IpHeader: hdr,
+			Packet:   pkt,
+			SrcAddr:  addrFrom4(hdr.SrcIP),
+			DstAddr:  addrFrom4(hdr.DstIP),
+			Protocol: hdr.Protocol,
+			Tos:      hdr.TOS,
+			Payload:  pkt.Buf[hdr.IHL*4 : hdr.TotalLength],
+		}, nil
+	case IP_VERSION_6:
+		hdr, err := unmarshalIpv6(pkt.Buf[:pkt.N])
+		if err != nil {
+			return IpPacket{}, err
+		}
+		end := IPV6_HEADER_LENGTH + int(hdr.PayloadLength)
+		if end > int(pkt.N) {
+			return IpPacket{}, fmt.Errorf("invalid payload length: %d", hdr.PayloadLength)
+		}
+		chain, err := walkExtensionHeaders(pkt.Buf[:end], hdr.NextHeader)
+		if err != nil {
+			return IpPacket{}, err
+		}
+		return IpPacket{
+			Ipv6Header: hdr,
+			Packet:     pkt,
+			SrcAddr:    netip.AddrFrom16(hdr.SrcIP),
+			DstAddr:    netip.AddrFrom16(hdr.DstIP),
+			Protocol:   chain.protocol,
+			Tos:        hdr.TrafficClass,
+			Payload:    pkt.Buf[chain.offset:end],
+		}, nil
+	default:
+		return IpPacket{}, fmt.Errorf("unsupported ip version: %d", pkt.Buf[0]>>4)
+	}
+}
+
+// NewDatagram 根据地址族组装IPv4或IPv6数据报，tos为IPv4的TOS或IPv6的Traffic Class
+func NewDatagram(srcIP, dstIP netip.Addr, protocol, tos uint8, payload []byte) []byte {
+	var buf []byte
+	if srcIP.Is4() {
+		hdr := NewHeader(srcIP.As4(), dstIP.As4(), len(payload))
+		hdr.Protocol = protocol
+		hdr.TOS = tos
+		buf = hdr.Marshal()
+	} else {
+		hdr := NewIpv6Header(srcIP.As16(), dstIP.As16(), protocol, len(payload))
+		hdr.TrafficClass = tos
+		buf = hdr.Marshal()
+	}
+	return append(buf, payload...)
+}
+
+// 上层协议校验和使用的伪首部，根据地址族选择IPv4或IPv6格式
+func pseudoHeader(src, dst netip.Addr, length int, protocol uint8) []byte {
+	if src.Is6() {
+		return ipv6PseudoHeader(src, dst, length, protocol)
 	}
+	srcIP, dstIP := src.As4(), dst.As4()
+	pseudoHeader := make([]byte, 12)
+	copy(pseudoHeader[0:4], srcIP[:])
+	copy(pseudoHeader[4:8], dstIP[:])
+	pseudoHeader[9] = protocol
+	binary.BigEndian.PutUint16(pseudoHeader[10:12], uint16(length))
+	return pseudoHeader
 }
@@ -8,11 +8,17 @@ import (
 const (
 	IP_VERSION_4         = 4       // IP协议版本
 	IHL                  = 5       // Internet Header Length
-	TOS                  = 0       // 服务类型
+	TOS                  = 0       // 默认服务类型，DSCP和ECN均为0
 	TTL                  = 64      // 生存时间
 	LENGTH               = IHL * 4 // IP头部长度
 	TCP_PROTOCOL         = 6       // TCP协议
+	UDP_PROTOCOL         = 17      // UDP协议
 	IP_HEADER_MIN_LENGTH = 20      // IP头部最小长度
+	FLAG_DONT_FRAGMENT   = 0x2     // DF: 禁止分片
+	FLAG_MORE_FRAGMENTS  = 0x1     // MF: 后面还有分片
+	IP_OPTION_EOL        = 0       // 选项列表结束
+	IP_OPTION_NOP        = 1       // 无操作，用于对齐
+	IP_OPTION_COPIED     = 0x80    // 选项类型的最高位：分片时复制到每个分片
 )
 
 type Header struct {
@@ -41,7 +47,7 @@ func NewHeader(srcIP, dstIP [4]byte, len int) *Header {
 		SrcIP:       srcIP,
 		DstIP:       dstIP,
 		ID:          0,
-		Flags:       0x40,
+		Flags:       FLAG_DONT_FRAGMENT,
 		Checksum:    0,
 	}
 }
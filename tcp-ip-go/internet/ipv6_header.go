@@ -0,0 +1,173 @@
+package internet
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	IP_VERSION_6       = 6    // IPv6协议版本
+	IPV6_HEADER_LENGTH = 40   // IPv6固定头部长度
+	HOP_LIMIT          = 64   // 默认跳数限制
+	IPV6_MIN_MTU       = 1280 // IPv6要求所有链路支持的最小MTU (RFC 8200 5)
+
+	// 扩展头部和上层协议的 Next Header 值
+	IPV6_HOP_BY_HOP    = 0
+	IPV6_ROUTING       = 43
+	IPV6_FRAGMENT      = 44
+	IPV6_ESP           = 50
+	IPV6_AH            = 51
+	IPV6_NO_NEXT       = 59
+	IPV6_DEST_OPTIONS  = 60
+	IPV6_FRAGMENT_SIZE = 8 // 分片头部固定为8字节
+)
+
+type Ipv6Header struct {
+	Version       uint8
+	TrafficClass  uint8
+	FlowLabel     uint32 // 低20位有效
+	PayloadLength uint16 // 扩展头部和上层数据的总长度
+	NextHeader    uint8
+	HopLimit      uint8
+	SrcIP         [16]byte
+	DstIP         [16]byte
+}
+
+func NewIpv6Header(srcIP, dstIP [16]byte, nextHeader uint8, len int) *Ipv6Header {
+	return &Ipv6Header{
+		Version:       IP_VERSION_6,
+		TrafficClass:  TOS,
+		PayloadLength: uint16(len),
+		NextHeader:    nextHeader,
+		HopLimit:      HOP_LIMIT,
+		SrcIP:         srcIP,
+		DstIP:         dstIP,
+	}
+}
+
+// 0                   1                   2                   3
+// 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |Version| Traffic Class |           Flow Label                  |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |         Payload Length        |  Next Header  |   Hop Limit   |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                                                               |
+// +                                                               +
+// |                                                               |
+// +                         Source Address                        +
+// |                                                               |
+// +                                                               +
+// |                                                               |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                                                               |
+// +                                                               +
+// |                                                               |
+// +                      Destination Address                      +
+// |                                                               |
+// +                                                               +
+// |                                                               |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+func unmarshalIpv6(pkt []byte) (*Ipv6Header, error) {
+	if len(pkt) < IPV6_HEADER_LENGTH {
+		return nil, fmt.Errorf("invalid ipv6 header length")
+	}
+
+	versionClassLabel := binary.BigEndian.Uint32(pkt[0:4])
+	header := &Ipv6Header{
+		Version:       uint8(versionClassLabel >> 28), // 高4位
+		TrafficClass:  uint8(versionClassLabel >> 20), // 接下来的8位
+		FlowLabel:     versionClassLabel & 0x000fffff, // 低20位
+		PayloadLength: binary.BigEndian.Uint16(pkt[4:6]),
+		NextHeader:    pkt[6],
+		HopLimit:      pkt[7],
+	}
+
+	copy(header.SrcIP[:], pkt[8:24])
+	copy(header.DstIP[:], pkt[24:40])
+
+	return header, nil
+}
+
+func (h *Ipv6Header) Marshal() []byte {
+	versionClassLabel := uint32(h.Version)<<28 | uint32(h.TrafficClass)<<20 | h.FlowLabel&0x000fffff
+
+	pkt := make([]byte, IPV6_HEADER_LENGTH)
+	binary.BigEndian.PutUint32(pkt[0:4], versionClassLabel)
+	binary.BigEndian.PutUint16(pkt[4:6], h.PayloadLength)
+	pkt[6] = h.NextHeader
+	pkt[7] = h.HopLimit
+	copy(pkt[8:24], h.SrcIP[:])
+	copy(pkt[24:40], h.DstIP[:])
+
+	return pkt
+}
+
+// 扩展头部链的遍历结果
+type extensionChain struct {
+	protocol   uint8 // 链末端的上层协议
+	offset     int   // 上层数据在数据报中的起始位置
+	fragmented bool  // 是否含有分片头部
+	fragOffset uint16
+	// 指向末端协议所在的 Next Header 字段，用于回送参数问题报文
+	nextHeaderPos int
+}
+
+// 遍历扩展头部链 (RFC 8200 4)，找到上层协议及其数据的位置
+func walkExtensionHeaders(pkt []byte, nextHeader uint8) (extensionChain, error) {
+	chain := extensionChain{
+		protocol: nextHeader,
+		offset:   IPV6_HEADER_LENGTH,
+	}
+	// Next Header 字段在固定头部中的位置
+	nextHeaderPos := 6
+
+	for {
+		switch chain.protocol {
+		case IPV6_HOP_BY_HOP, IPV6_ROUTING, IPV6_DEST_OPTIONS:
+			// 通用格式：Next Header(1) + Hdr Ext Len(1，以8字节为单位，不含前8字节)
+			if len(pkt) < chain.offset+2 {
+				return chain, fmt.Errorf("truncated extension header")
+			}
+			// 逐跳选项头部只能紧跟在固定头部之后
+			if chain.protocol == IPV6_HOP_BY_HOP && chain.offset != IPV6_HEADER_LENGTH {
+				chain.nextHeaderPos = nextHeaderPos
+				return chain, fmt.Errorf("hop-by-hop options header not first")
+			}
+			length := (int(pkt[chain.offset+1]) + 1) * 8
+			if len(pkt) < chain.offset+length {
+				return chain, fmt.Errorf("truncated extension header")
+			}
+			nextHeaderPos = chain.offset
+			chain.protocol = pkt[chain.offset]
+			chain.offset += length
+		case IPV6_AH:
+			// 认证头部的长度以4字节为单位，不含前8字节
+			if len(pkt) < chain.offset+2 {
+				return chain, fmt.Errorf("truncated authentication header")
+			}
+			length := (int(pkt[chain.offset+1]) + 2) * 4
+			if len(pkt) < chain.offset+length {
+				return chain, fmt.Errorf("truncated authentication header")
+			}
+			nextHeaderPos = chain.offset
+			chain.protocol = pkt[chain.offset]
+			chain.offset += length
+		case IPV6_FRAGMENT:
+			if len(pkt) < chain.offset+IPV6_FRAGMENT_SIZE {
+				return chain, fmt.Errorf("truncated fragment header")
+			}
+			offsetAndFlags := binary.BigEndian.Uint16(pkt[chain.offset+2 : chain.offset+4])
+			chain.fragmented = true
+			chain.fragOffset = offsetAndFlags >> 3
+			nextHeaderPos = chain.offset
+			chain.protocol = pkt[chain.offset]
+			chain.offset += IPV6_FRAGMENT_SIZE
+		default:
+			// 上层协议、ESP或No Next Header，遍历结束
+			chain.nextHeaderPos = nextHeaderPos
+			return chain, nil
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package internet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sync"
+)
+
+// 地址转换的类型
+type NatType int
+
+const (
+	NAT_SNAT       NatType = iota // 将源地址改为ToAddr，在POSTROUTING生效
+	NAT_MASQUERADE                // 将源地址改为出接口的地址，在POSTROUTING生效
+	NAT_DNAT                      // 将目的地址改为ToAddr，在PREROUTING生效
+)
+
+func (t NatType) String() string {
+	switch t {
+	case NAT_SNAT:
+		return "SNAT"
+	case NAT_MASQUERADE:
+		return "MASQUERADE"
+	case NAT_DNAT:
+		return "DNAT"
+	}
+	return fmt.Sprintf("NAT(%d)", int(t))
+}
+
+const (
+	NAT_PORT_MIN = 1024 // 源端口冲突时重新选择端口的范围
+	NAT_PORT_MAX = 65535
+)
+
+// NatRule 地址转换规则，只对连接的第一个数据报匹配，之后整条连接沿用同样的转换
+type NatRule struct {
+	Type         NatType
+	Src          netip.Prefix
+	Dst          netip.Prefix
+	Protocol     uint8
+	DstPort      PortRange
+	InInterface  string // 仅DNAT可用
+	OutInterface string // 仅SNAT和MASQUERADE可用
+	ToAddr       netip.Addr
+	// SNAT和MASQUERADE为可选择的源端口范围，零值表示尽量保留原端口；
+	// DNAT时Min为新的目的端口，零值表示不修改端口
+	ToPorts PortRange
+}
+
+func (r *NatRule) validate() error {
+	switch r.Type {
+	case NAT_SNAT, NAT_DNAT:
+		if !r.ToAddr.Is4() {
+			return fmt.Errorf("%s requires an ipv4 address", r.Type)
+		}
+	case NAT_MASQUERADE:
+		if r.ToAddr.IsValid() {
+			return fmt.Errorf("masquerade uses the address of the output interface")
+		}
+	default:
+		return fmt.Errorf("invalid nat type: %d", r.Type)
+	}
+	if r.Type == NAT_DNAT && r.OutInterface != "" {
+		return fmt.Errorf("output interface match is not available for dnat")
+	}
+	if r.Type != NAT_DNAT && r.InInterface != "" {
+		return fmt.Errorf("input interface match is not available for %s", r.Type)
+	}
+	if (!r.DstPort.any() || !r.ToPorts.any()) && r.Protocol != TCP_PROTOCOL && r.Protocol != UDP_PROTOCOL {
+		return fmt.Errorf("port match requires tcp or udp protocol")
+	}
+	return nil
+}
+
+func (r *NatRule) matches(pkt IpPacket, in, out *Interface) bool {
+	rule := Rule{
+		Src:          r.Src,
+		Dst:          r.Dst,
+		Protocol:     r.Protocol,
+		DstPort:      r.DstPort,
+		InInterface:  r.InInterface,
+		OutInterface: r.OutInterface,
+	}
+	return rule.matches(pkt, in, out)
+}
+
+// Nat 地址转换规则表，只转换IPv4数据报
+type Nat struct {
+	rules []NatRule
+	lock  sync.RWMutex
+}
+
+func NewNat() *Nat {
+	return &Nat{}
+}
+
+// Nat 返回协议栈的地址转换规则表
+func (q *IpPacketQueue) Nat() *Nat {
+	return q.nat
+}
+
+// Append 在规则表末尾添加规则
+func (n *Nat) Append(rule NatRule) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.rules = append(n.rules, rule)
+	return nil
+}
+
+// Delete 删除index处的规则，已经建立的连接不受影响
+func (n *Nat) Delete(index int) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if index < 0 || index >= len(n.rules) {
+		return fmt.Errorf("rule index out of range: %d", index)
+	}
+	n.rules = append(n.rules[:index:index], n.rules[index+1:]...)
+	return nil
+}
+
+// Rules 返回规则表的快照
+func (n *Nat) Rules() []NatRule {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	rules := make([]NatRule, len(n.rules))
+	copy(rules, n.rules)
+	return rules
+}
+
+// 为新连接选择目的地址转换，修改应答方向的源地址
+func (n *Nat) bindDnat(entry *ctEntry, pkt IpPacket, in *Interface) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	for _, rule := range n.rules {
+		if rule.Type != NAT_DNAT || !rule.matches(pkt, in, nil) {
+			continue
+		}
+		entry.reply.Src = rule.ToAddr
+		if rule.ToPorts.Min != 0 {
+			entry.reply.SrcPort = rule.ToPorts.Min
+		}
+		return
+	}
+}
+
+// 为新连接选择源地址转换，修改应答方向的目的地址，端口冲突时在范围内另选端口
+func (n *Nat) bindSnat(c *Conntrack, entry *ctEntry, pkt IpPacket, out *Interface) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	for _, rule := range n.rules {
+		if rule.Type == NAT_DNAT || !rule.matches(pkt, nil, out) {
+			continue
+		}
+		addr := rule.ToAddr
+		if rule.Type == NAT_MASQUERADE {
+			prefix, ok := out.addrOf(pkt.DstAddr)
+			if !ok {
+				return
+			}
+			addr = prefix.Addr()
+		}
+
+		reply := entry.reply
+		reply.Dst = addr
+		if reply.Protocol != TCP_PROTOCOL && reply.Protocol != UDP_PROTOCOL &&
+			reply.Protocol != ICMP_PROTOCOL {
+			// 没有端口的协议只转换地址
+			entry.reply = reply
+			return
+		}
+
+		ports := rule.ToPorts
+		if ports.any() {
+			ports = PortRange{NAT_PORT_MIN, NAT_PORT_MAX}
+		}
+		port := entry.orig.SrcPort
+		if port < ports.Min || port > ports.Max {
+			port = ports.Min
+		}
+		for i := 0; i <= int(ports.Max-ports.Min); i++ {
+			reply = withReplyPort(reply, port)
+			if _, taken := c.entries[reply]; !taken {
+				entry.reply = reply
+				return
+			}
+			port++
+			if port > ports.Max || port == 0 {
+				port = ports.Min
+			}
+		}
+		// 端口耗尽时不转换，连接无法建立
+		return
+	}
+}
+
+// 修改应答方向的目的端口，ICMP回显的标识符同时出现在两个端口中
+func withReplyPort(reply Tuple, port uint16) Tuple {
+	reply.DstPort = port
+	if reply.Protocol == ICMP_PROTOCOL {
+		reply.SrcPort = port
+	}
+	return reply
+}
+
+// 按连接的地址转换改写数据报，PREROUTING中改写目的地址，POSTROUTING中改写源地址
+func (q *IpPacketQueue) translate(hook Hook, pkt *IpPacket, in, out *Interface) {
+	entry := pkt.ct
+	if entry == nil || pkt.IpHeader == nil {
+		return
+	}
+
+	q.conntrack.lock.Lock()
+	defer q.conntrack.lock.Unlock()
+
+	dstManip := hook == HOOK_PREROUTING
+	// 新连接在第一次经过时选择转换
+	if !entry.confirmed && pkt.CtState != CT_STATE_RELATED {
+		if dstManip && !entry.dnatDone {
+			entry.dnatDone = true
+			q.nat.bindDnat(entry, *pkt, in)
+		}
+		if !dstManip && !entry.snatDone {
+			entry.snatDone = true
+			q.nat.bindSnat(q.conntrack, entry, *pkt, out)
+		}
+	}
+
+	// 原方向的目的地址转换和应答方向的源地址转换对应连接的DNAT，其余对应SNAT
+	needed := entry.srcNat()
+	if dstManip == (pkt.ctDir == CT_DIR_ORIGINAL) {
+		needed = entry.dstNat()
+	}
+	if !needed {
+		return
+	}
+
+	// 转换后的数据报应当与另一个方向的Tuple互为反转
+	target := entry.reply.reverse()
+	if pkt.ctDir == CT_DIR_REPLY {
+		target = entry.orig.reverse()
+	}
+	addr, port := target.Src, target.SrcPort
+	if dstManip {
+		addr, port = target.Dst, target.DstPort
+	}
+
+	datagram := pkt.Packet.Buf[:pkt.IpHeader.TotalLength]
+	if pkt.CtState == CT_STATE_RELATED {
+		translateIcmpError(datagram, !dstManip, addr, port)
+	} else {
+		rewrite(datagram, !dstManip, addr, port)
+	}
+
+	ip := addr.As4()
+	if dstManip {
+		pkt.IpHeader.DstIP = ip
+		pkt.DstAddr = addr
+	} else {
+		pkt.IpHeader.SrcIP = ip
+		pkt.SrcAddr = addr
+	}
+	pkt.IpHeader.Checksum = binary.BigEndian.Uint16(datagram[10:12])
+}
+
+// 改写IPv4数据报的源(src为true)或目的地址和端口，增量更新IP头部和上层协议的校验和。
+// datagram可以是ICMP差错中被截断的原始数据报
+func rewrite(datagram []byte, src bool, addr netip.Addr, port uint16) {
+	hdrLen := int(datagram[0]&0x0f) * 4
+	addrOffset, portOffset := 16, 2
+	if src {
+		addrOffset, portOffset = 12, 0
+	}
+
+	oldIP := [4]byte(datagram[addrOffset : addrOffset+4])
+	newIP := addr.As4()
+	copy(datagram[addrOffset:addrOffset+4], newIP[:])
+	ipSum := binary.BigEndian.Uint16(datagram[10:12])
+	ipSum = updateChecksum(ipSum, binary.BigEndian.Uint16(oldIP[0:2]), binary.BigEndian.Uint16(newIP[0:2]))
+	ipSum = updateChecksum(ipSum, binary.BigEndian.Uint16(oldIP[2:4]), binary.BigEndian.Uint16(newIP[2:4]))
+	binary.BigEndian.PutUint16(datagram[10:12], ipSum)
+
+	// 非首个分片不含上层协议头部
+	if binary.BigEndian.Uint16(datagram[6:8])&0x1fff != 0 || len(datagram) < hdrLen {
+		return
+	}
+	payload := datagram[hdrLen:]
+
+	switch datagram[9] {
+	case TCP_PROTOCOL, UDP_PROTOCOL:
+		if len(payload) < 4 {
+			return
+		}
+		oldPort := binary.BigEndian.Uint16(payload[portOffset : portOffset+2])
+		binary.BigEndian.PutUint16(payload[portOffset:portOffset+2], port)
+
+		// 校验和包含伪首部中的地址，ICMP差错中的原始数据报可能不含TCP校验和字段
+		sumOffset := 16
+		if datagram[9] == UDP_PROTOCOL {
+			sumOffset = 6
+		}
+		if len(payload) < sumOffset+2 {
+			return
+		}
+		sum := binary.BigEndian.Uint16(payload[sumOffset : sumOffset+2])
+		// UDP校验和为0表示未计算
+		if datagram[9] == UDP_PROTOCOL && sum == 0 {
+			return
+		}
+		sum = updateChecksum(sum, binary.BigEndian.Uint16(oldIP[0:2]), binary.BigEndian.Uint16(newIP[0:2]))
+		sum = updateChecksum(sum, binary.BigEndian.Uint16(oldIP[2:4]), binary.BigEndian.Uint16(newIP[2:4]))
+		sum = updateChecksum(sum, oldPort, port)
+		if datagram[9] == UDP_PROTOCOL && sum == 0 {
+			sum = 0xffff
+		}
+		binary.BigEndian.PutUint16(payload[sumOffset:sumOffset+2], sum)
+	case ICMP_PROTOCOL:
+		// ICMP校验和不含伪首部，回显报文只需改写标识符
+		if len(payload) < ICMP_HEADER_LENGTH || !isEcho(ICMP_PROTOCOL, payload[0]) {
+			return
+		}
+		oldId := binary.BigEndian.Uint16(payload[4:6])
+		binary.BigEndian.PutUint16(payload[4:6], port)
+		sum := updateChecksum(binary.BigEndian.Uint16(payload[2:4]), oldId, port)
+		binary.BigEndian.PutUint16(payload[2:4], sum)
+	}
+}
+
+// 改写ICMP差错：外层只改地址，内层原始数据报的方向相反，改写另一侧的地址和端口
+func translateIcmpError(datagram []byte, src bool, addr netip.Addr, port uint16) {
+	hdrLen := int(datagram[0]&0x0f) * 4
+	icmp := datagram[hdrLen:]
+	inner := icmp[ICMP_HEADER_LENGTH:]
+	if len(inner) < IP_HEADER_MIN_LENGTH || len(inner) < int(inner[0]&0x0f)*4 {
+		return
+	}
+
+	rewrite(inner, !src, addr, port)
+	binary.BigEndian.PutUint16(icmp[2:4], 0)
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp))
+
+	// 外层是ICMP差错，rewrite只会修改地址和IP头部校验和
+	rewrite(datagram, src, addr, 0)
+}
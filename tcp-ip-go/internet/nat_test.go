@@ -0,0 +1,313 @@
+package internet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"net/netip"
+	"testing"
+)
+
+var testPublic = netip.MustParseAddr("203.0.113.1")
+
+// 从头计算IP头部和上层协议的校验和，与数据报中的值比较
+func checkChecksums(t *testing.T, datagram []byte) {
+	t.Helper()
+	hdrLen := int(datagram[0]&0x0f) * 4
+	if got, want := binary.BigEndian.Uint16(datagram[10:12]), recomputeAt(datagram[:hdrLen], 10, nil); got != want {
+		t.Fatalf("ip header checksum %#04x, recomputed %#04x", got, want)
+	}
+	// 非首个分片不含上层协议头部
+	if binary.BigEndian.Uint16(datagram[6:8])&0x1fff != 0 {
+		return
+	}
+	src, dst := netip.AddrFrom4([4]byte(datagram[12:16])), netip.AddrFrom4([4]byte(datagram[16:20]))
+	payload := datagram[hdrLen:]
+	switch datagram[9] {
+	case TCP_PROTOCOL:
+		if got, want := binary.BigEndian.Uint16(payload[16:18]), recomputeAt(payload, 16, pseudoHeader(src, dst, len(payload), TCP_PROTOCOL)); got != want {
+			t.Fatalf("tcp checksum %#04x, recomputed %#04x", got, want)
+		}
+	case UDP_PROTOCOL:
+		got := binary.BigEndian.Uint16(payload[6:8])
+		if got == 0 {
+			return
+		}
+		want := recomputeAt(payload, 6, pseudoHeader(src, dst, len(payload), UDP_PROTOCOL))
+		if want == 0 {
+			want = 0xffff
+		}
+		if got != want {
+			t.Fatalf("udp checksum %#04x, recomputed %#04x", got, want)
+		}
+	case ICMP_PROTOCOL:
+		if got, want := binary.BigEndian.Uint16(payload[2:4]), recomputeAt(payload, 2, nil); got != want {
+			t.Fatalf("icmp checksum %#04x, recomputed %#04x", got, want)
+		}
+	}
+}
+
+// 把offset处的校验和字段置零后重新计算
+func recomputeAt(buf []byte, offset int, pseudo []byte) uint16 {
+	data := append(pseudo, buf...)
+	offset += len(pseudo)
+	data[offset], data[offset+1] = 0, 0
+	return checksum(data)
+}
+
+func TestRewrite(t *testing.T) {
+	server := netip.MustParseAddrPort("198.51.100.7:53")
+	echo := (&IcmpMessage{Type: ICMP_TYPE_ECHO_REQUEST, Rest: 40000<<16 | 1, Data: []byte("ping")}).Marshal()
+	noChecksum := udpTestDatagram(testClient, server)
+	binary.BigEndian.PutUint16(noChecksum[IP_HEADER_MIN_LENGTH+6:], 0)
+	fragment := udpTestDatagram(testClient, server)
+	binary.BigEndian.PutUint16(fragment[6:8], 100)
+	binary.BigEndian.PutUint16(fragment[10:12], 0)
+	binary.BigEndian.PutUint16(fragment[10:12], checksum(fragment[:IP_HEADER_MIN_LENGTH]))
+
+	tests := []struct {
+		name     string
+		datagram []byte
+		src      bool
+		addr     netip.Addr
+		port     uint16
+		// 转换后应当得到的数据报，nil表示只比较校验和
+		want []byte
+	}{
+		{"tcp source", tcpDatagram(testClient, testServer, TCP_FLAG_SYN), true, testPublic, 2000,
+			tcpDatagram(netip.AddrPortFrom(testPublic, 2000), testServer, TCP_FLAG_SYN)},
+		{"tcp destination", tcpDatagram(testServer, netip.AddrPortFrom(testPublic, 2000), TCP_FLAG_ACK), false, testClient.Addr(), testClient.Port(),
+			tcpDatagram(testServer, testClient, TCP_FLAG_ACK)},
+		{"udp source", udpTestDatagram(testClient, server), true, testPublic, 2000,
+			udpTestDatagram(netip.AddrPortFrom(testPublic, 2000), server)},
+		{"udp destination", udpTestDatagram(server, netip.AddrPortFrom(testPublic, 2000)), false, testClient.Addr(), testClient.Port(),
+			udpTestDatagram(server, testClient)},
+		{"udp without checksum", noChecksum, true, testPublic, 2000, nil},
+		{"icmp echo", NewDatagram(testClient.Addr(), server.Addr(), ICMP_PROTOCOL, TOS, echo), true, testPublic, 2000,
+			NewDatagram(testPublic, server.Addr(), ICMP_PROTOCOL, TOS, (&IcmpMessage{Type: ICMP_TYPE_ECHO_REQUEST, Rest: 2000<<16 | 1, Data: []byte("ping")}).Marshal())},
+		{"non-first fragment", fragment, true, testPublic, 2000, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			datagram := append([]byte(nil), tt.datagram...)
+			rewrite(datagram, tt.src, tt.addr, tt.port)
+			checkChecksums(t, datagram)
+			if tt.want != nil && !bytes.Equal(datagram, tt.want) {
+				t.Fatalf("rewritten\n%x\nwant\n%x", datagram, tt.want)
+			}
+		})
+	}
+
+	// 没有校验和的UDP报文保持没有校验和，非首个分片只改写地址
+	datagram := append([]byte(nil), noChecksum...)
+	rewrite(datagram, true, testPublic, 2000)
+	if sum := binary.BigEndian.Uint16(datagram[IP_HEADER_MIN_LENGTH+6:]); sum != 0 {
+		t.Fatalf("udp checksum %#04x, want 0", sum)
+	}
+	datagram = append([]byte(nil), fragment...)
+	rewrite(datagram, true, testPublic, 2000)
+	if !bytes.Equal(datagram[IP_HEADER_MIN_LENGTH:], fragment[IP_HEADER_MIN_LENGTH:]) {
+		t.Fatal("payload of a non-first fragment rewritten")
+	}
+}
+
+// 随机的地址、端口和数据，增量更新的校验和都与重新计算的相同
+func TestRewriteChecksumRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randAddrPort := func() netip.AddrPort {
+		var ip [4]byte
+		rng.Read(ip[:])
+		return netip.AddrPortFrom(netip.AddrFrom4(ip), uint16(rng.Intn(65536)))
+	}
+	for i := 0; i < 2000; i++ {
+		src, dst, to := randAddrPort(), randAddrPort(), randAddrPort()
+		payload := make([]byte, rng.Intn(64))
+		rng.Read(payload)
+		var datagram []byte
+		if i%2 == 0 {
+			datagram = NewDatagram(src.Addr(), dst.Addr(), TCP_PROTOCOL, TOS, tcpSegment(src, dst, TCP_FLAG_ACK, payload))
+		} else {
+			datagram = NewDatagram(src.Addr(), dst.Addr(), UDP_PROTOCOL, TOS, marshalUdp(src.Addr(), dst.Addr(), src.Port(), dst.Port(), payload))
+		}
+		rewrite(datagram, i%4 < 2, to.Addr(), to.Port())
+		checkChecksums(t, datagram)
+	}
+}
+
+func TestBindSnat(t *testing.T) {
+	q := NewIpPacketQueue()
+	defer q.Close()
+	out := q.AddInterface(newFakeLink(DEFAULT_MTU), netip.MustParsePrefix("203.0.113.2/24"))
+
+	server := netip.MustParseAddrPort("198.51.100.7:53")
+	tests := []struct {
+		name     string
+		rule     NatRule
+		datagram []byte
+		taken    []uint16 // 已被其他连接占用的端口
+		wantAddr netip.Addr
+		wantPort uint16
+	}{
+		{"keep port in range", NatRule{Type: NAT_SNAT, Protocol: UDP_PROTOCOL, ToAddr: testPublic, ToPorts: PortRange{39999, 40001}},
+			udpTestDatagram(testClient, server), nil, testPublic, 40000},
+		{"next free port", NatRule{Type: NAT_SNAT, Protocol: UDP_PROTOCOL, ToAddr: testPublic, ToPorts: PortRange{39999, 40001}},
+			udpTestDatagram(testClient, server), []uint16{40000}, testPublic, 40001},
+		{"wrap around", NatRule{Type: NAT_SNAT, Protocol: UDP_PROTOCOL, ToAddr: testPublic, ToPorts: PortRange{39999, 40001}},
+			udpTestDatagram(testClient, server), []uint16{40000, 40001}, testPublic, 39999},
+		{"ports exhausted", NatRule{Type: NAT_SNAT, Protocol: UDP_PROTOCOL, ToAddr: testPublic, ToPorts: PortRange{39999, 40001}},
+			udpTestDatagram(testClient, server), []uint16{39999, 40000, 40001}, testClient.Addr(), testClient.Port()},
+		{"port out of range", NatRule{Type: NAT_SNAT, Protocol: UDP_PROTOCOL, ToAddr: testPublic, ToPorts: PortRange{2000, 2001}},
+			udpTestDatagram(testClient, server), nil, testPublic, 2000},
+		{"default range keeps port", NatRule{Type: NAT_SNAT, ToAddr: testPublic},
+			udpTestDatagram(testClient, server), nil, testPublic, 40000},
+		{"default range conflict", NatRule{Type: NAT_SNAT, ToAddr: testPublic},
+			udpTestDatagram(testClient, server), []uint16{40000}, testPublic, 40001},
+		{"default range top wraps", NatRule{Type: NAT_SNAT, ToAddr: testPublic},
+			udpTestDatagram(netip.AddrPortFrom(testClient.Addr(), NAT_PORT_MAX), server), []uint16{NAT_PORT_MAX}, testPublic, NAT_PORT_MIN},
+		{"masquerade", NatRule{Type: NAT_MASQUERADE, OutInterface: out.Name},
+			tcpDatagram(testClient, testServer, TCP_FLAG_SYN), nil, netip.MustParseAddr("203.0.113.2"), 40000},
+		{"other output interface", NatRule{Type: NAT_MASQUERADE, OutInterface: "eth9"},
+			tcpDatagram(testClient, testServer, TCP_FLAG_SYN), nil, testClient.Addr(), testClient.Port()},
+		{"dnat rule ignored", NatRule{Type: NAT_DNAT, ToAddr: testPublic},
+			tcpDatagram(testClient, testServer, TCP_FLAG_SYN), nil, testClient.Addr(), testClient.Port()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := NewNat()
+			if err := n.Append(tt.rule); err != nil {
+				t.Fatal(err)
+			}
+			c := NewConntrack()
+			pkt := testPacket(t, tt.datagram)
+			c.track(pkt)
+			for _, port := range tt.taken {
+				reply := pkt.ct.reply
+				reply.Dst, reply.DstPort = testPublic, port
+				c.entries[reply] = &ctEntry{}
+			}
+
+			n.bindSnat(c, pkt.ct, *pkt, out)
+			reply := pkt.ct.reply
+			if reply.Dst != tt.wantAddr || reply.DstPort != tt.wantPort {
+				t.Fatalf("reply destination %s:%d, want %s:%d", reply.Dst, reply.DstPort, tt.wantAddr, tt.wantPort)
+			}
+			if reply.Src != pkt.ct.orig.Dst || reply.SrcPort != pkt.ct.orig.DstPort {
+				t.Fatalf("reply source changed to %s:%d", reply.Src, reply.SrcPort)
+			}
+		})
+	}
+}
+
+// ICMP回显的标识符同时作为两个方向的端口，协议没有端口时只转换地址
+func TestBindSnatPortless(t *testing.T) {
+	n := NewNat()
+	if err := n.Append(NatRule{Type: NAT_SNAT, ToAddr: testPublic}); err != nil {
+		t.Fatal(err)
+	}
+	c := NewConntrack()
+
+	echo := (&IcmpMessage{Type: ICMP_TYPE_ECHO_REQUEST, Rest: 40000 << 16}).Marshal()
+	pkt := testPacket(t, NewDatagram(testClient.Addr(), testServer.Addr(), ICMP_PROTOCOL, TOS, echo))
+	c.track(pkt)
+	// 另一条连接占用了同样的标识符
+	taken := pkt.ct.reply
+	taken.Dst = testPublic
+	c.entries[taken] = &ctEntry{}
+	n.bindSnat(c, pkt.ct, *pkt, nil)
+	if reply := pkt.ct.reply; reply.Dst != testPublic || reply.SrcPort != 40001 || reply.DstPort != 40001 {
+		t.Fatalf("echo reply tuple %s", reply)
+	}
+
+	gre := testPacket(t, NewDatagram(testClient.Addr(), testServer.Addr(), GRE_PROTOCOL, TOS, make([]byte, 8)))
+	c.track(gre)
+	n.bindSnat(c, gre.ct, *gre, nil)
+	if reply := gre.ct.reply; reply.Dst != testPublic || reply.DstPort != 0 || reply.SrcPort != 0 {
+		t.Fatalf("gre reply tuple %s", reply)
+	}
+}
+
+func TestTranslateIcmpError(t *testing.T) {
+	dnsServer := netip.MustParseAddrPort("198.51.100.7:53")
+	webServer := netip.MustParseAddrPort("192.168.1.20:8080")
+	public := netip.AddrPortFrom(testPublic, 2000)
+	publicWeb := netip.AddrPortFrom(testPublic, 80)
+
+	tests := []struct {
+		name string
+		// 转换前后的ICMP差错，携带的原始数据报也随之转换
+		before, after []byte
+		src           bool
+		addr          netip.Addr
+		port          uint16
+	}{
+		// SNAT：对已转换的数据报的差错返回时，外层目的地址和内层源地址改回内网客户端
+		{"snat full datagram",
+			icmpErrorDatagram(dnsServer.Addr(), udpTestDatagram(public, dnsServer), IP_HEADER_MIN_LENGTH+12),
+			icmpErrorDatagram(dnsServer.Addr(), udpTestDatagram(testClient, dnsServer), IP_HEADER_MIN_LENGTH+12),
+			false, testClient.Addr(), testClient.Port()},
+		{"snat truncated tcp",
+			icmpErrorDatagram(testServer.Addr(), tcpDatagram(public, testServer, TCP_FLAG_SYN), IP_HEADER_MIN_LENGTH+8),
+			icmpErrorDatagram(testServer.Addr(), tcpDatagram(testClient, testServer, TCP_FLAG_SYN), IP_HEADER_MIN_LENGTH+8),
+			false, testClient.Addr(), testClient.Port()},
+		// DNAT：内网服务器发出的差错离开时，外层源地址和内层目的地址改为公网地址
+		{"dnat",
+			icmpErrorDatagram(webServer.Addr(), tcpDatagram(testServer, webServer, TCP_FLAG_SYN), IP_HEADER_MIN_LENGTH+20),
+			icmpErrorDatagram(testPublic, tcpDatagram(testServer, publicWeb, TCP_FLAG_SYN), IP_HEADER_MIN_LENGTH+20),
+			true, testPublic, 80},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			datagram := append([]byte(nil), tt.before...)
+			translateIcmpError(datagram, tt.src, tt.addr, tt.port)
+			checkChecksums(t, datagram)
+			inner := datagram[IP_HEADER_MIN_LENGTH+ICMP_HEADER_LENGTH:]
+			if got, want := binary.BigEndian.Uint16(inner[10:12]), recomputeAt(inner[:IP_HEADER_MIN_LENGTH], 10, nil); got != want {
+				t.Fatalf("inner ip header checksum %#04x, recomputed %#04x", got, want)
+			}
+			if !bytes.Equal(datagram, tt.after) {
+				t.Fatalf("translated\n%x\nwant\n%x", datagram, tt.after)
+			}
+		})
+	}
+}
+
+// 经过SNAT的连接：原方向在POSTROUTING改写源地址，应答和ICMP差错在PREROUTING改回
+func TestTranslateSnatConnection(t *testing.T) {
+	q := NewIpPacketQueue()
+	defer q.Close()
+	out := q.AddInterface(newFakeLink(DEFAULT_MTU), netip.PrefixFrom(testPublic, 24))
+	if err := q.Nat().Append(NatRule{Type: NAT_MASQUERADE, OutInterface: out.Name}); err != nil {
+		t.Fatal(err)
+	}
+	// 另一条连接已经占用了公网地址上的客户端端口
+	busy := testPacket(t, tcpDatagram(netip.AddrPortFrom(testPublic, testClient.Port()), testServer, TCP_FLAG_SYN))
+	q.conntrack.track(busy)
+	q.conntrack.confirm(*busy)
+
+	syn := testPacket(t, tcpDatagram(testClient, testServer, TCP_FLAG_SYN))
+	q.conntrack.track(syn)
+	q.translate(HOOK_POSTROUTING, syn, nil, out)
+	q.conntrack.confirm(*syn)
+	mapped := netip.AddrPortFrom(testPublic, testClient.Port()+1)
+	want := tcpDatagram(mapped, testServer, TCP_FLAG_SYN)
+	if !bytes.Equal(syn.Packet.Buf, want) || syn.SrcAddr != testPublic || syn.IpHeader.SrcIP != testPublic.As4() {
+		t.Fatalf("translated syn\n%x\nwant\n%x", syn.Packet.Buf, want)
+	}
+
+	synAck := testPacket(t, tcpDatagram(testServer, mapped, TCP_FLAG_SYN|TCP_FLAG_ACK))
+	q.conntrack.track(synAck)
+	q.translate(HOOK_PREROUTING, synAck, out, nil)
+	if want := tcpDatagram(testServer, testClient, TCP_FLAG_SYN|TCP_FLAG_ACK); !bytes.Equal(synAck.Packet.Buf, want) || synAck.DstAddr != testClient.Addr() {
+		t.Fatalf("translated syn-ack\n%x\nwant\n%x", synAck.Packet.Buf, want)
+	}
+
+	icmp := testPacket(t, icmpErrorDatagram(testServer.Addr(), tcpDatagram(mapped, testServer, TCP_FLAG_SYN), IP_HEADER_MIN_LENGTH+8))
+	q.conntrack.track(icmp)
+	if icmp.CtState != CT_STATE_RELATED {
+		t.Fatalf("icmp error state %s", icmp.CtState)
+	}
+	q.translate(HOOK_PREROUTING, icmp, out, nil)
+	if want := icmpErrorDatagram(testServer.Addr(), tcpDatagram(testClient, testServer, TCP_FLAG_SYN), IP_HEADER_MIN_LENGTH+8); !bytes.Equal(icmp.Packet.Buf, want) {
+		t.Fatalf("translated icmp error\n%x\nwant\n%x", icmp.Packet.Buf, want)
+	}
+}
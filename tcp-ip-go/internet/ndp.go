@@ -0,0 +1,446 @@
+package internet
+
+import (
+	"encoding/binary"
+	"log"
+	"net/netip"
+	"sync"
+	"tcp/network"
+	"time"
+)
+
+const (
+	NDP_HOP_LIMIT = 255 // 邻居发现报文的跳数限制，收到的报文不是255说明来自其他链路
+
+	NDP_OPTION_SOURCE_LINK_ADDR = 1
+	NDP_OPTION_TARGET_LINK_ADDR = 2
+	NDP_OPTION_PREFIX_INFO      = 3
+	NDP_OPTION_MTU              = 5
+
+	NA_FLAG_ROUTER    = 1 << 31
+	NA_FLAG_SOLICITED = 1 << 30
+	NA_FLAG_OVERRIDE  = 1 << 29
+
+	PREFIX_FLAG_ON_LINK    = 0x80 // L: 前缀在链路上
+	PREFIX_FLAG_AUTONOMOUS = 0x40 // A: 可用于无状态地址自动配置
+
+	MAX_RTR_SOLICITATIONS     = 3               // 路由器请求的最大发送次数 (RFC 4861 10)
+	RTR_SOLICITATION_INTERVAL = 4 * time.Second // 路由器请求的发送间隔
+	RETRANS_TIMER             = time.Second     // 邻居请求的重传间隔
+	DUP_ADDR_DETECT_TRANSMITS = 1               // 重复地址检测发送邻居请求的次数 (RFC 4862 5.1)
+	INFINITE_LIFETIME         = 0xffffffff
+)
+
+var (
+	allNodesAddr   = netip.MustParseAddr("ff02::1")
+	allRoutersAddr = netip.MustParseAddr("ff02::2")
+	linkLocalNet   = netip.MustParsePrefix("fe80::/64")
+)
+
+// 接口上邻居发现和无状态地址自动配置的状态
+type ndpState struct {
+	advertised   bool                         // 是否已收到路由器通告
+	addrTimers   map[netip.Addr]*time.Timer   // 自动配置地址的有效期
+	routerTimers map[netip.Addr]*time.Timer   // 默认路由器的有效期
+	prefixTimers map[netip.Prefix]*time.Timer // 链路上前缀的有效期
+	lock         sync.Mutex
+}
+
+func newNdpState() *ndpState {
+	return &ndpState{
+		addrTimers:   make(map[netip.Addr]*time.Timer),
+		routerTimers: make(map[netip.Addr]*time.Timer),
+		prefixTimers: make(map[netip.Prefix]*time.Timer),
+	}
+}
+
+// 由MAC地址生成修改后的EUI-64接口标识 (RFC 4291 附录A)
+func eui64(hwAddr network.HardwareAddr) [8]byte {
+	return [8]byte{hwAddr[0] ^ 0x02, hwAddr[1], hwAddr[2], 0xff, 0xfe, hwAddr[3], hwAddr[4], hwAddr[5]}
+}
+
+// 由/64前缀和MAC地址生成接口地址
+func slaacAddr(prefix netip.Prefix, hwAddr network.HardwareAddr) netip.Addr {
+	ip := prefix.Masked().Addr().As16()
+	id := eui64(hwAddr)
+	copy(ip[8:], id[:])
+	return netip.AddrFrom16(ip)
+}
+
+// 被请求节点组播地址 ff02::1:ffXX:XXXX (RFC 4291 2.7.1)
+func solicitedNodeAddr(addr netip.Addr) netip.Addr {
+	ip := addr.As16()
+	return netip.AddrFrom16([16]byte{0xff, 0x02, 10: 0, 11: 0x01, 12: 0xff, 13: ip[13], 14: ip[14], 15: ip[15]})
+}
+
+// 邻居发现报文的选项，每个选项的长度以8字节为单位
+type ndpOption struct {
+	Type uint8
+	Data []byte // 不含类型和长度字段
+}
+
+func unmarshalNdpOptions(buf []byte) []ndpOption {
+	var options []ndpOption
+	for len(buf) >= 2 {
+		length := int(buf[1]) * 8
+		// 长度为0的选项是非法的，必须丢弃整个报文 (RFC 4861 4.6)
+		if length == 0 || length > len(buf) {
+			return nil
+		}
+		options = append(options, ndpOption{Type: buf[0], Data: buf[2:length]})
+		buf = buf[length:]
+	}
+	return options
+}
+
+func linkAddrOption(typ uint8, hwAddr network.HardwareAddr) []byte {
+	return append([]byte{typ, 1}, hwAddr[:]...)
+}
+
+// 在以太网接口上启用IPv6：配置链路本地地址，重复地址检测通过后请求路由器通告
+func (q *IpPacketQueue) startNdp(iface *Interface) {
+	linkLocal := netip.PrefixFrom(slaacAddr(linkLocalNet, iface.Link.HardwareAddr()), 64)
+	iface.lock.Lock()
+	// 链路本地地址放在最前面，作为邻居发现报文的源地址
+	iface.Addrs = append([]InterfaceAddr{{Prefix: linkLocal, Tentative: true}}, iface.Addrs...)
+	iface.lock.Unlock()
+	q.routes.Add(Route{
+		Prefix:    linkLocalNet,
+		Interface: iface,
+	})
+
+	go func() {
+		if !q.detectDuplicate(iface, linkLocal.Addr()) {
+			return
+		}
+		for i := 0; i < MAX_RTR_SOLICITATIONS; i++ {
+			iface.ndp.lock.Lock()
+			advertised := iface.ndp.advertised
+			iface.ndp.lock.Unlock()
+			if advertised || q.ctx.Err() != nil {
+				return
+			}
+			q.sendRouterSolicitation(iface, linkLocal.Addr())
+
+			select {
+			case <-q.ctx.Done():
+				return
+			case <-time.After(RTR_SOLICITATION_INTERVAL):
+			}
+		}
+	}()
+}
+
+// 返回接口已通过重复地址检测的链路本地地址
+func (iface *Interface) linkLocalAddr() (netip.Addr, bool) {
+	for _, a := range iface.AddressTable() {
+		if a.Prefix.Addr().Is6() && a.Prefix.Addr().IsLinkLocalUnicast() && !a.Tentative {
+			return a.Prefix.Addr(), true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// 重复地址检测：以未指定地址为源向被请求节点组播地址发送邻居请求，
+// 等待期间没有收到冲突的通告或请求时地址成为可用地址，返回地址是否可用 (RFC 4862 5.4)
+func (q *IpPacketQueue) detectDuplicate(iface *Interface, addr netip.Addr) bool {
+	for i := 0; i < DUP_ADDR_DETECT_TRANSMITS; i++ {
+		if !iface.isTentative(addr) {
+			return false
+		}
+		q.sendDadSolicitation(iface, addr)
+
+		select {
+		case <-q.ctx.Done():
+			return false
+		case <-time.After(RETRANS_TIMER):
+		}
+	}
+	if !iface.isTentative(addr) || !iface.setPreferred(addr) {
+		return false
+	}
+	log.Printf("address %s on %s passed duplicate address detection", addr, iface.Name)
+	return true
+}
+
+// 重复地址检测的邻居请求，源地址未指定，不能携带源链路层地址选项 (RFC 4861 7.2.2)
+func (q *IpPacketQueue) sendDadSolicitation(iface *Interface, target netip.Addr) {
+	ip := target.As16()
+	msg := &IcmpMessage{
+		Type: ICMPV6_TYPE_NEIGHBOR_SOLICITATION,
+		Data: ip[:],
+	}
+	q.writeIcmpv6(iface, netip.IPv6Unspecified(), solicitedNodeAddr(target), NDP_HOP_LIMIT, msg)
+}
+
+// 检测到地址重复时删除该地址，不再使用 (RFC 4862 5.4.5)
+func (q *IpPacketQueue) duplicateAddress(iface *Interface, addr netip.Addr) {
+	if iface.removeAddress(addr) {
+		log.Printf("duplicate address %s detected on %s", addr, iface.Name)
+	}
+}
+
+func (q *IpPacketQueue) sendRouterSolicitation(iface *Interface, src netip.Addr) {
+	msg := &IcmpMessage{
+		Type: ICMPV6_TYPE_ROUTER_SOLICITATION,
+		Data: linkAddrOption(NDP_OPTION_SOURCE_LINK_ADDR, iface.Link.HardwareAddr()),
+	}
+	q.writeIcmpv6(iface, src, allRoutersAddr, NDP_HOP_LIMIT, msg)
+}
+
+// 向被请求节点组播地址发送邻居请求，解析target的MAC地址
+func (q *IpPacketQueue) sendNeighborSolicitation(iface *Interface, target netip.Addr) {
+	src, ok := iface.linkLocalAddr()
+	if !ok {
+		log.Printf("no link-local address on %s for neighbor solicitation", iface.Name)
+		return
+	}
+
+	ip := target.As16()
+	data := append(ip[:], linkAddrOption(NDP_OPTION_SOURCE_LINK_ADDR, iface.Link.HardwareAddr())...)
+	msg := &IcmpMessage{
+		Type: ICMPV6_TYPE_NEIGHBOR_SOLICITATION,
+		Data: data,
+	}
+	q.writeIcmpv6(iface, src, solicitedNodeAddr(target), NDP_HOP_LIMIT, msg)
+}
+
+// 邻居发现报文必须来自同一链路 (RFC 4861 6.1, 7.1)
+func validNdp(pkt IpPacket, msg *IcmpMessage, minLength int) bool {
+	return pkt.Interface.isEthernet() && pkt.Ipv6Header.HopLimit == NDP_HOP_LIMIT &&
+		msg.Code == 0 && len(msg.Data) >= minLength
+}
+
+// 处理邻居请求，请求的是本机地址时回复邻居通告
+func (q *IpPacketQueue) recvNeighborSolicitation(pkt IpPacket, msg *IcmpMessage) {
+	if !validNdp(pkt, msg, 16) {
+		return
+	}
+	iface := pkt.Interface
+	target := netip.AddrFrom16([16]byte(msg.Data[0:16]))
+	if target.IsMulticast() {
+		return
+	}
+
+	// 记录请求者的MAC地址
+	for _, opt := range unmarshalNdpOptions(msg.Data[16:]) {
+		if opt.Type == NDP_OPTION_SOURCE_LINK_ADDR && len(opt.Data) >= 6 && !pkt.SrcAddr.IsUnspecified() {
+			q.learnNeighbor(iface, pkt.SrcAddr, network.HardwareAddr(opt.Data[0:6]), true)
+		}
+	}
+
+	if iface.isTentative(target) {
+		// 其他节点也在对该地址进行重复地址检测；来自其他源地址的请求静默丢弃 (RFC 4862 5.4.3)
+		if pkt.SrcAddr.IsUnspecified() {
+			q.duplicateAddress(iface, target)
+		}
+		return
+	}
+	if !iface.hasAddress(target) {
+		return
+	}
+	// 源地址未指定说明是重复地址检测，通告发往所有节点
+	dst := pkt.SrcAddr
+	flags := uint32(NA_FLAG_SOLICITED | NA_FLAG_OVERRIDE)
+	if dst.IsUnspecified() {
+		dst = allNodesAddr
+		flags = NA_FLAG_OVERRIDE
+	}
+	ip := target.As16()
+	reply := &IcmpMessage{
+		Type: ICMPV6_TYPE_NEIGHBOR_ADVERTISEMENT,
+		Rest: flags,
+		Data: append(ip[:], linkAddrOption(NDP_OPTION_TARGET_LINK_ADDR, iface.Link.HardwareAddr())...),
+	}
+	q.writeIcmpv6(iface, target, dst, NDP_HOP_LIMIT, reply)
+}
+
+// 处理邻居通告，更新正在解析的邻居
+func (q *IpPacketQueue) recvNeighborAdvertisement(pkt IpPacket, msg *IcmpMessage) {
+	if !validNdp(pkt, msg, 16) {
+		return
+	}
+	target := netip.AddrFrom16([16]byte(msg.Data[0:16]))
+	if target.IsMulticast() {
+		return
+	}
+	// 其他节点已在使用正在检测的地址 (RFC 4862 5.4.4)
+	if pkt.Interface.isTentative(target) {
+		q.duplicateAddress(pkt.Interface, target)
+		return
+	}
+	for _, opt := range unmarshalNdpOptions(msg.Data[16:]) {
+		if opt.Type == NDP_OPTION_TARGET_LINK_ADDR && len(opt.Data) >= 6 {
+			// 没有对应条目时丢弃 (RFC 4861 7.2.5)
+			q.learnNeighbor(pkt.Interface, target, network.HardwareAddr(opt.Data[0:6]), false)
+		}
+	}
+}
+
+// 处理路由器通告：更新默认路由、链路MTU，并根据前缀信息自动配置地址 (RFC 4861 6.3.4, RFC 4862 5.5.3)
+func (q *IpPacketQueue) recvRouterAdvertisement(pkt IpPacket, msg *IcmpMessage) {
+	// 路由器通告的源地址必须是链路本地地址
+	if !validNdp(pkt, msg, 8) || !pkt.SrcAddr.IsLinkLocalUnicast() {
+		return
+	}
+	iface := pkt.Interface
+	router := pkt.SrcAddr
+	routerLifetime := time.Duration(msg.Rest&0xffff) * time.Second
+
+	iface.ndp.lock.Lock()
+	iface.ndp.advertised = true
+	iface.ndp.lock.Unlock()
+
+	q.updateDefaultRouter(iface, router, routerLifetime)
+
+	for _, opt := range unmarshalNdpOptions(msg.Data[8:]) {
+		switch opt.Type {
+		case NDP_OPTION_SOURCE_LINK_ADDR:
+			if len(opt.Data) >= 6 {
+				q.learnNeighbor(iface, router, network.HardwareAddr(opt.Data[0:6]), true)
+			}
+		case NDP_OPTION_MTU:
+			if len(opt.Data) < 6 {
+				continue
+			}
+			mtu := int(binary.BigEndian.Uint32(opt.Data[2:6]))
+			// 通告的MTU不能小于IPv6最小MTU，也不能超过链路MTU，只用于IPv6
+			if mtu >= IPV6_MIN_MTU && mtu <= iface.Link.MTU() {
+				iface.setMtu6(mtu)
+			}
+		case NDP_OPTION_PREFIX_INFO:
+			q.recvPrefixInfo(iface, opt.Data)
+		}
+	}
+}
+
+// 添加、刷新或删除经由router的默认路由
+func (q *IpPacketQueue) updateDefaultRouter(iface *Interface, router netip.Addr, lifetime time.Duration) {
+	defaultNet := netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+
+	iface.ndp.lock.Lock()
+	defer iface.ndp.lock.Unlock()
+
+	if timer, ok := iface.ndp.routerTimers[router]; ok {
+		timer.Stop()
+		delete(iface.ndp.routerTimers, router)
+		if lifetime == 0 {
+			q.routes.Delete(defaultNet, router)
+			log.Printf("default router %s on %s expired", router, iface.Name)
+			return
+		}
+	} else if lifetime > 0 {
+		q.routes.Add(Route{
+			Prefix:    defaultNet,
+			Gateway:   router,
+			Interface: iface,
+		})
+		log.Printf("add default router %s on %s", router, iface.Name)
+	}
+	if lifetime == 0 {
+		return
+	}
+
+	iface.ndp.routerTimers[router] = time.AfterFunc(lifetime, func() {
+		q.updateDefaultRouter(iface, router, 0)
+	})
+}
+
+// 处理前缀信息选项
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |     Type      |    Length     | Prefix Length |L|A| Reserved1 |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                         Valid Lifetime                        |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                       Preferred Lifetime                      |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                           Reserved2                           |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                            Prefix (128)                       |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+func (q *IpPacketQueue) recvPrefixInfo(iface *Interface, data []byte) {
+	if len(data) < 30 {
+		return
+	}
+	prefixLen := int(data[0])
+	flags := data[1]
+	validLifetime := binary.BigEndian.Uint32(data[2:6])
+	preferredLifetime := binary.BigEndian.Uint32(data[6:10])
+	prefix, err := netip.AddrFrom16([16]byte(data[14:30])).Prefix(prefixLen)
+	if err != nil || prefix.Addr().IsLinkLocalUnicast() || preferredLifetime > validLifetime {
+		return
+	}
+
+	if flags&PREFIX_FLAG_ON_LINK != 0 {
+		q.updateOnLinkPrefix(iface, prefix, validLifetime)
+	}
+	// 只有/64前缀可以与EUI-64接口标识组成地址
+	if flags&PREFIX_FLAG_AUTONOMOUS != 0 && prefixLen == 64 {
+		addr := netip.PrefixFrom(slaacAddr(prefix, iface.Link.HardwareAddr()), prefixLen)
+		q.updateSlaacAddr(iface, addr, validLifetime)
+		// 首选有效期为0的地址已废弃，不再作为新连接的源地址 (RFC 4862 5.5.4)
+		iface.setDeprecated(addr.Addr(), preferredLifetime == 0)
+	}
+}
+
+// 添加、刷新或删除链路上前缀的直连路由
+func (q *IpPacketQueue) updateOnLinkPrefix(iface *Interface, prefix netip.Prefix, lifetime uint32) {
+	iface.ndp.lock.Lock()
+	defer iface.ndp.lock.Unlock()
+
+	timer, ok := iface.ndp.prefixTimers[prefix]
+	if ok {
+		timer.Stop()
+		delete(iface.ndp.prefixTimers, prefix)
+	}
+	if lifetime == 0 {
+		if ok {
+			q.routes.Delete(prefix, netip.Addr{})
+		}
+		return
+	}
+	if !ok {
+		q.routes.Add(Route{
+			Prefix:    prefix,
+			Interface: iface,
+		})
+	}
+	iface.ndp.prefixTimers[prefix] = lifetimeTimer(lifetime, func() {
+		q.updateOnLinkPrefix(iface, prefix, 0)
+	})
+}
+
+// 添加、刷新或删除自动配置的地址
+func (q *IpPacketQueue) updateSlaacAddr(iface *Interface, addr netip.Prefix, lifetime uint32) {
+	iface.ndp.lock.Lock()
+	defer iface.ndp.lock.Unlock()
+
+	timer, ok := iface.ndp.addrTimers[addr.Addr()]
+	if ok {
+		timer.Stop()
+		delete(iface.ndp.addrTimers, addr.Addr())
+	}
+	if lifetime == 0 {
+		if ok && iface.removeAddress(addr.Addr()) {
+			log.Printf("slaac address %s on %s expired", addr, iface.Name)
+		}
+		return
+	}
+	// 新地址在重复地址检测通过前是暂定地址
+	if !ok && iface.addAddress(addr, true) {
+		log.Printf("add slaac address %s on %s", addr, iface.Name)
+		go q.detectDuplicate(iface, addr.Addr())
+	}
+	iface.ndp.addrTimers[addr.Addr()] = lifetimeTimer(lifetime, func() {
+		q.updateSlaacAddr(iface, addr, 0)
+	})
+}
+
+// 有效期结束时调用f，无限有效期的计时器不会触发
+func lifetimeTimer(lifetime uint32, f func()) *time.Timer {
+	timer := time.AfterFunc(time.Duration(lifetime)*time.Second, f)
+	if lifetime == INFINITE_LIFETIME {
+		timer.Stop()
+	}
+	return timer
+}
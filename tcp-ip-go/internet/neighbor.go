@@ -0,0 +1,251 @@
+package internet
+
+import (
+	"log"
+	"net/netip"
+	"sync"
+	"tcp/network"
+	"time"
+)
+
+const (
+	NEIGHBOR_TIMEOUT       = 60 * time.Second // 邻居缓存的有效期，过期后重新解析
+	NEIGHBOR_RETRANS_TIMER = time.Second      // 请求的重传间隔 (RFC 4861 10)
+	NEIGHBOR_MAX_RETRIES   = 3                // 请求的最大发送次数
+	NEIGHBOR_QUEUE_SIZE    = 3                // 每个邻居等待解析的最大数据报数
+)
+
+// 一个邻居的链路层地址
+type neighbor struct {
+	hwAddr   network.HardwareAddr
+	resolved bool
+	expires  time.Time
+	pending  [][]byte // 等待地址解析的数据报
+	retries  int
+}
+
+// 以太网链路上IP地址到MAC地址的映射，IPv4由ARP填充，IPv6由邻居发现填充
+type neighborCache struct {
+	entries map[netip.Addr]*neighbor
+	lock    sync.Mutex
+}
+
+func newNeighborCache() *neighborCache {
+	return &neighborCache{
+		entries: make(map[netip.Addr]*neighbor),
+	}
+}
+
+// Neighbors 返回接口上已解析的邻居
+func (iface *Interface) Neighbors() map[netip.Addr]network.HardwareAddr {
+	neighbors := make(map[netip.Addr]network.HardwareAddr)
+	if iface.neighbors == nil {
+		return neighbors
+	}
+
+	iface.neighbors.lock.Lock()
+	defer iface.neighbors.lock.Unlock()
+
+	for addr, entry := range iface.neighbors.entries {
+		if entry.resolved && time.Now().Before(entry.expires) {
+			neighbors[addr] = entry.hwAddr
+		}
+	}
+	return neighbors
+}
+
+// 更新邻居的MAC地址，create为false时只更新已存在的条目 (RFC 826 的合并规则)，返回等待发送的数据报
+func (c *neighborCache) update(addr netip.Addr, hwAddr network.HardwareAddr, create bool) [][]byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[addr]
+	if !ok {
+		if !create {
+			return nil
+		}
+		entry = &neighbor{}
+		c.entries[addr] = entry
+	}
+	entry.hwAddr = hwAddr
+	entry.resolved = true
+	entry.expires = time.Now().Add(NEIGHBOR_TIMEOUT)
+	entry.retries = 0
+
+	pending := entry.pending
+	entry.pending = nil
+	return pending
+}
+
+// 查找邻居的MAC地址，未解析时将数据报加入等待队列，返回是否需要发送请求
+func (c *neighborCache) lookup(addr netip.Addr, datagram []byte) (network.HardwareAddr, bool, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[addr]
+	if ok && entry.resolved && time.Now().Before(entry.expires) {
+		return entry.hwAddr, true, false
+	}
+
+	if !ok || entry.resolved {
+		// 新的或已过期的条目重新开始解析
+		entry = &neighbor{}
+		c.entries[addr] = entry
+		entry.pending = append(entry.pending, datagram)
+		return network.HardwareAddr{}, false, true
+	}
+
+	// 正在解析中，超出队列长度时丢弃最早的数据报
+	entry.pending = append(entry.pending, datagram)
+	if len(entry.pending) > NEIGHBOR_QUEUE_SIZE {
+		entry.pending = entry.pending[1:]
+	}
+	return network.HardwareAddr{}, false, false
+}
+
+// 解析超时后判断是否还需要重发请求，超过最大次数时删除条目并丢弃等待的数据报
+func (c *neighborCache) retry(addr netip.Addr) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[addr]
+	if !ok || entry.resolved {
+		return false
+	}
+	entry.retries++
+	if entry.retries >= NEIGHBOR_MAX_RETRIES {
+		delete(c.entries, addr)
+		return false
+	}
+	return true
+}
+
+// 通过以太网链路发送数据报，目的MAC地址由下一跳地址解析得到
+func (q *IpPacketQueue) outputEthernet(iface *Interface, nextHop netip.Addr, datagram []byte) error {
+	etherType := uint16(network.ETHER_TYPE_IPV4)
+	if nextHop.Is6() {
+		etherType = network.ETHER_TYPE_IPV6
+	}
+
+	// 广播和组播地址直接映射为MAC地址，不需要解析
+	if hwAddr, ok := q.multicastHardwareAddr(iface, nextHop); ok {
+		return q.outputFrame(iface, hwAddr, etherType, datagram)
+	}
+
+	hwAddr, ok, solicit := iface.neighbors.lookup(nextHop, datagram)
+	if ok {
+		return q.outputFrame(iface, hwAddr, etherType, datagram)
+	}
+	if solicit {
+		q.solicit(iface, nextHop)
+	}
+	return nil
+}
+
+// 发送地址解析请求，并在超时后重传
+func (q *IpPacketQueue) solicit(iface *Interface, target netip.Addr) {
+	if target.Is4() {
+		q.sendArpRequest(iface, target)
+	} else {
+		q.sendNeighborSolicitation(iface, target)
+	}
+
+	time.AfterFunc(NEIGHBOR_RETRANS_TIMER, func() {
+		if q.ctx.Err() == nil && iface.neighbors.retry(target) {
+			q.solicit(iface, target)
+		}
+	})
+}
+
+// 地址解析完成后发送等待中的数据报
+func (q *IpPacketQueue) learnNeighbor(iface *Interface, addr netip.Addr, hwAddr network.HardwareAddr, create bool) {
+	etherType := uint16(network.ETHER_TYPE_IPV4)
+	if addr.Is6() {
+		etherType = network.ETHER_TYPE_IPV6
+	}
+	for _, datagram := range iface.neighbors.update(addr, hwAddr, create) {
+		q.outputFrame(iface, hwAddr, etherType, datagram)
+	}
+}
+
+// 封装以太网帧并放入出接口的发送队列
+func (q *IpPacketQueue) outputFrame(iface *Interface, dst network.HardwareAddr, etherType uint16, payload []byte) error {
+	hdr := &network.EthernetHeader{
+		Dst:  dst,
+		Src:  iface.Link.HardwareAddr(),
+		Type: etherType,
+	}
+	frame := append(hdr.Marshal(), payload...)
+	return q.enqueue(iface, network.Packet{Buf: frame, N: uintptr(len(frame))})
+}
+
+// 广播和组播地址对应的MAC地址
+func (q *IpPacketQueue) multicastHardwareAddr(iface *Interface, addr netip.Addr) (network.HardwareAddr, bool) {
+	if addr.Is4() {
+		if addr == netip.AddrFrom4([4]byte{255, 255, 255, 255}) {
+			return network.BroadcastHardwareAddr, true
+		}
+		for _, a := range iface.AddressTable() {
+			if a.Broadcast.IsValid() && addr == a.Broadcast {
+				return network.BroadcastHardwareAddr, true
+			}
+		}
+		if addr.IsMulticast() {
+			return ipv4MulticastHardwareAddr(addr), true
+		}
+		return network.HardwareAddr{}, false
+	}
+	if addr.IsMulticast() {
+		// IPv6组播地址映射为 33:33 加上地址的低32位 (RFC 2464 7)
+		ip := addr.As16()
+		return network.HardwareAddr{0x33, 0x33, ip[12], ip[13], ip[14], ip[15]}, true
+	}
+	return network.HardwareAddr{}, false
+}
+
+// 接口是否接收发往该广播或组播MAC地址的帧：已加入的IPv4组播组和全主机组 (RFC 1112 6.4)、
+// IPv6全节点组和本机地址的被请求节点组播组 (RFC 4861 7.2.1)，路由器还接收全路由器组
+func (q *IpPacketQueue) listensOn(iface *Interface, hwAddr network.HardwareAddr) bool {
+	if hwAddr == network.BroadcastHardwareAddr {
+		return true
+	}
+	if !hwAddr.IsMulticast() {
+		return false
+	}
+	groups := append(iface.Groups(), allSystemsAddr, allNodesAddr)
+	if q.Forwarding() {
+		groups = append(groups, allRouters4Addr, allRoutersAddr)
+	}
+	for _, a := range iface.AddressTable() {
+		if a.Prefix.Addr().Is6() {
+			groups = append(groups, solicitedNodeAddr(a.Prefix.Addr()))
+		}
+	}
+	for _, group := range groups {
+		if mac, _ := q.multicastHardwareAddr(iface, group); mac == hwAddr {
+			return true
+		}
+	}
+	return false
+}
+
+// 处理以太网链路收到的帧
+func (q *IpPacketQueue) receiveFrame(iface *Interface, frame network.Packet) {
+	hdr, err := network.UnmarshalEthernet(frame.Buf[:frame.N])
+	if err != nil {
+		log.Printf("ethernet unmarshal error: %s", err)
+		return
+	}
+	// 只接收发给本机MAC地址的帧、广播帧和接口监听的组播帧
+	if hdr.Dst != iface.Link.HardwareAddr() && !q.listensOn(iface, hdr.Dst) {
+		return
+	}
+
+	payload := frame.Buf[network.ETHERNET_HEADER_LENGTH:frame.N]
+	switch hdr.Type {
+	case network.ETHER_TYPE_ARP:
+		q.recvArp(iface, payload)
+	case network.ETHER_TYPE_IPV4, network.ETHER_TYPE_IPV6:
+		q.receive(iface, network.Packet{Buf: payload, N: uintptr(len(payload))})
+	}
+}
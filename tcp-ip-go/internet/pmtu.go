@@ -0,0 +1,99 @@
+package internet
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	MIN_MTU      = 68               // IPv4要求所有链路支持的最小MTU (RFC 791)
+	DEFAULT_MTU  = 1500             // 以太网MTU，也是TUN设备的默认MTU
+	PMTU_TIMEOUT = 10 * time.Minute // 路径MTU的老化时间 (RFC 1191 6.3)
+)
+
+// 路由器不支持下一跳MTU字段时，依次尝试的常见MTU值 (RFC 1191 7)
+var mtuPlateaus = []uint16{65535, 32000, 17914, 8166, 4352, 2002, 1492, 1006, 508, 296, MIN_MTU}
+
+type pmtuEntry struct {
+	mtu     uint16
+	expires time.Time
+}
+
+// 按目的地址缓存的路径MTU，没有记录的目的地址使用出接口的MTU
+type PmtuCache struct {
+	entries map[netip.Addr]pmtuEntry
+	lock    sync.Mutex
+}
+
+func NewPmtuCache() *PmtuCache {
+	return &PmtuCache{
+		entries: make(map[netip.Addr]pmtuEntry),
+	}
+}
+
+// Get 返回缓存的路径MTU，过期的记录会被删除
+func (c *PmtuCache) Get(dst netip.Addr) (uint16, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[dst]
+	if !ok {
+		return 0, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, dst)
+		return 0, false
+	}
+	return entry.mtu, true
+}
+
+// Update 根据 Fragmentation Needed 报文降低路径MTU，路径MTU只会减小，返回是否发生了变化
+func (c *PmtuCache) Update(dst netip.Addr, mtu uint16) bool {
+	if mtu < MIN_MTU {
+		mtu = MIN_MTU
+	}
+	if dst.Is6() && mtu < IPV6_MIN_MTU {
+		mtu = IPV6_MIN_MTU
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if entry, ok := c.entries[dst]; ok && time.Now().Before(entry.expires) && mtu >= entry.mtu {
+		return false
+	}
+
+	c.entries[dst] = pmtuEntry{
+		mtu:     mtu,
+		expires: time.Now().Add(PMTU_TIMEOUT),
+	}
+	return true
+}
+
+// 旧路由器在下一跳MTU字段填0，此时根据原始数据报长度选择下一个更小的常见MTU
+func nextPlateau(totalLength uint16) uint16 {
+	for _, mtu := range mtuPlateaus {
+		if mtu < totalLength {
+			return mtu
+		}
+	}
+	return MIN_MTU
+}
+
+// LinkMTU 返回到达dst的出接口MTU，没有路由时为以太网MTU
+func (q *IpPacketQueue) LinkMTU(dst netip.Addr) uint16 {
+	if route, ok := q.routes.Lookup(dst); ok {
+		return uint16(route.Interface.mtuFor(dst))
+	}
+	return DEFAULT_MTU
+}
+
+// PathMTU 返回到达dst的当前路径MTU，即出接口MTU和缓存的路径MTU中较小的一个
+func (q *IpPacketQueue) PathMTU(dst netip.Addr) uint16 {
+	mtu := q.LinkMTU(dst)
+	if cached, ok := q.pmtu.Get(dst); ok && cached < mtu {
+		mtu = cached
+	}
+	return mtu
+}
@@ -0,0 +1,174 @@
+package internet
+
+import (
+	"encoding/binary"
+	"log"
+	"sync"
+	"tcp/network"
+	"time"
+)
+
+const (
+	REASSEMBLY_TIMEOUT       = 60 * time.Second // 分片重组超时 (RFC 1122 3.3.2 建议60到120秒)
+	REASSEMBLY_MAX_DATAGRAMS = 64               // 同时重组的数据报上限，防止分片耗尽内存
+	IP_MAX_LENGTH            = 65535            // IPv4数据报的最大长度
+)
+
+// 同一个数据报的分片由源地址、目的地址、协议和标识确定 (RFC 791 3.2)
+type fragmentKey struct {
+	src, dst [4]byte
+	protocol uint8
+	id       uint16
+}
+
+type fragmentRange struct {
+	start, end int
+}
+
+// 正在重组的数据报
+type reassemblyEntry struct {
+	first  *IpPacket       // 偏移为0的分片，提供重组后数据报的头部
+	data   []byte          // 按偏移放置的数据
+	ranges []fragmentRange // 已收到的数据区间，按起点排序且互不相邻
+	total  int             // 数据的总长度，收到最后一片之前为-1
+	timer  *time.Timer
+}
+
+type reassembler struct {
+	entries map[fragmentKey]*reassemblyEntry
+	lock    sync.Mutex
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{
+		entries: make(map[fragmentKey]*reassemblyEntry),
+	}
+}
+
+// 加入一个发往本机的分片，所有分片到齐时返回重组后的数据报 (RFC 791 3.2, RFC 815)
+func (q *IpPacketQueue) reassemble(pkt IpPacket) (IpPacket, bool) {
+	hdr := pkt.IpHeader
+	offset := int(hdr.FragmentOffset) * 8
+	end := offset + len(pkt.Payload)
+	more := hdr.Flags&FLAG_MORE_FRAGMENTS != 0
+	// 除最后一片外分片的数据长度都是8字节的整数倍，重组后也不能超过最大长度
+	if (more && len(pkt.Payload)%8 != 0) || int(hdr.IHL)*4+end > IP_MAX_LENGTH {
+		log.Printf("drop invalid fragment: %s -> %s, id: %d, offset: %d", pkt.SrcAddr, pkt.DstAddr, hdr.ID, offset)
+		return IpPacket{}, false
+	}
+
+	r := q.reassembly
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := fragmentKey{src: hdr.SrcIP, dst: hdr.DstIP, protocol: hdr.Protocol, id: hdr.ID}
+	entry, ok := r.entries[key]
+	if !ok {
+		if len(r.entries) >= REASSEMBLY_MAX_DATAGRAMS {
+			log.Printf("too many datagrams in reassembly, drop fragment: %s -> %s", pkt.SrcAddr, pkt.DstAddr)
+			return IpPacket{}, false
+		}
+		entry = &reassemblyEntry{total: -1}
+		entry.timer = time.AfterFunc(REASSEMBLY_TIMEOUT, func() { q.reassemblyTimeout(key, entry) })
+		r.entries[key] = entry
+	}
+
+	// 最后一片确定了总长度，与已收到的数据矛盾时放弃整个数据报
+	if !more {
+		if (entry.total >= 0 && entry.total != end) || (len(entry.ranges) > 0 && entry.ranges[len(entry.ranges)-1].end > end) {
+			log.Printf("drop datagram with inconsistent fragments: %s -> %s, id: %d", pkt.SrcAddr, pkt.DstAddr, hdr.ID)
+			r.remove(key, entry)
+			return IpPacket{}, false
+		}
+		entry.total = end
+	} else if entry.total >= 0 && end > entry.total {
+		log.Printf("drop datagram with inconsistent fragments: %s -> %s, id: %d", pkt.SrcAddr, pkt.DstAddr, hdr.ID)
+		r.remove(key, entry)
+		return IpPacket{}, false
+	}
+
+	// 接收缓冲区可能被复用，分片的数据都要复制
+	if end > len(entry.data) {
+		entry.data = append(entry.data, make([]byte, end-len(entry.data))...)
+	}
+	copy(entry.data[offset:end], pkt.Payload)
+	if offset == 0 && entry.first == nil {
+		first := pkt
+		first.Packet.Buf = append([]byte(nil), pkt.Packet.Buf[:hdr.TotalLength]...)
+		first.Packet.N = uintptr(hdr.TotalLength)
+		entry.first = &first
+	}
+	entry.addRange(offset, end)
+
+	if entry.first == nil || entry.total < 0 || len(entry.ranges) != 1 || entry.ranges[0] != (fragmentRange{0, entry.total}) {
+		return IpPacket{}, false
+	}
+	r.remove(key, entry)
+	return entry.datagram(), true
+}
+
+// 记录收到的数据区间，与重叠或相邻的区间合并
+func (e *reassemblyEntry) addRange(start, end int) {
+	merged := make([]fragmentRange, 0, len(e.ranges)+1)
+	for _, r := range e.ranges {
+		if r.end < start || r.start > end {
+			merged = append(merged, r)
+			continue
+		}
+		start, end = min(start, r.start), max(end, r.end)
+	}
+	merged = append(merged, fragmentRange{start, end})
+	for i := len(merged) - 1; i > 0 && merged[i].start < merged[i-1].start; i-- {
+		merged[i], merged[i-1] = merged[i-1], merged[i]
+	}
+	e.ranges = merged
+}
+
+// 用第一片的头部和完整的数据组装数据报，清除分片字段并重新计算校验和
+func (e *reassemblyEntry) datagram() IpPacket {
+	first := *e.first
+	hdrLen := int(first.IpHeader.IHL) * 4
+	buf := make([]byte, hdrLen+e.total)
+	copy(buf, first.Packet.Buf[:hdrLen])
+	copy(buf[hdrLen:], e.data[:e.total])
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(buf)))
+	binary.BigEndian.PutUint16(buf[6:8], binary.BigEndian.Uint16(buf[6:8])&(FLAG_DONT_FRAGMENT<<13))
+	binary.BigEndian.PutUint16(buf[10:12], 0)
+	binary.BigEndian.PutUint16(buf[10:12], checksum(buf[:hdrLen]))
+
+	hdr := *first.IpHeader
+	hdr.TotalLength = uint16(len(buf))
+	hdr.Flags &= FLAG_DONT_FRAGMENT
+	hdr.FragmentOffset = 0
+	hdr.Checksum = binary.BigEndian.Uint16(buf[10:12])
+
+	first.IpHeader = &hdr
+	first.Packet = network.Packet{Buf: buf, N: uintptr(len(buf))}
+	first.Payload = buf[hdrLen:]
+	return first
+}
+
+// 调用方持有锁
+func (r *reassembler) remove(key fragmentKey, entry *reassemblyEntry) {
+	entry.timer.Stop()
+	if r.entries[key] == entry {
+		delete(r.entries, key)
+	}
+}
+
+// 重组超时放弃数据报，收到过第一片时回送 Time Exceeded (RFC 792, RFC 1122 3.3.2)
+func (q *IpPacketQueue) reassemblyTimeout(key fragmentKey, entry *reassemblyEntry) {
+	r := q.reassembly
+	r.lock.Lock()
+	if r.entries[key] != entry {
+		r.lock.Unlock()
+		return
+	}
+	delete(r.entries, key)
+	r.lock.Unlock()
+
+	log.Printf("fragment reassembly timeout: %s -> %s, id: %d", addrFrom4(key.src), addrFrom4(key.dst), key.id)
+	if entry.first != nil {
+		q.SendIcmpError(*entry.first, ICMP_TYPE_TIME_EXCEEDED, ICMP_CODE_REASSEMBLY_EXCEEDED, 0)
+	}
+}
@@ -0,0 +1,175 @@
+package internet
+
+import (
+	"bytes"
+	"net/netip"
+	"tcp/network"
+	"testing"
+	"time"
+)
+
+// 本机分片发出的数据报经由另一个协议栈重组后交给上层协议
+func TestFragmentRoundTrip(t *testing.T) {
+	src, dst := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+
+	sender := NewIpPacketQueue()
+	defer sender.Close()
+	out := newFakeLink(576)
+	sender.ManageQueues(out, netip.PrefixFrom(src, 24))
+
+	receiver := NewIpPacketQueue()
+	defer receiver.Close()
+	in := newFakeLink(DEFAULT_MTU)
+	receiver.ManageQueues(in, netip.PrefixFrom(dst, 24))
+
+	datagram := testDatagram(src, dst, TCP_PROTOCOL, 1400, false)
+	if err := sender.Write(network.Packet{Buf: datagram, N: uintptr(len(datagram))}); err != nil {
+		t.Fatal(err)
+	}
+	var fragments [][]byte
+	for total := 0; total < len(datagram)-IP_HEADER_MIN_LENGTH; {
+		frag := out.next(t)
+		if len(frag) > 576 {
+			t.Fatalf("fragment of %d bytes exceeds mtu", len(frag))
+		}
+		fragments = append(fragments, frag)
+		total += len(frag) - IP_HEADER_MIN_LENGTH
+	}
+	if len(fragments) < 3 {
+		t.Fatalf("got %d fragments, want at least 3", len(fragments))
+	}
+
+	// 乱序并重复到达
+	for _, i := range []int{2, 0, 0, 1} {
+		in.in <- network.Packet{Buf: fragments[i], N: uintptr(len(fragments[i]))}
+	}
+	pkt, err := receiver.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pkt.Payload, datagram[IP_HEADER_MIN_LENGTH:]) {
+		t.Fatalf("reassembled payload of %d bytes, want %d", len(pkt.Payload), len(datagram)-IP_HEADER_MIN_LENGTH)
+	}
+	if hdr := pkt.IpHeader; hdr.FragmentOffset != 0 || hdr.Flags&FLAG_MORE_FRAGMENTS != 0 || int(hdr.TotalLength) != len(datagram) {
+		t.Fatalf("reassembled header %+v", hdr)
+	}
+	if checksum(pkt.Packet.Buf[:IP_HEADER_MIN_LENGTH]) != 0 {
+		t.Fatal("bad header checksum after reassembly")
+	}
+}
+
+// 正在重组的数据报数
+func pending(q *IpPacketQueue) int {
+	q.reassembly.lock.Lock()
+	defer q.reassembly.lock.Unlock()
+	return len(q.reassembly.entries)
+}
+
+func TestReassemble(t *testing.T) {
+	src, dst := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	datagram := testDatagram(src, dst, TCP_PROTOCOL, 100, false)
+	fragments, err := fragment(datagram, 44) // 每片24字节数据，共4片
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		order []int
+		want  bool
+	}{
+		{"in order", []int{0, 1, 2, 3}, true},
+		{"reversed", []int{3, 2, 1, 0}, true},
+		{"duplicate", []int{0, 1, 1, 2, 3}, true},
+		{"missing middle", []int{0, 1, 3}, false},
+		{"missing first", []int{1, 2, 3}, false},
+		{"missing last", []int{0, 1, 2}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewIpPacketQueue()
+			defer q.Close()
+			var got IpPacket
+			done := false
+			for i, idx := range tt.order {
+				pkt, err := parseDatagram(network.Packet{Buf: fragments[idx], N: uintptr(len(fragments[idx]))})
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, done = q.reassemble(pkt)
+				if done && i != len(tt.order)-1 {
+					t.Fatalf("reassembled after %d fragments", i+1)
+				}
+			}
+			if done != tt.want {
+				t.Fatalf("reassembled %t, want %t", done, tt.want)
+			}
+			if done && !bytes.Equal(got.Packet.Buf, datagram) {
+				t.Fatalf("reassembled %x, want %x", got.Packet.Buf, datagram)
+			}
+			// 重组完成后不再保留分片
+			if n := pending(q); (n == 0) != tt.want {
+				t.Fatalf("%d datagrams pending", n)
+			}
+		})
+	}
+}
+
+// 最后一片与已收到的数据矛盾时放弃整个数据报
+func TestReassembleInconsistent(t *testing.T) {
+	src, dst := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	datagram := testDatagram(src, dst, TCP_PROTOCOL, 100, false)
+	fragments, err := fragment(datagram, 44)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 把第二片改成最后一片
+	short := append([]byte(nil), fragments[1]...)
+	short[6] &^= FLAG_MORE_FRAGMENTS << 5
+	short[10], short[11] = 0, 0
+	sum := checksum(short[:IP_HEADER_MIN_LENGTH])
+	short[10], short[11] = byte(sum>>8), byte(sum)
+
+	q := NewIpPacketQueue()
+	defer q.Close()
+	for _, frag := range [][]byte{fragments[2], short} {
+		pkt, err := parseDatagram(network.Packet{Buf: frag, N: uintptr(len(frag))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := q.reassemble(pkt); ok {
+			t.Fatal("inconsistent fragments reassembled")
+		}
+	}
+	if n := pending(q); n != 0 {
+		t.Fatalf("%d datagrams pending, want inconsistent datagram dropped", n)
+	}
+}
+
+// 只收到部分分片时超时放弃
+func TestReassemblyTimeout(t *testing.T) {
+	q := NewIpPacketQueue()
+	defer q.Close()
+	datagram := testDatagram(netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2"), TCP_PROTOCOL, 100, false)
+	fragments, err := fragment(datagram, 44)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := parseDatagram(network.Packet{Buf: fragments[1], N: uintptr(len(fragments[1]))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.reassemble(pkt)
+	q.reassembly.lock.Lock()
+	for _, entry := range q.reassembly.entries {
+		entry.timer.Reset(time.Millisecond)
+	}
+	q.reassembly.lock.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for pending(q) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("fragments not dropped after timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,108 @@
+package internet
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+)
+
+// 一条路由
+type Route struct {
+	Prefix    netip.Prefix // 目的网络
+	Gateway   netip.Addr   // 下一跳网关，无效地址表示目的网络直连
+	Metric    int          // 度量值，前缀长度相同时优先选择较小的
+	Interface *Interface   // 出接口
+}
+
+// NextHop 返回发往dst的数据报的下一跳地址
+func (r Route) NextHop(dst netip.Addr) netip.Addr {
+	if r.Gateway.IsValid() {
+		return r.Gateway
+	}
+	return dst
+}
+
+func (r Route) String() string {
+	if r.Gateway.IsValid() {
+		return fmt.Sprintf("%s via %s dev %s metric %d", r.Prefix, r.Gateway, r.Interface.Name, r.Metric)
+	}
+	return fmt.Sprintf("%s dev %s metric %d", r.Prefix, r.Interface.Name, r.Metric)
+}
+
+// 路由表，按前缀长度从长到短、度量值从小到大排序，查找时第一条匹配的路由即为最长前缀匹配
+type RouteTable struct {
+	routes []Route
+	lock   sync.RWMutex
+}
+
+func NewRouteTable() *RouteTable {
+	return &RouteTable{
+		routes: make([]Route, 0),
+	}
+}
+
+// Add 添加路由，相同前缀、网关和出接口的路由只能存在一条
+func (t *RouteTable) Add(route Route) error {
+	if !route.Prefix.IsValid() || route.Interface == nil {
+		return fmt.Errorf("invalid route: %v", route.Prefix)
+	}
+	route.Prefix = route.Prefix.Masked()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, r := range t.routes {
+		if r.Prefix == route.Prefix && r.Gateway == route.Gateway && r.Interface == route.Interface {
+			return fmt.Errorf("route already exists: %s", route)
+		}
+	}
+
+	t.routes = append(t.routes, route)
+	sort.SliceStable(t.routes, func(i, j int) bool {
+		if t.routes[i].Prefix.Bits() != t.routes[j].Prefix.Bits() {
+			return t.routes[i].Prefix.Bits() > t.routes[j].Prefix.Bits()
+		}
+		return t.routes[i].Metric < t.routes[j].Metric
+	})
+	return nil
+}
+
+// Delete 删除与前缀和网关都相同的路由
+func (t *RouteTable) Delete(prefix netip.Prefix, gateway netip.Addr) error {
+	prefix = prefix.Masked()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for i, r := range t.routes {
+		if r.Prefix == prefix && r.Gateway == gateway {
+			t.routes = append(t.routes[:i], t.routes[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("route not found: %s", prefix)
+}
+
+// Lookup 最长前缀匹配查找发往dst的路由
+func (t *RouteTable) Lookup(dst netip.Addr) (Route, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	for _, r := range t.routes {
+		if r.Prefix.Contains(dst) {
+			return r, true
+		}
+	}
+	return Route{}, false
+}
+
+// Routes 返回路由表的快照
+func (t *RouteTable) Routes() []Route {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	routes := make([]Route, len(t.routes))
+	copy(routes, t.routes)
+	return routes
+}
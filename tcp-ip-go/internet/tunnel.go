@@ -0,0 +1,280 @@
+package internet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/netip"
+	"tcp/network"
+)
+
+type TunnelMode int
+
+const (
+	TUNNEL_GRE  TunnelMode = iota // GRE封装 (RFC 2784)
+	TUNNEL_IPIP                   // IP-in-IP封装 (RFC 2003)
+)
+
+const (
+	IPIP_PROTOCOL = 4
+	GRE_PROTOCOL  = 47
+
+	GRE_HEADER_LENGTH = 4      // 不带可选字段的GRE头部长度
+	GRE_FLAG_CHECKSUM = 0x8000 // C: 带有校验和字段
+	GRE_FLAG_KEY      = 0x2000 // K: 带有密钥字段 (RFC 2890)
+	GRE_FLAG_SEQUENCE = 0x1000 // S: 带有序列号字段 (RFC 2890)
+	GRE_RESERVED0     = 0x4ff8 // 必须为0的保留位
+	GRE_VERSION_MASK  = 0x0007
+)
+
+func (m TunnelMode) String() string {
+	switch m {
+	case TUNNEL_GRE:
+		return "gre"
+	case TUNNEL_IPIP:
+		return "ipip"
+	}
+	return fmt.Sprintf("mode(%d)", int(m))
+}
+
+// Tunnel 虚拟隧道链路，写入的IPv4数据报被封装后经由承载网络发往对端，
+// 从对端收到的封装数据报解封装后从该链路读出。挂载为接口后路由可以指向隧道
+type Tunnel struct {
+	name     string
+	Mode     TunnelMode
+	Local    netip.Addr // 外层头部的源地址
+	Remote   netip.Addr // 隧道对端地址
+	mtu      int
+	ip       *IpPacketQueue
+	incoming chan network.Packet
+}
+
+// NewTunnel 创建到remote的隧道链路，MTU为承载接口的MTU减去封装开销
+func (q *IpPacketQueue) NewTunnel(name string, mode TunnelMode, local, remote netip.Addr) (*Tunnel, error) {
+	if !local.Is4() || !remote.Is4() {
+		return nil, fmt.Errorf("tunnel endpoints must be ipv4: %s -> %s", local, remote)
+	}
+	if mode != TUNNEL_GRE && mode != TUNNEL_IPIP {
+		return nil, fmt.Errorf("unsupported tunnel mode: %s", mode)
+	}
+	route, ok := q.routes.Lookup(remote)
+	if !ok {
+		return nil, fmt.Errorf("network unreachable: %s", remote)
+	}
+
+	t := &Tunnel{
+		name:     name,
+		Mode:     mode,
+		Local:    local,
+		Remote:   remote,
+		mtu:      route.Interface.MTU - tunnelOverhead(mode),
+		ip:       q,
+		incoming: make(chan network.Packet, QUEUE_SIZE),
+	}
+	if t.mtu < MIN_MTU {
+		return nil, fmt.Errorf("mtu %d of %s too small for %s tunnel", route.Interface.MTU, route.Interface.Name, mode)
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, other := range q.tunnels {
+		if other.Mode == mode && other.Local == local && other.Remote == remote {
+			return nil, fmt.Errorf("%s tunnel %s -> %s already exists", mode, local, remote)
+		}
+	}
+	q.tunnels = append(q.tunnels, t)
+	return t, nil
+}
+
+// 封装带来的额外开销：外层IPv4头部，GRE还有GRE头部
+func tunnelOverhead(mode TunnelMode) int {
+	if mode == TUNNEL_GRE {
+		return LENGTH + GRE_HEADER_LENGTH
+	}
+	return LENGTH
+}
+
+func (t *Tunnel) Read() (network.Packet, error) {
+	select {
+	case pkt := <-t.incoming:
+		return pkt, nil
+	case <-t.ip.ctx.Done():
+		return network.Packet{}, fmt.Errorf("tunnel %s closed", t.name)
+	}
+}
+
+// Write 封装内层数据报并交给协议栈发往隧道对端
+func (t *Tunnel) Write(pkt network.Packet) error {
+	inner := pkt.Buf[:pkt.N]
+	if len(inner) < IP_HEADER_MIN_LENGTH || inner[0]>>4 != IP_VERSION_4 {
+		return fmt.Errorf("%s tunnel only carries ipv4 datagrams", t.Mode)
+	}
+	// 承载路由指向隧道自身时封装会无限循环
+	if route, ok := t.ip.routes.Lookup(t.Remote); ok && route.Interface.Link == t {
+		return fmt.Errorf("tunnel %s loops back through itself", t.name)
+	}
+
+	// 外层头部总是设置DF，承载路径的MTU变小后隧道的有效MTU随之变小 (RFC 4459 3)。
+	// 内层设置了DF时通知源主机，否则先对内层分片再分别封装 (RFC 2003 5.1)
+	if mtu := t.pathMTU(); len(inner) > mtu {
+		innerPkt, err := parseDatagram(network.Packet{Buf: inner, N: uintptr(len(inner))})
+		if err != nil {
+			return err
+		}
+		if innerPkt.IpHeader.Flags&FLAG_DONT_FRAGMENT != 0 {
+			t.ip.fragmentationNeeded(innerPkt, mtu)
+			return fmt.Errorf("message too long: %d > mtu %d of %s", len(inner), mtu, t.name)
+		}
+		fragments, err := fragment(inner[:innerPkt.IpHeader.TotalLength], mtu)
+		if err != nil {
+			return err
+		}
+		for _, frag := range fragments {
+			if err := t.encapsulate(frag); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return t.encapsulate(inner)
+}
+
+// 隧道的有效MTU：创建时的MTU和到隧道对端的路径MTU扣除封装开销中较小的一个
+func (t *Tunnel) pathMTU() int {
+	return min(t.mtu, int(t.ip.PathMTU(t.Remote))-tunnelOverhead(t.Mode))
+}
+
+// 封装一个内层数据报并发往隧道对端
+func (t *Tunnel) encapsulate(inner []byte) error {
+	var payload []byte
+	protocol := uint8(IPIP_PROTOCOL)
+	if t.Mode == TUNNEL_GRE {
+		protocol = GRE_PROTOCOL
+		payload = make([]byte, GRE_HEADER_LENGTH, GRE_HEADER_LENGTH+len(inner))
+		binary.BigEndian.PutUint16(payload[2:4], network.ETHER_TYPE_IPV4)
+	}
+	payload = append(payload, inner...)
+
+	// 外层复制内层的DSCP和ECN (RFC 2983, RFC 6040 4.1 正常模式)
+	datagram := NewDatagram(t.Local, t.Remote, protocol, inner[1], payload)
+	return t.ip.Write(network.Packet{Buf: datagram, N: uintptr(len(datagram))})
+}
+
+func (t *Tunnel) Name() string {
+	return t.name
+}
+
+func (t *Tunnel) MTU() int {
+	return t.mtu
+}
+
+func (t *Tunnel) Type() network.LinkType {
+	return network.LINK_TYPE_IP
+}
+
+func (t *Tunnel) HardwareAddr() network.HardwareAddr {
+	return network.HardwareAddr{}
+}
+
+// 处理发往本机的GRE或IP-in-IP数据报，解封装后交给对应的隧道链路
+func (q *IpPacketQueue) recvTunnel(pkt IpPacket) {
+	mode := TUNNEL_IPIP
+	if pkt.Protocol == GRE_PROTOCOL {
+		mode = TUNNEL_GRE
+	}
+	t, ok := q.findTunnel(mode, pkt.DstAddr, pkt.SrcAddr)
+	if !ok {
+		q.SendIcmpError(pkt, ICMP_TYPE_DESTINATION_UNREACHABLE, ICMP_CODE_PROTOCOL_UNREACHABLE, 0)
+		return
+	}
+
+	inner := pkt.Payload
+	if mode == TUNNEL_GRE {
+		var err error
+		if inner, err = decapsulateGre(inner); err != nil {
+			log.Printf("%s: %s", t.name, err)
+			return
+		}
+	}
+	if len(inner) < IP_HEADER_MIN_LENGTH || inner[0]>>4 != IP_VERSION_4 {
+		log.Printf("%s: invalid inner datagram", t.name)
+		return
+	}
+
+	// 复制一份，外层数据报的缓冲区可能被复用
+	buf := make([]byte, len(inner))
+	copy(buf, inner)
+	if !decapsulateEcn(pkt.Ecn(), buf) {
+		return
+	}
+
+	select {
+	case t.incoming <- network.Packet{Buf: buf, N: uintptr(len(buf))}:
+	default:
+		log.Printf("%s: incoming queue full, drop datagram", t.name)
+	}
+}
+
+func (q *IpPacketQueue) findTunnel(mode TunnelMode, local, remote netip.Addr) (*Tunnel, bool) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	for _, t := range q.tunnels {
+		if t.Mode == mode && t.Local == local && t.Remote == remote {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// 0                   1                   2                   3
+// 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |C|K|S| Reserved0       | Ver |         Protocol Type         |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |      Checksum (optional)      |       Reserved1 (Optional)    |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+// 校验GRE头部并返回内层数据报，跳过RFC 2890的密钥和序列号字段
+func decapsulateGre(msg []byte) ([]byte, error) {
+	if len(msg) < GRE_HEADER_LENGTH {
+		return nil, fmt.Errorf("gre header too short: %d", len(msg))
+	}
+	flags := binary.BigEndian.Uint16(msg[0:2])
+	if flags&GRE_VERSION_MASK != 0 || flags&GRE_RESERVED0 != 0 {
+		return nil, fmt.Errorf("unsupported gre flags: %#04x", flags)
+	}
+	if proto := binary.BigEndian.Uint16(msg[2:4]); proto != network.ETHER_TYPE_IPV4 {
+		return nil, fmt.Errorf("unsupported gre protocol type: %#04x", proto)
+	}
+
+	length := GRE_HEADER_LENGTH
+	for _, flag := range []uint16{GRE_FLAG_CHECKSUM, GRE_FLAG_KEY, GRE_FLAG_SEQUENCE} {
+		if flags&flag != 0 {
+			length += 4
+		}
+	}
+	if len(msg) < length {
+		return nil, fmt.Errorf("gre header too short: %d", len(msg))
+	}
+	// 校验和覆盖GRE头部和内层数据报
+	if flags&GRE_FLAG_CHECKSUM != 0 && checksum(msg) != 0 {
+		return nil, fmt.Errorf("invalid gre checksum")
+	}
+	return msg[length:], nil
+}
+
+// 按外层的ECN标记更新内层数据报 (RFC 6040 4.2)，需要丢弃时返回false
+func decapsulateEcn(outer uint8, inner []byte) bool {
+	if outer != ECN_CE {
+		return true
+	}
+	switch datagramEcn(inner) {
+	case ECN_NOT_ECT:
+		// 内层不支持ECN，无法传递拥塞标记
+		return false
+	case ECN_ECT0, ECN_ECT1:
+		setDatagramEcn(inner, ECN_CE)
+	}
+	return true
+}
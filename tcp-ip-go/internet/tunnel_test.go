@@ -0,0 +1,133 @@
+package internet
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"tcp/network"
+	"testing"
+	"time"
+)
+
+// 测试用的IP链路，协议栈写出的数据报放入out，放入in的数据报作为收到的数据报
+type fakeLink struct {
+	in, out chan network.Packet
+	mtu     int
+}
+
+func newFakeLink(mtu int) *fakeLink {
+	return &fakeLink{
+		in:  make(chan network.Packet, QUEUE_SIZE),
+		out: make(chan network.Packet, QUEUE_SIZE),
+		mtu: mtu,
+	}
+}
+
+func (l *fakeLink) Read() (network.Packet, error)      { return <-l.in, nil }
+func (l *fakeLink) Write(pkt network.Packet) error     { l.out <- pkt; return nil }
+func (l *fakeLink) Name() string                       { return "fake0" }
+func (l *fakeLink) MTU() int                           { return l.mtu }
+func (l *fakeLink) Type() network.LinkType             { return network.LINK_TYPE_IP }
+func (l *fakeLink) HardwareAddr() network.HardwareAddr { return network.HardwareAddr{} }
+
+// 等待协议栈写出的下一个数据报
+func (l *fakeLink) next(t *testing.T) []byte {
+	t.Helper()
+	select {
+	case pkt := <-l.out:
+		return pkt.Buf[:pkt.N]
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for datagram")
+	}
+	return nil
+}
+
+// 构造一个数据报，df为false时清除DF标志
+func testDatagram(src, dst netip.Addr, protocol uint8, length int, df bool) []byte {
+	payload := make([]byte, length-IP_HEADER_MIN_LENGTH)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	datagram := NewDatagram(src, dst, protocol, 0, payload)
+	if !df {
+		datagram[6] &^= FLAG_DONT_FRAGMENT << 5
+		binary.BigEndian.PutUint16(datagram[10:12], 0)
+		binary.BigEndian.PutUint16(datagram[10:12], checksum(datagram[:IP_HEADER_MIN_LENGTH]))
+	}
+	return datagram
+}
+
+// 承载路径上的路由器回送 Fragmentation Needed 后，隧道按新的路径MTU处理内层数据报
+func TestTunnelPathMTU(t *testing.T) {
+	local, remote := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	innerSrc, innerDst := netip.MustParseAddr("172.16.0.1"), netip.MustParseAddr("192.168.2.5")
+
+	q := NewIpPacketQueue()
+	defer q.Close()
+	link := newFakeLink(DEFAULT_MTU)
+	q.ManageQueues(link, netip.PrefixFrom(local, 24))
+	tunnel, err := q.NewTunnel("gre0", TUNNEL_GRE, local, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.AddInterface(tunnel, netip.PrefixFrom(innerSrc, 30))
+	overhead := tunnelOverhead(TUNNEL_GRE)
+
+	// 路由器对一个满长度的外层数据报回送 Fragmentation Needed，下一跳MTU为1400
+	orig := testDatagram(local, remote, GRE_PROTOCOL, DEFAULT_MTU, true)
+	icmp := (&IcmpMessage{
+		Type: ICMP_TYPE_DESTINATION_UNREACHABLE,
+		Code: ICMP_CODE_FRAGMENTATION_NEEDED,
+		Rest: 1400,
+		Data: orig[:IP_HEADER_MIN_LENGTH+8],
+	}).Marshal()
+	msg := NewDatagram(netip.MustParseAddr("10.0.0.254"), local, ICMP_PROTOCOL, 0, icmp)
+	link.in <- network.Packet{Buf: msg, N: uintptr(len(msg))}
+	if e, err := q.ReadIcmpError(); err != nil || e.DstIP != remote || e.NextHopMTU != 1400 {
+		t.Fatalf("icmp error %+v %v, want fragmentation needed for %s", e, err, remote)
+	}
+	if got, want := tunnel.pathMTU(), 1400-overhead; got != want {
+		t.Fatalf("tunnel mtu %d, want %d", got, want)
+	}
+
+	// 设置了DF的内层数据报不能封装，本机发出的直接更新路径MTU并通知上层协议
+	inner := testDatagram(innerSrc, innerDst, TCP_PROTOCOL, 1450, true)
+	if err := tunnel.Write(network.Packet{Buf: inner, N: uintptr(len(inner))}); err == nil {
+		t.Fatal("oversized DF datagram written")
+	}
+	e, err := q.ReadIcmpError()
+	if err != nil || !e.IsFragmentationNeeded() || e.DstIP != innerDst || int(e.NextHopMTU) != 1400-overhead {
+		t.Fatalf("icmp error %+v %v, want fragmentation needed for %s with mtu %d", e, err, innerDst, 1400-overhead)
+	}
+	if got := q.PathMTU(innerDst); int(got) != 1400-overhead {
+		t.Fatalf("path mtu of %s is %d, want %d", innerDst, got, 1400-overhead)
+	}
+
+	// 没有设置DF的内层数据报先分片再封装，外层数据报都不超过路径MTU
+	inner = testDatagram(innerSrc, innerDst, UDP_PROTOCOL, 1450, false)
+	if err := tunnel.Write(network.Packet{Buf: inner, N: uintptr(len(inner))}); err != nil {
+		t.Fatal(err)
+	}
+	var payload []byte
+	for more := true; more; {
+		outer := link.next(t)
+		if len(outer) > 1400 || outer[6]&(FLAG_DONT_FRAGMENT<<5) == 0 {
+			t.Fatalf("outer datagram of %d bytes, flags %#x", len(outer), outer[6]>>5)
+		}
+		frag, err := decapsulateGre(outer[IP_HEADER_MIN_LENGTH:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr, err := unmarshal(frag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(hdr.FragmentOffset)*8 != len(payload) {
+			t.Fatalf("fragment offset %d, want %d", int(hdr.FragmentOffset)*8, len(payload))
+		}
+		payload = append(payload, frag[hdr.IHL*4:]...)
+		more = hdr.Flags&FLAG_MORE_FRAGMENTS != 0
+	}
+	if string(payload) != string(inner[IP_HEADER_MIN_LENGTH:]) {
+		t.Fatalf("reassembled %d bytes, want %d", len(payload), len(inner)-IP_HEADER_MIN_LENGTH)
+	}
+}
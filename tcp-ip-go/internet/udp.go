@@ -0,0 +1,234 @@
+package internet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"tcp/network"
+)
+
+const (
+	UDP_HEADER_LENGTH = 8
+	MULTICAST_TTL     = 1 // 组播数据报默认只在本链路上传播 (RFC 1112 6.1)
+)
+
+// 协议栈内部使用的UDP头部，如DHCP客户端
+type UdpHeader struct {
+	SrcPort  uint16
+	DstPort  uint16
+	Length   uint16 // UDP头部和数据的总长度
+	Checksum uint16 // IPv4中为0表示不校验
+}
+
+// 0                   1                   2                   3
+// 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |          Source Port          |       Destination Port        |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |            Length             |           Checksum            |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+// 解析并校验UDP报文，返回头部和数据
+func unmarshalUdp(src, dst netip.Addr, buf []byte) (*UdpHeader, []byte, error) {
+	if len(buf) < UDP_HEADER_LENGTH {
+		return nil, nil, fmt.Errorf("invalid udp length: %d", len(buf))
+	}
+	h := &UdpHeader{
+		SrcPort:  binary.BigEndian.Uint16(buf[0:2]),
+		DstPort:  binary.BigEndian.Uint16(buf[2:4]),
+		Length:   binary.BigEndian.Uint16(buf[4:6]),
+		Checksum: binary.BigEndian.Uint16(buf[6:8]),
+	}
+	if int(h.Length) < UDP_HEADER_LENGTH || int(h.Length) > len(buf) {
+		return nil, nil, fmt.Errorf("invalid udp length: %d", h.Length)
+	}
+	buf = buf[:h.Length]
+	// IPv6必须校验 (RFC 8200 8.1)
+	if h.Checksum != 0 || src.Is6() {
+		if checksum(append(pseudoHeader(src, dst, len(buf), UDP_PROTOCOL), buf...)) != 0 {
+			return nil, nil, fmt.Errorf("invalid udp checksum")
+		}
+	}
+	return h, buf[UDP_HEADER_LENGTH:], nil
+}
+
+// 组装带校验和的UDP报文
+func marshalUdp(src, dst netip.Addr, srcPort, dstPort uint16, payload []byte) []byte {
+	buf := make([]byte, UDP_HEADER_LENGTH, UDP_HEADER_LENGTH+len(payload))
+	binary.BigEndian.PutUint16(buf[0:2], srcPort)
+	binary.BigEndian.PutUint16(buf[2:4], dstPort)
+	binary.BigEndian.PutUint16(buf[4:6], uint16(UDP_HEADER_LENGTH+len(payload)))
+	buf = append(buf, payload...)
+
+	sum := checksum(append(pseudoHeader(src, dst, len(buf), UDP_PROTOCOL), buf...))
+	// 计算结果为0时发送全1，0表示没有校验和 (RFC 768)
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(buf[6:8], sum)
+	return buf
+}
+
+// 将UDP报文交给协议栈内部监听该端口的模块或绑定的套接字，没有时回送端口不可达
+func (q *IpPacketQueue) recvUdp(pkt IpPacket) {
+	hdr, payload, err := unmarshalUdp(pkt.SrcAddr, pkt.DstAddr, pkt.Payload)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case hdr.DstPort == DHCP_CLIENT_PORT && pkt.Interface != nil && pkt.Interface.dhcpClient() != nil:
+		pkt.Interface.dhcpClient().recv(payload)
+	case q.deliverUdp(pkt, hdr, payload):
+	default:
+		if pkt.DstAddr.Is4() {
+			q.SendIcmpError(pkt, ICMP_TYPE_DESTINATION_UNREACHABLE, ICMP_CODE_PORT_UNREACHABLE, 0)
+		} else {
+			q.SendIcmpv6Error(pkt, ICMPV6_TYPE_DESTINATION_UNREACHABLE, ICMPV6_CODE_PORT_UNREACHABLE, 0)
+		}
+	}
+}
+
+// UdpConn 绑定在本地地址和端口上的UDP套接字。地址未指定时接收该端口上发往本机任意地址、
+// 广播地址和已加入的组播组的数据报，绑定组播地址时只接收发往该组的数据报
+type UdpConn struct {
+	q        *IpPacketQueue
+	local    netip.AddrPort
+	incoming chan udpDatagram
+	done     chan struct{}
+	once     sync.Once
+}
+
+type udpDatagram struct {
+	src  netip.AddrPort
+	data []byte
+}
+
+// ListenUdp 绑定UDP端口，接收组播数据报需要先在接口上加入该组
+func (q *IpPacketQueue) ListenUdp(addr netip.AddrPort) (*UdpConn, error) {
+	if addr.Port() == 0 || !addr.Addr().IsValid() {
+		return nil, fmt.Errorf("invalid udp address: %s", addr)
+	}
+	if ip := addr.Addr(); !ip.IsUnspecified() && !ip.IsMulticast() && !q.isLocal(ip) {
+		return nil, fmt.Errorf("cannot assign requested address: %s", ip)
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.udpConns[addr]; ok {
+		return nil, fmt.Errorf("address already in use: %s", addr)
+	}
+	c := &UdpConn{
+		q:        q,
+		local:    addr,
+		incoming: make(chan udpDatagram, QUEUE_SIZE),
+		done:     make(chan struct{}),
+	}
+	q.udpConns[addr] = c
+	return c, nil
+}
+
+// 交给绑定了目的地址和端口的套接字，没有时交给绑定了未指定地址的套接字。
+// 广播和组播数据报交给所有匹配的套接字，组播只在收到数据报的接口加入了该组时交付
+func (q *IpPacketQueue) deliverUdp(pkt IpPacket, hdr *UdpHeader, payload []byte) bool {
+	dst := pkt.DstAddr
+	unspecified := netip.IPv4Unspecified()
+	if dst.Is6() {
+		unspecified = netip.IPv6Unspecified()
+	}
+	broadcast := dst.IsMulticast() || q.isBroadcast(dst)
+	if dst.Is4() && dst.IsMulticast() && pkt.Interface != nil && !pkt.Interface.isMember(dst) {
+		return true
+	}
+
+	q.lock.RLock()
+	var conns []*UdpConn
+	for _, addr := range []netip.Addr{dst, unspecified} {
+		if c, ok := q.udpConns[netip.AddrPortFrom(addr, hdr.DstPort)]; ok {
+			conns = append(conns, c)
+			if !broadcast {
+				break
+			}
+		}
+	}
+	q.lock.RUnlock()
+
+	src := netip.AddrPortFrom(pkt.SrcAddr, hdr.SrcPort)
+	for _, c := range conns {
+		// 接收缓冲区可能被复用，每个套接字得到一份副本
+		d := udpDatagram{src: src, data: append([]byte(nil), payload...)}
+		select {
+		case c.incoming <- d:
+		default:
+			log.Printf("udp receive queue of %s is full, drop datagram from %s", c.local, src)
+		}
+	}
+	// 没有套接字接收的广播和组播数据报直接丢弃，不回送端口不可达 (RFC 1122 3.2.2.1)
+	return len(conns) > 0 || broadcast
+}
+
+// ReadFrom 读取一个数据报，b不够大时多余的数据被丢弃
+func (c *UdpConn) ReadFrom(b []byte) (int, netip.AddrPort, error) {
+	select {
+	case d := <-c.incoming:
+		return copy(b, d.data), d.src, nil
+	case <-c.done:
+		return 0, netip.AddrPort{}, net.ErrClosed
+	case <-c.q.ctx.Done():
+		return 0, netip.AddrPort{}, net.ErrClosed
+	}
+}
+
+// WriteTo 发送数据报到dst，绑定了未指定地址或组播地址时按路由选择源地址
+func (c *UdpConn) WriteTo(b []byte, dst netip.AddrPort) error {
+	select {
+	case <-c.done:
+		return net.ErrClosed
+	default:
+	}
+	src := c.local.Addr()
+	if src.IsUnspecified() || src.IsMulticast() {
+		var err error
+		if src, err = c.q.SelectSource(dst.Addr()); err != nil {
+			return err
+		}
+	}
+	if src.Is4() != dst.Addr().Is4() {
+		return fmt.Errorf("address family mismatch: %s -> %s", src, dst)
+	}
+
+	datagram := NewDatagram(src, dst.Addr(), UDP_PROTOCOL, TOS, marshalUdp(src, dst.Addr(), c.local.Port(), dst.Port(), b))
+	if dst.Addr().IsMulticast() {
+		if dst.Addr().Is4() {
+			datagram[8] = MULTICAST_TTL
+			binary.BigEndian.PutUint16(datagram[10:12], 0)
+			binary.BigEndian.PutUint16(datagram[10:12], checksum(datagram[:LENGTH]))
+		} else {
+			datagram[7] = MULTICAST_TTL
+		}
+	}
+	return c.q.Write(network.Packet{Buf: datagram, N: uintptr(len(datagram))})
+}
+
+// Close 解除绑定，阻塞中的ReadFrom返回net.ErrClosed
+func (c *UdpConn) Close() error {
+	closed := false
+	c.once.Do(func() {
+		c.q.lock.Lock()
+		delete(c.q.udpConns, c.local)
+		c.q.lock.Unlock()
+		close(c.done)
+		closed = true
+	})
+	if !closed {
+		return net.ErrClosed
+	}
+	return nil
+}
+
+func (c *UdpConn) LocalAddr() netip.AddrPort {
+	return c.local
+}
@@ -0,0 +1,179 @@
+package internet
+
+import (
+	"net/netip"
+	"tcp/network"
+	"testing"
+	"time"
+)
+
+var (
+	testHostAddr  = netip.MustParseAddr("192.168.1.10")
+	testGroupAddr = netip.MustParseAddr("239.1.2.3")
+)
+
+// 在以太网链路上运行协议栈，并添加组播路由
+func startUdpHost(t *testing.T) (*fakeEthernet, *IpPacketQueue, *Interface) {
+	t.Helper()
+	link := newFakeEthernet(testClientHwAddr)
+	q := NewIpPacketQueue()
+	t.Cleanup(q.Close)
+	iface := q.AddInterface(link, netip.PrefixFrom(testHostAddr, 24))
+	q.Routes().Add(Route{Prefix: netip.MustParsePrefix("224.0.0.0/4"), Interface: iface})
+	return link, q, iface
+}
+
+// 从链路上的服务器注入一个UDP数据报，目的MAC按目的地址选择
+func injectUdp(link *fakeEthernet, dst netip.Addr, dstPort uint16, payload []byte) {
+	hwAddr := testClientHwAddr
+	if dst.IsMulticast() {
+		hwAddr = ipv4MulticastHardwareAddr(dst)
+	}
+	udp := marshalUdp(testServerAddr, dst, 4000, dstPort, payload)
+	datagram := NewDatagram(testServerAddr, dst, UDP_PROTOCOL, TOS, udp)
+	link.inject(hwAddr, network.ETHER_TYPE_IPV4, datagram)
+}
+
+// 等待套接字收到下一个数据报
+func readUdp(t *testing.T, c *UdpConn) (string, netip.AddrPort) {
+	t.Helper()
+	type result struct {
+		data string
+		src  netip.AddrPort
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		b := make([]byte, 1500)
+		n, src, err := c.ReadFrom(b)
+		ch <- result{string(b[:n]), src, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.data, r.src
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for udp datagram")
+	}
+	return "", netip.AddrPort{}
+}
+
+// 加入组播组后绑定的套接字收到发往该组的数据报，没有加入的组的数据报不交付
+func TestUdpMulticastReceive(t *testing.T) {
+	link, q, iface := startUdpHost(t)
+	wildcard, err := q.ListenUdp(netip.AddrPortFrom(netip.IPv4Unspecified(), 5000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wildcard.Close()
+	group, err := q.ListenUdp(netip.AddrPortFrom(testGroupAddr, 5000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer group.Close()
+	if _, err := q.ListenUdp(netip.AddrPortFrom(testGroupAddr, 5000)); err == nil {
+		t.Fatal("bound the same address twice")
+	}
+
+	// 加入之前发往该组的数据报被丢弃，链路上的帧按顺序处理，收到随后的单播数据报时已经处理过
+	injectUdp(link, testGroupAddr, 5000, []byte("before join"))
+	injectUdp(link, testHostAddr, 5000, []byte("sync"))
+	if data, _ := readUdp(t, wildcard); data != "sync" {
+		t.Fatalf("received %q before join", data)
+	}
+	if err := q.JoinGroup(iface, testGroupAddr); err != nil {
+		t.Fatal(err)
+	}
+	// 发往其他组的帧在链路层就被过滤
+	injectUdp(link, netip.MustParseAddr("239.1.2.4"), 5000, []byte("other group"))
+	injectUdp(link, testGroupAddr, 5000, []byte("hello group"))
+
+	// 组播数据报交给绑定了组地址和未指定地址的所有套接字
+	for _, c := range []*UdpConn{group, wildcard} {
+		data, src := readUdp(t, c)
+		if data != "hello group" || src != netip.AddrPortFrom(testServerAddr, 4000) {
+			t.Fatalf("%s received %q from %s", c.LocalAddr(), data, src)
+		}
+	}
+
+	// 单播数据报只交给绑定了未指定地址的套接字
+	injectUdp(link, testHostAddr, 5000, []byte("hello host"))
+	if data, _ := readUdp(t, wildcard); data != "hello host" {
+		t.Fatalf("received %q, want %q", data, "hello host")
+	}
+	select {
+	case d := <-group.incoming:
+		t.Fatalf("group socket received %q", d.data)
+	default:
+	}
+}
+
+// 发往组播组的数据报TTL为1，目的MAC为组对应的MAC地址
+func TestUdpMulticastSend(t *testing.T) {
+	link, q, _ := startUdpHost(t)
+	c, err := q.ListenUdp(netip.AddrPortFrom(netip.IPv4Unspecified(), 5000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteTo([]byte("hello"), netip.AddrPortFrom(testGroupAddr, 6000)); err != nil {
+		t.Fatal(err)
+	}
+	eth, datagram := link.next(t, network.ETHER_TYPE_IPV4)
+	if eth.Dst != ipv4MulticastHardwareAddr(testGroupAddr) {
+		t.Fatalf("destination mac %s, want %s", eth.Dst, ipv4MulticastHardwareAddr(testGroupAddr))
+	}
+	pkt, err := parseDatagram(network.Packet{Buf: datagram, N: uintptr(len(datagram))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt.IpHeader.TTL != MULTICAST_TTL || pkt.SrcAddr != testHostAddr {
+		t.Fatalf("ttl %d, source %s", pkt.IpHeader.TTL, pkt.SrcAddr)
+	}
+	hdr, payload, err := unmarshalUdp(pkt.SrcAddr, pkt.DstAddr, pkt.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.SrcPort != 5000 || hdr.DstPort != 6000 || string(payload) != "hello" {
+		t.Fatalf("udp header %+v, payload %q", hdr, payload)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteTo([]byte("hello"), netip.AddrPortFrom(testGroupAddr, 6000)); err == nil {
+		t.Fatal("wrote to a closed socket")
+	}
+	if _, _, err := c.ReadFrom(make([]byte, 10)); err == nil {
+		t.Fatal("read from a closed socket")
+	}
+}
+
+func TestListensOn(t *testing.T) {
+	_, q, iface := startUdpHost(t)
+	if err := q.JoinGroup(iface, testGroupAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		hwAddr network.HardwareAddr
+		want   bool
+	}{
+		{"broadcast", network.BroadcastHardwareAddr, true},
+		{"all systems", ipv4MulticastHardwareAddr(allSystemsAddr), true},
+		{"joined group", ipv4MulticastHardwareAddr(testGroupAddr), true},
+		{"other group", ipv4MulticastHardwareAddr(netip.MustParseAddr("239.1.2.4")), false},
+		{"ipv6 all nodes", network.HardwareAddr{0x33, 0x33, 0, 0, 0, 1}, true},
+		{"ipv6 other group", network.HardwareAddr{0x33, 0x33, 0, 0, 0, 0xfb}, false},
+		{"unicast", testServerHwAddr, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := q.listensOn(iface, tt.hwAddr); got != tt.want {
+				t.Fatalf("listensOn(%s) = %t, want %t", tt.hwAddr, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package network
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	ETHERNET_HEADER_LENGTH = 14 // 目的MAC(6) + 源MAC(6) + 类型(2)
+	ETHER_TYPE_IPV4        = 0x0800
+	ETHER_TYPE_ARP         = 0x0806
+	ETHER_TYPE_IPV6        = 0x86dd
+)
+
+// MAC地址
+type HardwareAddr [6]byte
+
+var BroadcastHardwareAddr = HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+func (a HardwareAddr) String() string {
+	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", a[0], a[1], a[2], a[3], a[4], a[5])
+}
+
+// 第一个字节的最低位为1表示组播(广播也是一种组播)
+func (a HardwareAddr) IsMulticast() bool {
+	return a[0]&0x01 == 0x01
+}
+
+// 随机生成一个本地管理的单播MAC地址
+func randomHardwareAddr() HardwareAddr {
+	var addr HardwareAddr
+	rand.Read(addr[:])
+	addr[0] = (addr[0] | 0x02) &^ 0x01 // 本地管理位置1，组播位置0
+	return addr
+}
+
+type EthernetHeader struct {
+	Dst  HardwareAddr
+	Src  HardwareAddr
+	Type uint16
+}
+
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// | Destination MAC (6) | Source MAC (6) | EtherType (2) | Data |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+func UnmarshalEthernet(frame []byte) (*EthernetHeader, error) {
+	if len(frame) < ETHERNET_HEADER_LENGTH {
+		return nil, fmt.Errorf("invalid ethernet frame length: %d", len(frame))
+	}
+
+	h := &EthernetHeader{
+		Type: binary.BigEndian.Uint16(frame[12:14]),
+	}
+	copy(h.Dst[:], frame[0:6])
+	copy(h.Src[:], frame[6:12])
+
+	return h, nil
+}
+
+func (h *EthernetHeader) Marshal() []byte {
+	frame := make([]byte, ETHERNET_HEADER_LENGTH)
+	copy(frame[0:6], h.Dst[:])
+	copy(frame[6:12], h.Src[:])
+	binary.BigEndian.PutUint16(frame[12:14], h.Type)
+	return frame
+}
@@ -0,0 +1,18 @@
+package network
+
+type LinkType int
+
+const (
+	LINK_TYPE_IP       LinkType = iota // 收发的是IP数据报，如TUN设备
+	LINK_TYPE_ETHERNET                 // 收发的是以太网帧，如TAP设备
+)
+
+// 链路层设备，协议栈通过该接口在不同类型的设备上收发数据包
+type Link interface {
+	Read() (Packet, error)
+	Write(pkt Packet) error
+	Name() string
+	MTU() int
+	Type() LinkType
+	HardwareAddr() HardwareAddr // 以太网链路的MAC地址，其他链路为零值
+}
@@ -18,9 +18,11 @@ type ifreq struct {
 const (
 	TUNSETIFF   = 0x400454ca // 设置tun/tap设备的名称
 	IFF_TUN     = 0x0001     // 表示tun设备
+	IFF_TAP     = 0x0002     // 表示tap设备
 	IFF_NO_PI   = 0x1000     // 表示不包含包头 protocol information
 	PACKET_SIZE = 2048       // 数据包大小
 	QUEUE_SIZE  = 10         // 队列大小
+	MTU         = 1500       // TUN设备的默认MTU
 )
 
 type Packet struct {
@@ -29,14 +31,38 @@ type Packet struct {
 }
 
 type NetDevice struct {
-	file          *os.File    // 文件描述符
-	incomingQueue chan Packet // 接收网络数据包
-	outgoingQueue chan Packet // 发送网络数据包
+	name          string       // 设备名称
+	mtu           int          // 最大传输单元
+	linkType      LinkType     // TUN设备收发IP数据报，TAP设备收发以太网帧
+	hwAddr        HardwareAddr // TAP设备上协议栈使用的MAC地址
+	file          *os.File     // 文件描述符
+	incomingQueue chan Packet  // 接收网络数据包
+	outgoingQueue chan Packet  // 发送网络数据包
 	ctx           context.Context
 	cancel        context.CancelFunc //上下文相关的操作将被取消
 }
 
 func NewTun() (*NetDevice, error) {
+	return NewTunWithName("tun0")
+}
+
+// NewTunWithName 打开指定名称的TUN设备，一个协议栈可以同时使用多个设备
+func NewTunWithName(name string) (*NetDevice, error) {
+	return newDevice(name, IFF_TUN)
+}
+
+// NewTap 打开指定名称的TAP设备，协议栈使用随机生成的MAC地址收发以太网帧
+func NewTap(name string) (*NetDevice, error) {
+	dev, err := newDevice(name, IFF_TAP)
+	if err != nil {
+		return nil, err
+	}
+	dev.linkType = LINK_TYPE_ETHERNET
+	dev.hwAddr = randomHardwareAddr()
+	return dev, nil
+}
+
+func newDevice(name string, mode int16) (*NetDevice, error) {
 	// 打开TUN设备
 	file, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
 	if err != nil {
@@ -44,9 +70,9 @@ func NewTun() (*NetDevice, error) {
 	}
 
 	ifr := ifreq{}
-	copy(ifr.ifrName[:], []byte("tun0"))
+	copy(ifr.ifrName[:], []byte(name))
 	// 将这两个标志进行按位或操作,可以将它们合并到一个字段中
-	ifr.ifrFlags = IFF_TUN | IFF_NO_PI
+	ifr.ifrFlags = mode | IFF_NO_PI
 	// ioctl()是一个用于设备、套接字和其他文件描述符的I/O控制操作的系统调用
 	_, _, sysErr := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), uintptr(TUNSETIFF), uintptr(unsafe.Pointer(&ifr)))
 	if sysErr != 0 {
@@ -56,6 +82,9 @@ func NewTun() (*NetDevice, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	return &NetDevice{
+		name:          name,
+		mtu:           MTU,
+		linkType:      LINK_TYPE_IP,
 		file:          file,
 		incomingQueue: make(chan Packet, QUEUE_SIZE),
 		outgoingQueue: make(chan Packet, QUEUE_SIZE),
@@ -142,3 +171,19 @@ func (t *NetDevice) Write(pkt Packet) error {
 		return fmt.Errorf("device closed")
 	}
 }
+
+func (t *NetDevice) Name() string {
+	return t.name
+}
+
+func (t *NetDevice) MTU() int {
+	return t.mtu
+}
+
+func (t *NetDevice) Type() LinkType {
+	return t.linkType
+}
+
+func (t *NetDevice) HardwareAddr() HardwareAddr {
+	return t.hwAddr
+}
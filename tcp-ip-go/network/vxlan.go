@@ -0,0 +1,173 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	VXLAN_PORT          = 4789 // IANA分配的VXLAN端口 (RFC 7348 5)
+	VXLAN_HEADER_LENGTH = 8
+	VXLAN_FLAG_VNI      = 0x08 // I: VNI有效
+	VXLAN_MAX_VNI       = 1<<24 - 1
+	// 外层IPv4、UDP、VXLAN头部和内层以太网头部的开销
+	VXLAN_OVERHEAD    = 20 + 8 + VXLAN_HEADER_LENGTH + ETHERNET_HEADER_LENGTH
+	VXLAN_FDB_TIMEOUT = 5 * time.Minute // 学习到的MAC地址的老化时间
+)
+
+// 转发表中的一项，记录MAC地址所在的对端
+type fdbEntry struct {
+	remote  *net.UDPAddr
+	expires time.Time
+}
+
+// Vxlan 通过主机UDP套接字收发VXLAN封装的以太网帧的链路 (RFC 7348)，
+// 同一VNI的多个进程或主机组成一个虚拟二层网段
+type Vxlan struct {
+	name   string
+	vni    uint32
+	hwAddr HardwareAddr
+	conn   *net.UDPConn
+	peers  []*net.UDPAddr            // 广播、组播和未知单播帧复制发往的对端
+	fdb    map[HardwareAddr]fdbEntry // 从收到的帧中学习的MAC地址
+	lock   sync.Mutex
+}
+
+// NewVxlan 在local上监听VXLAN报文，peers为同一网段的其他VTEP地址
+func NewVxlan(name string, vni uint32, local string, peers ...string) (*Vxlan, error) {
+	if vni > VXLAN_MAX_VNI {
+		return nil, fmt.Errorf("invalid vni: %d", vni)
+	}
+	laddr, err := net.ResolveUDPAddr("udp", local)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Vxlan{
+		name:   name,
+		vni:    vni,
+		hwAddr: randomHardwareAddr(),
+		conn:   conn,
+		fdb:    make(map[HardwareAddr]fdbEntry),
+	}
+	for _, peer := range peers {
+		if err := v.AddPeer(peer); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// AddPeer 添加同一网段的VTEP
+func (v *Vxlan) AddPeer(peer string) error {
+	addr, err := net.ResolveUDPAddr("udp", peer)
+	if err != nil {
+		return err
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.peers = append(v.peers, addr)
+	return nil
+}
+
+// LocalAddr 返回本端监听的UDP地址
+func (v *Vxlan) LocalAddr() net.Addr {
+	return v.conn.LocalAddr()
+}
+
+func (v *Vxlan) Close() error {
+	return v.conn.Close()
+}
+
+// 0                   1                   2                   3
+// 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |R|R|R|R|I|R|R|R|            Reserved                           |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                VXLAN Network Identifier (VNI) |   Reserved    |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+// Read 接收一个VNI匹配的VXLAN报文，返回解封装后的以太网帧并学习源MAC地址
+func (v *Vxlan) Read() (Packet, error) {
+	for {
+		buf := make([]byte, PACKET_SIZE)
+		n, remote, err := v.conn.ReadFromUDP(buf)
+		if err != nil {
+			return Packet{}, err
+		}
+		if n < VXLAN_HEADER_LENGTH+ETHERNET_HEADER_LENGTH || buf[0]&VXLAN_FLAG_VNI == 0 {
+			continue
+		}
+		if binary.BigEndian.Uint32(buf[4:8])>>8 != v.vni {
+			continue
+		}
+
+		frame := buf[VXLAN_HEADER_LENGTH:n]
+		hdr, err := UnmarshalEthernet(frame)
+		if err != nil {
+			continue
+		}
+		if !hdr.Src.IsMulticast() {
+			v.lock.Lock()
+			v.fdb[hdr.Src] = fdbEntry{remote: remote, expires: time.Now().Add(VXLAN_FDB_TIMEOUT)}
+			v.lock.Unlock()
+		}
+		return Packet{Buf: frame, N: uintptr(len(frame))}, nil
+	}
+}
+
+// Write 封装以太网帧，已学习的单播地址直接发往对应的VTEP，其余复制发往所有对端
+func (v *Vxlan) Write(pkt Packet) error {
+	frame := pkt.Buf[:pkt.N]
+	hdr, err := UnmarshalEthernet(frame)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, VXLAN_HEADER_LENGTH, VXLAN_HEADER_LENGTH+len(frame))
+	buf[0] = VXLAN_FLAG_VNI
+	binary.BigEndian.PutUint32(buf[4:8], v.vni<<8)
+	buf = append(buf, frame...)
+
+	v.lock.Lock()
+	var remotes []*net.UDPAddr
+	if entry, ok := v.fdb[hdr.Dst]; ok && time.Now().Before(entry.expires) {
+		remotes = []*net.UDPAddr{entry.remote}
+	} else {
+		delete(v.fdb, hdr.Dst)
+		remotes = append(remotes, v.peers...)
+	}
+	v.lock.Unlock()
+
+	for _, remote := range remotes {
+		if _, err := v.conn.WriteToUDP(buf, remote); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *Vxlan) Name() string {
+	return v.name
+}
+
+// MTU 外层按以太网MTU计算，扣除封装开销
+func (v *Vxlan) MTU() int {
+	return MTU - VXLAN_OVERHEAD
+}
+
+func (v *Vxlan) Type() LinkType {
+	return LINK_TYPE_ETHERNET
+}
+
+func (v *Vxlan) HardwareAddr() HardwareAddr {
+	return v.hwAddr
+}
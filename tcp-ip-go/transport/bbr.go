@@ -0,0 +1,346 @@
+package transport
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	BBR_HIGH_GAIN          = 2.885 // 2/ln2，启动阶段每个RTT发送速率翻倍需要的增益
+	BBR_DRAIN_GAIN         = 1 / BBR_HIGH_GAIN
+	BBR_CWND_GAIN          = 2                      // 探测带宽阶段拥塞窗口为两倍BDP
+	BBR_BTLBW_FILTER_LEN   = 10                     // 最大带宽滤波器的窗口，单位为往返轮次
+	BBR_RTPROP_FILTER_LEN  = 10 * time.Second       // 最小RTT滤波器的窗口
+	BBR_PROBE_RTT_DURATION = 200 * time.Millisecond // 探测RTT阶段至少持续的时间
+	BBR_MIN_PIPE_SEGMENTS  = 4                      // 拥塞窗口的下限，单位为报文段
+	BBR_FULL_BW_THRESHOLD  = 1.25                   // 带宽增长不到25%时认为没有增长
+	BBR_FULL_BW_COUNT      = 3                      // 连续多少轮没有增长认为管道已满
+)
+
+// 探测带宽阶段按RTT轮换的发送速率增益：先多发探测更多带宽，再少发排空队列
+var bbrPacingGainCycle = []float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+type bbrMode int
+
+const (
+	bbrStartup bbrMode = iota
+	bbrDrain
+	bbrProbeBw
+	bbrProbeRtt
+)
+
+func (m bbrMode) String() string {
+	switch m {
+	case bbrStartup:
+		return "STARTUP"
+	case bbrDrain:
+		return "DRAIN"
+	case bbrProbeBw:
+		return "PROBE_BW"
+	case bbrProbeRtt:
+		return "PROBE_RTT"
+	}
+	return "UNKNOWN"
+}
+
+type roundSample struct {
+	round uint64
+	value float64
+}
+
+// 按往返轮次滑动的最大值滤波器，单调队列的队首是窗口内的最大值
+type maxFilter struct {
+	length  uint64
+	samples []roundSample
+}
+
+func (f *maxFilter) update(round uint64, value float64) {
+	for len(f.samples) > 0 && f.samples[len(f.samples)-1].value <= value {
+		f.samples = f.samples[:len(f.samples)-1]
+	}
+	f.samples = append(f.samples, roundSample{round, value})
+	for f.samples[0].round+f.length <= round {
+		f.samples = f.samples[1:]
+	}
+}
+
+func (f *maxFilter) best() float64 {
+	if len(f.samples) == 0 {
+		return 0
+	}
+	return f.samples[0].value
+}
+
+// Bbr 基于模型的拥塞控制 (draft-cardwell-iccrg-bbr-congestion-control)。
+// 用投递速率样本估计瓶颈带宽BtlBw，用最小RTT估计传播时延RTprop，
+// 按BtlBw控制发送速率，按BDP = BtlBw * RTprop限制在传输中的数据量，不把随机丢包当作拥塞
+type Bbr struct {
+	mode bbrMode
+	mss  uint32
+
+	btlBw       maxFilter     // 最近10轮的最大投递速率，字节每秒
+	rtProp      time.Duration // 最近10秒的最小RTT，0表示还没有测量值
+	rtPropStamp time.Time
+	rtPropStale bool // rtProp已超过10秒没有更新
+
+	round              uint64 // 往返轮次计数
+	nextRoundDelivered uint64 // 累计确认越过这个位置时进入下一轮
+	roundStart         bool   // 当前ACK开始了新的一轮
+
+	filledPipe  bool    // 启动阶段已经填满瓶颈
+	fullBw      float64 // 上一次带宽明显增长时的值
+	fullBwCount int     // 带宽没有明显增长的轮数
+
+	pacingGain float64
+	cwndGain   float64
+	pacingRate float64 // 字节每秒
+	targetCwnd uint32
+
+	cycleIndex int       // 探测带宽阶段当前的增益
+	cycleStamp time.Time // 当前增益开始的时间
+
+	probeRttDone      time.Time // 探测RTT阶段结束的时间，零值表示还没有排空到最小窗口
+	probeRttRoundDone bool
+
+	priorCwnd    uint32 // 丢包恢复和探测RTT之前的拥塞窗口，之后恢复
+	restoreRound uint64 // 到这一轮时恢复priorCwnd
+}
+
+// NewBbr 创建BBR拥塞控制
+func NewBbr() CongestionControl {
+	return &Bbr{}
+}
+
+func (b *Bbr) Name() string {
+	return "bbr"
+}
+
+func (b *Bbr) Init(mss uint32) (uint32, uint32) {
+	b.mss = mss
+	b.btlBw = maxFilter{length: BBR_BTLBW_FILTER_LEN}
+	b.rtPropStamp = time.Now()
+	b.targetCwnd = initialWindow(mss)
+	b.enterStartup()
+	// 还没有RTT样本时按1毫秒估计初始的发送速率
+	b.pacingRate = BBR_HIGH_GAIN * float64(initialWindow(mss)) / time.Millisecond.Seconds()
+	// BBR不使用慢启动阈值
+	return initialWindow(mss), math.MaxUint32
+}
+
+// OnMssChange 路径MTU变化后按新的MSS计算窗口下限和额外的报文段
+func (b *Bbr) OnMssChange(mss uint32) {
+	b.mss = mss
+}
+
+// PacingRate 当前的发送速率，字节每秒
+func (b *Bbr) PacingRate() uint64 {
+	return uint64(b.pacingRate)
+}
+
+func (b *Bbr) setMode(mode bbrMode) {
+	if b.mode != mode {
+		log.Printf("bbr %s -> %s, btlbw: %.0f B/s, rtprop: %s", b.mode, mode, b.btlBw.best(), b.rtProp)
+	}
+	b.mode = mode
+}
+
+func (b *Bbr) enterStartup() {
+	b.setMode(bbrStartup)
+	b.pacingGain = BBR_HIGH_GAIN
+	b.cwndGain = BBR_HIGH_GAIN
+}
+
+// 进入探测带宽阶段，从随机的增益开始，但不从排空队列的0.75开始
+func (b *Bbr) enterProbeBw(now time.Time) {
+	b.setMode(bbrProbeBw)
+	b.cwndGain = BBR_CWND_GAIN
+	b.cycleIndex = len(bbrPacingGainCycle) - 1 - rand.Intn(len(bbrPacingGainCycle)-1)
+	b.advanceCyclePhase(now)
+}
+
+func (b *Bbr) advanceCyclePhase(now time.Time) {
+	b.cycleStamp = now
+	b.cycleIndex = (b.cycleIndex + 1) % len(bbrPacingGainCycle)
+	b.pacingGain = bbrPacingGainCycle[b.cycleIndex]
+}
+
+// 按增益计算的在传输中的数据量
+func (b *Bbr) inflight(gain float64) uint32 {
+	if b.rtProp == 0 {
+		return initialWindow(b.mss)
+	}
+	bdp := b.btlBw.best() * b.rtProp.Seconds()
+	// 加上几个报文段，抵消ACK聚合和延迟确认的影响
+	return uint32(gain*bdp) + 3*b.mss
+}
+
+// OnRateSample 用投递速率样本更新路径模型和状态机，计算发送速率和目标窗口
+func (b *Bbr) OnRateSample(s CongestionState, rs RateSample) {
+	now := time.Now()
+
+	// 样本报文段发送时的数据全部被确认，经过了一个往返
+	b.roundStart = false
+	if rs.PriorDelivered >= b.nextRoundDelivered {
+		b.nextRoundDelivered = rs.Delivered
+		b.round++
+		b.roundStart = true
+	}
+
+	// 受应用限制的样本只在高于当前估计时使用；区间短于RTprop的样本受ACK压缩影响
+	if rs.DeliveryRate > 0 && (b.rtProp == 0 || rs.Interval >= b.rtProp) &&
+		(!rs.AppLimited || rs.DeliveryRate >= b.btlBw.best()) {
+		b.btlBw.update(b.round, rs.DeliveryRate)
+	}
+
+	b.checkCyclePhase(s, now)
+	b.checkFullPipe(rs)
+	b.checkDrain(s, now)
+	b.updateRtProp(rs, now)
+	b.checkProbeRtt(s, rs, now)
+
+	// 发送速率为增益乘以瓶颈带宽，管道填满之前不降低
+	if bw := b.btlBw.best(); bw > 0 {
+		rate := b.pacingGain * bw
+		if b.filledPipe || rate > b.pacingRate {
+			b.pacingRate = rate
+		}
+	} else if s.Srtt > 0 {
+		b.pacingRate = BBR_HIGH_GAIN * float64(s.Cwnd) / s.Srtt.Seconds()
+	}
+	b.targetCwnd = max(b.inflight(b.cwndGain), BBR_MIN_PIPE_SEGMENTS*b.mss)
+}
+
+// 探测带宽阶段每个RTprop切换一次增益。增益大于1时直到在传输中的数据达到目标才切换，
+// 小于1时在队列排空后提前切换
+func (b *Bbr) checkCyclePhase(s CongestionState, now time.Time) {
+	if b.mode != bbrProbeBw {
+		return
+	}
+	fullLength := now.Sub(b.cycleStamp) > b.rtProp
+	next := fullLength
+	switch {
+	case b.pacingGain > 1:
+		next = fullLength && s.InFlight >= b.inflight(b.pacingGain)
+	case b.pacingGain < 1:
+		next = fullLength || s.InFlight <= b.inflight(1)
+	}
+	if next {
+		b.advanceCyclePhase(now)
+	}
+}
+
+// 连续三轮带宽增长不到25%，说明已经填满瓶颈
+func (b *Bbr) checkFullPipe(rs RateSample) {
+	if b.filledPipe || !b.roundStart || rs.AppLimited {
+		return
+	}
+	if bw := b.btlBw.best(); bw >= b.fullBw*BBR_FULL_BW_THRESHOLD {
+		b.fullBw = bw
+		b.fullBwCount = 0
+		return
+	}
+	b.fullBwCount++
+	if b.fullBwCount >= BBR_FULL_BW_COUNT {
+		b.filledPipe = true
+	}
+}
+
+// 管道填满后进入排空阶段，排空启动阶段在瓶颈形成的队列
+func (b *Bbr) checkDrain(s CongestionState, now time.Time) {
+	if b.mode == bbrStartup && b.filledPipe {
+		b.setMode(bbrDrain)
+		b.pacingGain = BBR_DRAIN_GAIN
+		b.cwndGain = BBR_HIGH_GAIN
+	}
+	if b.mode == bbrDrain && s.InFlight <= b.inflight(1) {
+		b.enterProbeBw(now)
+	}
+}
+
+func (b *Bbr) updateRtProp(rs RateSample, now time.Time) {
+	b.rtPropStale = now.After(b.rtPropStamp.Add(BBR_RTPROP_FILTER_LEN))
+	if rs.Rtt > 0 && (b.rtProp == 0 || rs.Rtt <= b.rtProp || b.rtPropStale) {
+		b.rtProp = rs.Rtt
+		b.rtPropStamp = now
+	}
+}
+
+// RTprop超过10秒没有更新时进入探测RTT阶段，把窗口降到最小排空队列，
+// 至少持续200毫秒和一个往返以测量真实的传播时延
+func (b *Bbr) checkProbeRtt(s CongestionState, rs RateSample, now time.Time) {
+	if b.mode != bbrProbeRtt && b.rtPropStale {
+		b.saveCwnd(s.Cwnd)
+		b.setMode(bbrProbeRtt)
+		b.pacingGain = 1
+		b.cwndGain = 1
+		b.probeRttDone = time.Time{}
+	}
+	if b.mode != bbrProbeRtt {
+		return
+	}
+
+	if b.probeRttDone.IsZero() {
+		if s.InFlight <= BBR_MIN_PIPE_SEGMENTS*b.mss {
+			b.probeRttDone = now.Add(BBR_PROBE_RTT_DURATION)
+			b.probeRttRoundDone = false
+			b.nextRoundDelivered = rs.Delivered
+		}
+		return
+	}
+	if b.roundStart {
+		b.probeRttRoundDone = true
+	}
+	if b.probeRttRoundDone && now.After(b.probeRttDone) {
+		b.rtPropStamp = now
+		b.restoreRound = b.round
+		if b.filledPipe {
+			b.enterProbeBw(now)
+		} else {
+			b.enterStartup()
+		}
+	}
+}
+
+// 记录降低之前的窗口，已经记录过时保留较大的
+func (b *Bbr) saveCwnd(cwnd uint32) {
+	b.priorCwnd = max(b.priorCwnd, cwnd)
+}
+
+// OnAck 窗口向目标增长，管道填满之前只增不减
+func (b *Bbr) OnAck(s CongestionState, acked uint32) (uint32, uint32) {
+	cwnd := s.Cwnd
+	if b.priorCwnd > 0 && b.round >= b.restoreRound && b.mode != bbrProbeRtt {
+		cwnd = max(cwnd, b.priorCwnd)
+		b.priorCwnd = 0
+	}
+	if b.filledPipe {
+		cwnd = min(cwnd+acked, b.targetCwnd)
+	} else if cwnd < b.targetCwnd {
+		cwnd += acked
+	}
+	cwnd = max(cwnd, BBR_MIN_PIPE_SEGMENTS*s.Mss)
+	if b.mode == bbrProbeRtt {
+		cwnd = min(cwnd, BBR_MIN_PIPE_SEGMENTS*s.Mss)
+	}
+	return cwnd, s.Ssthresh
+}
+
+// 丢包不降低模型，恢复的第一轮按包守恒只在数据离开网络时发送，之后恢复原来的窗口
+func (b *Bbr) OnLoss(s CongestionState) (uint32, uint32) {
+	b.saveCwnd(s.Cwnd)
+	b.restoreRound = b.round + 1
+	return max(s.InFlight, s.Mss), s.Ssthresh
+}
+
+func (b *Bbr) OnRetransmitTimeout(s CongestionState) (uint32, uint32) {
+	b.saveCwnd(s.Cwnd)
+	b.restoreRound = b.round + 1
+	return s.Mss, s.Ssthresh
+}
+
+// BBR不响应ECN
+func (b *Bbr) OnEcn(s CongestionState) (uint32, uint32) {
+	return s.Cwnd, s.Ssthresh
+}
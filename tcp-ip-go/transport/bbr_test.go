@@ -0,0 +1,273 @@
+package transport
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+const (
+	testBw  = 1e6 // 模拟路径的瓶颈带宽，字节每秒
+	testRtt = 10 * time.Millisecond
+)
+
+// 模拟的路径，每个样本确认上一个样本之后发送的数据，开始新的一轮
+type bbrPath struct {
+	b         *Bbr
+	delivered uint64
+}
+
+func newBbrPath() *bbrPath {
+	b := NewBbr().(*Bbr)
+	b.Init(testMss)
+	return &bbrPath{b: b}
+}
+
+func (p *bbrPath) round(rate float64, inFlight uint32) {
+	rs := RateSample{
+		PriorDelivered: p.delivered,
+		Delivered:      p.delivered + uint64(rate*testRtt.Seconds()),
+		Interval:       testRtt,
+		DeliveryRate:   rate,
+		Rtt:            testRtt,
+	}
+	p.delivered = rs.Delivered
+	p.b.OnRateSample(CongestionState{Mss: testMss, Cwnd: inFlight, InFlight: inFlight}, rs)
+}
+
+func approx(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-6*math.Max(math.Abs(a), math.Abs(b))
+}
+
+// 带宽增长时停留在启动阶段，连续三轮不再增长后进入排空阶段，队列排空后进入探测带宽阶段
+func TestBbrStartupDrainProbeBw(t *testing.T) {
+	p := newBbrPath()
+	b := p.b
+	if want := BBR_HIGH_GAIN * float64(initialWindow(testMss)) / time.Millisecond.Seconds(); b.pacingRate != want {
+		t.Fatalf("initial pacing rate %.0f, want %.0f", b.pacingRate, want)
+	}
+
+	inFlight := uint32(10 * testBw * testRtt.Seconds())
+	for _, rate := range []float64{testBw / 8, testBw / 4, testBw / 2, testBw, testBw, testBw} {
+		p.round(rate, inFlight)
+		if b.mode != bbrStartup || b.filledPipe {
+			t.Fatalf("mode %s after bandwidth %.0f, want STARTUP", b.mode, rate)
+		}
+		// 启动阶段发送速率为瓶颈带宽的2/ln2倍
+		if want := BBR_HIGH_GAIN * b.btlBw.best(); b.pacingRate < want {
+			t.Fatalf("pacing rate %.0f, want at least %.0f", b.pacingRate, want)
+		}
+	}
+	if b.btlBw.best() != testBw || b.rtProp != testRtt {
+		t.Fatalf("btlbw %.0f rtprop %s, want %.0f %s", b.btlBw.best(), b.rtProp, float64(testBw), testRtt)
+	}
+
+	// 第三轮没有增长，管道已满
+	p.round(testBw, inFlight)
+	if b.mode != bbrDrain || !b.filledPipe {
+		t.Fatalf("mode %s filled %t, want DRAIN", b.mode, b.filledPipe)
+	}
+	if !approx(b.pacingRate, BBR_DRAIN_GAIN*testBw) {
+		t.Fatalf("drain pacing rate %.0f, want %.0f", b.pacingRate, BBR_DRAIN_GAIN*testBw)
+	}
+
+	// 在传输中的数据降到BDP以下后开始探测带宽，不从0.75的增益开始
+	p.round(testBw, uint32(testBw*testRtt.Seconds()))
+	if b.mode != bbrProbeBw {
+		t.Fatalf("mode %s, want PROBE_BW", b.mode)
+	}
+	if b.pacingGain == 0.75 || b.cwndGain != BBR_CWND_GAIN {
+		t.Fatalf("pacing gain %.2f cwnd gain %.2f", b.pacingGain, b.cwndGain)
+	}
+	if !approx(b.pacingRate, b.pacingGain*testBw) {
+		t.Fatalf("pacing rate %.0f, want %.0f", b.pacingRate, b.pacingGain*testBw)
+	}
+	if want := uint32(BBR_CWND_GAIN*testBw*testRtt.Seconds()) + 3*testMss; b.targetCwnd != want {
+		t.Fatalf("target cwnd %d, want %d", b.targetCwnd, want)
+	}
+	if got := b.PacingRate(); got != uint64(b.pacingRate) {
+		t.Fatalf("PacingRate() = %d, want %d", got, uint64(b.pacingRate))
+	}
+}
+
+// 受应用限制的样本不能判断管道是否已满，也不能降低带宽估计
+func TestBbrAppLimited(t *testing.T) {
+	p := newBbrPath()
+	b := p.b
+	p.round(testBw, 0)
+	for i := 0; i < 2*BBR_FULL_BW_COUNT; i++ {
+		b.OnRateSample(CongestionState{Mss: testMss}, RateSample{
+			PriorDelivered: p.delivered,
+			Delivered:      p.delivered + 1000,
+			Interval:       testRtt,
+			DeliveryRate:   testBw / 2,
+			Rtt:            testRtt,
+			AppLimited:     true,
+		})
+		p.delivered += 1000
+	}
+	if b.filledPipe || b.mode != bbrStartup {
+		t.Fatalf("filled pipe on app-limited samples, mode %s", b.mode)
+	}
+	if len(b.btlBw.samples) != 1 || b.btlBw.best() != testBw {
+		t.Fatalf("app-limited samples entered the filter: %+v", b.btlBw.samples)
+	}
+
+	// 高于当前估计的受应用限制的样本仍然使用
+	b.OnRateSample(CongestionState{Mss: testMss}, RateSample{
+		PriorDelivered: p.delivered,
+		Delivered:      p.delivered + 1000,
+		Interval:       testRtt,
+		DeliveryRate:   2 * testBw,
+		Rtt:            testRtt,
+		AppLimited:     true,
+	})
+	if b.btlBw.best() != 2*testBw {
+		t.Fatalf("btlbw %.0f, want %.0f", b.btlBw.best(), float64(2*testBw))
+	}
+
+	// 区间短于RTprop的样本受ACK压缩影响，不使用
+	b.OnRateSample(CongestionState{Mss: testMss}, RateSample{
+		Delivered:    p.delivered + 2000,
+		Interval:     testRtt / 2,
+		DeliveryRate: 10 * testBw,
+		Rtt:          testRtt,
+	})
+	if b.btlBw.best() != 2*testBw {
+		t.Fatalf("btlbw %.0f from a compressed sample", b.btlBw.best())
+	}
+}
+
+func TestBbrCyclePhase(t *testing.T) {
+	bdp := uint32(testBw * testRtt.Seconds())
+	tests := []struct {
+		name     string
+		index    int
+		elapsed  time.Duration
+		inFlight uint32
+		advance  bool
+	}{
+		{"probe until inflight reaches target", 0, 2 * testRtt, 2 * bdp, true},
+		{"probe inflight below target", 0, 2 * testRtt, bdp, false},
+		{"probe shorter than rtprop", 0, testRtt / 2, 2 * bdp, false},
+		{"drain queue empty", 1, testRtt / 2, bdp, true},
+		{"drain queue not empty", 1, testRtt / 2, 2 * bdp, false},
+		{"drain full length", 1, 2 * testRtt, 2 * bdp, true},
+		{"cruise full length", 2, 2 * testRtt, bdp, true},
+		{"cruise shorter than rtprop", 2, testRtt / 2, bdp, false},
+		{"last phase wraps", len(bbrPacingGainCycle) - 1, 2 * testRtt, bdp, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBbr().(*Bbr)
+			b.Init(testMss)
+			b.btlBw.update(1, testBw)
+			b.rtProp = testRtt
+			b.mode = bbrProbeBw
+			b.cycleIndex = tt.index
+			b.pacingGain = bbrPacingGainCycle[tt.index]
+			now := time.Now()
+			b.cycleStamp = now.Add(-tt.elapsed)
+
+			b.checkCyclePhase(CongestionState{Mss: testMss, InFlight: tt.inFlight}, now)
+			want := tt.index
+			if tt.advance {
+				want = (tt.index + 1) % len(bbrPacingGainCycle)
+			}
+			if b.cycleIndex != want || b.pacingGain != bbrPacingGainCycle[want] {
+				t.Fatalf("cycle index %d gain %.2f, want %d", b.cycleIndex, b.pacingGain, want)
+			}
+		})
+	}
+}
+
+// RTprop超过10秒没有更新时进入探测RTT阶段，窗口降到4个报文段，
+// 持续200毫秒和一个往返后回到探测带宽阶段并恢复窗口
+func TestBbrProbeRtt(t *testing.T) {
+	p := newBbrPath()
+	b := p.b
+	bdp := uint32(testBw * testRtt.Seconds())
+	for i := 0; i < 8; i++ {
+		p.round(testBw, 10*bdp)
+	}
+	p.round(testBw, bdp)
+	if b.mode != bbrProbeBw {
+		t.Fatalf("mode %s, want PROBE_BW", b.mode)
+	}
+
+	cwnd := 2 * bdp
+	b.rtPropStamp = time.Now().Add(-BBR_RTPROP_FILTER_LEN - time.Second)
+	p.round(testBw, cwnd)
+	if b.mode != bbrProbeRtt || b.pacingGain != 1 {
+		t.Fatalf("mode %s gain %.2f, want PROBE_RTT", b.mode, b.pacingGain)
+	}
+	if got, _ := b.OnAck(CongestionState{Mss: testMss, Cwnd: cwnd}, testMss); got != BBR_MIN_PIPE_SEGMENTS*testMss {
+		t.Fatalf("probe rtt cwnd %d, want %d", got, BBR_MIN_PIPE_SEGMENTS*testMss)
+	}
+
+	// 排空到最小窗口后开始计时，时间未到时留在探测RTT阶段
+	p.round(testBw, BBR_MIN_PIPE_SEGMENTS*testMss)
+	if b.probeRttDone.IsZero() {
+		t.Fatal("probe rtt timer not started after inflight reached the minimum")
+	}
+	p.round(testBw, BBR_MIN_PIPE_SEGMENTS*testMss)
+	if b.mode != bbrProbeRtt {
+		t.Fatalf("mode %s before %s elapsed, want PROBE_RTT", b.mode, BBR_PROBE_RTT_DURATION)
+	}
+
+	b.probeRttDone = time.Now().Add(-time.Millisecond)
+	p.round(testBw, BBR_MIN_PIPE_SEGMENTS*testMss)
+	if b.mode != bbrProbeBw {
+		t.Fatalf("mode %s, want PROBE_BW after probe rtt", b.mode)
+	}
+	got, _ := b.OnAck(CongestionState{Mss: testMss, Cwnd: BBR_MIN_PIPE_SEGMENTS * testMss}, 0)
+	if want := min(cwnd, b.targetCwnd); got != want {
+		t.Fatalf("cwnd %d after probe rtt, want restored %d", got, want)
+	}
+}
+
+// 丢包不降低带宽估计，恢复的第一轮窗口为在传输中的数据量，下一轮恢复原来的窗口
+func TestBbrLoss(t *testing.T) {
+	p := newBbrPath()
+	b := p.b
+	bdp := uint32(testBw * testRtt.Seconds())
+	for i := 0; i < 8; i++ {
+		p.round(testBw, 10*bdp)
+	}
+	cwnd := b.targetCwnd
+	got, ssthresh := b.OnLoss(CongestionState{Mss: testMss, Cwnd: cwnd, Ssthresh: math.MaxUint32, InFlight: bdp})
+	if got != bdp || ssthresh != math.MaxUint32 {
+		t.Fatalf("cwnd %d ssthresh %d after loss, want %d", got, ssthresh, bdp)
+	}
+	if b.btlBw.best() != testBw {
+		t.Fatalf("btlbw %.0f after loss", b.btlBw.best())
+	}
+	p.round(testBw, bdp)
+	if got, _ = b.OnAck(CongestionState{Mss: testMss, Cwnd: bdp}, 0); got != min(cwnd, b.targetCwnd) {
+		t.Fatalf("cwnd %d next round, want restored %d", got, min(cwnd, b.targetCwnd))
+	}
+}
+
+// 最大值滤波器保留最近10轮的最大值
+func TestMaxFilter(t *testing.T) {
+	f := maxFilter{length: BBR_BTLBW_FILTER_LEN}
+	steps := []struct {
+		round uint64
+		value float64
+		want  float64
+	}{
+		{1, 100, 100},
+		{2, 300, 300},
+		{3, 200, 300},
+		{11, 50, 300},
+		{12, 50, 200},
+		{13, 60, 60},
+		{14, 400, 400},
+	}
+	for _, s := range steps {
+		f.update(s.round, s.value)
+		if got := f.best(); got != s.want {
+			t.Fatalf("best %.0f after round %d, want %.0f", got, s.round, s.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package transport
+
+import (
+	"math"
+	"time"
+)
+
+// CongestionState 调用拥塞控制算法时连接的状态，长度都以字节为单位
+type CongestionState struct {
+	Mss      uint32        // 有效最大报文段长度
+	Cwnd     uint32        // 当前的拥塞窗口
+	Ssthresh uint32        // 当前的慢启动阈值
+	InFlight uint32        // 已发送但未确认的字节数
+	Srtt     time.Duration // 平滑往返时间，还没有测量值时为0
+}
+
+// CongestionControl 拥塞控制算法。每条连接使用独立的实例，在持有连接的锁时调用，
+// 每个事件返回新的拥塞窗口和慢启动阈值。快速恢复期间的窗口膨胀和收缩由连接按RFC 6582处理
+type CongestionControl interface {
+	// Name 算法的名称
+	Name() string
+	// Init 返回连接初始的拥塞窗口和慢启动阈值
+	Init(mss uint32) (cwnd, ssthresh uint32)
+	// OnAck 不在丢包恢复中时收到确认了acked字节新数据的ACK
+	OnAck(s CongestionState, acked uint32) (cwnd, ssthresh uint32)
+	// OnLoss 重复ACK检测到丢包，进入快速恢复
+	OnLoss(s CongestionState) (cwnd, ssthresh uint32)
+	// OnRetransmitTimeout 重传定时器到期，同一报文段的多次超时只调用一次
+	OnRetransmitTimeout(s CongestionState) (cwnd, ssthresh uint32)
+	// OnEcn 对端回显了ECE，每个窗口最多调用一次 (RFC 3168 6.1.2)
+	OnEcn(s CongestionState) (cwnd, ssthresh uint32)
+}
+
+// RateSample 一个ACK得到的投递速率样本 (draft-cheng-iccrg-delivery-rate-estimation)
+type RateSample struct {
+	Delivered      uint64        // 连接累计被确认的字节数
+	PriorDelivered uint64        // 样本报文段发送时累计被确认的字节数
+	Interval       time.Duration // 采样区间，取发送和确认两个区间中较长的
+	DeliveryRate   float64       // 区间内的投递速率，字节每秒，区间为0时为0
+	Rtt            time.Duration // 样本报文段的往返时间
+	AppLimited     bool          // 样本报文段发送时连接受应用限制，速率可能低于路径的带宽
+}
+
+// RateSampler 需要投递速率的拥塞控制算法实现的可选接口，
+// 每个确认了新数据的ACK都在OnAck之前调用，包括快速恢复期间
+type RateSampler interface {
+	OnRateSample(s CongestionState, rs RateSample)
+}
+
+// Pacer 控制发送速率的拥塞控制算法实现的可选接口，
+// 连接按返回的速率均匀发送数据报文段，返回字节每秒，0表示不限速
+type Pacer interface {
+	PacingRate() uint64
+}
+
+// MssObserver 缓存了MSS的拥塞控制算法实现的可选接口，
+// 连接建立后有效MSS随路径MTU变化时调用
+type MssObserver interface {
+	OnMssChange(mss uint32)
+}
+
+// 初始窗口 (RFC 6928 2)
+func initialWindow(mss uint32) uint32 {
+	return min(10*mss, max(2*mss, 14600))
+}
+
+// 丢包后的慢启动阈值，不小于两个报文段 (RFC 5681 3.1)
+func lossThreshold(inFlight, mss uint32) uint32 {
+	return max(inFlight/2, 2*mss)
+}
+
+// 慢启动：每个ACK按确认的字节数增加，最多一个报文段 (RFC 5681 3.1, RFC 3465)
+func slowStart(s CongestionState, acked uint32) uint32 {
+	return s.Cwnd + min(acked, s.Mss)
+}
+
+// Reno RFC 5681的慢启动和拥塞避免
+type Reno struct{}
+
+// NewReno 创建Reno拥塞控制，是连接默认使用的算法
+func NewReno() CongestionControl {
+	return &Reno{}
+}
+
+func (r *Reno) Name() string {
+	return "reno"
+}
+
+func (r *Reno) Init(mss uint32) (uint32, uint32) {
+	// 初始阈值取任意大的值，由第一次拥塞决定 (RFC 5681 3.1)
+	return initialWindow(mss), math.MaxUint32
+}
+
+func (r *Reno) OnAck(s CongestionState, acked uint32) (uint32, uint32) {
+	if s.Cwnd < s.Ssthresh {
+		return slowStart(s, acked), s.Ssthresh
+	}
+	// 拥塞避免：每个RTT大约增加一个报文段
+	return s.Cwnd + max(s.Mss*s.Mss/s.Cwnd, 1), s.Ssthresh
+}
+
+func (r *Reno) OnLoss(s CongestionState) (uint32, uint32) {
+	ssthresh := lossThreshold(s.InFlight, s.Mss)
+	return ssthresh, ssthresh
+}
+
+// 超时后拥塞窗口回到一个报文段，重新慢启动
+func (r *Reno) OnRetransmitTimeout(s CongestionState) (uint32, uint32) {
+	return s.Mss, lossThreshold(s.InFlight, s.Mss)
+}
+
+// 收到ECE时窗口和阈值减半 (RFC 3168 6.1.2)
+func (r *Reno) OnEcn(s CongestionState) (uint32, uint32) {
+	ssthresh := max(s.Cwnd/2, 2*s.Mss)
+	return ssthresh, ssthresh
+}
@@ -0,0 +1,92 @@
+package transport
+
+import (
+	"math"
+	"testing"
+)
+
+const testMss = 1460
+
+func TestInitialWindow(t *testing.T) {
+	tests := []struct {
+		mss  uint32
+		want uint32
+	}{
+		{536, 5360},
+		{1460, 14600},
+		{4000, 14600},
+		{9000, 18000},
+	}
+	for _, tt := range tests {
+		if got := initialWindow(tt.mss); got != tt.want {
+			t.Errorf("initialWindow(%d) = %d, want %d", tt.mss, got, tt.want)
+		}
+	}
+}
+
+func TestRenoOnAck(t *testing.T) {
+	tests := []struct {
+		name     string
+		cwnd     uint32
+		ssthresh uint32
+		acked    uint32
+		want     uint32
+	}{
+		{"slow start full segment", 10 * testMss, math.MaxUint32, testMss, 11 * testMss},
+		{"slow start partial segment", 10 * testMss, math.MaxUint32, 100, 10*testMss + 100},
+		{"slow start stretch ack", 10 * testMss, math.MaxUint32, 3 * testMss, 11 * testMss},
+		{"slow start below ssthresh", 10 * testMss, 20 * testMss, testMss, 11 * testMss},
+		{"congestion avoidance at ssthresh", 10 * testMss, 10 * testMss, testMss, 10*testMss + testMss/10},
+		{"congestion avoidance", 20 * testMss, 10 * testMss, testMss, 20*testMss + testMss/20},
+		{"congestion avoidance huge window", math.MaxUint32 / 2, 10 * testMss, testMss, math.MaxUint32/2 + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := CongestionState{Mss: testMss, Cwnd: tt.cwnd, Ssthresh: tt.ssthresh}
+			cwnd, ssthresh := NewReno().OnAck(s, tt.acked)
+			if cwnd != tt.want || ssthresh != tt.ssthresh {
+				t.Fatalf("cwnd %d ssthresh %d, want %d %d", cwnd, ssthresh, tt.want, tt.ssthresh)
+			}
+		})
+	}
+}
+
+// 拥塞避免阶段每个RTT大约增加一个报文段
+func TestRenoCongestionAvoidanceRtt(t *testing.T) {
+	cc := NewReno()
+	s := CongestionState{Mss: testMss, Cwnd: 20 * testMss, Ssthresh: 10 * testMss}
+	for i := 0; i < 20; i++ {
+		s.Cwnd, s.Ssthresh = cc.OnAck(s, testMss)
+	}
+	if s.Cwnd < 20*testMss+testMss*9/10 || s.Cwnd > 21*testMss {
+		t.Fatalf("cwnd %d after one window of acks, want about %d", s.Cwnd, 21*testMss)
+	}
+}
+
+func TestRenoLoss(t *testing.T) {
+	tests := []struct {
+		name         string
+		event        func(CongestionControl, CongestionState) (uint32, uint32)
+		cwnd         uint32
+		inFlight     uint32
+		wantCwnd     uint32
+		wantSsthresh uint32
+	}{
+		{"fast retransmit", CongestionControl.OnLoss, 20 * testMss, 20 * testMss, 10 * testMss, 10 * testMss},
+		{"fast retransmit uses flight size", CongestionControl.OnLoss, 20 * testMss, 8 * testMss, 4 * testMss, 4 * testMss},
+		{"fast retransmit minimum", CongestionControl.OnLoss, 3 * testMss, 3 * testMss, 2 * testMss, 2 * testMss},
+		{"retransmit timeout", CongestionControl.OnRetransmitTimeout, 20 * testMss, 20 * testMss, testMss, 10 * testMss},
+		{"retransmit timeout minimum", CongestionControl.OnRetransmitTimeout, 20 * testMss, testMss, testMss, 2 * testMss},
+		{"ecn uses cwnd", CongestionControl.OnEcn, 20 * testMss, 8 * testMss, 10 * testMss, 10 * testMss},
+		{"ecn minimum", CongestionControl.OnEcn, 3 * testMss, 3 * testMss, 2 * testMss, 2 * testMss},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := CongestionState{Mss: testMss, Cwnd: tt.cwnd, Ssthresh: math.MaxUint32, InFlight: tt.inFlight}
+			cwnd, ssthresh := tt.event(NewReno(), s)
+			if cwnd != tt.wantCwnd || ssthresh != tt.wantSsthresh {
+				t.Fatalf("cwnd %d ssthresh %d, want %d %d", cwnd, ssthresh, tt.wantCwnd, tt.wantSsthresh)
+			}
+		})
+	}
+}
@@ -0,0 +1,344 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"tcp/internet"
+	"time"
+)
+
+// Listener 监听本地地址的被动打开端点，实现net.Listener
+type Listener struct {
+	tcp     *TcpPacketQueue
+	addr    netip.AddrPort   // 地址无效时监听该端口的所有本地地址
+	backlog chan *Connection // 已完成握手、等待Accept的连接
+	done    chan struct{}
+	once    sync.Once
+
+	newCC    func() CongestionControl // 为接受的连接创建拥塞控制算法，nil表示使用默认的Reno
+	halfOpen int                      // 处于SYN-RECEIVED状态的连接数
+	lock     sync.Mutex
+}
+
+// Accept 返回下一条完成三次握手的连接
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.backlog:
+		return newConn(l.tcp, conn), nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close 停止监听，重置还没有被Accept的连接
+func (l *Listener) Close() error {
+	err := net.ErrClosed
+	l.once.Do(func() {
+		err = nil
+		close(l.done)
+		l.tcp.manager.unlisten(l)
+		for {
+			select {
+			case conn := <-l.backlog:
+				l.tcp.abort(conn, ErrConnectionReset)
+			default:
+				return
+			}
+		}
+	})
+	return err
+}
+
+func (l *Listener) Addr() net.Addr {
+	return net.TCPAddrFromAddrPort(l.addr)
+}
+
+// SetCongestionControl 设置之后接受的连接使用的拥塞控制算法，如NewCubic
+func (l *Listener) SetCongestionControl(newCC func() CongestionControl) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.newCC = newCC
+}
+
+func (l *Listener) congestionControl() func() CongestionControl {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.newCC
+}
+
+// 为新的半连接占用一个名额，半连接数与等待队列长度相同时返回false
+func (l *Listener) reserveHalfOpen() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.halfOpen >= cap(l.backlog) {
+		return false
+	}
+	l.halfOpen++
+	return true
+}
+
+func (l *Listener) releaseHalfOpen() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.halfOpen--
+}
+
+// 握手完成的连接放入等待队列，队列已满时返回false
+func (l *Listener) enqueue(conn *Connection) bool {
+	select {
+	case <-l.done:
+		return false
+	default:
+	}
+	select {
+	case l.backlog <- conn:
+		return true
+	default:
+		return false
+	}
+}
+
+// Conn 一条TCP连接的应用端，实现net.Conn
+type Conn struct {
+	tcp           *TcpPacketQueue
+	conn          *Connection
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+func newConn(tcp *TcpPacketQueue, conn *Connection) *Conn {
+	return &Conn{
+		tcp:           tcp,
+		conn:          conn,
+		readDeadline:  deadline{expired: make(chan struct{})},
+		writeDeadline: deadline{expired: make(chan struct{})},
+	}
+}
+
+// Read 读取按序到达的数据，对端关闭发送方向后返回io.EOF
+func (c *Conn) Read(b []byte) (int, error) {
+	conn := c.conn
+	for {
+		conn.lock.Lock()
+		if conn.readClosed {
+			conn.lock.Unlock()
+			return 0, net.ErrClosed
+		}
+		if conn.rcv.output.bufferSize() > 0 {
+			before := conn.rcvWindow()
+			n := conn.rcv.output.readTo(b)
+			c.tcp.windowUpdate(conn, before)
+			conn.lock.Unlock()
+			return n, nil
+		}
+		if conn.rcv.output.eof() {
+			conn.lock.Unlock()
+			return 0, io.EOF
+		}
+		if conn.State == Closed {
+			err := conn.Err
+			conn.lock.Unlock()
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		changed := conn.changed
+		conn.lock.Unlock()
+
+		select {
+		case <-changed:
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Write 把数据写入发送缓冲区并按窗口发送，缓冲区满时等待对端确认
+func (c *Conn) Write(b []byte) (int, error) {
+	conn := c.conn
+	written := 0
+	for {
+		select {
+		case <-c.writeDeadline.wait():
+			return written, os.ErrDeadlineExceeded
+		default:
+		}
+
+		conn.lock.Lock()
+		if err := conn.writeError(); err != nil {
+			conn.lock.Unlock()
+			return written, err
+		}
+		n := min(len(b)-written, conn.sendSpace())
+		conn.snd.write(b[written : written+n])
+		written += n
+		c.tcp.fill(conn)
+		changed := conn.changed
+		conn.lock.Unlock()
+		if written == len(b) {
+			return written, nil
+		}
+
+		select {
+		case <-changed:
+		case <-c.writeDeadline.wait():
+			return written, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// 连接当前不能写入的原因
+func (conn *Connection) writeError() error {
+	if conn.writeClosed {
+		return net.ErrClosed
+	}
+	switch conn.State {
+	case Established, CloseWait:
+		return nil
+	case Closed:
+		if conn.Err != nil {
+			return conn.Err
+		}
+		return net.ErrClosed
+	}
+	return ErrConnectionClosing
+}
+
+// Close 关闭连接，之后不能再读写
+func (c *Conn) Close() error {
+	conn := c.conn
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.readClosed {
+		return net.ErrClosed
+	}
+	conn.readClosed = true
+	conn.notify()
+	// 连接已经被对端重置或因错误中止，资源已释放，只需标记关闭
+	if conn.State == Closed {
+		return nil
+	}
+	// 还有没读取的数据时发送RST而不是FIN，让对端知道数据没有被交付 (RFC 9293 3.10.4, RFC 2525 2.17)
+	if conn.rcv.output.bufferSize() > 0 {
+		c.tcp.terminate(conn, nil)
+		return nil
+	}
+	if conn.writeClosed {
+		c.tcp.manager.finWait2Timeout(conn)
+		return nil
+	}
+	return c.tcp.shutdown(conn)
+}
+
+// CloseWrite 关闭发送方向，发送FIN后仍然可以读取对端的数据
+func (c *Conn) CloseWrite() error {
+	conn := c.conn
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.writeClosed {
+		return net.ErrClosed
+	}
+	return c.tcp.shutdown(conn)
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return net.TCPAddrFromAddrPort(c.conn.LocalAddr)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return net.TCPAddrFromAddrPort(c.conn.RemoteAddr)
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// SetDscp 设置连接之后发出的数据报使用的区分服务代码点
+func (c *Conn) SetDscp(dscp uint8) error {
+	if dscp > internet.DSCP_MAX {
+		return fmt.Errorf("invalid dscp: %d", dscp)
+	}
+	c.conn.lock.Lock()
+	defer c.conn.lock.Unlock()
+	c.conn.dscp = dscp
+	return nil
+}
+
+// SetCongestionControl 更换连接的拥塞控制算法，cc不能被其他连接共用
+func (c *Conn) SetCongestionControl(cc CongestionControl) {
+	c.conn.lock.Lock()
+	defer c.conn.lock.Unlock()
+	c.conn.setCongestionControl(cc)
+}
+
+// CongestionControl 连接使用的拥塞控制算法
+func (c *Conn) CongestionControl() CongestionControl {
+	c.conn.lock.Lock()
+	defer c.conn.lock.Unlock()
+	return c.conn.cc
+}
+
+// State 连接当前的状态
+func (c *Conn) State() State {
+	c.conn.lock.Lock()
+	defer c.conn.lock.Unlock()
+	return c.conn.State
+}
+
+// 读写的截止时间，到期时关闭expired唤醒等待的调用方
+type deadline struct {
+	lock    sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+// 设置新的截止时间，零值表示不超时
+func (d *deadline) set(t time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// 已经到期或正在到期的通道不能复用
+	if d.timer != nil && !d.timer.Stop() {
+		d.expired = make(chan struct{})
+	} else {
+		select {
+		case <-d.expired:
+			d.expired = make(chan struct{})
+		default:
+		}
+	}
+	d.timer = nil
+	if t.IsZero() {
+		return
+	}
+
+	expired := d.expired
+	if dur := time.Until(t); dur > 0 {
+		d.timer = time.AfterFunc(dur, func() { close(expired) })
+		return
+	}
+	close(expired)
+}
+
+func (d *deadline) wait() <-chan struct{} {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.expired
+}
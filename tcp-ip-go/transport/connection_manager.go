@@ -1,183 +1,450 @@
 package transport
 
 import (
+	"encoding/binary"
+	"fmt"
 	"log"
 	"math/rand"
+	"net/netip"
 	"sync"
+	"tcp/internet"
 	"time"
 )
 
-type State int
-
-// 服务器端的连接状态
-const (
-	Listen State = iota
-	SynReceived
-	Established
-	CloseWait
-	LastAck
-	Closed
-)
-
 // 一条TCP连接
 type Connection struct {
-	SrcPort uint16
-	DstPort uint16
-	State   State
-	Pkt     TcpPacket
-	N       uintptr // 数据包长度
+	LocalAddr  netip.AddrPort
+	RemoteAddr netip.AddrPort
+	State      State
+	Err        error // 连接被重置、拒绝的原因或最近一次收到的ICMP软错误
+
+	// 发送序列号空间 (RFC 9293 3.3.1)
+	iss    uint32 // 初始发送序列号
+	sndUna uint32 // 最早的未确认序列号
+	sndNxt uint32 // 下一个发送的序列号
+	sndWnd uint32 // 对端通告的窗口
+	sndWl1 uint32 // 最近一次更新窗口的报文段序列号
+	sndWl2 uint32 // 最近一次更新窗口的报文段确认号
+	cwnd   uint32 // 拥塞窗口
+	rtt    rttEstimator
+	// 拥塞控制和丢包恢复 (RFC 5681, RFC 6582)
+	cc           CongestionControl
+	ssthresh     uint32 // 慢启动阈值
+	dupAcks      int    // 连续收到的重复ACK数
+	dupAckFlight uint32 // 收到第一个重复ACK时的在途字节数，不含之后Limited Transmit发送的数据
+	recover      uint32 // 进入恢复时已发送的最大序列号
+	inRecovery   bool   // 是否处于快速恢复
+	lossRecovery bool   // 超时后逐个重传recover之前的数据
+	ecnRecover   uint32 // 上一次响应ECE时的SND.NXT，确认越过它之前不再降低窗口
+	// 投递速率采样和发送节奏
+	delivered     uint64      // 累计被确认的字节数
+	deliveredTime time.Time   // delivered最近一次增加的时间
+	firstSentTime time.Time   // 当前采样区间中第一个报文段的发送时间
+	appLimited    uint64      // 非零时表示确认到这个位置之前的样本受应用限制
+	nextSend      time.Time   // 按发送速率下一个报文段最早的发送时间
+	paceTimer     *time.Timer // 发送速率限制解除时继续发送
+	// 重传定时器 (RFC 6298)
+	rtoTimer        *time.Timer
+	rtoExpires      time.Time   // 定时器到期的时间，零值表示没有运行
+	retransmissions int         // 最早的未确认报文段连续重传的次数
+	snd             *byteStream // 应用写入、还没有发送的数据
+	// 接收序列号空间
+	irs    uint32       // 对端的初始序列号
+	rcvNxt uint32       // 期待收到的下一个序列号
+	rcv    *reassembler // 重组收到的数据，输出等待应用读取的字节流
+
+	mss        uint16    // 有效最大报文段长度
+	peerMss    uint16    // 对端在SYN中通告的MSS
+	unacked    []segment // 已发送但未确认的报文段
+	dscp       uint8     // 发出的数据报使用的区分服务代码点
+	ecn        bool      // 是否协商使用ECN (RFC 3168 6.1.1)
+	ecnEcho    bool      // 收到CE标记后在ACK中设置ECE，直到对端回应CWR
+	cwrPending bool      // 收到ECE后在下一个数据报文段中设置CWR
+	ceCount    uint32    // 收到的CE标记数
+
+	readClosed  bool // 应用已关闭连接，不再读取
+	writeClosed bool // 应用已关闭发送方向
+	finSent     bool // FIN已经发送
 
-	initialSeqNum   uint32 // 初始序列号
-	incrementSeqNum uint32 // 增量序列号
+	passive       bool        // 是否由监听者被动打开
+	listener      *Listener   // 被动打开的连接完成握手后交给的监听者
+	timeWaitTimer *time.Timer // TIME-WAIT结束时删除连接
+	finWaitTimer  *time.Timer // 应用关闭后FIN-WAIT-2的超时
 
-	isAccept bool // 是否接受连接
+	changed chan struct{} // 状态变化时关闭并替换，等待连接建立等事件
+	lock    sync.Mutex    // 报文段处理和应用调用都会修改连接状态
+}
+
+// 标识一条连接的四元组 (RFC 9293 3.3.1)
+type connKey struct {
+	local  netip.AddrPort
+	remote netip.AddrPort
+}
+
+// 收到的报文段所属连接的四元组，报文段的目的地址是本地地址
+func segmentKey(pkt TcpPacket) connKey {
+	return connKey{
+		local:  netip.AddrPortFrom(pkt.DstAddr, pkt.TcpHeader.DstPort),
+		remote: netip.AddrPortFrom(pkt.SrcAddr, pkt.TcpHeader.SrcPort),
+	}
+}
+
+func (conn *Connection) key() connKey {
+	return connKey{local: conn.LocalAddr, remote: conn.RemoteAddr}
+}
+
+// 已发送的报文段，保留到被确认为止以便重传
+type segment struct {
+	seqNum uint32
+	flags  HeaderFlags
+	data   []byte
+
+	retransmit bool      // 重传的报文段不能设置ECT (RFC 3168 6.1.5)，也不能用于测量RTT
+	sentAt     time.Time // 首次发送的时间
+
+	// 发送时连接的投递状态，用于投递速率采样
+	delivered     uint64
+	deliveredTime time.Time
+	firstSentTime time.Time
+	appLimited    bool
+}
+
+// 报文段占用的序列号长度，SYN和FIN各占一个序列号
+func (s segment) length() uint32 {
+	length := uint32(len(s.data))
+	if s.flags.SYN {
+		length++
+	}
+	if s.flags.FIN {
+		length++
+	}
+	return length
 }
 
 // TCP连接管理
 type ConnectionManager struct {
-	Connections           []Connection
-	AcceptConnectionQueue chan Connection
-	lock                  sync.Mutex
+	connections map[connKey]*Connection
+	listeners   map[netip.AddrPort]*Listener
+	lock        sync.RWMutex
 }
 
 func NewConnectionManager() *ConnectionManager {
 	return &ConnectionManager{
-		Connections:           make([]Connection, 0),
-		AcceptConnectionQueue: make(chan Connection, QUEUESIZE),
+		connections: make(map[connKey]*Connection),
+		listeners:   make(map[netip.AddrPort]*Listener),
 	}
 }
 
 // 服务器端接收到数据包处理
 func (m *ConnectionManager) recv(queue *TcpPacketQueue, pkt TcpPacket) {
-	// 查找是否有已经建立的连接
-	conn, ok := m.find(pkt)
-	if ok {
-		conn.Pkt = pkt
-	} else {
-		// 如果连接不存在，则添加该连接
-		conn = m.addConnection(pkt)
-	}
-
-	// 如果是建立连接的SYN包
-	if pkt.TcpHeader.Flags.SYN && !ok {
-		log.Printf("recv SYN packet, src port: %d, dst port: %d", pkt.TcpHeader.SrcPort, pkt.TcpHeader.DstPort)
-		// 转为SYN_RECEIVED状态
-		m.updateState(pkt, SynReceived, false)
-		// 发送SYN+ACK包
-		queue.Write(conn, HeaderFlags{SYN: true, ACK: true}, nil)
-	}
-
-	// 如果是建立连接的ACK包
-	if ok && pkt.TcpHeader.Flags.ACK && conn.State == SynReceived {
-		log.Printf("recv ACK packet, src port: %d, dst port: %d", pkt.TcpHeader.SrcPort, pkt.TcpHeader.DstPort)
-		// 转为ESTABLISHED状态
-		m.updateState(pkt, Established, false)
-	}
-
-	// 当发送端的应用程序发送了一个数据块（chunk）时，它会设置 PSH 标志位，这样接收端的应用程序就会尽快地从 TCP 缓冲区中读取数据。
-	if ok && pkt.TcpHeader.Flags.PSH && conn.State == Established {
-		log.Printf("recv PSH packet, src port: %d, dst port: %d", pkt.TcpHeader.SrcPort, pkt.TcpHeader.DstPort)
-		// 将数据包放入接收队列
-		m.updateState(pkt, Established, true)
-		m.AcceptConnectionQueue <- conn
-	}
-
-	if ok && pkt.TcpHeader.Flags.FIN && conn.State == Established {
-		log.Printf("recv FIN packet, src port: %d, dst port: %d", pkt.TcpHeader.SrcPort, pkt.TcpHeader.DstPort)
-		// 转为CLOSE_WAIT状态
-		m.updateState(pkt, CloseWait, false)
-		// 发送ACK包
-		queue.Write(conn, HeaderFlags{ACK: true}, nil)
-		// 默认没有数据传送
-		// 转为LAST_ACK状态
-		m.updateState(pkt, LastAck, false)
-		// 发送FIN+ACK包
-		queue.Write(conn, HeaderFlags{
-			FIN: true,
-			ACK: true,
-		}, nil)
-	}
-
-	if ok && pkt.TcpHeader.Flags.ACK && conn.State == LastAck {
-		log.Printf("recv ACK packet, src port: %d, dst port: %d", pkt.TcpHeader.SrcPort, pkt.TcpHeader.DstPort)
-		// 转为CLOSED状态
-		m.updateState(pkt, Closed, false)
-		// 关闭连接
-		m.remove(conn)
+	// 查找四元组完全匹配的连接，没有时交给监听者
+	conn, ok := m.find(segmentKey(pkt))
+	if !ok {
+		m.recvListen(queue, pkt)
+		return
 	}
+
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	m.recvSegment(queue, conn, pkt)
 }
 
-func (m *ConnectionManager) find(pkt TcpPacket) (Connection, bool) {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+// 处理不属于任何连接的报文段：监听地址上的SYN创建新连接，其余回应RST (RFC 9293 3.10.7.1)
+func (m *ConnectionManager) recvListen(queue *TcpPacketQueue, pkt TcpPacket) {
+	flags := pkt.TcpHeader.Flags
+	if flags.RST {
+		return
+	}
+	l, ok := m.findListener(netip.AddrPortFrom(pkt.DstAddr, pkt.TcpHeader.DstPort))
+	if !flags.SYN || flags.ACK || !ok {
+		queue.sendReset(pkt)
+		return
+	}
 
-	// 遍历所有连接，通过源端口和目的端口查找连接
-	for _, conn := range m.Connections {
-		if conn.SrcPort == pkt.TcpHeader.SrcPort && conn.DstPort == pkt.TcpHeader.DstPort {
-			return conn, true
-		}
+	// 限制半连接数，超过时丢弃SYN，避免SYN洪泛耗尽连接资源 (RFC 4987)
+	if !l.reserveHalfOpen() {
+		log.Printf("too many half-open connections on %s, drop SYN from %s", l.addr, netip.AddrPortFrom(pkt.SrcAddr, pkt.TcpHeader.SrcPort))
+		return
 	}
 
-	return Connection{}, false
+	log.Printf("recv SYN packet, src port: %d, dst port: %d", pkt.TcpHeader.SrcPort, pkt.TcpHeader.DstPort)
+	// MSS不超过对端通告的MSS和路径MTU
+	peer := peerMss(pkt.TcpHeader, pkt.SrcAddr)
+	// 新连接处于SYN_RECEIVED状态
+	conn := m.addConnection(pkt, queue.sendMss(peer, pkt.SrcAddr))
+
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.passive = true
+	conn.listener = l
+	conn.peerMss = peer
+	if newCC := l.congestionControl(); newCC != nil {
+		conn.setCongestionControl(newCC())
+	}
+	conn.irs = pkt.TcpHeader.SeqNum
+	conn.rcvNxt = pkt.TcpHeader.SeqNum + 1
+	// 对端在SYN中同时设置ECE和CWR表示请求使用ECN，在SYN+ACK中只设置ECE作为应答
+	synAck := HeaderFlags{SYN: true, ACK: true}
+	if flags.ECE && flags.CWR {
+		conn.ecn = true
+		synAck.ECE = true
+	}
+	// 发送SYN+ACK包
+	queue.write(conn, synAck, nil)
+}
+
+// 查找接受发往addr的连接的监听者，先匹配具体地址，再匹配通配地址
+func (m *ConnectionManager) findListener(addr netip.AddrPort) (*Listener, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if l, ok := m.listeners[addr]; ok {
+		return l, true
+	}
+	l, ok := m.listeners[netip.AddrPortFrom(netip.Addr{}, addr.Port())]
+	return l, ok
 }
 
-func (m *ConnectionManager) remove(conn Connection) {
+// 注册监听者，未指定地址时监听该端口的所有本地地址
+func (m *ConnectionManager) listen(queue *TcpPacketQueue, addr netip.AddrPort) (*Listener, error) {
+	if addr.Addr().IsUnspecified() {
+		addr = netip.AddrPortFrom(netip.Addr{}, addr.Port())
+	}
+
 	m.lock.Lock()
 	defer m.lock.Unlock()
-
-	for i, c := range m.Connections {
-		if c.SrcPort == conn.SrcPort && c.DstPort == conn.DstPort {
-			m.Connections = append(m.Connections[:i], m.Connections[i+1:]...)
-			return
-		}
+	if _, ok := m.listeners[addr]; ok {
+		return nil, fmt.Errorf("address already in use: %s", addr)
 	}
+	l := &Listener{
+		tcp:     queue,
+		addr:    addr,
+		backlog: make(chan *Connection, QUEUESIZE),
+		done:    make(chan struct{}),
+	}
+	m.listeners[addr] = l
+	return l, nil
 }
 
-// 更新连接状态
-func (m *ConnectionManager) updateState(pkt TcpPacket, state State, isAccept bool) {
+func (m *ConnectionManager) unlisten(l *Listener) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	for i, conn := range m.Connections {
-		if conn.SrcPort == pkt.TcpHeader.SrcPort && conn.DstPort == pkt.TcpHeader.DstPort {
-			m.Connections[i].State = state
-			m.Connections[i].isAccept = isAccept
-			return
-		}
+	if m.listeners[l.addr] == l {
+		delete(m.listeners, l.addr)
 	}
 }
 
-// 添加新的连接
-func (m *ConnectionManager) addConnection(pkt TcpPacket) Connection {
+func (m *ConnectionManager) find(key connKey) (*Connection, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	conn, ok := m.connections[key]
+	return conn, ok
+}
+
+func (m *ConnectionManager) remove(conn *Connection) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
+
+	// 四元组可能已被新的连接复用
+	if m.connections[conn.key()] == conn {
+		delete(m.connections, conn.key())
+	}
+}
+
+// 创建连接，初始序列号随机生成
+func newConnection(local, remote netip.AddrPort, state State, mss uint16) *Connection {
 	seed := time.Now().UnixNano()
 	r := rand.New(rand.NewSource(seed))
 
-	conn := Connection{
-		SrcPort:         pkt.TcpHeader.DstPort,
-		DstPort:         pkt.TcpHeader.SrcPort,
-		State:           SynReceived,
-		Pkt:             pkt,
-		N:               pkt.Packet.N,
-		initialSeqNum:   r.Uint32(), // 随机生成初始序列号
-		incrementSeqNum: 0,
-		isAccept:        false,
+	iss := r.Uint32() // 随机生成初始序列号
+	conn := &Connection{
+		LocalAddr:  local,
+		RemoteAddr: remote,
+		State:      state,
+		iss:        iss,
+		sndUna:     iss,
+		sndNxt:     iss,
+		recover:    iss,
+		ecnRecover: iss,
+		rtt:        rttEstimator{rto: INITIAL_RTO},
+		snd:        newByteStream(SEND_BUFFER_SIZE),
+		rcv:        newReassembler(RECEIVE_BUFFER_SIZE),
+		mss:        mss,
+		peerMss:    mss,
+		changed:    make(chan struct{}),
 	}
+	conn.setCongestionControl(NewReno())
+	return conn
+}
+
+// 添加新的连接
+func (m *ConnectionManager) addConnection(pkt TcpPacket, mss uint16) *Connection {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
-	m.Connections = append(m.Connections, conn)
+	key := segmentKey(pkt)
+	conn := newConnection(key.local, key.remote, SynReceived, mss)
+
+	m.connections[key] = conn
 
 	return conn
 }
 
-func (m *ConnectionManager) updateSeqNum(pkt TcpPacket, incrementSeqNum uint32) {
+// 为主动打开的连接分配临时端口并添加连接 (RFC 6056 3.3.1)
+func (m *ConnectionManager) addActiveConnection(local netip.Addr, remote netip.AddrPort, mss uint16) (*Connection, error) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	for i, conn := range m.Connections {
-		if conn.SrcPort == pkt.TcpHeader.SrcPort && conn.DstPort == pkt.TcpHeader.DstPort {
-			m.Connections[i].incrementSeqNum += incrementSeqNum
+	count := uint32(EPHEMERAL_PORT_MAX - EPHEMERAL_PORT_MIN + 1)
+	offset := rand.Uint32()
+	for i := uint32(0); i < count; i++ {
+		port := uint16(EPHEMERAL_PORT_MIN + (offset+i)%count)
+		key := connKey{local: netip.AddrPortFrom(local, port), remote: remote}
+		if _, ok := m.connections[key]; ok {
+			continue
+		}
+		// 不占用监听者的端口
+		if _, ok := m.listeners[key.local]; ok {
+			continue
+		}
+		if _, ok := m.listeners[netip.AddrPortFrom(netip.Addr{}, port)]; ok {
+			continue
+		}
+
+		conn := newConnection(key.local, remote, SynSent, mss)
+		m.connections[key] = conn
+		return conn, nil
+	}
+	return nil, fmt.Errorf("no ephemeral port available for %s", remote)
+}
+
+// 处理已协商ECN的连接上收到的拥塞信号 (RFC 3168 6.1.2, 6.1.3)，
+// 报文段需要先通过序列号和确认号的检查，旧的或伪造的报文段不能改变拥塞状态
+func (conn *Connection) recvEcn(pkt TcpPacket) {
+	// CWR表示对端已经降低了拥塞窗口，停止回显ECE
+	if pkt.TcpHeader.Flags.CWR {
+		conn.ecnEcho = false
+	}
+	if pkt.Ecn == internet.ECN_CE {
+		conn.ceCount++
+		conn.ecnEcho = true
+		log.Printf("recv CE mark, src port: %d, dst port: %d", pkt.TcpHeader.SrcPort, pkt.TcpHeader.DstPort)
+	}
+	// 对端回显的ECE表示路径上发生了拥塞，下一个数据报文段中用CWR应答
+	if pkt.TcpHeader.Flags.ECE && !pkt.TcpHeader.Flags.SYN {
+		conn.cwrPending = true
+		if pkt.TcpHeader.Flags.ACK {
+			conn.recvEce(pkt.TcpHeader.AckNum)
+		}
+	}
+}
+
+// 根据确认号移除已被完整确认的报文段，返回被确认的报文段
+func (conn *Connection) ackSegments(ackNum uint32) []segment {
+	var acked []segment
+	unacked := conn.unacked[:0]
+	for _, seg := range conn.unacked {
+		if seqLT(ackNum, seg.seqNum+seg.length()) {
+			unacked = append(unacked, seg)
+		} else {
+			acked = append(acked, seg)
+		}
+	}
+	conn.unacked = unacked
+	return acked
+}
+
+// 处理与连接相关的ICMP差错
+func (m *ConnectionManager) recvIcmpError(queue *TcpPacketQueue, icmpErr internet.IcmpError) {
+	if len(icmpErr.Data) < 8 {
+		return
+	}
+	// 差错报文携带的是本端发出的报文段，源地址和源端口是本地的
+	localPort := binary.BigEndian.Uint16(icmpErr.Data[0:2])
+	remotePort := binary.BigEndian.Uint16(icmpErr.Data[2:4])
+	seqNum := binary.BigEndian.Uint32(icmpErr.Data[4:8])
+
+	conn, ok := m.find(connKey{
+		local:  netip.AddrPortFrom(icmpErr.SrcIP, localPort),
+		remote: netip.AddrPortFrom(icmpErr.DstIP, remotePort),
+	})
+	if !ok {
+		return
+	}
+
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	// 序列号必须落在已发送的范围内，防止伪造的ICMP差错攻击连接 (RFC 5927)
+	if seqLT(seqNum, conn.sndUna) || !seqLT(seqNum, conn.sndNxt) {
+		log.Printf("icmp error with invalid seq num, src port: %d, dst port: %d", localPort, remotePort)
+		return
+	}
+
+	switch {
+	case icmpErr.IsFragmentationNeeded():
+		// 路径MTU扣除IP和TCP头部即为新的MSS
+		mss := mtuToMss(icmpErr.NextHopMTU, icmpErr.DstIP)
+		if mss == 0 {
 			return
 		}
+		if mss < conn.mss {
+			conn.setMss(mss)
+		}
+		log.Printf("recv fragmentation needed, src port: %d, dst port: %d, mss: %d", localPort, remotePort, conn.mss)
+		// 超过MSS的未确认报文段已被丢弃，切分后重传。发送时可能已经按缓存的路径MTU调小了MSS，
+		// 此时也要切分之前按旧MSS发出的报文段
+		var retransmit []segment
+		conn.unacked, retransmit = splitSegments(conn.unacked, conn.mss)
+		for _, seg := range retransmit {
+			queue.send(conn, seg)
+		}
+	case icmpErr.IsHard():
+		// 硬错误直接中止连接
+		log.Printf("abort connection on %s, src port: %d, dst port: %d", icmpErr.Error(), localPort, remotePort)
+		conn.Err = icmpErr
+		conn.setState(Closed)
+		m.remove(conn)
+	default:
+		// 软错误只记录下来，由上层决定是否放弃
+		conn.Err = icmpErr
+	}
+}
+
+// 将超过mss的报文段切分，返回新的未确认队列和需要重传的报文段
+func splitSegments(segs []segment, mss uint16) ([]segment, []segment) {
+	var unacked, retransmit []segment
+	for _, seg := range segs {
+		if len(seg.data) <= int(mss) {
+			unacked = append(unacked, seg)
+			continue
+		}
+		for offset := 0; offset < len(seg.data); offset += int(mss) {
+			end := offset + int(mss)
+			if end > len(seg.data) {
+				end = len(seg.data)
+			}
+			piece := segment{
+				seqNum: seg.seqNum + uint32(offset),
+				flags:  seg.flags,
+				data:   seg.data[offset:end],
+
+				retransmit: true,
+			}
+			// SYN只保留在第一段，FIN只保留在最后一段
+			if offset > 0 {
+				piece.flags.SYN = false
+				if seg.flags.SYN {
+					piece.seqNum++
+				}
+			}
+			if end < len(seg.data) {
+				piece.flags.FIN = false
+			}
+			unacked = append(unacked, piece)
+			retransmit = append(retransmit, piece)
+		}
 	}
+	return unacked, retransmit
 }
@@ -0,0 +1,112 @@
+package transport
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	CUBIC_C    = 0.4 // 三次函数的缩放系数 (RFC 9438 5)
+	CUBIC_BETA = 0.7 // 拥塞事件后窗口的缩减系数
+	// 与Reno公平的加性增长系数 (RFC 9438 4.3)
+	CUBIC_ALPHA = 3 * (1 - CUBIC_BETA) / (1 + CUBIC_BETA)
+)
+
+// Cubic RFC 9438的CUBIC拥塞控制。拥塞避免阶段的窗口是距上一次拥塞事件时间的三次函数，
+// 在上一次拥塞的窗口附近增长放缓，远离时快速增长，与RTT无关。窗口以报文段为单位计算
+type Cubic struct {
+	wMax       float64   // 上一次拥塞事件前的窗口
+	cwndPrior  float64   // 上一次拥塞事件时的窗口
+	k          float64   // 窗口增长回wMax需要的秒数
+	epochStart time.Time // 当前拥塞避免阶段开始的时间，零值表示还没有开始
+	wEst       float64   // 按Reno方式估计的窗口
+	credit     float64   // 还不足一个字节的窗口增量
+}
+
+// NewCubic 创建CUBIC拥塞控制
+func NewCubic() CongestionControl {
+	return &Cubic{}
+}
+
+func (c *Cubic) Name() string {
+	return "cubic"
+}
+
+func (c *Cubic) Init(mss uint32) (uint32, uint32) {
+	return initialWindow(mss), math.MaxUint32
+}
+
+// W_cubic(t) = C * (t - K)^3 + W_max (RFC 9438 4.2)
+func (c *Cubic) window(t time.Duration) float64 {
+	d := t.Seconds() - c.k
+	return CUBIC_C*d*d*d + c.wMax
+}
+
+func (c *Cubic) OnAck(s CongestionState, acked uint32) (uint32, uint32) {
+	if s.Cwnd < s.Ssthresh {
+		return slowStart(s, acked), s.Ssthresh
+	}
+
+	mss := float64(s.Mss)
+	cwnd := float64(s.Cwnd) / mss
+	now := time.Now()
+	if c.epochStart.IsZero() {
+		c.epochStart = now
+		c.wEst = cwnd
+		if cwnd < c.wMax {
+			c.k = math.Cbrt((c.wMax - cwnd) / CUBIC_C)
+		} else {
+			c.k = 0
+			c.wMax = cwnd
+		}
+	}
+	t := now.Sub(c.epochStart)
+
+	// Reno友好区域：窗口达到上一次拥塞时的大小后按标准Reno增长 (RFC 9438 4.3)
+	alpha := CUBIC_ALPHA
+	if c.wEst >= c.cwndPrior {
+		alpha = 1
+	}
+	c.wEst += alpha * float64(acked) / mss / cwnd
+	if c.window(t) < c.wEst {
+		return uint32(c.wEst * mss), s.Ssthresh
+	}
+
+	// 以一个RTT之后的三次函数值为目标，限制在[cwnd, 1.5cwnd]之间 (RFC 9438 4.4, 4.5)
+	target := min(max(c.window(t+s.Srtt), cwnd), 1.5*cwnd)
+	inc := (target-cwnd)/cwnd*float64(acked) + c.credit
+	bytes := math.Floor(inc)
+	c.credit = inc - bytes
+	return s.Cwnd + uint32(bytes), s.Ssthresh
+}
+
+// 拥塞事件：记录wMax并把窗口缩减为beta倍，开始新的拥塞避免阶段 (RFC 9438 4.6, 4.7)
+func (c *Cubic) reduce(s CongestionState) uint32 {
+	mss := float64(s.Mss)
+	cwnd := float64(s.Cwnd) / mss
+	// 快速收敛：窗口比上一次拥塞时小，说明有新的流加入，让出更多带宽
+	if cwnd < c.wMax {
+		c.wMax = cwnd * (1 + CUBIC_BETA) / 2
+	} else {
+		c.wMax = cwnd
+	}
+	c.cwndPrior = cwnd
+	c.epochStart = time.Time{}
+	c.credit = 0
+	return max(uint32(cwnd*CUBIC_BETA*mss), 2*s.Mss)
+}
+
+func (c *Cubic) OnLoss(s CongestionState) (uint32, uint32) {
+	ssthresh := c.reduce(s)
+	return ssthresh, ssthresh
+}
+
+// 超时后按Reno回到一个报文段，阈值按beta缩减 (RFC 9438 4.8)
+func (c *Cubic) OnRetransmitTimeout(s CongestionState) (uint32, uint32) {
+	return s.Mss, c.reduce(s)
+}
+
+func (c *Cubic) OnEcn(s CongestionState) (uint32, uint32) {
+	ssthresh := c.reduce(s)
+	return ssthresh, ssthresh
+}
@@ -0,0 +1,156 @@
+package transport
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// 窗口为100个报文段时发生拥塞后进入拥塞避免的CUBIC，t为距拥塞避免阶段开始的时间
+func cubicAfterLoss(t time.Duration) (*Cubic, CongestionState) {
+	c := NewCubic().(*Cubic)
+	s := CongestionState{Mss: testMss, Cwnd: 100 * testMss, InFlight: 100 * testMss}
+	s.Cwnd, s.Ssthresh = c.OnLoss(s)
+	c.OnAck(s, 0)
+	c.epochStart = time.Now().Add(-t)
+	c.wEst = float64(s.Cwnd) / testMss
+	return c, s
+}
+
+func TestCubicSlowStart(t *testing.T) {
+	c := NewCubic()
+	cwnd, ssthresh := c.Init(testMss)
+	s := CongestionState{Mss: testMss, Cwnd: cwnd, Ssthresh: ssthresh}
+	if got, _ := c.OnAck(s, 2*testMss); got != cwnd+testMss {
+		t.Fatalf("cwnd %d, want %d", got, cwnd+testMss)
+	}
+}
+
+// W_cubic(t) = C * (t - K)^3 + W_max，K = cbrt(W_max * (1 - beta) / C) (RFC 9438 4.2)
+func TestCubicWindow(t *testing.T) {
+	c, _ := cubicAfterLoss(0)
+	if c.wMax != 100 {
+		t.Fatalf("wMax %f, want 100", c.wMax)
+	}
+	k := math.Cbrt(100 * (1 - CUBIC_BETA) / CUBIC_C)
+	if math.Abs(c.k-k) > 1e-9 {
+		t.Fatalf("K %f, want %f", c.k, k)
+	}
+
+	tests := []struct {
+		t    float64
+		want float64
+	}{
+		{0, 100 * CUBIC_BETA},
+		{k / 2, 100 - CUBIC_C*k*k*k/8},
+		{k, 100},
+		{k + 1, 100 + CUBIC_C},
+		{k + 2, 100 + 8*CUBIC_C},
+	}
+	for _, tt := range tests {
+		got := c.window(time.Duration(tt.t * float64(time.Second)))
+		if math.Abs(got-tt.want) > 1e-6 {
+			t.Errorf("W_cubic(%.3fs) = %f, want %f", tt.t, got, tt.want)
+		}
+	}
+}
+
+// 拥塞避免阶段确认一个窗口的数据后，窗口增长到W_cubic(t)，但每个RTT不超过1.5倍
+func TestCubicCongestionAvoidance(t *testing.T) {
+	k := math.Cbrt(100 * (1 - CUBIC_BETA) / CUBIC_C)
+	tests := []struct {
+		name string
+		t    float64
+		want float64 // 以报文段为单位
+	}{
+		{"concave", k / 2, 100 - CUBIC_C*k*k*k/8},
+		{"plateau", k, 100},
+		{"convex", k + 2, 100 + 8*CUBIC_C},
+		{"limited to 1.5 cwnd", k + 10, 1.5 * 70},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s := cubicAfterLoss(time.Duration(tt.t * float64(time.Second)))
+			cwnd, ssthresh := c.OnAck(s, s.Cwnd)
+			if ssthresh != s.Ssthresh {
+				t.Fatalf("ssthresh changed to %d", ssthresh)
+			}
+			if got := float64(cwnd) / testMss; math.Abs(got-tt.want) > 0.1 {
+				t.Fatalf("cwnd %.2f segments, want %.2f", got, tt.want)
+			}
+		})
+	}
+}
+
+// 三次函数的值低于按Reno估计的窗口时按Reno增长 (RFC 9438 4.3)
+func TestCubicRenoFriendly(t *testing.T) {
+	c, s := cubicAfterLoss(0)
+	cwnd, _ := c.OnAck(s, s.Cwnd)
+	if got, want := float64(cwnd)/testMss, 70+CUBIC_ALPHA; math.Abs(got-want) > 0.01 {
+		t.Fatalf("cwnd %.3f segments, want %.3f with alpha %.3f", got, want, CUBIC_ALPHA)
+	}
+
+	// 估计的窗口达到上一次拥塞时的窗口后alpha为1
+	c, s = cubicAfterLoss(0)
+	c.wEst = 100
+	s.Cwnd = 100 * testMss
+	cwnd, _ = c.OnAck(s, s.Cwnd)
+	if got := float64(cwnd) / testMss; math.Abs(got-101) > 0.01 {
+		t.Fatalf("cwnd %.3f segments, want 101", got)
+	}
+}
+
+func TestCubicLoss(t *testing.T) {
+	tests := []struct {
+		name         string
+		event        func(CongestionControl, CongestionState) (uint32, uint32)
+		cwnd         uint32 // 以报文段为单位
+		wantCwnd     uint32
+		wantSsthresh uint32
+	}{
+		{"fast retransmit", CongestionControl.OnLoss, 100, 70, 70},
+		{"retransmit timeout", CongestionControl.OnRetransmitTimeout, 100, 1, 70},
+		{"ecn", CongestionControl.OnEcn, 100, 70, 70},
+		{"minimum", CongestionControl.OnLoss, 2, 2, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCubic().(*Cubic)
+			c.epochStart = time.Now()
+			s := CongestionState{Mss: testMss, Cwnd: tt.cwnd * testMss, Ssthresh: math.MaxUint32, InFlight: tt.cwnd * testMss}
+			cwnd, ssthresh := tt.event(c, s)
+			if cwnd != tt.wantCwnd*testMss || ssthresh != tt.wantSsthresh*testMss {
+				t.Fatalf("cwnd %d ssthresh %d, want %d %d", cwnd, ssthresh, tt.wantCwnd*testMss, tt.wantSsthresh*testMss)
+			}
+			if c.wMax != float64(tt.cwnd) || c.cwndPrior != float64(tt.cwnd) || !c.epochStart.IsZero() {
+				t.Fatalf("wMax %f cwndPrior %f epoch %s after loss", c.wMax, c.cwndPrior, c.epochStart)
+			}
+		})
+	}
+}
+
+// 快速收敛：拥塞时的窗口小于上一次的wMax时，wMax取两者之间更低的值 (RFC 9438 4.7)
+func TestCubicFastConvergence(t *testing.T) {
+	tests := []struct {
+		name     string
+		cwnd     float64
+		wantWMax float64
+	}{
+		{"window shrinking", 80, 80 * (1 + CUBIC_BETA) / 2},
+		{"window equal", 100, 100},
+		{"window growing", 120, 120},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCubic().(*Cubic)
+			c.OnLoss(CongestionState{Mss: testMss, Cwnd: 100 * testMss})
+			cwnd, _ := c.OnLoss(CongestionState{Mss: testMss, Cwnd: uint32(tt.cwnd * testMss)})
+			if math.Abs(c.wMax-tt.wantWMax) > 1e-9 {
+				t.Fatalf("wMax %f, want %f", c.wMax, tt.wantWMax)
+			}
+			if want := uint32(tt.cwnd * CUBIC_BETA * testMss); cwnd != want {
+				t.Fatalf("cwnd %d, want %d", cwnd, want)
+			}
+		})
+	}
+}
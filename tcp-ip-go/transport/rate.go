@@ -0,0 +1,104 @@
+package transport
+
+import "time"
+
+const (
+	PACING_QUANTUM = time.Millisecond // 按发送速率一次最多提前发送的时间量，减少定时器的触发次数
+)
+
+// 发送占用序列号的报文段时记录连接当前的投递状态，调用方持有连接的锁
+func (conn *Connection) onSend(seg *segment) {
+	// 没有数据在传输时从这个报文段开始新的采样区间
+	if len(conn.unacked) == 0 {
+		conn.firstSentTime = seg.sentAt
+		conn.deliveredTime = seg.sentAt
+	}
+	seg.delivered = conn.delivered
+	seg.deliveredTime = conn.deliveredTime
+	seg.firstSentTime = conn.firstSentTime
+	seg.appLimited = conn.appLimited != 0
+}
+
+// 累计被确认的报文段，用其中最后发送的报文段生成投递速率样本。
+// 重传的报文段无法区分确认的是哪一次发送，不用于采样，调用方持有连接的锁
+func (conn *Connection) sampleRate(acked []segment) (RateSample, bool) {
+	now := time.Now()
+	var p *segment
+	for i := range acked {
+		seg := &acked[i]
+		conn.delivered += uint64(seg.length())
+		conn.deliveredTime = now
+		if !seg.retransmit && (p == nil || seg.sentAt.After(p.sentAt)) {
+			p = seg
+		}
+	}
+	// 受应用限制的数据都已被确认
+	if conn.appLimited != 0 && conn.delivered > conn.appLimited {
+		conn.appLimited = 0
+	}
+	if p == nil {
+		return RateSample{}, false
+	}
+
+	conn.firstSentTime = p.sentAt
+	// 确认可能被压缩，取发送和确认两个区间中较长的，避免高估速率
+	sendElapsed := p.sentAt.Sub(p.firstSentTime)
+	ackElapsed := conn.deliveredTime.Sub(p.deliveredTime)
+	rs := RateSample{
+		Delivered:      conn.delivered,
+		PriorDelivered: p.delivered,
+		Interval:       max(sendElapsed, ackElapsed),
+		Rtt:            now.Sub(p.sentAt),
+		AppLimited:     p.appLimited,
+	}
+	if rs.Interval > 0 {
+		rs.DeliveryRate = float64(rs.Delivered-rs.PriorDelivered) / rs.Interval.Seconds()
+	}
+	return rs, true
+}
+
+// 应用没有更多数据而窗口还有余量，之后发送的报文段受应用限制，
+// 直到这时在传输中的数据都被确认，调用方持有连接的锁
+func (conn *Connection) markAppLimited() {
+	conn.appLimited = max(conn.delivered+uint64(conn.bytesInFlight()), 1)
+}
+
+// 按拥塞控制算法给出的速率检查现在能否发送，不能时启动定时器稍后继续发送，调用方持有连接的锁
+func (tcp *TcpPacketQueue) paced(conn *Connection) bool {
+	pacer, ok := conn.cc.(Pacer)
+	if !ok || pacer.PacingRate() == 0 {
+		return true
+	}
+	now := time.Now()
+	// 空闲的时间不能积累为之后的突发
+	if conn.nextSend.Before(now) {
+		conn.nextSend = now
+	}
+	wait := conn.nextSend.Sub(now) - PACING_QUANTUM
+	if wait <= 0 {
+		return true
+	}
+	if conn.paceTimer == nil {
+		conn.paceTimer = time.AfterFunc(wait, func() { tcp.paceTimeout(conn) })
+	} else {
+		conn.paceTimer.Reset(wait)
+	}
+	return false
+}
+
+// 发送了length字节后推迟下一个报文段的发送时间，调用方持有连接的锁
+func (conn *Connection) onPacedSend(length int) {
+	pacer, ok := conn.cc.(Pacer)
+	if !ok {
+		return
+	}
+	if rate := pacer.PacingRate(); rate > 0 {
+		conn.nextSend = conn.nextSend.Add(time.Duration(float64(length) / float64(rate) * float64(time.Second)))
+	}
+}
+
+func (tcp *TcpPacketQueue) paceTimeout(conn *Connection) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	tcp.fill(conn)
+}
@@ -0,0 +1,171 @@
+package transport
+
+import (
+	"testing"
+	"time"
+)
+
+// 模拟发送一个报文段，sentAt为发送时间
+func sendSegment(conn *Connection, sentAt time.Time, retransmit bool) {
+	seg := segment{seqNum: conn.sndNxt, data: make([]byte, testMss), sentAt: sentAt, retransmit: retransmit}
+	conn.onSend(&seg)
+	conn.unacked = append(conn.unacked, seg)
+	conn.sndNxt += testMss
+}
+
+// 确认最早的n个报文段
+func ackSegments(conn *Connection, n int) (RateSample, bool) {
+	acked := conn.unacked[:n]
+	conn.unacked = conn.unacked[n:]
+	conn.sndUna += uint32(n) * testMss
+	return conn.sampleRate(acked)
+}
+
+func near(got, want, tolerance time.Duration) bool {
+	return got >= want-tolerance && got <= want+tolerance
+}
+
+func TestSampleRate(t *testing.T) {
+	tcp := newTestQueue()
+	conn := testConnection(tcp, Established)
+	defer tcp.abort(conn, nil)
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	// 第一个窗口在100毫秒前开始每毫秒发送一个报文段
+	start := time.Now().Add(-100 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		sendSegment(conn, start.Add(time.Duration(i)*time.Millisecond), false)
+	}
+	rs, ok := ackSegments(conn, 5)
+	if !ok {
+		t.Fatal("no rate sample")
+	}
+	// 采样区间取较长的确认区间：从第一个报文段发送到现在
+	if rs.Delivered != 5*testMss || rs.PriorDelivered != 0 || !near(rs.Interval, 100*time.Millisecond, 20*time.Millisecond) {
+		t.Fatalf("sample %+v, want 5 segments delivered in about 100ms", rs)
+	}
+	if want := float64(rs.Delivered) / rs.Interval.Seconds(); rs.DeliveryRate != want {
+		t.Fatalf("delivery rate %.0f, want %.0f", rs.DeliveryRate, want)
+	}
+	if !near(rs.Rtt, 96*time.Millisecond, 20*time.Millisecond) || rs.AppLimited {
+		t.Fatalf("sample %+v, want rtt of the last segment sent", rs)
+	}
+
+	// 确认之后发送的报文段从确认时的投递状态开始采样，较长的是发送区间
+	sendSegment(conn, time.Now(), false)
+	ackSegments(conn, 5)
+	rs, ok = ackSegments(conn, 1)
+	if !ok {
+		t.Fatal("no rate sample")
+	}
+	if rs.Delivered != 11*testMss || rs.PriorDelivered != 5*testMss || !near(rs.Interval, 96*time.Millisecond, 20*time.Millisecond) {
+		t.Fatalf("sample %+v, want 6 segments delivered over the send interval", rs)
+	}
+
+	// 只确认了重传的报文段时不采样，但累计投递量仍然增加
+	sendSegment(conn, time.Now(), true)
+	if _, ok := ackSegments(conn, 1); ok {
+		t.Fatal("rate sampled from a retransmitted segment")
+	}
+	if conn.delivered != 12*testMss {
+		t.Fatalf("delivered %d, want %d", conn.delivered, 12*testMss)
+	}
+}
+
+// 应用没有数据可发时之后的报文段标记为受应用限制，之前在传输中的数据都被确认后解除
+func TestSampleRateAppLimited(t *testing.T) {
+	tcp := newTestQueue()
+	conn := testConnection(tcp, Established)
+	defer tcp.abort(conn, nil)
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	now := time.Now()
+	sendSegment(conn, now, false)
+	conn.markAppLimited()
+	if conn.appLimited != testMss {
+		t.Fatalf("app limited until %d, want %d", conn.appLimited, testMss)
+	}
+	sendSegment(conn, now, false)
+
+	rs, _ := ackSegments(conn, 1)
+	if rs.AppLimited || conn.appLimited == 0 {
+		t.Fatalf("sample app limited %t, connection app limited until %d", rs.AppLimited, conn.appLimited)
+	}
+	rs, _ = ackSegments(conn, 1)
+	if !rs.AppLimited || conn.appLimited != 0 {
+		t.Fatalf("sample app limited %t, connection app limited until %d", rs.AppLimited, conn.appLimited)
+	}
+}
+
+// 按固定速率发送的拥塞控制
+type fixedPacer struct {
+	Reno
+	rate uint64
+}
+
+func (p *fixedPacer) PacingRate() uint64 {
+	return p.rate
+}
+
+// 报文段按拥塞控制给出的速率发送，超出一个PACING_QUANTUM的部分由定时器稍后发送
+func TestPacing(t *testing.T) {
+	tcp := newTestQueue()
+	conn := testConnection(tcp, Established)
+	mss := uint32(conn.mss)
+	// 每毫秒发送一个报文段
+	rate := uint64(mss) * uint64(time.Second/time.Millisecond)
+	conn.lock.Lock()
+	conn.setCongestionControl(&fixedPacer{rate: rate})
+	conn.cwnd = 100 * mss
+	conn.snd.write(make([]byte, 10*mss))
+	start := time.Now()
+	tcp.fill(conn)
+	sent := len(sentHeaders(t, tcp))
+	nextSend := conn.nextSend
+	conn.lock.Unlock()
+	defer func() {
+		conn.lock.Lock()
+		tcp.terminate(conn, nil)
+		conn.lock.Unlock()
+	}()
+
+	if sent < 1 || sent > 3 {
+		t.Fatalf("sent %d segments at once, want at most one quantum", sent)
+	}
+	if want := start.Add(time.Duration(sent) * time.Millisecond); !near(nextSend.Sub(want), 0, time.Millisecond) {
+		t.Fatalf("next send at %s after start, want %s", nextSend.Sub(start), time.Duration(sent)*time.Millisecond)
+	}
+
+	// 定时器到期后继续发送剩下的报文段
+	deadline := time.Now().Add(5 * time.Second)
+	for sent < 10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("sent %d segments, want 10", sent)
+		}
+		time.Sleep(time.Millisecond)
+		conn.lock.Lock()
+		sent += len(sentHeaders(t, tcp))
+		conn.lock.Unlock()
+	}
+	if elapsed := time.Since(start); elapsed < 7*time.Millisecond {
+		t.Fatalf("10 segments sent in %s, want paced over about 9ms", elapsed)
+	}
+}
+
+// 不限速时不推迟发送
+func TestPacingDisabled(t *testing.T) {
+	tcp := newTestQueue()
+	conn := testConnection(tcp, Established)
+	mss := uint32(conn.mss)
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	defer tcp.terminate(conn, nil)
+	conn.setCongestionControl(&fixedPacer{})
+	conn.snd.write(make([]byte, 5*mss))
+	tcp.fill(conn)
+	if sent := len(sentHeaders(t, tcp)); sent != 5 || conn.paceTimer != nil {
+		t.Fatalf("sent %d segments, pace timer %v", sent, conn.paceTimer)
+	}
+}
@@ -0,0 +1,340 @@
+package transport
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	SEND_BUFFER_SIZE = WINDOW_SIZE // 每条连接的发送缓冲区大小，包括已发送未确认的数据
+
+	INITIAL_RTO         = time.Second      // 初始重传超时 (RFC 6298 2.1)
+	MIN_RTO             = time.Second      // RTO的下限 (RFC 6298 2.4)
+	MAX_RTO             = 60 * time.Second // RTO的上限 (RFC 6298 2.5)
+	SYN_TIMEOUT_RTO     = 3 * time.Second  // SYN超时重传过的连接在握手完成后使用的RTO (RFC 6298 5.7)
+	CLOCK_GRANULARITY   = time.Millisecond // 时钟粒度G
+	SYN_RETRIES         = 6                // SYN的最大重传次数
+	MAX_RETRANSMISSIONS = 8                // 同一报文段连续重传的上限，超过后中止连接
+	DUPACK_THRESHOLD    = 3                // 触发快速重传的重复ACK数 (RFC 5681 3.2)
+)
+
+// 已发送但未被确认的字节数
+func (conn *Connection) bytesInFlight() uint32 {
+	return conn.sndNxt - conn.sndUna
+}
+
+// 发送缓冲区还能写入的字节数
+func (conn *Connection) sendSpace() int {
+	return SEND_BUFFER_SIZE - conn.snd.bufferSize() - int(conn.bytesInFlight())
+}
+
+// 按发送窗口把缓冲区中的数据切分为不超过MSS的报文段发送，
+// 数据发完且应用已关闭发送方向时发送FIN，调用方持有连接的锁
+func (tcp *TcpPacketQueue) fill(conn *Connection) {
+	switch conn.State {
+	case Established, CloseWait, FinWait1, Closing, LastAck:
+	default:
+		return
+	}
+
+	tcp.refreshMss(conn)
+	// 对端通告零窗口时按一个字节的窗口发送，作为零窗口探测 (RFC 9293 3.8.6.1)
+	window := max(min(conn.sndWnd, conn.congestionWindow()), 1)
+	for !conn.finSent {
+		inFlight := conn.bytesInFlight()
+		if inFlight >= window {
+			return
+		}
+		n := min(window-inFlight, uint32(conn.mss), uint32(conn.snd.bufferSize()))
+		// FIN也占用一个序列号，窗口还有余量时随最后一段数据发送
+		fin := conn.writeClosed && int(n) == conn.snd.bufferSize() && inFlight+n < window
+		if n == 0 && !fin {
+			if conn.snd.bufferSize() == 0 {
+				conn.markAppLimited()
+			}
+			return
+		}
+		if !tcp.paced(conn) {
+			return
+		}
+
+		data := make([]byte, n)
+		conn.snd.readTo(data)
+		// 发送缓冲区中的最后一段设置PSH，让对端尽快交给应用
+		flags := HeaderFlags{ACK: true, PSH: n > 0 && conn.snd.bufferSize() == 0, FIN: fin}
+		tcp.write(conn, flags, data)
+		conn.onPacedSend(len(data))
+		if fin {
+			conn.finSent = true
+		}
+	}
+}
+
+// 发送时使用的拥塞窗口。快速重传之前的前两个重复ACK各允许发送一个新的报文段，
+// 拥塞窗口本身不变 (RFC 3042 2)
+func (conn *Connection) congestionWindow() uint32 {
+	if conn.inRecovery || conn.dupAcks >= DUPACK_THRESHOLD {
+		return conn.cwnd
+	}
+	return conn.cwnd + uint32(conn.dupAcks)*uint32(conn.mss)
+}
+
+// 往返时间估计 (RFC 6298 2)
+type rttEstimator struct {
+	srtt     time.Duration // 平滑往返时间
+	rttvar   time.Duration // 往返时间的偏差
+	rto      time.Duration // 重传超时
+	measured bool          // 是否已有测量值
+}
+
+// 用一次测量值更新估计和RTO
+func (e *rttEstimator) sample(r time.Duration) {
+	if !e.measured {
+		e.srtt = r
+		e.rttvar = r / 2
+		e.measured = true
+	} else {
+		// RTTVAR <- (1 - beta) * RTTVAR + beta * |SRTT - R'|，beta = 1/4
+		// SRTT <- (1 - alpha) * SRTT + alpha * R'，alpha = 1/8
+		diff := e.srtt - r
+		if diff < 0 {
+			diff = -diff
+		}
+		e.rttvar = (3*e.rttvar + diff) / 4
+		e.srtt = (7*e.srtt + r) / 8
+	}
+	e.rto = min(max(e.srtt+max(CLOCK_GRANULARITY, 4*e.rttvar), MIN_RTO), MAX_RTO)
+}
+
+// 超时后RTO加倍 (RFC 6298 5.5)
+func (e *rttEstimator) backoff() {
+	e.rto = min(2*e.rto, MAX_RTO)
+}
+
+// 定时器没有运行时启动，调用方持有连接的锁 (RFC 6298 5.1)
+func (tcp *TcpPacketQueue) startTimer(conn *Connection) {
+	if conn.rtoExpires.IsZero() {
+		tcp.restartTimer(conn)
+	}
+}
+
+// 从现在开始重新计时
+func (tcp *TcpPacketQueue) restartTimer(conn *Connection) {
+	conn.rtoExpires = time.Now().Add(conn.rtt.rto)
+	if conn.rtoTimer == nil {
+		conn.rtoTimer = time.AfterFunc(conn.rtt.rto, func() { tcp.retransmitTimeout(conn) })
+		return
+	}
+	conn.rtoTimer.Reset(conn.rtt.rto)
+}
+
+func (conn *Connection) stopTimer() {
+	conn.rtoExpires = time.Time{}
+	if conn.rtoTimer != nil {
+		conn.rtoTimer.Stop()
+	}
+}
+
+// 收到确认了新数据的ACK：按Karn算法只用没有重传过的报文段测量RTT，
+// 然后重新启动或停止定时器 (RFC 6298 3, 5.2, 5.3)，调用方持有连接的锁
+func (tcp *TcpPacketQueue) ackReceived(conn *Connection, acked []segment) {
+	sample := len(acked) > 0
+	for _, seg := range acked {
+		if seg.retransmit {
+			sample = false
+		}
+	}
+	if sample {
+		conn.rtt.sample(time.Since(acked[0].sentAt))
+	}
+	// 等待SYN的确认时定时器到期过，握手完成后不沿用退避的RTO，重新初始化为3秒 (RFC 6298 5.7)
+	if conn.retransmissions > 0 && len(acked) > 0 && acked[0].flags.SYN {
+		conn.rtt.rto = SYN_TIMEOUT_RTO
+	}
+
+	conn.retransmissions = 0
+	if len(conn.unacked) > 0 {
+		tcp.restartTimer(conn)
+	} else {
+		conn.stopTimer()
+	}
+}
+
+// 重传定时器到期：重传最早的未确认报文段并加倍RTO，连续重传次数过多时中止连接 (RFC 6298 5.4-5.6)
+func (tcp *TcpPacketQueue) retransmitTimeout(conn *Connection) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	// 定时器已被停止或重新计时
+	if conn.rtoExpires.IsZero() || time.Now().Before(conn.rtoExpires) {
+		return
+	}
+	conn.rtoExpires = time.Time{}
+	if len(conn.unacked) == 0 {
+		return
+	}
+
+	limit := MAX_RETRANSMISSIONS
+	if conn.unacked[0].flags.SYN {
+		limit = SYN_RETRIES
+	}
+	if conn.retransmissions >= limit {
+		log.Printf("too many retransmissions, abort connection %s -> %s", conn.LocalAddr, conn.RemoteAddr)
+		tcp.terminate(conn, ErrConnectionTimeout)
+		return
+	}
+
+	// 同一报文段的多次超时只降低一次拥塞窗口 (RFC 5681 3.1)，
+	// 超时前发出的数据都按丢失处理，不再进入快速恢复 (RFC 6582 3.2 第四步)
+	if conn.retransmissions == 0 {
+		conn.setCongestionWindow(conn.cc.OnRetransmitTimeout(conn.congestionState()))
+	}
+	conn.recover = conn.sndNxt - 1
+	conn.inRecovery = false
+	conn.lossRecovery = true
+	conn.dupAcks = 0
+
+	conn.retransmissions++
+	conn.unacked[0].retransmit = true
+	log.Printf("retransmit seq %d, %s -> %s, rto: %s", conn.unacked[0].seqNum, conn.LocalAddr, conn.RemoteAddr, conn.rtt.rto)
+	tcp.send(conn, conn.unacked[0])
+	conn.rtt.backoff()
+	tcp.restartTimer(conn)
+}
+
+// 重复ACK：不携带数据和SYN、FIN，确认号等于SND.UNA，窗口没有变化，并且有未确认的数据 (RFC 5681 2)
+func (conn *Connection) isDupAck(pkt TcpPacket) bool {
+	hdr := pkt.TcpHeader
+	return hdr.AckNum == conn.sndUna && len(conn.unacked) > 0 && len(pkt.Payload) == 0 &&
+		!hdr.Flags.SYN && !hdr.Flags.FIN && uint32(hdr.Window) == conn.sndWnd
+}
+
+// 收到重复ACK，第三个时快速重传并进入NewReno快速恢复 (RFC 6582 3.2)，调用方持有连接的锁
+func (tcp *TcpPacketQueue) recvDupAck(conn *Connection) {
+	mss := uint32(conn.mss)
+	conn.dupAcks++
+	if conn.dupAcks == 1 && !conn.inRecovery {
+		conn.dupAckFlight = conn.bytesInFlight()
+	}
+	switch {
+	case conn.inRecovery:
+		// 每个重复ACK表示有一个报文段离开了网络，膨胀拥塞窗口
+		conn.cwnd += mss
+	case conn.dupAcks == DUPACK_THRESHOLD:
+		// 确认号没有越过recover时，重复ACK可能来自上一次恢复中的重传，不再降低窗口
+		if !seqLT(conn.recover, conn.sndUna) {
+			return
+		}
+		// Limited Transmit发送的数据不计入FlightSize (RFC 5681 3.2)
+		s := conn.congestionState()
+		s.InFlight = conn.dupAckFlight
+		cwnd, ssthresh := conn.cc.OnLoss(s)
+		conn.recover = conn.sndNxt - 1
+		conn.inRecovery = true
+		conn.lossRecovery = false
+		log.Printf("fast retransmit seq %d, %s -> %s", conn.unacked[0].seqNum, conn.LocalAddr, conn.RemoteAddr)
+		tcp.retransmitFirst(conn)
+		// 三个重复ACK对应的报文段已经离开网络 (RFC 5681 3.2)
+		conn.setCongestionWindow(cwnd+DUPACK_THRESHOLD*mss, ssthresh)
+	}
+}
+
+// 收到确认了新数据的ACK，acked为新确认的字节数，segs为被完整确认的报文段，调用方持有连接的锁
+func (tcp *TcpPacketQueue) recvNewAck(conn *Connection, acked uint32, segs []segment) {
+	mss := uint32(conn.mss)
+	if rs, ok := conn.sampleRate(segs); ok {
+		if sampler, ok := conn.cc.(RateSampler); ok {
+			sampler.OnRateSample(conn.congestionState(), rs)
+		}
+	}
+	switch {
+	case conn.inRecovery && seqLT(conn.recover, conn.sndUna):
+		// 完整确认：退出快速恢复，拥塞窗口收缩到慢启动阈值，同时避免突发 (RFC 6582 3.2 第三步)
+		conn.cwnd = min(conn.ssthresh, max(conn.bytesInFlight(), mss)+mss)
+		conn.inRecovery = false
+		conn.dupAcks = 0
+	case conn.inRecovery:
+		// 部分确认：下一个未确认的报文段也丢失了，立即重传，
+		// 拥塞窗口减去新确认的数据量，确认超过一个报文段时再加回一个报文段
+		if len(conn.unacked) > 0 {
+			tcp.retransmitFirst(conn)
+		}
+		conn.cwnd -= min(acked, conn.cwnd)
+		if acked >= mss {
+			conn.cwnd += mss
+		}
+		conn.cwnd = max(conn.cwnd, mss)
+	default:
+		conn.dupAcks = 0
+		// 超时后recover之前的数据都已发出很久，ACK前进说明重传到达，继续重传下一个报文段
+		if conn.lossRecovery {
+			if seqLT(conn.recover, conn.sndUna) {
+				conn.lossRecovery = false
+			} else if len(conn.unacked) > 0 {
+				tcp.retransmitFirst(conn)
+			}
+		}
+		conn.setCongestionWindow(conn.cc.OnAck(conn.congestionState(), acked))
+	}
+}
+
+// 对端回显ECE时降低拥塞窗口，每个窗口只响应一次 (RFC 3168 6.1.2)，调用方持有连接的锁
+func (conn *Connection) recvEce(ackNum uint32) {
+	if conn.inRecovery || !seqLT(conn.ecnRecover, ackNum) {
+		return
+	}
+	conn.setCongestionWindow(conn.cc.OnEcn(conn.congestionState()))
+	conn.ecnRecover = conn.sndNxt
+}
+
+func (conn *Connection) congestionState() CongestionState {
+	return CongestionState{
+		Mss:      uint32(conn.mss),
+		Cwnd:     conn.cwnd,
+		Ssthresh: conn.ssthresh,
+		InFlight: conn.bytesInFlight(),
+		Srtt:     conn.rtt.srtt,
+	}
+}
+
+// 设置拥塞控制算法给出的窗口。窗口不小于一个报文段，
+// 也不超过发送缓冲区，更大的窗口不会被用到
+func (conn *Connection) setCongestionWindow(cwnd, ssthresh uint32) {
+	conn.cwnd = min(max(cwnd, uint32(conn.mss)), SEND_BUFFER_SIZE)
+	conn.ssthresh = ssthresh
+}
+
+// 更换拥塞控制算法。还没有发送过数据时使用新算法的初始窗口，否则沿用当前的窗口
+func (conn *Connection) setCongestionControl(cc CongestionControl) {
+	conn.cc = cc
+	cwnd, ssthresh := cc.Init(uint32(conn.mss))
+	if conn.snd.read == 0 {
+		conn.setCongestionWindow(cwnd, ssthresh)
+	}
+}
+
+// 更新有效MSS。还没有发送数据时按新的MSS重新计算初始窗口，否则通知缓存了MSS的拥塞控制算法
+func (conn *Connection) setMss(mss uint16) {
+	conn.mss = mss
+	if conn.snd.read == 0 {
+		conn.setCongestionControl(conn.cc)
+		return
+	}
+	if o, ok := conn.cc.(MssObserver); ok {
+		o.OnMssChange(uint32(mss))
+	}
+}
+
+// 发送前按当前的路径MTU重新计算有效MSS，缓存的路径MTU老化后MSS可以重新增大 (RFC 1191 6.3)
+func (tcp *TcpPacketQueue) refreshMss(conn *Connection) {
+	if mss := tcp.sendMss(conn.peerMss, conn.RemoteAddr.Addr()); mss != 0 && mss != conn.mss {
+		log.Printf("path mtu changed, %s -> %s, mss: %d -> %d", conn.LocalAddr, conn.RemoteAddr, conn.mss, mss)
+		conn.setMss(mss)
+	}
+}
+
+// 重传最早的未确认报文段，调用方持有连接的锁
+func (tcp *TcpPacketQueue) retransmitFirst(conn *Connection) {
+	conn.unacked[0].retransmit = true
+	tcp.send(conn, conn.unacked[0])
+}
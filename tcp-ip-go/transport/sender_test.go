@@ -0,0 +1,105 @@
+package transport
+
+import (
+	"testing"
+	"time"
+)
+
+// Limited Transmit发送的报文段不计入快速重传时的FlightSize (RFC 5681 3.2)
+func TestLimitedTransmitFlightSize(t *testing.T) {
+	tcp := newTestQueue()
+	conn := testConnection(tcp, Established)
+	mss := uint32(conn.mss)
+
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	defer tcp.terminate(conn, nil)
+	conn.snd.write(make([]byte, 20*mss))
+	tcp.fill(conn)
+	flight := conn.bytesInFlight()
+	if flight != conn.cwnd {
+		t.Fatalf("in flight %d, want initial window %d", flight, conn.cwnd)
+	}
+	sentHeaders(t, tcp)
+
+	dupAck := testSegment{0, 1, HeaderFlags{ACK: true}, ""}
+	for i := 1; i < DUPACK_THRESHOLD; i++ {
+		tcp.manager.recvSegment(tcp, conn, dupAck.packet(conn))
+		if got := conn.bytesInFlight(); got != flight+uint32(i)*mss {
+			t.Fatalf("in flight %d after %d dupacks, want one more segment by limited transmit", got, i)
+		}
+	}
+	tcp.manager.recvSegment(tcp, conn, dupAck.packet(conn))
+	if !conn.inRecovery {
+		t.Fatal("fast retransmit not triggered")
+	}
+	if want := lossThreshold(flight, mss); conn.ssthresh != want {
+		t.Fatalf("ssthresh %d, want %d from flight size before limited transmit", conn.ssthresh, want)
+	}
+}
+
+// SYN超时重传后握手完成时RTO重新初始化为3秒，不沿用退避的值 (RFC 6298 5.7)
+func TestRtoAfterSynTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		state    State
+		timeouts int
+		seg      testSegment
+		want     time.Duration
+	}{
+		{"syn-sent", SynSent, 0, testSegment{-1, 1, HeaderFlags{SYN: true, ACK: true}, ""}, MIN_RTO},
+		{"syn-sent after timeout", SynSent, 2, testSegment{-1, 1, HeaderFlags{SYN: true, ACK: true}, ""}, SYN_TIMEOUT_RTO},
+		{"syn-received after timeout", SynReceived, 3, testSegment{0, 1, HeaderFlags{ACK: true}, ""}, SYN_TIMEOUT_RTO},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tcp := newTestQueue()
+			conn := testConnection(tcp, tt.state)
+			defer tcp.abort(conn, nil)
+			conn.unacked[0].sentAt = time.Now()
+
+			for i := 0; i < tt.timeouts; i++ {
+				conn.lock.Lock()
+				conn.rtoExpires = time.Now().Add(-time.Millisecond)
+				conn.lock.Unlock()
+				tcp.retransmitTimeout(conn)
+			}
+
+			conn.lock.Lock()
+			defer conn.lock.Unlock()
+			if tt.timeouts > 0 && conn.rtt.rto <= SYN_TIMEOUT_RTO {
+				t.Fatalf("rto %s after %d timeouts, want backed off", conn.rtt.rto, tt.timeouts)
+			}
+			tcp.manager.recvSegment(tcp, conn, tt.seg.packet(conn))
+			if conn.State != Established || conn.rtt.rto != tt.want {
+				t.Fatalf("state %s rto %s, want ESTABLISHED rto %s", conn.State, conn.rtt.rto, tt.want)
+			}
+		})
+	}
+}
+
+// 缓存的路径MTU老化后发送时重新增大MSS，并通知拥塞控制算法
+func TestRefreshMss(t *testing.T) {
+	tcp := newTestQueue()
+	conn := testConnection(tcp, Established)
+	bbr := NewBbr().(*Bbr)
+
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	defer tcp.terminate(conn, nil)
+	conn.setCongestionControl(bbr)
+	conn.snd.write(make([]byte, 100))
+	tcp.fill(conn)
+	sentHeaders(t, tcp)
+
+	// 对端通告了1460，此前因为 Fragmentation Needed 降低到了536，路径MTU缓存已经过期
+	conn.peerMss = 1460
+	conn.snd.write(make([]byte, 2000))
+	tcp.fill(conn)
+	if conn.mss != 1460 || bbr.mss != 1460 {
+		t.Fatalf("mss %d, bbr mss %d, want 1460", conn.mss, bbr.mss)
+	}
+	if hdrs := sentHeaders(t, tcp); len(hdrs) == 0 {
+		t.Fatal("no segment sent")
+	}
+}
@@ -0,0 +1,425 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+type State int
+
+// TCP连接状态 (RFC 9293 3.3.2)
+const (
+	Closed State = iota
+	Listen
+	SynSent
+	SynReceived
+	Established
+	FinWait1
+	FinWait2
+	CloseWait
+	Closing
+	LastAck
+	TimeWait
+)
+
+const (
+	MSL                = 30 * time.Second // 报文段最大生存时间，TIME_WAIT持续2MSL
+	FIN_WAIT_2_TIMEOUT = 60 * time.Second // 应用已关闭的连接在FIN-WAIT-2等待对端FIN的时间
+)
+
+var (
+	ErrConnectionReset   = errors.New("connection reset by peer")
+	ErrConnectionRefused = errors.New("connection refused")
+	ErrConnectionClosing = errors.New("connection closing")
+	ErrConnectionTimeout = errors.New("connection timed out")
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "CLOSED"
+	case Listen:
+		return "LISTEN"
+	case SynSent:
+		return "SYN-SENT"
+	case SynReceived:
+		return "SYN-RECEIVED"
+	case Established:
+		return "ESTABLISHED"
+	case FinWait1:
+		return "FIN-WAIT-1"
+	case FinWait2:
+		return "FIN-WAIT-2"
+	case CloseWait:
+		return "CLOSE-WAIT"
+	case Closing:
+		return "CLOSING"
+	case LastAck:
+		return "LAST-ACK"
+	case TimeWait:
+		return "TIME-WAIT"
+	}
+	return fmt.Sprintf("state(%d)", int(s))
+}
+
+// 序列号可能回绕，用差值的符号比较先后 (RFC 9293 3.4)
+func seqLT(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func seqLEQ(a, b uint32) bool {
+	return int32(a-b) <= 0
+}
+
+// seq是否落在[start, start+size)内
+func seqInWindow(seq, start, size uint32) bool {
+	return seq-start < size
+}
+
+func (conn *Connection) setState(state State) {
+	log.Printf("%s -> %s: %s -> %s", conn.LocalAddr, conn.RemoteAddr, conn.State, state)
+	// 被动打开的连接离开SYN-RECEIVED后不再占用监听者的半连接名额
+	if conn.State == SynReceived && state != SynReceived && conn.listener != nil {
+		conn.listener.releaseHalfOpen()
+	}
+	conn.State = state
+	if state == Closed {
+		conn.stopTimer()
+		if conn.paceTimer != nil {
+			conn.paceTimer.Stop()
+		}
+	}
+	conn.notify()
+}
+
+// 唤醒等待连接状态变化的调用方
+func (conn *Connection) notify() {
+	close(conn.changed)
+	conn.changed = make(chan struct{})
+}
+
+// 报文段是否可以接受 (RFC 9293 3.10.7.4 第一步)
+//
+//	Segment Length  Receive Window  Test
+//	0               0               SEG.SEQ = RCV.NXT
+//	0               >0              RCV.NXT =< SEG.SEQ < RCV.NXT+RCV.WND
+//	>0              0               not acceptable
+//	>0              >0              RCV.NXT =< SEG.SEQ < RCV.NXT+RCV.WND
+//	                                or RCV.NXT =< SEG.SEQ+SEG.LEN-1 < RCV.NXT+RCV.WND
+func (conn *Connection) acceptable(seq, length uint32) bool {
+	wnd := conn.rcvWindow()
+	if length == 0 {
+		if wnd == 0 {
+			return seq == conn.rcvNxt
+		}
+		return seqInWindow(seq, conn.rcvNxt, wnd)
+	}
+	if wnd == 0 {
+		return false
+	}
+	return seqInWindow(seq, conn.rcvNxt, wnd) || seqInWindow(seq+length-1, conn.rcvNxt, wnd)
+}
+
+// 通告的接收窗口为接收缓冲区的剩余空间，没有窗口缩放时不超过65535
+func (conn *Connection) rcvWindow() uint32 {
+	return uint32(min(conn.rcv.output.remainingCapacity(), WINDOW_SIZE))
+}
+
+// 处理属于已有连接的报文段，调用方持有连接的锁 (RFC 9293 3.10.7)
+func (m *ConnectionManager) recvSegment(queue *TcpPacketQueue, conn *Connection, pkt TcpPacket) {
+	if conn.State == SynSent {
+		m.recvSynSent(queue, conn, pkt)
+		return
+	}
+
+	flags := pkt.TcpHeader.Flags
+	seqNum := pkt.TcpHeader.SeqNum
+	length := segment{flags: flags, data: pkt.Payload}.length()
+
+	// 第一步：检查序列号，不可接受的报文段回应ACK后丢弃
+	if !conn.acceptable(seqNum, length) {
+		// 对端重传了SYN，说明SYN+ACK丢失了，立即重传
+		if conn.State == SynReceived && flags.SYN && !flags.ACK && seqNum == conn.irs && len(conn.unacked) > 0 {
+			conn.unacked[0].retransmit = true
+			queue.send(conn, conn.unacked[0])
+			return
+		}
+		// TIME-WAIT中收到重传的FIN说明对端没有收到ACK，再次确认并重新开始2MSL计时 (RFC 9293 3.10.7.4 第七步)
+		if conn.State == TimeWait && flags.FIN && !flags.RST {
+			queue.write(conn, HeaderFlags{ACK: true}, nil)
+			m.timeWait(conn)
+			return
+		}
+		if !flags.RST {
+			queue.write(conn, HeaderFlags{ACK: true}, nil)
+		}
+		return
+	}
+
+	// 第二步：检查RST，只有序列号恰好为RCV.NXT时才重置连接，
+	// 窗口内的其他RST回应挑战ACK (RFC 5961 3.2)
+	if flags.RST {
+		if seqNum != conn.rcvNxt {
+			queue.write(conn, HeaderFlags{ACK: true}, nil)
+			return
+		}
+		m.recvReset(conn)
+		return
+	}
+
+	// 第四步：检查SYN，被动打开的连接回到LISTEN，其余回应挑战ACK (RFC 5961 4.2)
+	if flags.SYN {
+		if conn.State == SynReceived && conn.passive {
+			conn.setState(Closed)
+			m.remove(conn)
+			return
+		}
+		queue.write(conn, HeaderFlags{ACK: true}, nil)
+		return
+	}
+
+	// 第五步：检查ACK，没有ACK的报文段直接丢弃
+	if !flags.ACK || !m.recvAck(queue, conn, pkt) {
+		return
+	}
+
+	// 第七步：处理数据，乱序和重叠的数据交给重组器，占用序列号的报文段都要确认
+	switch conn.State {
+	case Established, FinWait1, FinWait2:
+		// 应用关闭后收到的新数据无法交付，重置连接 (RFC 1122 4.2.2.13)
+		if conn.readClosed && len(pkt.Payload) > 0 {
+			log.Printf("data after close, reset connection, src port: %d, dst port: %d", conn.RemoteAddr.Port(), conn.LocalAddr.Port())
+			queue.terminate(conn, nil)
+			return
+		}
+		stream := conn.rcv.output
+		written, ended := stream.written, stream.ended
+		conn.rcv.push(pkt.Payload, unwrap(seqNum, conn.irs+1, written), flags.FIN)
+		conn.rcvNxt = conn.irs + 1 + uint32(stream.written)
+		if stream.written != written {
+			conn.notify()
+		}
+		// 第八步：FIN之前的数据全部到达后才处理FIN
+		if !ended && stream.ended {
+			m.recvFin(conn)
+		}
+	}
+	if length > 0 {
+		queue.write(conn, HeaderFlags{ACK: true}, nil)
+	}
+}
+
+// 处理SYN-SENT状态收到的报文段 (RFC 9293 3.10.7.3)
+func (m *ConnectionManager) recvSynSent(queue *TcpPacketQueue, conn *Connection, pkt TcpPacket) {
+	hdr := pkt.TcpHeader
+	flags := hdr.Flags
+
+	// 确认号必须确认本端的SYN
+	if flags.ACK && (seqLEQ(hdr.AckNum, conn.iss) || seqLT(conn.sndNxt, hdr.AckNum)) {
+		if !flags.RST {
+			queue.sendReset(pkt)
+		}
+		return
+	}
+	if flags.RST {
+		if flags.ACK {
+			conn.Err = ErrConnectionRefused
+			conn.setState(Closed)
+			m.remove(conn)
+		}
+		return
+	}
+	if !flags.SYN {
+		return
+	}
+
+	conn.irs = hdr.SeqNum
+	conn.rcvNxt = hdr.SeqNum + 1
+	conn.peerMss = peerMss(hdr, conn.RemoteAddr.Addr())
+	conn.setMss(queue.sendMss(conn.peerMss, conn.RemoteAddr.Addr()))
+	if !flags.ACK {
+		// 同时打开：重发带ACK的SYN并进入SYN-RECEIVED
+		conn.setState(SynReceived)
+		conn.sndWnd = uint32(hdr.Window)
+		conn.sndWl1, conn.sndWl2 = hdr.SeqNum, hdr.AckNum
+		queue.send(conn, segment{seqNum: conn.iss, flags: HeaderFlags{SYN: true, ACK: true}})
+		return
+	}
+
+	// 主动打开发送的是ECN-setup SYN，对端在SYN+ACK中只设置ECE表示同意使用ECN (RFC 3168 6.1.1)
+	conn.ecn = flags.ECE && !flags.CWR
+	conn.sndUna = hdr.AckNum
+	queue.ackReceived(conn, conn.ackSegments(hdr.AckNum))
+	conn.sndWnd = uint32(hdr.Window)
+	conn.sndWl1, conn.sndWl2 = hdr.SeqNum, hdr.AckNum
+	conn.setState(Established)
+	queue.write(conn, HeaderFlags{ACK: true}, nil)
+}
+
+// 处理同步状态下的ACK字段，返回是否继续处理报文段 (RFC 9293 3.10.7.4 第五步)
+func (m *ConnectionManager) recvAck(queue *TcpPacketQueue, conn *Connection, pkt TcpPacket) bool {
+	hdr := pkt.TcpHeader
+
+	if conn.State == SynReceived {
+		if !seqLT(conn.sndUna, hdr.AckNum) || !seqLEQ(hdr.AckNum, conn.sndNxt) {
+			queue.sendReset(pkt)
+			return false
+		}
+		conn.sndWnd = uint32(hdr.Window)
+		conn.sndWl1, conn.sndWl2 = hdr.SeqNum, hdr.AckNum
+		conn.setState(Established)
+		// 被动打开的连接交给监听者，等待队列已满时重置连接
+		if conn.listener != nil && !conn.listener.enqueue(conn) {
+			log.Printf("listen queue of %s overflow, reset connection from %s", conn.LocalAddr, conn.RemoteAddr)
+			queue.send(conn, segment{seqNum: conn.sndNxt, flags: HeaderFlags{RST: true}})
+			conn.setState(Closed)
+			m.remove(conn)
+			return false
+		}
+	}
+
+	// 确认了还没发送的数据，回应ACK后丢弃
+	if seqLT(conn.sndNxt, hdr.AckNum) {
+		queue.write(conn, HeaderFlags{ACK: true}, nil)
+		return false
+	}
+	if conn.ecn {
+		conn.recvEcn(pkt)
+	}
+	if seqLT(conn.sndUna, hdr.AckNum) {
+		acked := hdr.AckNum - conn.sndUna
+		conn.sndUna = hdr.AckNum
+		segs := conn.ackSegments(hdr.AckNum)
+		queue.ackReceived(conn, segs)
+		queue.recvNewAck(conn, acked, segs)
+		// 发送缓冲区腾出了空间
+		conn.notify()
+	} else if conn.sndWnd == 0 && len(conn.unacked) > 0 {
+		// 对端仍在回应零窗口探测，不能因为探测没有被确认而中止连接 (RFC 9293 3.8.6.1)
+		conn.retransmissions = 0
+	} else if conn.isDupAck(pkt) {
+		queue.recvDupAck(conn)
+	}
+	// 用更新的报文段更新发送窗口，防止旧报文段缩小窗口
+	if seqLT(conn.sndWl1, hdr.SeqNum) || (conn.sndWl1 == hdr.SeqNum && seqLEQ(conn.sndWl2, hdr.AckNum)) {
+		conn.sndWnd = uint32(hdr.Window)
+		conn.sndWl1, conn.sndWl2 = hdr.SeqNum, hdr.AckNum
+	}
+
+	// FIN是本端发送的最后一个序列号，全部确认即FIN被确认
+	finAcked := conn.finSent && conn.sndUna == conn.sndNxt
+	switch conn.State {
+	case FinWait1:
+		if finAcked {
+			conn.setState(FinWait2)
+			m.finWait2Timeout(conn)
+		}
+	case Closing:
+		if finAcked {
+			m.timeWait(conn)
+		}
+	case LastAck:
+		if finAcked {
+			conn.setState(Closed)
+			m.remove(conn)
+			return false
+		}
+	}
+	// 确认和窗口更新后可能可以继续发送
+	queue.fill(conn)
+	return true
+}
+
+// 处理按序到达的FIN (RFC 9293 3.10.7.4 第八步)，CLOSE-WAIT、CLOSING和LAST-ACK已经收到过FIN
+func (m *ConnectionManager) recvFin(conn *Connection) {
+	switch conn.State {
+	case SynReceived, Established:
+		conn.rcvNxt++
+		conn.setState(CloseWait)
+	case FinWait1:
+		conn.rcvNxt++
+		if conn.finSent && conn.sndUna == conn.sndNxt {
+			m.timeWait(conn)
+		} else {
+			conn.setState(Closing)
+		}
+	case FinWait2:
+		conn.rcvNxt++
+		m.timeWait(conn)
+	}
+}
+
+// 对端重置了连接 (RFC 9293 3.10.7.4 第二步)
+func (m *ConnectionManager) recvReset(conn *Connection) {
+	switch conn.State {
+	case SynReceived:
+		// 被动打开的连接回到LISTEN，主动打开的连接被拒绝
+		if !conn.passive {
+			conn.Err = ErrConnectionRefused
+		}
+	case Established, FinWait1, FinWait2, CloseWait:
+		conn.Err = ErrConnectionReset
+	}
+	log.Printf("connection reset, src port: %d, dst port: %d", conn.RemoteAddr.Port(), conn.LocalAddr.Port())
+	conn.setState(Closed)
+	m.remove(conn)
+}
+
+// 进入TIME-WAIT，2MSL后删除连接，已在TIME-WAIT时重新计时
+func (m *ConnectionManager) timeWait(conn *Connection) {
+	if conn.State != TimeWait {
+		conn.setState(TimeWait)
+	}
+	if conn.timeWaitTimer != nil {
+		conn.timeWaitTimer.Reset(2 * MSL)
+		return
+	}
+	conn.timeWaitTimer = time.AfterFunc(2*MSL, func() {
+		conn.lock.Lock()
+		defer conn.lock.Unlock()
+		if conn.State == TimeWait {
+			conn.setState(Closed)
+			m.remove(conn)
+		}
+	})
+}
+
+// 应用已关闭的连接不会再读取数据，对端一直不发送FIN时在FIN-WAIT-2超时后删除连接
+func (m *ConnectionManager) finWait2Timeout(conn *Connection) {
+	if conn.State != FinWait2 || !conn.readClosed || conn.finWaitTimer != nil {
+		return
+	}
+	conn.finWaitTimer = time.AfterFunc(FIN_WAIT_2_TIMEOUT, func() {
+		conn.lock.Lock()
+		defer conn.lock.Unlock()
+		if conn.State == FinWait2 {
+			log.Printf("fin-wait-2 timeout, src port: %d, dst port: %d", conn.RemoteAddr.Port(), conn.LocalAddr.Port())
+			conn.Err = ErrConnectionTimeout
+			conn.setState(Closed)
+			m.remove(conn)
+		}
+	})
+}
+
+// 应用关闭连接的发送方向 (RFC 9293 3.10.4)，在发送的数据之后发送FIN
+func (m *ConnectionManager) close(queue *TcpPacketQueue, conn *Connection) error {
+	conn.writeClosed = true
+	switch conn.State {
+	case SynSent:
+		conn.setState(Closed)
+		m.remove(conn)
+	case SynReceived, Established:
+		conn.setState(FinWait1)
+		queue.fill(conn)
+	case CloseWait:
+		conn.setState(LastAck)
+		queue.fill(conn)
+	case Closed:
+		return fmt.Errorf("connection does not exist")
+	default:
+		return ErrConnectionClosing
+	}
+	return nil
+}
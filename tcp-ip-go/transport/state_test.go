@@ -0,0 +1,476 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"tcp/internet"
+	"tcp/network"
+	"testing"
+)
+
+const testIrs = 1000 // 测试中对端的初始序列号
+
+var (
+	testLocal  = netip.MustParseAddrPort("10.0.0.1:80")
+	testRemote = netip.MustParseAddrPort("10.0.0.2:40000")
+)
+
+// 测试用的协议栈，发出的报文段留在发送队列中由测试读取
+func newTestQueue() *TcpPacketQueue {
+	tcp := NewTcpPacketQueue()
+	tcp.ip = internet.NewIpPacketQueue()
+	tcp.outgoingQueue = make(chan network.Packet, 1000)
+	return tcp
+}
+
+// 取出发送队列中的所有报文段头部
+func sentHeaders(t *testing.T, tcp *TcpPacketQueue) []*Header {
+	t.Helper()
+	var hdrs []*Header
+	for {
+		select {
+		case pkt := <-tcp.outgoingQueue:
+			ihl := int(pkt.Buf[0]&0x0f) * 4
+			hdr, err := unmarshal(pkt.Buf[ihl:pkt.N])
+			if err != nil {
+				t.Fatal(err)
+			}
+			hdrs = append(hdrs, hdr)
+		default:
+			return hdrs
+		}
+	}
+}
+
+// 构造处于state的连接：双方的SYN已交换，FIN-WAIT-1之后的状态本端已发送FIN，
+// CLOSE-WAIT之后和TIME-WAIT已收到对端在testIrs+1处的FIN
+func testConnection(tcp *TcpPacketQueue, state State) *Connection {
+	conn := newConnection(testLocal, testRemote, state, DEFAULT_MSS)
+	conn.passive = true
+	conn.irs = testIrs
+	conn.rcvNxt = testIrs + 1
+	conn.sndWnd = WINDOW_SIZE
+	conn.sndNxt = conn.iss + 1
+	conn.sndUna = conn.iss + 1
+
+	switch state {
+	case SynSent:
+		// 主动打开发送了ECN-setup SYN，还没有收到对端的SYN
+		conn.passive = false
+		conn.irs, conn.rcvNxt = 0, 0
+		conn.sndUna = conn.iss
+		conn.unacked = []segment{{seqNum: conn.iss, flags: HeaderFlags{SYN: true, ECE: true, CWR: true}}}
+	case SynReceived:
+		conn.sndUna = conn.iss
+		conn.unacked = []segment{{seqNum: conn.iss, flags: HeaderFlags{SYN: true, ACK: true}}}
+	case FinWait1, Closing, LastAck:
+		// FIN已发送还没有被确认
+		conn.finSent = true
+		conn.unacked = []segment{{seqNum: conn.sndNxt, flags: HeaderFlags{FIN: true, ACK: true}}}
+		conn.sndNxt++
+	case FinWait2, TimeWait:
+		conn.finSent = true
+		conn.sndNxt++
+		conn.sndUna = conn.sndNxt
+	}
+	switch state {
+	case CloseWait, Closing, LastAck, TimeWait:
+		conn.rcvNxt++
+	}
+
+	tcp.manager.lock.Lock()
+	tcp.manager.connections[conn.key()] = conn
+	tcp.manager.lock.Unlock()
+	return conn
+}
+
+// 对端发来的报文段，序列号和确认号分别相对于testIrs+1和本端的ISS
+type testSegment struct {
+	seq   int32
+	ack   uint32
+	flags HeaderFlags
+	data  string
+}
+
+func (s testSegment) packet(conn *Connection) TcpPacket {
+	return TcpPacket{
+		SrcAddr: testRemote.Addr(),
+		DstAddr: testLocal.Addr(),
+		TcpHeader: &Header{
+			SrcPort: testRemote.Port(),
+			DstPort: testLocal.Port(),
+			SeqNum:  uint32(int32(testIrs+1) + s.seq),
+			AckNum:  conn.iss + s.ack,
+			Flags:   s.flags,
+			Window:  WINDOW_SIZE,
+		},
+		Payload: []byte(s.data),
+	}
+}
+
+func TestRecvSegment(t *testing.T) {
+	ack := HeaderFlags{ACK: true}
+	finAck := HeaderFlags{FIN: true, ACK: true}
+	rst := HeaderFlags{RST: true}
+
+	tests := []struct {
+		name  string
+		state State
+		seg   testSegment
+		want  State
+		reply *HeaderFlags // 期望回应的第一个报文段的标志，nil表示不回应
+	}{
+		{"syn-received ack of syn", SynReceived, testSegment{0, 1, ack, ""}, Established, nil},
+		{"syn-received unacceptable ack", SynReceived, testSegment{0, 5, ack, ""}, SynReceived, &HeaderFlags{RST: true}},
+		{"syn-received retransmitted syn", SynReceived, testSegment{-1, 0, HeaderFlags{SYN: true}, ""}, SynReceived, &HeaderFlags{SYN: true, ACK: true}},
+		{"syn-received rst", SynReceived, testSegment{0, 0, rst, ""}, Closed, nil},
+		{"syn-received syn in window", SynReceived, testSegment{0, 0, HeaderFlags{SYN: true}, ""}, Closed, nil},
+		{"established data", Established, testSegment{0, 1, ack, "hello"}, Established, &ack},
+		{"established old duplicate", Established, testSegment{-5, 1, ack, "hello"}, Established, &ack},
+		{"established fin", Established, testSegment{0, 1, finAck, ""}, CloseWait, &ack},
+		{"established rst", Established, testSegment{0, 1, rst, ""}, Closed, nil},
+		{"established rst in window", Established, testSegment{10, 1, rst, ""}, Established, &ack},
+		{"established syn in window", Established, testSegment{0, 1, HeaderFlags{SYN: true}, ""}, Established, &ack},
+		{"established segment without ack", Established, testSegment{0, 0, HeaderFlags{}, "hello"}, Established, nil},
+		{"fin-wait-1 ack of fin", FinWait1, testSegment{0, 2, ack, ""}, FinWait2, nil},
+		{"fin-wait-1 simultaneous close", FinWait1, testSegment{0, 1, finAck, ""}, Closing, &ack},
+		{"fin-wait-1 fin and ack of fin", FinWait1, testSegment{0, 2, finAck, ""}, TimeWait, &ack},
+		{"fin-wait-2 data", FinWait2, testSegment{0, 2, ack, "hello"}, FinWait2, &ack},
+		{"fin-wait-2 fin", FinWait2, testSegment{0, 2, finAck, ""}, TimeWait, &ack},
+		{"close-wait retransmitted fin", CloseWait, testSegment{0, 1, finAck, ""}, CloseWait, &ack},
+		{"closing ack of fin", Closing, testSegment{1, 2, ack, ""}, TimeWait, nil},
+		{"last-ack ack of fin", LastAck, testSegment{1, 2, ack, ""}, Closed, nil},
+		{"last-ack retransmitted fin", LastAck, testSegment{0, 1, finAck, ""}, LastAck, &ack},
+		{"time-wait retransmitted fin", TimeWait, testSegment{0, 2, finAck, ""}, TimeWait, &ack},
+		{"time-wait rst", TimeWait, testSegment{1, 2, rst, ""}, Closed, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tcp := newTestQueue()
+			conn := testConnection(tcp, tt.state)
+
+			conn.lock.Lock()
+			tcp.manager.recvSegment(tcp, conn, tt.seg.packet(conn))
+			state := conn.State
+			conn.lock.Unlock()
+			defer tcp.abort(conn, nil)
+
+			if state != tt.want {
+				t.Fatalf("state %s, want %s", state, tt.want)
+			}
+			if _, ok := tcp.manager.find(conn.key()); ok == (state == Closed) {
+				t.Fatalf("connection in %s, registered %t", state, ok)
+			}
+			hdrs := sentHeaders(t, tcp)
+			switch {
+			case tt.reply == nil && len(hdrs) > 0:
+				t.Fatalf("unexpected reply %+v", hdrs[0].Flags)
+			case tt.reply != nil && len(hdrs) == 0:
+				t.Fatalf("no reply, want %+v", *tt.reply)
+			case tt.reply != nil && hdrs[0].Flags != *tt.reply:
+				t.Fatalf("reply %+v, want %+v", hdrs[0].Flags, *tt.reply)
+			}
+			if tt.reply != nil && tt.reply.ACK && hdrs[0].AckNum != conn.rcvNxt {
+				t.Fatalf("ack num %d, want %d", hdrs[0].AckNum, conn.rcvNxt)
+			}
+		})
+	}
+}
+
+// TIME-WAIT收到重传的FIN后重新开始2MSL计时
+func TestTimeWaitRestart(t *testing.T) {
+	tcp := newTestQueue()
+	conn := testConnection(tcp, FinWait2)
+
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	fin := testSegment{0, 2, HeaderFlags{FIN: true, ACK: true}, ""}
+	tcp.manager.recvSegment(tcp, conn, fin.packet(conn))
+	if conn.State != TimeWait || conn.timeWaitTimer == nil {
+		t.Fatalf("state %s, want TIME-WAIT with timer", conn.State)
+	}
+	timer := conn.timeWaitTimer
+	sentHeaders(t, tcp)
+
+	tcp.manager.recvSegment(tcp, conn, fin.packet(conn))
+	if conn.State != TimeWait || conn.timeWaitTimer != timer || !timer.Stop() {
+		t.Fatalf("state %s, time-wait timer not restarted", conn.State)
+	}
+	if hdrs := sentHeaders(t, tcp); len(hdrs) != 1 || !hdrs[0].Flags.ACK || hdrs[0].AckNum != testIrs+2 {
+		t.Fatalf("got %d segments, want ACK of retransmitted fin", len(hdrs))
+	}
+}
+
+// 超过半连接上限的SYN被丢弃，握手完成后释放名额
+func TestHalfOpenLimit(t *testing.T) {
+	tcp := newTestQueue()
+	l, err := tcp.Listen(testLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syn := func(port uint16) {
+		tcp.manager.recv(tcp, TcpPacket{
+			SrcAddr:   testRemote.Addr(),
+			DstAddr:   testLocal.Addr(),
+			TcpHeader: &Header{SrcPort: port, DstPort: testLocal.Port(), SeqNum: testIrs, Flags: HeaderFlags{SYN: true}, Window: WINDOW_SIZE},
+		})
+	}
+
+	limit := cap(l.backlog)
+	for i := 0; i <= limit; i++ {
+		syn(uint16(10000 + i))
+	}
+	if got := len(sentHeaders(t, tcp)); got != limit {
+		t.Fatalf("sent %d SYN+ACKs, want %d", got, limit)
+	}
+
+	conn, ok := tcp.manager.find(connKey{local: testLocal, remote: netip.AddrPortFrom(testRemote.Addr(), 10000)})
+	if !ok {
+		t.Fatal("half-open connection not found")
+	}
+	pkt := testSegment{0, 1, HeaderFlags{ACK: true}, ""}.packet(conn)
+	pkt.TcpHeader.SrcPort = conn.RemoteAddr.Port()
+	tcp.manager.recv(tcp, pkt)
+	if conn.State != Established {
+		t.Fatalf("state %s, want ESTABLISHED", conn.State)
+	}
+	syn(20000)
+	if got := len(sentHeaders(t, tcp)); got != 1 {
+		t.Fatalf("sent %d segments after handshake completed, want SYN+ACK", got)
+	}
+}
+
+// 关闭时还有没读取的数据则发送RST而不是FIN
+func TestCloseWithUnreadData(t *testing.T) {
+	tcp := newTestQueue()
+	conn := testConnection(tcp, Established)
+
+	conn.lock.Lock()
+	tcp.manager.recvSegment(tcp, conn, testSegment{0, 1, HeaderFlags{ACK: true}, "hello"}.packet(conn))
+	conn.lock.Unlock()
+	sentHeaders(t, tcp)
+
+	if err := newConn(tcp, conn).Close(); err != nil {
+		t.Fatal(err)
+	}
+	hdrs := sentHeaders(t, tcp)
+	if conn.State != Closed || len(hdrs) != 1 || !hdrs[0].Flags.RST {
+		t.Fatalf("state %s after close with %d segments sent, want CLOSED after RST", conn.State, len(hdrs))
+	}
+}
+
+// 应用关闭后进入FIN-WAIT-2时启动超时，之后收到的数据重置连接
+func TestFinWait2AfterClose(t *testing.T) {
+	tcp := newTestQueue()
+	conn := testConnection(tcp, FinWait1)
+	conn.readClosed = true
+	conn.writeClosed = true
+
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	tcp.manager.recvSegment(tcp, conn, testSegment{0, 2, HeaderFlags{ACK: true}, ""}.packet(conn))
+	if conn.State != FinWait2 || conn.finWaitTimer == nil {
+		t.Fatalf("state %s, want FIN-WAIT-2 with timeout", conn.State)
+	}
+	conn.finWaitTimer.Stop()
+
+	tcp.manager.recvSegment(tcp, conn, testSegment{0, 2, HeaderFlags{ACK: true}, "late"}.packet(conn))
+	if hdrs := sentHeaders(t, tcp); conn.State != Closed || len(hdrs) != 1 || !hdrs[0].Flags.RST {
+		t.Fatalf("state %s after data, want CLOSED after RST", conn.State)
+	}
+}
+
+// 对端重置连接后Close释放资源并返回nil，重复Close返回net.ErrClosed
+func TestCloseAfterReset(t *testing.T) {
+	tcp := newTestQueue()
+	conn := testConnection(tcp, Established)
+
+	conn.lock.Lock()
+	tcp.manager.recvSegment(tcp, conn, testSegment{0, 1, HeaderFlags{RST: true}, ""}.packet(conn))
+	conn.lock.Unlock()
+	if conn.State != Closed {
+		t.Fatalf("state %s, want CLOSED", conn.State)
+	}
+
+	c := newConn(tcp, conn)
+	if err := c.Close(); err != nil {
+		t.Fatalf("close after reset: %v", err)
+	}
+	if err := c.Close(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("second close: %v, want %v", err, net.ErrClosed)
+	}
+	if hdrs := sentHeaders(t, tcp); len(hdrs) != 0 {
+		t.Fatalf("sent %d segments after reset, want none", len(hdrs))
+	}
+}
+
+// 主动打开时对端在SYN+ACK中只设置ECE才使用ECN (RFC 3168 6.1.1)
+func TestEcnActiveOpen(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags HeaderFlags
+		want  bool
+	}{
+		{"ecn-setup syn-ack", HeaderFlags{SYN: true, ACK: true, ECE: true}, true},
+		{"non-ecn syn-ack", HeaderFlags{SYN: true, ACK: true}, false},
+		{"syn-ack with ece and cwr", HeaderFlags{SYN: true, ACK: true, ECE: true, CWR: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tcp := newTestQueue()
+			conn := testConnection(tcp, SynSent)
+			defer tcp.abort(conn, nil)
+
+			conn.lock.Lock()
+			defer conn.lock.Unlock()
+			cwnd := conn.cwnd
+			tcp.manager.recvSegment(tcp, conn, testSegment{-1, 1, tt.flags, ""}.packet(conn))
+			if conn.State != Established || conn.ecn != tt.want {
+				t.Fatalf("state %s ecn %t, want ESTABLISHED ecn %t", conn.State, conn.ecn, tt.want)
+			}
+			// SYN+ACK中的ECE不是拥塞信号
+			if conn.cwnd != cwnd || conn.cwrPending {
+				t.Fatalf("cwnd %d cwr pending %t after syn-ack, want %d", conn.cwnd, conn.cwrPending, cwnd)
+			}
+		})
+	}
+}
+
+// 被动打开时对端的SYN同时设置ECE和CWR才使用ECN，SYN+ACK中只设置ECE
+func TestEcnPassiveOpen(t *testing.T) {
+	tests := []struct {
+		name   string
+		flags  HeaderFlags
+		want   bool
+		synAck HeaderFlags
+	}{
+		{"ecn-setup syn", HeaderFlags{SYN: true, ECE: true, CWR: true}, true, HeaderFlags{SYN: true, ACK: true, ECE: true}},
+		{"non-ecn syn", HeaderFlags{SYN: true}, false, HeaderFlags{SYN: true, ACK: true}},
+		{"syn with ece only", HeaderFlags{SYN: true, ECE: true}, false, HeaderFlags{SYN: true, ACK: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tcp := newTestQueue()
+			if _, err := tcp.Listen(testLocal); err != nil {
+				t.Fatal(err)
+			}
+			tcp.manager.recv(tcp, TcpPacket{
+				SrcAddr:   testRemote.Addr(),
+				DstAddr:   testLocal.Addr(),
+				TcpHeader: &Header{SrcPort: testRemote.Port(), DstPort: testLocal.Port(), SeqNum: testIrs, Flags: tt.flags, Window: WINDOW_SIZE},
+			})
+			conn, ok := tcp.manager.find(connKey{local: testLocal, remote: testRemote})
+			if !ok {
+				t.Fatal("connection not created")
+			}
+			defer tcp.abort(conn, nil)
+			if hdrs := sentHeaders(t, tcp); len(hdrs) != 1 || hdrs[0].Flags != tt.synAck {
+				t.Fatalf("sent %d segments, want %+v", len(hdrs), tt.synAck)
+			}
+			if conn.ecn != tt.want {
+				t.Fatalf("ecn %t, want %t", conn.ecn, tt.want)
+			}
+		})
+	}
+}
+
+// 只有通过序列号和确认号检查的报文段才能改变ECN状态
+func TestEcnUnacceptableSegment(t *testing.T) {
+	tests := []struct {
+		name string
+		seg  testSegment
+		ce   bool
+		want bool // 是否响应拥塞信号
+	}{
+		{"ece", testSegment{0, 1, HeaderFlags{ACK: true, ECE: true}, ""}, false, true},
+		{"ce", testSegment{0, 1, HeaderFlags{ACK: true}, "hello"}, true, true},
+		{"ece out of window", testSegment{100000, 1, HeaderFlags{ACK: true, ECE: true}, ""}, false, false},
+		{"ce out of window", testSegment{100000, 1, HeaderFlags{ACK: true}, "hello"}, true, false},
+		{"old ce duplicate", testSegment{-5, 1, HeaderFlags{ACK: true}, "hello"}, true, false},
+		{"ece acking unsent data", testSegment{0, 100, HeaderFlags{ACK: true, ECE: true}, ""}, false, false},
+		{"ece with rst", testSegment{0, 1, HeaderFlags{RST: true, ECE: true}, ""}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tcp := newTestQueue()
+			conn := testConnection(tcp, Established)
+			defer tcp.abort(conn, nil)
+
+			conn.lock.Lock()
+			defer conn.lock.Unlock()
+			conn.ecn = true
+			// 一个已发送未确认的报文段，使ECE的确认号越过ecnRecover
+			conn.unacked = []segment{{seqNum: conn.sndNxt, flags: HeaderFlags{ACK: true}, data: []byte("x")}}
+			conn.sndNxt++
+			cwnd := conn.cwnd
+
+			pkt := tt.seg.packet(conn)
+			if tt.ce {
+				pkt.Ecn = internet.ECN_CE
+			}
+			tcp.manager.recvSegment(tcp, conn, pkt)
+			if tt.ce && conn.ecnEcho != tt.want {
+				t.Fatalf("ecn echo %t, want %t", conn.ecnEcho, tt.want)
+			}
+			if !tt.ce && (conn.cwnd < cwnd) != tt.want {
+				t.Fatalf("cwnd %d -> %d, want reduced %t", cwnd, conn.cwnd, tt.want)
+			}
+		})
+	}
+}
+
+// 有效MSS取对端通告的MSS和路径MTU允许的较小值，SYN+ACK中通告接口MTU对应的MSS
+func TestMssNegotiation(t *testing.T) {
+	linkMss := uint16(1500 - 20 - LENGTH)
+	tests := []struct {
+		name string
+		mss  uint16 // 对端SYN中的MSS选项，0表示没有
+		want uint16
+	}{
+		{"peer mss", 1000, 1000},
+		{"no mss option", 0, DEFAULT_MSS},
+		{"larger than path", 9000, linkMss},
+	}
+	for _, tt := range tests {
+		t.Run("passive "+tt.name, func(t *testing.T) {
+			tcp := newTestQueue()
+			if _, err := tcp.Listen(testLocal); err != nil {
+				t.Fatal(err)
+			}
+			tcp.manager.recv(tcp, TcpPacket{
+				SrcAddr:   testRemote.Addr(),
+				DstAddr:   testLocal.Addr(),
+				TcpHeader: &Header{SrcPort: testRemote.Port(), DstPort: testLocal.Port(), SeqNum: testIrs, Flags: HeaderFlags{SYN: true}, Window: WINDOW_SIZE, Mss: tt.mss},
+			})
+			conn, ok := tcp.manager.find(connKey{local: testLocal, remote: testRemote})
+			if !ok {
+				t.Fatal("connection not created")
+			}
+			defer tcp.abort(conn, nil)
+			if hdrs := sentHeaders(t, tcp); len(hdrs) != 1 || hdrs[0].Mss != linkMss {
+				t.Fatalf("sent %d segments, want SYN+ACK with mss %d", len(hdrs), linkMss)
+			}
+			if conn.mss != tt.want {
+				t.Fatalf("mss %d, want %d", conn.mss, tt.want)
+			}
+		})
+		t.Run("active "+tt.name, func(t *testing.T) {
+			tcp := newTestQueue()
+			conn := testConnection(tcp, SynSent)
+			defer tcp.abort(conn, nil)
+
+			conn.lock.Lock()
+			defer conn.lock.Unlock()
+			pkt := testSegment{-1, 1, HeaderFlags{SYN: true, ACK: true}, ""}.packet(conn)
+			pkt.TcpHeader.Mss = tt.mss
+			tcp.manager.recvSegment(tcp, conn, pkt)
+			if conn.State != Established || conn.mss != tt.want {
+				t.Fatalf("state %s mss %d, want ESTABLISHED mss %d", conn.State, conn.mss, tt.want)
+			}
+			if conn.cwnd != initialWindow(uint32(tt.want)) {
+				t.Fatalf("cwnd %d, want initial window for mss %d", conn.cwnd, tt.want)
+			}
+		})
+	}
+}
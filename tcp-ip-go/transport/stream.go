@@ -0,0 +1,174 @@
+package transport
+
+const (
+	RECEIVE_BUFFER_SIZE = WINDOW_SIZE // 每条连接接收缓冲区的大小，决定了通告的接收窗口
+)
+
+// 有容量上限的字节流，一端写入一端读出。由连接的锁保护
+type byteStream struct {
+	buf      []byte
+	capacity int
+	written  uint64 // 累计写入的字节数
+	read     uint64 // 累计读出的字节数
+	ended    bool   // 写入端已结束
+}
+
+func newByteStream(capacity int) *byteStream {
+	return &byteStream{capacity: capacity}
+}
+
+// 写入不超过剩余容量的数据，返回实际写入的字节数
+func (s *byteStream) write(data []byte) int {
+	if s.ended {
+		return 0
+	}
+	n := len(data)
+	if remaining := s.remainingCapacity(); n > remaining {
+		n = remaining
+	}
+	s.buf = append(s.buf, data[:n]...)
+	s.written += uint64(n)
+	return n
+}
+
+// 读出数据到p，返回读出的字节数
+func (s *byteStream) readTo(p []byte) int {
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	s.read += uint64(n)
+	// 全部读完时释放底层数组，避免切片只向后移动
+	if len(s.buf) == 0 {
+		s.buf = nil
+	}
+	return n
+}
+
+func (s *byteStream) endInput() {
+	s.ended = true
+}
+
+func (s *byteStream) bufferSize() int {
+	return len(s.buf)
+}
+
+func (s *byteStream) remainingCapacity() int {
+	return s.capacity - len(s.buf)
+}
+
+// 写入端已结束并且数据已全部读出
+func (s *byteStream) eof() bool {
+	return s.ended && len(s.buf) == 0
+}
+
+// 还不能按序写入字节流的一段数据
+type substring struct {
+	index uint64 // 第一个字节在流中的位置
+	data  []byte
+}
+
+func (p substring) end() uint64 {
+	return p.index + uint64(len(p.data))
+}
+
+// 把乱序、重叠的报文段数据重组为按序的字节流。
+// 只缓存落在窗口[第一个未重组的位置, 第一个未读的位置+容量)内的数据
+type reassembler struct {
+	output   *byteStream
+	pending  []substring // 按位置排序且互不重叠
+	eofIndex uint64      // 流结束的位置
+	eofKnown bool
+}
+
+func newReassembler(capacity int) *reassembler {
+	return &reassembler{output: newByteStream(capacity)}
+}
+
+// 收到从index开始的数据，eof表示这是流的最后一段
+func (r *reassembler) push(data []byte, index uint64, eof bool) {
+	if eof {
+		r.eofIndex = index + uint64(len(data))
+		r.eofKnown = true
+	}
+
+	// 去掉已经重组的部分和超出窗口的部分
+	first := r.output.written
+	last := r.output.read + uint64(r.output.capacity)
+	start, end := index, index+uint64(len(data))
+	if start < first {
+		start = first
+	}
+	if end > last {
+		end = last
+	}
+	if start < end {
+		r.insert(substring{index: start, data: data[start-index : end-index]})
+	}
+
+	// 写入已经连续的部分
+	for len(r.pending) > 0 && r.pending[0].index == r.output.written {
+		r.output.write(r.pending[0].data)
+		r.pending = r.pending[1:]
+	}
+	if r.eofKnown && r.output.written == r.eofIndex {
+		r.output.endInput()
+	}
+}
+
+// 插入一段数据，与相邻或重叠的数据合并
+func (r *reassembler) insert(piece substring) {
+	merged := substring{index: piece.index, data: append([]byte(nil), piece.data...)}
+	pending := make([]substring, 0, len(r.pending)+1)
+	inserted := false
+	for _, p := range r.pending {
+		switch {
+		case p.end() < merged.index:
+			pending = append(pending, p)
+		case merged.end() < p.index:
+			if !inserted {
+				pending = append(pending, merged)
+				inserted = true
+			}
+			pending = append(pending, p)
+		default:
+			merged = mergeSubstrings(merged, p)
+		}
+	}
+	if !inserted {
+		pending = append(pending, merged)
+	}
+	r.pending = pending
+}
+
+// 合并两段重叠或相邻的数据，重叠部分的内容相同
+func mergeSubstrings(a, b substring) substring {
+	if b.index < a.index {
+		a, b = b, a
+	}
+	if b.end() <= a.end() {
+		return a
+	}
+	return substring{index: a.index, data: append(a.data, b.data[a.end()-b.index:]...)}
+}
+
+// 已缓存但还不能按序写入的字节数
+func (r *reassembler) unassembledBytes() int {
+	n := 0
+	for _, p := range r.pending {
+		n += len(p.data)
+	}
+	return n
+}
+
+// 把32位序列号还原为流中64位的绝对位置，取最接近checkpoint的那个
+func unwrap(seqNum, isn uint32, checkpoint uint64) uint64 {
+	offset := uint64(seqNum - isn)
+	const period = uint64(1) << 32
+	// 与checkpoint在同一个周期内的候选值
+	candidate := checkpoint&^(period-1) | offset
+	if candidate > checkpoint && candidate-checkpoint > period/2 && candidate >= period {
+		candidate -= period
+	} else if candidate < checkpoint && checkpoint-candidate > period/2 {
+		candidate += period
+	}
+	return candidate
+}
@@ -0,0 +1,128 @@
+package transport
+
+import (
+	"bytes"
+	"testing"
+)
+
+type testPush struct {
+	index uint64
+	data  string
+	eof   bool
+}
+
+func TestReassemblerPush(t *testing.T) {
+	tests := []struct {
+		name        string
+		capacity    int
+		pushes      []testPush
+		want        string
+		unassembled int
+		ended       bool
+	}{
+		{"in order", 16, []testPush{{0, "abc", false}, {3, "def", false}}, "abcdef", 0, false},
+		{"out of order", 16, []testPush{{3, "def", false}, {0, "abc", false}}, "abcdef", 0, false},
+		{"gap", 16, []testPush{{0, "abc", false}, {5, "fg", false}}, "abc", 2, false},
+		{"overlap", 16, []testPush{{2, "cdef", false}, {0, "abcd", false}}, "abcdef", 0, false},
+		{"overlap pending", 16, []testPush{{4, "ef", false}, {2, "cdefgh", false}, {0, "ab", false}}, "abcdefgh", 0, false},
+		{"fill several holes", 16, []testPush{{6, "gh", false}, {2, "cd", false}, {0, "ab", false}, {4, "ef", false}}, "abcdefgh", 0, false},
+		{"duplicate", 16, []testPush{{0, "abc", false}, {0, "abc", false}, {1, "b", false}}, "abc", 0, false},
+		{"duplicate pending", 16, []testPush{{4, "ef", false}, {4, "ef", false}, {5, "f", false}}, "", 2, false},
+		{"old data", 16, []testPush{{0, "abcd", false}, {1, "bcdef", false}}, "abcdef", 0, false},
+		{"trim beyond window", 8, []testPush{{4, "efghijkl", false}}, "", 4, false},
+		{"fill window", 8, []testPush{{4, "efghijkl", false}, {0, "abcd", false}}, "abcdefgh", 0, false},
+		{"drop when full", 8, []testPush{{0, "abcdefgh", false}, {8, "ij", false}}, "abcdefgh", 0, false},
+		{"eof", 16, []testPush{{0, "abc", true}}, "abc", 0, true},
+		{"eof out of order", 16, []testPush{{3, "def", true}, {0, "abc", false}}, "abcdef", 0, true},
+		{"empty eof", 16, []testPush{{0, "abc", false}, {3, "", true}}, "abc", 0, true},
+		{"eof with gap", 16, []testPush{{3, "def", true}}, "", 3, false},
+		{"eof beyond window", 4, []testPush{{0, "abcdef", true}}, "abcd", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newReassembler(tt.capacity)
+			for _, p := range tt.pushes {
+				r.push([]byte(p.data), p.index, p.eof)
+			}
+			if got := string(r.output.buf); got != tt.want {
+				t.Fatalf("output %q, want %q", got, tt.want)
+			}
+			if got := r.unassembledBytes(); got != tt.unassembled {
+				t.Fatalf("unassembled %d, want %d", got, tt.unassembled)
+			}
+			if r.output.ended != tt.ended {
+				t.Fatalf("ended %t, want %t", r.output.ended, tt.ended)
+			}
+		})
+	}
+}
+
+// 应用读出数据后窗口向后移动，之前超出窗口的数据可以被接收
+func TestReassemblerWindowMoves(t *testing.T) {
+	r := newReassembler(4)
+	r.push([]byte("abcdef"), 0, true)
+	if got := string(r.output.buf); got != "abcd" {
+		t.Fatalf("output %q, want %q", got, "abcd")
+	}
+
+	p := make([]byte, 2)
+	r.output.readTo(p)
+	r.push([]byte("cdef"), 2, true)
+	if got := string(r.output.buf); got != "cdef" || !r.output.ended {
+		t.Fatalf("output %q ended %t, want %q ended", got, r.output.ended, "cdef")
+	}
+	r.output.readTo(make([]byte, 4))
+	if !r.output.eof() {
+		t.Fatal("stream should be at eof")
+	}
+}
+
+func TestMergeSubstrings(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b substring
+		want substring
+	}{
+		{"overlap", substring{0, []byte("abc")}, substring{2, []byte("cde")}, substring{0, []byte("abcde")}},
+		{"reversed", substring{2, []byte("cde")}, substring{0, []byte("abc")}, substring{0, []byte("abcde")}},
+		{"adjacent", substring{0, []byte("ab")}, substring{2, []byte("cd")}, substring{0, []byte("abcd")}},
+		{"contained", substring{0, []byte("abcdef")}, substring{2, []byte("cd")}, substring{0, []byte("abcdef")}},
+		{"containing", substring{2, []byte("cd")}, substring{0, []byte("abcdef")}, substring{0, []byte("abcdef")}},
+		{"same", substring{3, []byte("de")}, substring{3, []byte("de")}, substring{3, []byte("de")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeSubstrings(tt.a, tt.b)
+			if got.index != tt.want.index || !bytes.Equal(got.data, tt.want.data) {
+				t.Fatalf("got {%d %q}, want {%d %q}", got.index, got.data, tt.want.index, tt.want.data)
+			}
+		})
+	}
+}
+
+func TestUnwrap(t *testing.T) {
+	const period = uint64(1) << 32
+	// 序列号984相对ISN 1000的偏移为0xfffffff0
+	tests := []struct {
+		name       string
+		seqNum     uint32
+		isn        uint32
+		checkpoint uint64
+		want       uint64
+	}{
+		{"start", 1005, 1000, 0, 5},
+		{"isn wraps", 0x10, 0xfffffff0, 0, 0x20},
+		{"next period", 1010, 1000, period - 5, period + 10},
+		{"previous period", 984, 1000, period + 10, 0xfffffff0},
+		{"no negative position", 984, 1000, 0, 0xfffffff0},
+		{"far from start", 1100, 1000, 3*period + 50, 3*period + 100},
+		{"half period ahead", 1000 + 1<<31, 1000, 3 * period, 3*period + 1<<31},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unwrap(tt.seqNum, tt.isn, tt.checkpoint); got != tt.want {
+				t.Fatalf("unwrap(%#x, %#x, %#x) = %#x, want %#x", tt.seqNum, tt.isn, tt.checkpoint, got, tt.want)
+			}
+		})
+	}
+}
@@ -4,23 +4,32 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/netip"
 	"tcp/internet"
 	"tcp/network"
+	"time"
 )
 
 const (
 	QUEUESIZE = 100
+
+	EPHEMERAL_PORT_MIN = 49152 // 临时端口范围 (RFC 6335 6)
+	EPHEMERAL_PORT_MAX = 65535
 )
 
 type TcpPacket struct {
-	IpHeader  *internet.Header
+	SrcAddr   netip.Addr // IPv4或IPv6源地址
+	DstAddr   netip.Addr
 	TcpHeader *Header
 	Packet    network.Packet
+	Payload   []byte // TCP数据
+	Ecn       uint8  // IP头部的ECN代码点
 }
 
 // TCP数据包队列
 type TcpPacketQueue struct {
 	manager       *ConnectionManager
+	ip            *internet.IpPacketQueue
 	outgoingQueue chan network.Packet
 	ctx           context.Context
 	cancel        context.CancelFunc
@@ -38,6 +47,7 @@ func NewTcpPacketQueue() *TcpPacketQueue {
 }
 
 func (tcp *TcpPacketQueue) ManageQueues(ip *internet.IpPacketQueue) {
+	tcp.ip = ip
 	go func() {
 		for {
 			select {
@@ -48,21 +58,52 @@ func (tcp *TcpPacketQueue) ManageQueues(ip *internet.IpPacketQueue) {
 				if err != nil {
 					fmt.Printf("read error: %s", err.Error())
 				}
-				tcpHeader, err := unmarshal(ipPkt.Packet.Buf[ipPkt.IpHeader.IHL*4 : ipPkt.Packet.N])
+				tcpHeader, err := unmarshal(ipPkt.Payload)
 				if err != nil {
 					fmt.Printf("unmarshal error: %s", err)
 					continue
 				}
+				if int(tcpHeader.DataOffs)*4 < LENGTH || int(tcpHeader.DataOffs)*4 > len(ipPkt.Payload) {
+					log.Printf("invalid data offset: %d", tcpHeader.DataOffs)
+					continue
+				}
+				// 校验和错误的报文段直接丢弃，不回应RST (RFC 9293 3.10.7.1)
+				if !validChecksum(ipPkt.SrcAddr, ipPkt.DstAddr, ipPkt.Payload) {
+					log.Printf("drop segment with bad checksum, src: %s, dst: %s", ipPkt.SrcAddr, ipPkt.DstAddr)
+					continue
+				}
 				tcpPkt := TcpPacket{
-					IpHeader:  ipPkt.IpHeader,
+					SrcAddr:   ipPkt.SrcAddr,
+					DstAddr:   ipPkt.DstAddr,
 					TcpHeader: tcpHeader,
 					Packet:    ipPkt.Packet,
+					Payload:   ipPkt.Payload[tcpHeader.DataOffs*4:],
+					Ecn:       ipPkt.Ecn(),
 				}
 				tcp.manager.recv(tcp, tcpPkt)
 			}
 		}
 	}()
 
+	go func() {
+		for {
+			select {
+			case <-tcp.ctx.Done():
+				return
+			default:
+				icmpErr, err := ip.ReadIcmpError()
+				if err != nil {
+					log.Printf("read icmp error: %s", err.Error())
+					continue
+				}
+				if icmpErr.Protocol != PROTOCOL {
+					continue
+				}
+				tcp.manager.recvIcmpError(tcp, icmpErr)
+			}
+		}
+	}()
+
 	go func() {
 		for {
 			select {
@@ -83,40 +124,125 @@ func (tcp *TcpPacketQueue) Close() {
 	tcp.cancel()
 }
 
-// 向接收队列中添加数据包
-func (tcp *TcpPacketQueue) Write(conn Connection, flgs HeaderFlags, data []byte) {
-	pkt := conn.Pkt
-	// tcp有效数据长度为：数据包总长度 - tcp头部长度 - ip头部长度
-	tcpDataLen := int(pkt.Packet.N) - int(pkt.TcpHeader.DataOffs)*4 - int(pkt.IpHeader.IHL)*4
+// Listen 监听addr，地址未指定时监听该端口的所有本地地址
+func (tcp *TcpPacketQueue) Listen(addr netip.AddrPort) (*Listener, error) {
+	return tcp.manager.listen(tcp, addr)
+}
 
-	var incrementAckNum uint32
-	if tcpDataLen == 0 {
-		incrementAckNum = 1
-	} else {
-		incrementAckNum = uint32(len(data))
+// Dial 主动打开到remote的连接，源地址按路由选择。SYN按指数退避重传，
+// 直到连接建立、被拒绝、重传次数用尽或ctx结束
+func (tcp *TcpPacketQueue) Dial(ctx context.Context, remote netip.AddrPort) (*Conn, error) {
+	local, err := tcp.ip.SelectSource(remote.Addr())
+	if err != nil {
+		return nil, err
+	}
+	// 收到对端的SYN之前按默认MSS计算
+	mss := tcp.sendMss(defaultMss(remote.Addr()), remote.Addr())
+	conn, err := tcp.manager.addActiveConnection(local, remote, mss)
+	if err != nil {
+		return nil, err
 	}
 
-	// 期待的下一个序列号
-	ackNum := pkt.TcpHeader.SeqNum + incrementAckNum
-	// data的第一个序列号
-	seqNum := conn.initialSeqNum + conn.incrementSeqNum
+	conn.lock.Lock()
+	log.Printf("send SYN packet, src port: %d, dst port: %d", conn.LocalAddr.Port(), remote.Port())
+	// 发送ECN-setup SYN请求使用ECN (RFC 3168 6.1.1)，SYN由重传定时器按指数退避重传
+	tcp.write(conn, HeaderFlags{SYN: true, ECE: true, CWR: true}, nil)
+	conn.lock.Unlock()
 
-	writeIphdr := internet.NewHeader(pkt.IpHeader.DstIP, pkt.IpHeader.SrcIP, len(data)+LENGTH)
-	writeTcphdr := NewHeader(pkt.TcpHeader.DstPort, pkt.TcpHeader.SrcPort, seqNum, ackNum, flgs)
+	for {
+		conn.lock.Lock()
+		state, err := conn.State, conn.Err
+		changed := conn.changed
+		conn.lock.Unlock()
+		switch state {
+		case SynSent, SynReceived:
+		case Closed:
+			return nil, err
+		default:
+			return newConn(tcp, conn), nil
+		}
 
-	ipHdr := writeIphdr.Marshal()
-	tcpHdr := writeTcphdr.Marshal(conn.Pkt.IpHeader, data)
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			tcp.abort(conn, ctx.Err())
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// 中止连接，同步状态下向对端发送RST (RFC 9293 3.10.5)
+func (tcp *TcpPacketQueue) abort(conn *Connection, err error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	tcp.terminate(conn, err)
+}
+
+// 中止连接，调用方持有连接的锁
+func (tcp *TcpPacketQueue) terminate(conn *Connection, err error) {
+	switch conn.State {
+	case Closed:
+		return
+	case SynReceived, Established, FinWait1, FinWait2, CloseWait:
+		tcp.send(conn, segment{seqNum: conn.sndNxt, flags: HeaderFlags{RST: true}})
+	}
+	conn.Err = err
+	conn.setState(Closed)
+	tcp.manager.remove(conn)
+}
 
-	writePkt := append(ipHdr, tcpHdr...)
-	writePkt = append(writePkt, data...)
+// 从SND.NXT开始发送报文段，调用方持有连接的锁
+func (tcp *TcpPacketQueue) write(conn *Connection, flgs HeaderFlags, data []byte) {
+	// 已协商ECN的连接回显收到的CE标记，并在发送新数据时应答对端的ECE
+	if conn.ecn && !flgs.SYN {
+		flgs.ECE = conn.ecnEcho
+		if conn.cwrPending && len(data) > 0 {
+			flgs.CWR = true
+			conn.cwrPending = false
+		}
+	}
 
-	var incrementSeqNum uint32
+	seg := segment{
+		seqNum: conn.sndNxt,
+		flags:  flgs,
+		data:   data,
+	}
 	// 如果SYN或FIN，则消耗一个序列号
-	if flgs.SYN || flgs.FIN {
-		incrementSeqNum += 1
+	conn.sndNxt += seg.length()
+	// 占用序列号的报文段需要保留到被确认为止，并启动重传定时器
+	if seg.length() > 0 {
+		seg.sentAt = time.Now()
+		conn.onSend(&seg)
+		conn.unacked = append(conn.unacked, seg)
+		tcp.startTimer(conn)
 	}
-	incrementSeqNum += uint32(len(data))
-	tcp.manager.updateSeqNum(pkt, incrementSeqNum)
+
+	tcp.send(conn, seg)
+}
+
+// 组装报文段并放入发送队列
+func (tcp *TcpPacketQueue) send(conn *Connection, seg segment) {
+	local, remote := conn.LocalAddr, conn.RemoteAddr
+	// 确认号总是取当前的RCV.NXT，重传的报文段也确认最新收到的数据
+	var ackNum uint32
+	if seg.flags.ACK {
+		ackNum = conn.rcvNxt
+	}
+	writeTcphdr := NewHeader(local.Port(), remote.Port(), seg.seqNum, ackNum, seg.flags)
+	writeTcphdr.Window = uint16(conn.rcvWindow())
+	// SYN中通告本端能接收的MSS (RFC 9293 3.7.1)
+	if seg.flags.SYN {
+		writeTcphdr.Mss = tcp.linkMss(remote.Addr())
+	}
+	tcpHdr := writeTcphdr.Marshal(local.Addr(), remote.Addr(), seg.data)
+
+	// 只有新数据可以设置ECT，SYN、纯ACK和重传的报文段不设置 (RFC 3168 6.1.4, 6.1.5)
+	ecn := uint8(internet.ECN_NOT_ECT)
+	if conn.ecn && len(seg.data) > 0 && !seg.retransmit {
+		ecn = internet.ECN_ECT0
+	}
+	tos := internet.Tos(conn.dscp, ecn)
+	writePkt := internet.NewDatagram(local.Addr(), remote.Addr(), PROTOCOL, tos, append(tcpHdr, seg.data...))
 
 	// 将数据包放入发送队列
 	tcp.outgoingQueue <- network.Packet{
@@ -125,11 +251,78 @@ func (tcp *TcpPacketQueue) Write(conn Connection, flgs HeaderFlags, data []byte)
 	}
 }
 
-func (tcp *TcpPacketQueue) ReadAcceptConnection() (Connection, error) {
-	pkt, ok := <-tcp.manager.AcceptConnectionQueue
-	if !ok {
-		return Connection{}, fmt.Errorf("connection queue is closed")
+// 回应不属于任何连接的报文段，序列号取自对方的确认号，使其被对端接受 (RFC 9293 3.10.7.1)
+func (tcp *TcpPacketQueue) sendReset(pkt TcpPacket) {
+	var hdr *Header
+	if pkt.TcpHeader.Flags.ACK {
+		hdr = NewHeader(pkt.TcpHeader.DstPort, pkt.TcpHeader.SrcPort, pkt.TcpHeader.AckNum, 0, HeaderFlags{RST: true})
+	} else {
+		seg := segment{flags: pkt.TcpHeader.Flags, data: pkt.Payload}
+		ackNum := pkt.TcpHeader.SeqNum + seg.length()
+		hdr = NewHeader(pkt.TcpHeader.DstPort, pkt.TcpHeader.SrcPort, 0, ackNum, HeaderFlags{RST: true, ACK: true})
+	}
+	hdr.Window = 0
+	tcpHdr := hdr.Marshal(pkt.DstAddr, pkt.SrcAddr, nil)
+	writePkt := internet.NewDatagram(pkt.DstAddr, pkt.SrcAddr, PROTOCOL, 0, tcpHdr)
+
+	tcp.outgoingQueue <- network.Packet{
+		Buf: writePkt,
+		N:   uintptr(len(writePkt)),
+	}
+}
+
+// 应用读出数据后，接收窗口从不足一个MSS重新打开时主动通告，
+// 避免对端等待零窗口探测 (RFC 9293 3.8.6.2.2)
+func (tcp *TcpPacketQueue) windowUpdate(conn *Connection, before uint32) {
+	threshold := min(uint32(RECEIVE_BUFFER_SIZE/2), uint32(conn.mss))
+	if before >= threshold || conn.rcvWindow() < threshold {
+		return
 	}
+	switch conn.State {
+	case Established, FinWait1, FinWait2:
+		tcp.write(conn, HeaderFlags{ACK: true}, nil)
+	}
+}
 
-	return pkt, nil
+// 关闭连接的发送方向，调用方持有连接的锁
+func (tcp *TcpPacketQueue) shutdown(conn *Connection) error {
+	return tcp.manager.close(tcp, conn)
+}
+
+// 根据路径MTU计算到达dst的MSS
+func (tcp *TcpPacketQueue) pathMss(dst netip.Addr) uint16 {
+	return mtuToMss(tcp.ip.PathMTU(dst), dst)
+}
+
+// 根据出接口MTU计算SYN中通告的MSS，即接口MTU减去固定的IP和TCP头部 (RFC 6691 2)
+func (tcp *TcpPacketQueue) linkMss(dst netip.Addr) uint16 {
+	return mtuToMss(tcp.ip.LinkMTU(dst), dst)
+}
+
+// 有效的发送MSS不超过对端通告的MSS，也不超过路径MTU (RFC 9293 3.7.1)
+func (tcp *TcpPacketQueue) sendMss(peerMss uint16, dst netip.Addr) uint16 {
+	return min(peerMss, tcp.pathMss(dst))
+}
+
+func mtuToMss(mtu uint16, dst netip.Addr) uint16 {
+	overhead := uint16(internet.HeaderLength(dst) + LENGTH)
+	if mtu < overhead {
+		return 0
+	}
+	return mtu - overhead
+}
+
+// 对端SYN中通告的MSS，没有MSS选项时IPv4假定536，IPv6假定1220 (RFC 9293 3.7.1)
+func peerMss(hdr *Header, addr netip.Addr) uint16 {
+	if hdr.Mss != 0 {
+		return hdr.Mss
+	}
+	return defaultMss(addr)
+}
+
+func defaultMss(addr netip.Addr) uint16 {
+	if addr.Is6() {
+		return IPV6_MSS
+	}
+	return DEFAULT_MSS
 }
@@ -3,13 +3,21 @@ package transport
 import (
 	"encoding/binary"
 	"fmt"
-	"tcp/internet"
+	"net/netip"
 )
 
 const (
 	LENGTH      = 20
 	WINDOW_SIZE = 65535
-	PROTOCOL    = 6 // TCP协议号
+	DEFAULT_MSS = 536  // 未协商时的默认MSS (RFC 9293 3.7.1)
+	IPV6_MSS    = 1220 // IPv6未协商时的默认MSS，IPv6最小MTU 1280减去IPv6和TCP头部 (RFC 8200 8.3)
+	PROTOCOL    = 6    // TCP协议号
+
+	// TCP选项类型 (RFC 9293 3.2)
+	OPTION_END        = 0
+	OPTION_NOP        = 1
+	OPTION_MSS        = 2
+	OPTION_MSS_LENGTH = 4
 )
 
 type Header struct {
@@ -23,6 +31,7 @@ type Header struct {
 	Window   uint16
 	Checksum uint16
 	UrgPtr   uint16
+	Mss      uint16 // MSS选项，0表示没有携带，只出现在SYN中 (RFC 9293 3.7.1)
 }
 
 type HeaderFlags struct {
@@ -77,11 +86,34 @@ func unmarshal(pkt []byte) (*Header, error) {
 		Checksum: binary.BigEndian.Uint16(pkt[16:18]),
 		UrgPtr:   binary.BigEndian.Uint16(pkt[18:20]),
 	}
+	if end := int(h.DataOffs) * 4; end > LENGTH && end <= len(pkt) {
+		h.parseOptions(pkt[LENGTH:end])
+	}
 
 	return h, nil
 
 }
 
+// 解析选项，除MSS外的选项按长度跳过，长度不合法时停止解析 (RFC 9293 3.1)
+func (h *Header) parseOptions(opts []byte) {
+	for len(opts) > 0 {
+		switch opts[0] {
+		case OPTION_END:
+			return
+		case OPTION_NOP:
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+			return
+		}
+		if opts[0] == OPTION_MSS && opts[1] == OPTION_MSS_LENGTH {
+			h.Mss = binary.BigEndian.Uint16(opts[2:4])
+		}
+		opts = opts[opts[1]:]
+	}
+}
+
 func unmarshalFlag(f uint8) HeaderFlags {
 	return HeaderFlags{
 		CWR: f&0x80 == 0x80, // 0x80 = 1000 0000
@@ -95,19 +127,23 @@ func unmarshalFlag(f uint8) HeaderFlags {
 	}
 }
 
-func (h *Header) Marshal(ipHdr *internet.Header, data []byte) []byte {
-	pkt := make([]byte, 20)
+func (h *Header) Marshal(srcAddr, dstAddr netip.Addr, data []byte) []byte {
+	pkt := make([]byte, LENGTH)
+	if h.Mss != 0 {
+		pkt = append(pkt, OPTION_MSS, OPTION_MSS_LENGTH, byte(h.Mss>>8), byte(h.Mss))
+	}
+	h.DataOffs = uint8(len(pkt) / 4)
 	binary.BigEndian.PutUint16(pkt[0:2], h.SrcPort)
 	binary.BigEndian.PutUint16(pkt[2:4], h.DstPort)
 	binary.BigEndian.PutUint32(pkt[4:8], h.SeqNum)
 	binary.BigEndian.PutUint32(pkt[8:12], h.AckNum)
-	pkt[12] = h.DataOffs
+	pkt[12] = h.DataOffs << 4
 	pkt[13] = marshalFlag(h.Flags)
 	binary.BigEndian.PutUint16(pkt[14:16], h.Window)
 	binary.BigEndian.PutUint16(pkt[16:18], h.Checksum)
 	binary.BigEndian.PutUint16(pkt[18:20], h.UrgPtr)
 
-	h.setChecksum(ipHdr, append(pkt, data...))
+	h.setChecksum(srcAddr, dstAddr, append(pkt, data...))
 	binary.BigEndian.PutUint16(pkt[16:18], h.Checksum)
 
 	return pkt
@@ -122,14 +158,36 @@ func (h *Header) Marshal(ipHdr *internet.Header, data []byte) []byte {
 // +--------+--------+--------+--------+
 // |  zero  |  PTCL  |    TCP Length   |
 // +--------+--------+--------+--------+
-func (h *Header) setChecksum(ipHeader *internet.Header, pkt []byte) {
+//
+// ipv6 pseudo-header (RFC 8200 8.1)
+// +--------+--------+--------+--------+
+// |      Source Address (128bit)      |
+// +--------+--------+--------+--------+
+// |   Destination Address (128bit)    |
+// +--------+--------+--------+--------+
+// |      Upper-Layer Packet Length    |
+// +--------+--------+--------+--------+
+// |           zero           |  Next  |
+// +--------+--------+--------+--------+
+func (h *Header) setChecksum(srcAddr, dstAddr netip.Addr, pkt []byte) {
 	// 伪首部
-	pseudoHeader := make([]byte, 12)
-	copy(pseudoHeader[0:4], ipHeader.SrcIP[:])
-	copy(pseudoHeader[4:8], ipHeader.DstIP[:])
-	pseudoHeader[8] = 0
-	pseudoHeader[9] = PROTOCOL
-	binary.BigEndian.PutUint16(pseudoHeader[10:12], uint16(len(pkt)))
+	var pseudoHeader []byte
+	if srcAddr.Is4() {
+		src, dst := srcAddr.As4(), dstAddr.As4()
+		pseudoHeader = make([]byte, 12)
+		copy(pseudoHeader[0:4], src[:])
+		copy(pseudoHeader[4:8], dst[:])
+		pseudoHeader[8] = 0
+		pseudoHeader[9] = PROTOCOL
+		binary.BigEndian.PutUint16(pseudoHeader[10:12], uint16(len(pkt)))
+	} else {
+		src, dst := srcAddr.As16(), dstAddr.As16()
+		pseudoHeader = make([]byte, 40)
+		copy(pseudoHeader[0:16], src[:])
+		copy(pseudoHeader[16:32], dst[:])
+		binary.BigEndian.PutUint32(pseudoHeader[32:36], uint32(len(pkt)))
+		pseudoHeader[39] = PROTOCOL
+	}
 
 	buf := append(pseudoHeader, pkt...)
 	if len(buf)%2 != 0 {
@@ -152,6 +210,13 @@ func (h *Header) setChecksum(ipHeader *internet.Header, pkt []byte) {
 	h.Checksum = ^uint16(checksum)
 }
 
+// 校验收到的报文段，包含校验和字段在内计算时结果为0 (RFC 9293 3.1)
+func validChecksum(srcAddr, dstAddr netip.Addr, segment []byte) bool {
+	var h Header
+	h.setChecksum(srcAddr, dstAddr, segment)
+	return h.Checksum == 0
+}
+
 func marshalFlag(f HeaderFlags) uint8 {
 	var flag uint8
 	// 如果f.CWR为true，则设置对应的flag位为1，否则为0
@@ -189,8 +254,6 @@ func NewHeader(srcPort, dstPort uint16, seqNum, ackNum uint32, flags HeaderFlags
 		SeqNum:  seqNum,
 		AckNum:  ackNum,
 		Flags:   flags,
-		// TODO
-		DataOffs: 5,
-		Window:   WINDOW_SIZE,
+		Window:  WINDOW_SIZE,
 	}
 }
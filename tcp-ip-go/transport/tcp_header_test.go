@@ -0,0 +1,84 @@
+package transport
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+)
+
+func TestValidChecksum(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst netip.Addr
+		data     string
+	}{
+		{"ipv4", netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2"), "hello"},
+		{"ipv4 even length", netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2"), "hi"},
+		{"ipv6", netip.MustParseAddr("fe80::1"), netip.MustParseAddr("fe80::2"), "hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hdr := NewHeader(40000, 80, 1000, 2000, HeaderFlags{ACK: true, PSH: true})
+			segment := append(hdr.Marshal(tt.src, tt.dst, []byte(tt.data)), tt.data...)
+			if !validChecksum(tt.src, tt.dst, segment) {
+				t.Fatal("valid segment rejected")
+			}
+			// 伪首部参与校验，地址不同时校验失败
+			if validChecksum(tt.dst, tt.src.Next(), segment) {
+				t.Fatal("segment accepted with wrong pseudo-header")
+			}
+			segment[len(segment)-1] ^= 0x01
+			if validChecksum(tt.src, tt.dst, segment) {
+				t.Fatal("corrupted segment accepted")
+			}
+		})
+	}
+}
+
+func TestMssOption(t *testing.T) {
+	src, dst := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	hdr := NewHeader(40000, 80, 1000, 0, HeaderFlags{SYN: true})
+	hdr.Mss = 1460
+	buf := hdr.Marshal(src, dst, nil)
+	if len(buf) != 24 || hdr.DataOffs != 6 {
+		t.Fatalf("header length %d data offset %d, want 24 and 6", len(buf), hdr.DataOffs)
+	}
+	if !bytes.Equal(buf[20:], []byte{OPTION_MSS, OPTION_MSS_LENGTH, 0x05, 0xb4}) {
+		t.Fatalf("options %x", buf[20:])
+	}
+	if !validChecksum(src, dst, buf) {
+		t.Fatal("checksum does not cover options")
+	}
+	got, err := unmarshal(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Mss != 1460 || got.DataOffs != 6 {
+		t.Fatalf("mss %d data offset %d, want 1460 and 6", got.Mss, got.DataOffs)
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []byte
+		want uint16
+	}{
+		{"mss", []byte{2, 4, 0x05, 0xb4}, 1460},
+		{"nop before mss", []byte{1, 1, 2, 4, 0x02, 0x18, 0, 0}, 536},
+		{"unknown option skipped", []byte{3, 3, 7, 2, 4, 0x05, 0xb4, 0}, 1460},
+		{"end of options", []byte{0, 0, 2, 4, 0x05, 0xb4, 0, 0}, 0},
+		{"zero length", []byte{8, 0, 2, 4, 0x05, 0xb4, 0, 0}, 0},
+		{"length beyond header", []byte{2, 4, 0x05}, 0},
+		{"wrong mss length", []byte{2, 6, 0x05, 0xb4, 0, 0, 0, 0}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h Header
+			h.parseOptions(tt.opts)
+			if h.Mss != tt.want {
+				t.Fatalf("mss %d, want %d", h.Mss, tt.want)
+			}
+		})
+	}
+}